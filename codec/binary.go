@@ -0,0 +1,84 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// jsonCodec JSON，[]byte 编码为 base64 字符串
+type jsonCodec struct{}
+
+func (jsonCodec) Decode(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// 保留整数精度
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid data after top-level value")
+	}
+	return normalize(v)
+}
+
+func (jsonCodec) Encode(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+// msgpackCodec MessagePack，map 按键排序编码，整数使用最短表示
+type msgpackCodec struct{}
+
+func (msgpackCodec) Decode(data []byte) (any, error) {
+	var v any
+	if err := msgpack.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return normalize(v)
+}
+
+func (msgpackCodec) Encode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetSortMapKeys(true)
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+// cborEncMode 确定性编码（RFC 8949 4.2 core deterministic encoding）
+var cborEncMode, _ = cbor.CoreDetEncOptions().EncMode()
+
+// cborCodec CBOR，带标签的值取其内容，时间转为 RFC 3339 字符串
+type cborCodec struct{}
+
+func (cborCodec) Decode(data []byte) (any, error) {
+	var v any
+	if err := cbor.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return normalize(v)
+}
+
+func (cborCodec) Encode(v any) ([]byte, error) {
+	return cborEncMode.Marshal(v)
+}
+
+func (cborCodec) Binary() bool {
+	return true
+}
@@ -0,0 +1,97 @@
+package codec
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 内置编解码器名称
+const (
+	JSON     = "json"
+	MsgPack  = "msgpack"
+	CBOR     = "cbor"
+	XML      = "xml"
+	Protobuf = "protobuf"
+)
+
+// Codec 在负载字节与通用值之间转换。
+// 通用值由 nil、bool、int64、uint64、float64、string、[]byte、[]any 与 map[string]any 组成
+type Codec interface {
+	Decode(data []byte) (any, error)
+	Encode(v any) ([]byte, error)
+	// Binary 编码结果是否为二进制，为 false 时可直接作为文本传输
+	Binary() bool
+}
+
+// Factory 创建编解码器，param 为名称中 : 之后的部分，如 protobuf:pkg.Message 中的消息全名
+type Factory func(param string) (Codec, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register 注册编解码器，重复注册时覆盖
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[strings.ToLower(name)] = factory
+}
+
+// Names 返回已注册的编解码器名称
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get 按名称获取编解码器，名称形如 msgpack 或 protobuf:pkg.Message
+func Get(name string) (Codec, error) {
+	name = strings.TrimSpace(name)
+	typ, param, _ := strings.Cut(name, ":")
+	registryMu.RLock()
+	factory, ok := registry[strings.ToLower(typ)]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return factory(param)
+}
+
+// Transcode 将 src 编码的负载转为 dst 编码
+func Transcode(src, dst Codec, data []byte) ([]byte, error) {
+	v, err := src.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	out, err := dst.Encode(v)
+	if err != nil {
+		return nil, fmt.Errorf("encode: %w", err)
+	}
+	return out, nil
+}
+
+// simple 不接受参数的编解码器工厂
+func simple(name string, c Codec) Factory {
+	return func(param string) (Codec, error) {
+		if param != "" {
+			return nil, fmt.Errorf("codec %s does not take a parameter", name)
+		}
+		return c, nil
+	}
+}
+
+func init() {
+	Register(JSON, simple(JSON, jsonCodec{}))
+	Register(MsgPack, simple(MsgPack, msgpackCodec{}))
+	Register(CBOR, simple(CBOR, cborCodec{}))
+	Register(XML, simple(XML, xmlCodec{}))
+	Register(Protobuf, newProtobufCodec)
+}
@@ -0,0 +1,351 @@
+package codec
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	for _, name := range []string{"json", "JSON", " msgpack ", "cbor", "xml"} {
+		if _, err := Get(name); err != nil {
+			t.Errorf("Get(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{"yaml", "json:x", "protobuf"} {
+		if _, err := Get(name); err == nil {
+			t.Errorf("Get(%q): expected an error", name)
+		}
+	}
+	if names := Names(); !reflect.DeepEqual(names, []string{CBOR, JSON, MsgPack, Protobuf, XML}) {
+		t.Errorf("Names() = %v", names)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	value := map[string]any{
+		"string": "温度",
+		"int":    int64(-3),
+		"big":    uint64(1 << 63),
+		"float":  21.5,
+		"bool":   true,
+		"null":   nil,
+		"list":   []any{int64(1), "x", []any{}},
+		"object": map[string]any{"k": "v", "empty": map[string]any{}},
+	}
+	withBytes := map[string]any{"raw": []byte{0x00, 0xff}, "value": value}
+	tests := []struct {
+		codec string
+		value any
+	}{
+		{JSON, value},
+		{MsgPack, withBytes},
+		{CBOR, withBytes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.codec, func(t *testing.T) {
+			c, err := Get(tt.codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := c.Encode(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.value) {
+				t.Fatalf("round trip = %#v, want %#v", got, tt.value)
+			}
+			// 编码结果是确定的
+			again, _ := c.Encode(got)
+			if !bytes.Equal(again, data) {
+				t.Fatalf("encoding is not deterministic: % x then % x", data, again)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		codec string
+		data  []byte
+		want  any
+	}{
+		{JSON, []byte(`{"a":1}`), map[string]any{"a": int64(1)}},
+		{JSON, []byte(`[9007199254740993, 18446744073709551615, 1e3]`), []any{int64(9007199254740993), uint64(18446744073709551615), 1000.0}},
+		{MsgPack, []byte{0x81, 0xa1, 'a', 0x01}, map[string]any{"a": int64(1)}},
+		{CBOR, []byte{0xa1, 0x61, 'a', 0x01}, map[string]any{"a": int64(1)}},
+		{CBOR, []byte{0xa1, 0x01, 0x61, 'a'}, map[string]any{"1": "a"}},
+		// 无符号整数超出 int64 范围时为 uint64
+		{CBOR, []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, uint64(18446744073709551615)},
+		// 标签 1（epoch 时间）与标签 0（RFC 3339 时间）均解码为 RFC 3339 字符串
+		{CBOR, []byte{0xc1, 0x1a, 0x65, 0x53, 0xf1, 0x00}, "2023-11-14T22:13:20Z"},
+		{CBOR, append([]byte{0xc0, 0x74}, "2023-11-14T22:13:20Z"...), "2023-11-14T22:13:20Z"},
+	}
+	for _, tt := range tests {
+		c, _ := Get(tt.codec)
+		got, err := c.Decode(tt.data)
+		if err != nil {
+			t.Errorf("%s decode % x: %v", tt.codec, tt.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s decode % x = %#v, want %#v", tt.codec, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		codec string
+		data  []byte
+	}{
+		{JSON, []byte(`{"a":1} {}`)},
+		{JSON, []byte(`{"a":`)},
+		{MsgPack, []byte{0x81, 0xa1}},
+		{CBOR, []byte{0xa1, 0x61}},
+		{XML, []byte(``)},
+		{XML, []byte(`<a><b></a>`)},
+	}
+	for _, tt := range tests {
+		c, _ := Get(tt.codec)
+		if v, err := c.Decode(tt.data); err == nil {
+			t.Errorf("%s decode %q = %#v, want an error", tt.codec, tt.data, v)
+		}
+	}
+}
+
+func TestXML(t *testing.T) {
+	// 编码时子元素按名称排序
+	doc := `<reading id="7"><empty></empty><unit>c<note></note></unit><value>1</value><value>2</value></reading>`
+	want := map[string]any{"reading": map[string]any{
+		"@id":   "7",
+		"value": []any{"1", "2"},
+		"unit":  map[string]any{"#text": "c", "note": ""},
+		"empty": "",
+	}}
+	c, _ := Get(XML)
+	got, err := c.Decode([]byte(`<?xml version="1.0"?>` + "\n" + doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decode = %#v, want %#v", got, want)
+	}
+	data, err := c.Encode(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != doc {
+		t.Fatalf("encode = %s, want %s", data, doc)
+	}
+
+	tests := []struct {
+		value any
+		want  string
+	}{
+		// 不是单字段对象时使用 root 根元素
+		{map[string]any{"a": int64(1), "b": true}, `<root><a>1</a><b>true</b></root>`},
+		{[]any{1.5, nil}, `<root>1.5</root><root></root>`},
+		{"a<b", `<root>a&lt;b</root>`},
+		{map[string]any{"data": []byte{1, 2}}, `<data>AQI=</data>`},
+		{map[string]any{"温度": "21.5"}, `<温度>21.5</温度>`},
+		{map[string]any{"a": map[string]any{"@_x-1.y": "1"}}, `<a _x-1.y="1"></a>`},
+	}
+	for _, tt := range tests {
+		data, err := c.Encode(tt.value)
+		if err != nil {
+			t.Errorf("encode %#v: %v", tt.value, err)
+			continue
+		}
+		if string(data) != tt.want {
+			t.Errorf("encode %#v = %s, want %s", tt.value, data, tt.want)
+		}
+	}
+}
+
+func TestXMLRejectsInvalidNames(t *testing.T) {
+	c, _ := Get(XML)
+	for _, v := range []map[string]any{
+		{"1a": "x"},
+		{"a b": "x"},
+		{"a": map[string]any{"-b": "x"}},
+		{"a": map[string]any{"ns:b": "x"}},
+		{"a": map[string]any{"": "x"}},
+		{"a": map[string]any{"@1": "x"}},
+		{"a": map[string]any{"@": "x"}},
+		{"a": map[string]any{"b>c": "x"}},
+		{"a": map[string]any{"b": map[string]any{"c": struct{}{}}}},
+	} {
+		if data, err := c.Encode(v); err == nil {
+			t.Errorf("encode %#v = %s, want an error", v, data)
+		}
+	}
+}
+
+const testProto = `
+syntax = "proto3";
+
+package test.v1;
+
+import "common.proto";
+
+enum Kind {
+  KIND_UNSPECIFIED = 0;
+  KIND_SENSOR = 1;
+}
+
+message Reading {
+  message Location {
+    double lat = 1;
+    double lon = 2;
+  }
+  string device_id = 1;
+  double temperature = 2;
+  int64 timestamp = 3;
+  map<string, string> labels = 4;
+  Kind kind = 5;
+  Location location = 6;
+  repeated Tag tags = 7;
+  bytes raw = 8;
+}
+`
+
+const testCommonProto = `
+syntax = "proto3";
+
+package test.v1;
+
+message Tag {
+  string name = 1;
+}
+`
+
+// loadTestProto 编译测试用的 .proto 文件，结束后恢复之前加载的消息
+func loadTestProto(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "reading.proto"), []byte(testProto), 0o644)
+	os.WriteFile(filepath.Join(dir, "common.proto"), []byte(testCommonProto), 0o644)
+
+	protoMu.Lock()
+	resolver, messages := protoResolver, protoMessages
+	protoResolver, protoMessages = nil, nil
+	protoMu.Unlock()
+	t.Cleanup(func() {
+		protoMu.Lock()
+		protoResolver, protoMessages = resolver, messages
+		protoMu.Unlock()
+	})
+
+	if _, err := Get("protobuf:test.v1.Reading"); err == nil || !strings.Contains(err.Error(), "no .proto files") {
+		t.Fatalf("before loading: err = %v", err)
+	}
+	if err := LoadProtobuf(context.Background(), ProtobufConfig{ImportPaths: []string{dir}, Files: []string{"reading.proto", "common.proto"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadProtobuf(t *testing.T) {
+	loadTestProto(t)
+	// 嵌套消息包含在内，map 字段生成的条目消息不包含
+	want := []string{"test.v1.Reading", "test.v1.Reading.Location", "test.v1.Tag"}
+	if got := ProtobufMessages(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("messages = %v, want %v", got, want)
+	}
+	for _, name := range []string{"protobuf:test.v1.Reading.Location", "protobuf:test.v1.Tag"} {
+		if _, err := Get(name); err != nil {
+			t.Errorf("Get(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{"protobuf:test.v1.Missing", "protobuf:test.v1.Kind", "protobuf:"} {
+		if _, err := Get(name); err == nil {
+			t.Errorf("Get(%q): expected an error", name)
+		}
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "broken.proto"), []byte(`syntax = "proto3"; message Broken { string a = 1 }`), 0o644)
+	for _, files := range [][]string{{"broken.proto"}, {"missing.proto"}} {
+		if err := LoadProtobuf(context.Background(), ProtobufConfig{ImportPaths: []string{dir}, Files: files}); err == nil {
+			t.Errorf("load %v: expected an error", files)
+		}
+	}
+	// 编译失败不影响已加载的消息
+	if _, err := Get("protobuf:test.v1.Reading"); err != nil {
+		t.Fatalf("after a failed load: %v", err)
+	}
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	loadTestProto(t)
+	c, err := Get("protobuf:test.v1.Reading")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Binary() {
+		t.Fatal("protobuf codec is not binary")
+	}
+	// 与 protojson 一致：字段名为 .proto 中的名称，int64 与 bytes 为字符串，枚举为名称
+	value := map[string]any{
+		"device_id":   "d1",
+		"temperature": 21.5,
+		"timestamp":   "1700000000",
+		"labels":      map[string]any{"site": "a"},
+		"kind":        "KIND_SENSOR",
+		"location":    map[string]any{"lat": 1.5, "lon": int64(-2)},
+		"tags":        []any{map[string]any{"name": "x"}},
+		"raw":         "AAE=",
+	}
+	data, err := c.Encode(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, value) {
+		t.Fatalf("round trip = %#v, want %#v", got, value)
+	}
+
+	// 整数也可以作为 int64 字段的值，编码与字符串相同
+	number, err := c.Encode(map[string]any{"timestamp": int64(1700000000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	str, _ := c.Encode(map[string]any{"timestamp": "1700000000"})
+	if !bytes.Equal(number, str) {
+		t.Fatalf("int64 as number % x, as string % x", number, str)
+	}
+
+	for _, v := range []any{
+		map[string]any{"unknown": 1},
+		map[string]any{"temperature": "hot"},
+		"not an object",
+	} {
+		if data, err := c.Encode(v); err == nil {
+			t.Errorf("encode %#v = % x, want an error", v, data)
+		}
+	}
+	if v, err := c.Decode([]byte{0x0a, 0x05, 'd'}); err == nil {
+		t.Errorf("decode truncated message = %#v, want an error", v)
+	}
+
+	// 转换到 JSON
+	j, _ := Get(JSON)
+	out, err := Transcode(c, j, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `"device_id":"d1"`) {
+		t.Fatalf("transcode to json = %s", out)
+	}
+}
@@ -0,0 +1,44 @@
+package codec
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/BurntSushi/toml"
+	"github.com/networkProtocalTrans/logger"
+)
+
+// CodecConfigPath 编解码器配置文件
+const CodecConfigPath = "./conf/codec.toml"
+
+// Config 编解码器配置
+type Config struct {
+	Protobuf ProtobufConfig `toml:"protobuf"`
+}
+
+// LoadConfig 加载配置并编译 .proto 文件，配置文件不存在时不加载
+func LoadConfig(ctx context.Context, path string) (*Config, error) {
+	var config Config
+	if _, err := toml.DecodeFile(path, &config); err != nil {
+		if os.IsNotExist(err) {
+			return &config, nil
+		}
+		return nil, fmt.Errorf("load codec config %s: %w", path, err)
+	}
+	if len(config.Protobuf.Files) > 0 {
+		if err := LoadProtobuf(ctx, config.Protobuf); err != nil {
+			return nil, fmt.Errorf("load .proto files: %w", err)
+		}
+	}
+	return &config, nil
+}
+
+// InitCodecs 加载编解码器配置，需在创建 servicer 与路由规则之前调用
+func InitCodecs(ctx context.Context) {
+	log := logger.DefaultLogger
+	if _, err := LoadConfig(ctx, CodecConfigPath); err != nil {
+		log.LogFatal(ctx, "Failed to load codecs", "error", err)
+	}
+	log.LogInfo(ctx, "codecs loaded", "codecs", Names(), "protobuf_messages", len(ProtobufMessages()))
+}
@@ -0,0 +1,123 @@
+package codec
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/bufbuild/protocompile/linker"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// ProtobufConfig 启动时编译的 .proto 文件
+type ProtobufConfig struct {
+	// .proto 文件及其 import 的查找目录
+	ImportPaths []string `toml:"import_paths"`
+	// 要加载的 .proto 文件，相对于 import_paths
+	Files []string `toml:"files"`
+}
+
+var (
+	protoMu       sync.RWMutex
+	protoResolver linker.Resolver
+	protoMessages []string
+)
+
+// LoadProtobuf 编译 .proto 文件，之后可通过 protobuf:<消息全名> 获取编解码器
+func LoadProtobuf(ctx context.Context, config ProtobufConfig) error {
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{ImportPaths: config.ImportPaths}),
+	}
+	files, err := compiler.Compile(ctx, config.Files...)
+	if err != nil {
+		return err
+	}
+	var messages []string
+	for _, f := range files {
+		messages = appendMessages(messages, f.Messages())
+	}
+	sort.Strings(messages)
+
+	protoMu.Lock()
+	defer protoMu.Unlock()
+	protoResolver, protoMessages = files.AsResolver(), messages
+	return nil
+}
+
+func appendMessages(names []string, messages protoreflect.MessageDescriptors) []string {
+	for i := 0; i < messages.Len(); i++ {
+		md := messages.Get(i)
+		if md.IsMapEntry() {
+			continue
+		}
+		names = append(names, string(md.FullName()))
+		names = appendMessages(names, md.Messages())
+	}
+	return names
+}
+
+// ProtobufMessages 返回已加载的消息全名
+func ProtobufMessages() []string {
+	protoMu.RLock()
+	defer protoMu.RUnlock()
+	return protoMessages
+}
+
+// protobufCodec 按消息描述编解码，通用值与消息的 JSON 映射（protojson）一致，字段名为 .proto 中的名称
+type protobufCodec struct {
+	desc protoreflect.MessageDescriptor
+}
+
+func newProtobufCodec(param string) (Codec, error) {
+	if param == "" {
+		return nil, fmt.Errorf("protobuf codec requires a message name, e.g. protobuf:pkg.Message")
+	}
+	protoMu.RLock()
+	resolver := protoResolver
+	protoMu.RUnlock()
+	if resolver == nil {
+		return nil, fmt.Errorf("no .proto files are loaded")
+	}
+	d, err := resolver.FindDescriptorByName(protoreflect.FullName(param))
+	if err != nil {
+		return nil, fmt.Errorf("protobuf message %s: %w", param, err)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a protobuf message", param)
+	}
+	return &protobufCodec{desc: md}, nil
+}
+
+func (c *protobufCodec) Decode(data []byte) (any, error) {
+	msg := dynamicpb.NewMessage(c.desc)
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	b, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return jsonCodec{}.Decode(b)
+}
+
+func (c *protobufCodec) Encode(v any) ([]byte, error) {
+	b, err := jsonCodec{}.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	msg := dynamicpb.NewMessage(c.desc)
+	if err := protojson.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+}
+
+func (c *protobufCodec) Binary() bool {
+	return true
+}
@@ -0,0 +1,126 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// normalize 将各解码库的结果统一为通用值：整数为 int64（超出范围的无符号数为 uint64），
+// 浮点数为 float64，map 的键转为字符串，时间转为 RFC 3339 字符串，CBOR 标签取其内容
+func normalize(v any) (any, error) {
+	switch x := v.(type) {
+	case nil, bool, string, []byte, int64, float64:
+		return x, nil
+	case uint64:
+		// CBOR 的无符号整数解码为 uint64
+		return normalizeUint(x), nil
+	case int:
+		return int64(x), nil
+	case int8:
+		return int64(x), nil
+	case int16:
+		return int64(x), nil
+	case int32:
+		return int64(x), nil
+	case uint:
+		return normalizeUint(uint64(x)), nil
+	case uint8:
+		return int64(x), nil
+	case uint16:
+		return int64(x), nil
+	case uint32:
+		return int64(x), nil
+	case float32:
+		return float64(x), nil
+	case json.Number:
+		if n, err := x.Int64(); err == nil {
+			return n, nil
+		}
+		if n, err := strconv.ParseUint(string(x), 10, 64); err == nil {
+			return n, nil
+		}
+		return x.Float64()
+	case cbor.Tag:
+		return normalize(x.Content)
+	case time.Time:
+		return x.Format(time.RFC3339Nano), nil
+	case big.Int:
+		return x.String(), nil
+	case *big.Int:
+		return x.String(), nil
+	case map[string]any:
+		for k, e := range x {
+			n, err := normalize(e)
+			if err != nil {
+				return nil, err
+			}
+			x[k] = n
+		}
+		return x, nil
+	case []any:
+		for i, e := range x {
+			n, err := normalize(e)
+			if err != nil {
+				return nil, err
+			}
+			x[i] = n
+		}
+		return x, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map:
+		m := make(map[string]any, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			n, err := normalize(iter.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+			m[mapKey(iter.Key().Interface())] = n
+		}
+		return m, nil
+	case reflect.Slice, reflect.Array:
+		list := make([]any, rv.Len())
+		for i := range list {
+			n, err := normalize(rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			list[i] = n
+		}
+		return list, nil
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return normalize(rv.Elem().Interface())
+	}
+	return nil, fmt.Errorf("unsupported value type %T", v)
+}
+
+func normalizeUint(n uint64) any {
+	if n <= math.MaxInt64 {
+		return int64(n)
+	}
+	return n
+}
+
+// mapKey 将非字符串的 map 键转为字符串
+func mapKey(k any) string {
+	switch x := k.(type) {
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	}
+	return fmt.Sprint(k)
+}
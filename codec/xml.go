@@ -0,0 +1,239 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// XML 元素与通用值的映射：属性为 @<名称> 字段，与子元素并存的文本为 #text 字段，
+// 重复的子元素为数组，只有文本的元素为字符串。文档为只有根元素一个字段的对象。
+// 编码时字段名须为合法的 XML 名称（不含冒号），否则返回错误
+const (
+	xmlAttrPrefix = "@"
+	xmlTextKey    = "#text"
+	// 编码的值不是单字段对象时使用的根元素名
+	xmlDefaultRoot = "root"
+)
+
+// xmlCodec XML，解码结果中的值均为字符串
+type xmlCodec struct{}
+
+func (xmlCodec) Decode(data []byte) (any, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil, errors.New("no root element")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			v, err := decodeXMLElement(d, start)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]any{start.Name.Local: v}, nil
+		}
+	}
+}
+
+func decodeXMLElement(d *xml.Decoder, start xml.StartElement) (any, error) {
+	obj := map[string]any{}
+	for _, attr := range start.Attr {
+		obj[xmlAttrPrefix+attr.Name.Local] = attr.Value
+	}
+	// 已出现多次、值为数组的子元素
+	lists := map[string]bool{}
+	var text strings.Builder
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			child, err := decodeXMLElement(d, t)
+			if err != nil {
+				return nil, err
+			}
+			name := t.Name.Local
+			prev, seen := obj[name]
+			switch {
+			case !seen:
+				obj[name] = child
+			case lists[name]:
+				obj[name] = append(prev.([]any), child)
+			default:
+				obj[name] = []any{prev, child}
+				lists[name] = true
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			s := strings.TrimSpace(text.String())
+			if len(obj) == 0 {
+				return s, nil
+			}
+			if s != "" {
+				obj[xmlTextKey] = s
+			}
+			return obj, nil
+		}
+	}
+}
+
+func (xmlCodec) Encode(v any) ([]byte, error) {
+	name, value := xmlDefaultRoot, v
+	if obj, ok := v.(map[string]any); ok && len(obj) == 1 {
+		for k, e := range obj {
+			if _, isList := e.([]any); !isList && !strings.HasPrefix(k, xmlAttrPrefix) && k != xmlTextKey {
+				name, value = k, e
+			}
+		}
+	}
+	var buf bytes.Buffer
+	e := xml.NewEncoder(&buf)
+	if err := encodeXMLElement(e, name, value); err != nil {
+		return nil, err
+	}
+	if err := e.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeXMLElement(e *xml.Encoder, name string, v any) error {
+	if list, ok := v.([]any); ok {
+		for _, item := range list {
+			if err := encodeXMLElement(e, name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !validXMLName(name) {
+		return fmt.Errorf("xml: invalid element name %q", name)
+	}
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	obj, ok := v.(map[string]any)
+	if !ok {
+		if err := e.EncodeToken(start); err != nil {
+			return err
+		}
+		if v != nil {
+			s, err := xmlText(v)
+			if err != nil {
+				return err
+			}
+			if err := e.EncodeToken(xml.CharData(s)); err != nil {
+				return err
+			}
+		}
+		return e.EncodeToken(start.End())
+	}
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var children []string
+	for _, k := range keys {
+		switch {
+		case k == xmlTextKey:
+		case strings.HasPrefix(k, xmlAttrPrefix):
+			attr := k[len(xmlAttrPrefix):]
+			if !validXMLName(attr) {
+				return fmt.Errorf("xml: invalid attribute name %q", attr)
+			}
+			s, err := xmlText(obj[k])
+			if err != nil {
+				return err
+			}
+			start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: attr}, Value: s})
+		default:
+			children = append(children, k)
+		}
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	if text, ok := obj[xmlTextKey]; ok {
+		s, err := xmlText(text)
+		if err != nil {
+			return err
+		}
+		if err := e.EncodeToken(xml.CharData(s)); err != nil {
+			return err
+		}
+	}
+	for _, k := range children {
+		if err := encodeXMLElement(e, k, obj[k]); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// validXMLName 是否为 XML 1.0 的 Name。冒号用于命名空间前缀，解码时会被拆分，编码时不允许
+func validXMLName(name string) bool {
+	if name == "" || !utf8.ValidString(name) {
+		return false
+	}
+	for i, r := range name {
+		if !xmlNameStartChar(r) && (i == 0 || !xmlNameChar(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// xmlNameStartChar XML 1.0 NameStartChar，不含冒号
+func xmlNameStartChar(r rune) bool {
+	return r == '_' || 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' ||
+		0xC0 <= r && r <= 0xD6 || 0xD8 <= r && r <= 0xF6 || 0xF8 <= r && r <= 0x2FF ||
+		0x370 <= r && r <= 0x37D || 0x37F <= r && r <= 0x1FFF || 0x200C <= r && r <= 0x200D ||
+		0x2070 <= r && r <= 0x218F || 0x2C00 <= r && r <= 0x2FEF || 0x3001 <= r && r <= 0xD7FF ||
+		0xF900 <= r && r <= 0xFDCF || 0xFDF0 <= r && r <= 0xFFFD || 0x10000 <= r && r <= 0xEFFFF
+}
+
+// xmlNameChar XML 1.0 NameChar 中 NameStartChar 之外的字符
+func xmlNameChar(r rune) bool {
+	return r == '-' || r == '.' || '0' <= r && r <= '9' || r == 0xB7 ||
+		0x300 <= r && r <= 0x36F || 0x203F <= r && r <= 0x2040
+}
+
+// xmlText 标量值的文本形式，[]byte 为 base64
+func xmlText(v any) (string, error) {
+	switch x := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return x, nil
+	case bool:
+		return strconv.FormatBool(x), nil
+	case int64:
+		return strconv.FormatInt(x, 10), nil
+	case uint64:
+		return strconv.FormatUint(x, 10), nil
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64), nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(x), nil
+	}
+	return "", fmt.Errorf("xml: unsupported value type %T", v)
+}
+
+func (xmlCodec) Binary() bool {
+	return false
+}
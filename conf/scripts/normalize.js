@@ -0,0 +1,16 @@
+// 将设备上报的华氏温度转换为摄氏度，并统一字段名
+// msg: { topic, source, headers, payload }，payload 为按 codec 解码后的值
+function transform(msg) {
+  var p = msg.payload;
+  if (p === null || typeof p.temp_f !== "number") {
+    // 返回 null 丢弃消息
+    return null;
+  }
+  msg.payload = {
+    device: p.id,
+    temperature: Math.round((p.temp_f - 32) * 5 / 9 * 10) / 10,
+    unit: "celsius",
+  };
+  msg.headers.unit = "celsius";
+  return msg;
+}
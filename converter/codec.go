@@ -0,0 +1,118 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/networkProtocalTrans/codec"
+	"github.com/networkProtocalTrans/module"
+)
+
+// codecConverter 源协议为编解码器名称（json、msgpack、cbor、xml、protobuf:<消息全名>）时，
+// 转换到另一编解码器或发布到 mqtt / websocket。协议对与编解码器无关时返回 nil, nil
+func codecConverter(source, destination string) (Converter, error) {
+	if !isCodec(source) {
+		return nil, nil
+	}
+	if _, err := codec.Get(source); err != nil {
+		return nil, module.BadRequest(module.ErrCodeUnsupported, err.Error())
+	}
+	switch destination {
+	case ProtocolMQTT:
+		return toMQTT(source), nil
+	case ProtocolWebsocket:
+		return toWebsocket(source), nil
+	}
+	if !isCodec(destination) {
+		return nil, nil
+	}
+	if _, err := codec.Get(destination); err != nil {
+		return nil, module.BadRequest(module.ErrCodeUnsupported, err.Error())
+	}
+	return transcode(source, destination), nil
+}
+
+// isCodec 名称的类型部分是否为已注册的编解码器
+func isCodec(name string) bool {
+	typ, _, _ := strings.Cut(name, ":")
+	for _, n := range codec.Names() {
+		if n == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// transcode 将数据由源编码转为目标编码。二进制编码的结果按 options.output_encoding（base64 或 hex，默认 base64）返回字符串，
+// json 返回 JSON 值，xml 返回字符串
+func transcode(src, dst string) Converter {
+	return ConverterFunc(func(ctx context.Context, req *module.ConvertRequest) (any, error) {
+		payload, err := requestPayload(src, dst, req)
+		if err != nil {
+			return nil, err
+		}
+		c, _ := codec.Get(dst)
+		switch {
+		case c.Binary():
+			encoding := optionString(req.Options, "output_encoding", EncodingBase64)
+			if encoding != EncodingBase64 && encoding != EncodingHex {
+				return nil, module.BadRequest(module.ErrCodeInvalidRequest, "options.output_encoding must be base64 or hex")
+			}
+			return encodePayload(encoding, payload)
+		case dst == codec.JSON:
+			return encodePayload(EncodingJSON, payload)
+		}
+		return encodePayload(EncodingText, payload)
+	})
+}
+
+// requestPayload 取出请求数据的原始字节，target 不为空时再转为该编码。
+// 源协议为二进制编码时 data 为 options.input_encoding（base64 或 hex，默认 base64）字符串，
+// 为 xml 时 data 为字符串，为 json、http-json 时 data 为任意 JSON 值，其余源协议见 DecodePayload
+func requestPayload(src, target string, req *module.ConvertRequest) ([]byte, error) {
+	name := src
+	if src == ProtocolHTTPJSON {
+		name = codec.JSON
+	}
+	srcCodec, codecErr := codec.Get(name)
+
+	var payload []byte
+	var err error
+	switch {
+	case codecErr != nil || name == codec.JSON:
+		payload, err = DecodePayload(src, req.Data)
+	case srcCodec.Binary():
+		encoding := optionString(req.Options, "input_encoding", EncodingBase64)
+		if encoding != EncodingBase64 && encoding != EncodingHex {
+			return nil, module.BadRequest(module.ErrCodeInvalidRequest, "options.input_encoding must be base64 or hex")
+		}
+		payload, err = DecodePayload(encoding, req.Data)
+	default:
+		payload, err = DecodePayload(EncodingText, req.Data)
+	}
+	if err != nil || target == "" {
+		return payload, err
+	}
+
+	if codecErr != nil {
+		return nil, module.BadRequest(module.ErrCodeUnsupported,
+			fmt.Sprintf("source protocol %q cannot be converted to codec %q", src, target))
+	}
+	dstCodec, err := codec.Get(target)
+	if err != nil {
+		return nil, module.BadRequest(module.ErrCodeUnsupported, err.Error())
+	}
+	out, err := codec.Transcode(srcCodec, dstCodec, payload)
+	if err != nil {
+		return nil, invalidData(fmt.Sprintf("%s to %s: %v", name, target, err))
+	}
+	return out, nil
+}
+
+func optionString(options map[string]string, key, def string) string {
+	if v := options[key]; v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,101 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/networkProtocalTrans/module"
+)
+
+// 协议名称
+const (
+	ProtocolHTTPJSON  = "http-json"
+	ProtocolMQTT      = "mqtt"
+	ProtocolWebsocket = "websocket"
+)
+
+// Converter 将请求数据从源协议转换到目标协议
+type Converter interface {
+	Convert(ctx context.Context, req *module.ConvertRequest) (any, error)
+}
+
+// ConverterFunc 函数形式的 Converter
+type ConverterFunc func(ctx context.Context, req *module.ConvertRequest) (any, error)
+
+func (f ConverterFunc) Convert(ctx context.Context, req *module.ConvertRequest) (any, error) {
+	return f(ctx, req)
+}
+
+// Pair 源协议与目标协议组成的转换对
+type Pair struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+var (
+	registry   = map[Pair]Converter{}
+	registryMu sync.RWMutex
+)
+
+// Register 注册 (source, destination) 协议对的转换器，重复注册会覆盖
+func Register(source, destination string, c Converter) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[Pair{normalize(source), normalize(destination)}] = c
+}
+
+// Get 获取 (source, destination) 协议对的转换器，未注册时按编解码器名称转换
+func Get(source, destination string) (Converter, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if c, ok := registry[Pair{normalize(source), normalize(destination)}]; ok {
+		return c, nil
+	}
+	if c, err := codecConverter(codecName(source), codecName(destination)); c != nil || err != nil {
+		return c, err
+	}
+	return nil, module.BadRequest(module.ErrCodeUnsupported,
+		fmt.Sprintf("conversion from %q to %q is not supported", source, destination))
+}
+
+// Pairs 返回所有已注册的协议对
+func Pairs() []Pair {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	pairs := make([]Pair, 0, len(registry))
+	for p := range registry {
+		pairs = append(pairs, p)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Source != pairs[j].Source {
+			return pairs[i].Source < pairs[j].Source
+		}
+		return pairs[i].Destination < pairs[j].Destination
+	})
+	return pairs
+}
+
+// Convert 查找转换器并执行转换
+func Convert(ctx context.Context, req *module.ConvertRequest) (any, error) {
+	c, err := Get(req.SourceProtocol, req.DestinationProtocol)
+	if err != nil {
+		return nil, err
+	}
+	return c.Convert(ctx, req)
+}
+
+func normalize(protocol string) string {
+	return strings.ToLower(strings.TrimSpace(protocol))
+}
+
+// codecName 与 normalize 相同，但保留 : 之后参数（如 protobuf 消息全名）的大小写
+func codecName(protocol string) string {
+	typ, param, found := strings.Cut(strings.TrimSpace(protocol), ":")
+	if !found {
+		return normalize(typ)
+	}
+	return normalize(typ) + ":" + param
+}
@@ -0,0 +1,146 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/networkProtocalTrans/module"
+)
+
+// errorStatus 返回 API 错误的状态码，其余错误返回 0
+func errorStatus(err error) int {
+	var apiErr *module.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Status
+	}
+	return 0
+}
+
+func TestReencode(t *testing.T) {
+	tests := []struct {
+		src, dst string
+		data     string
+		want     any
+	}{
+		{EncodingText, EncodingBase64, `"hello"`, "aGVsbG8="},
+		{EncodingText, EncodingHex, `"hi"`, "6869"},
+		{EncodingBase64, EncodingText, `"aGVsbG8="`, "hello"},
+		{EncodingHex, EncodingBase64, `"6869"`, "aGk="},
+		{EncodingJSON, EncodingText, `{"a":1}`, `{"a":1}`},
+		{EncodingText, EncodingJSON, `"[1,2]"`, json.RawMessage(`[1,2]`)},
+	}
+	for _, tt := range tests {
+		got, err := Convert(context.Background(), &module.ConvertRequest{SourceProtocol: tt.src, DestinationProtocol: tt.dst, Data: json.RawMessage(tt.data)})
+		if err != nil {
+			t.Errorf("%s -> %s: %v", tt.src, tt.dst, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s -> %s = %#v, want %#v", tt.src, tt.dst, got, tt.want)
+		}
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		req  module.ConvertRequest
+	}{
+		{"unsupported pair", module.ConvertRequest{SourceProtocol: "text", DestinationProtocol: "smtp", Data: json.RawMessage(`"a"`)}},
+		{"invalid base64", module.ConvertRequest{SourceProtocol: "base64", DestinationProtocol: "text", Data: json.RawMessage(`"%%%"`)}},
+		{"invalid json", module.ConvertRequest{SourceProtocol: "text", DestinationProtocol: "json", Data: json.RawMessage(`"{"`)}},
+		{"text is not a string", module.ConvertRequest{SourceProtocol: "text", DestinationProtocol: "hex", Data: json.RawMessage(`1`)}},
+	}
+	for _, tt := range tests {
+		if _, err := Convert(context.Background(), &tt.req); errorStatus(err) != http.StatusBadRequest {
+			t.Errorf("%s: err = %v, want 400", tt.name, err)
+		}
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	// {"a":1} 的 msgpack 编码
+	msgpack := "81a16101"
+	got, err := Convert(context.Background(), &module.ConvertRequest{
+		SourceProtocol: "json", DestinationProtocol: "msgpack",
+		Data: json.RawMessage(`{"a":1}`), Options: map[string]string{"output_encoding": EncodingHex},
+	})
+	if err != nil || got != msgpack {
+		t.Fatalf("json -> msgpack = %v, %v, want %s", got, err, msgpack)
+	}
+	got, err = Convert(context.Background(), &module.ConvertRequest{
+		SourceProtocol: "msgpack", DestinationProtocol: "json",
+		Data: json.RawMessage(`"` + msgpack + `"`), Options: map[string]string{"input_encoding": EncodingHex},
+	})
+	if err != nil || string(got.(json.RawMessage)) != `{"a":1}` {
+		t.Fatalf("msgpack -> json = %s, %v", got, err)
+	}
+}
+
+// fakePublisher 记录 toMQTT 发布的消息
+type fakePublisher struct {
+	topic   string
+	payload []byte
+	retain  bool
+	qos     byte
+	err     error
+}
+
+func (p *fakePublisher) publish(topic string, payload []byte, retain bool, qos byte) error {
+	p.topic, p.payload, p.retain, p.qos = topic, payload, retain, qos
+	return p.err
+}
+
+func useFakePublisher(t *testing.T) *fakePublisher {
+	p := &fakePublisher{}
+	prev := MQTTPublisher
+	MQTTPublisher = p.publish
+	t.Cleanup(func() { MQTTPublisher = prev })
+	return p
+}
+
+func TestToMQTT(t *testing.T) {
+	p := useFakePublisher(t)
+	got, err := Convert(context.Background(), &module.ConvertRequest{
+		SourceProtocol: "json", DestinationProtocol: "mqtt",
+		Data:    json.RawMessage(`{"a":1}`),
+		Options: map[string]string{"topic": "devices/a", "qos": "1", "retain": "true", "codec": "msgpack"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.topic != "devices/a" || p.qos != 1 || !p.retain || string(p.payload) != "\x81\xa1a\x01" {
+		t.Fatalf("published %s qos %d retain %v % x", p.topic, p.qos, p.retain, p.payload)
+	}
+	if r := got.(*MQTTResult); r.Topic != "devices/a" || r.Bytes != 4 {
+		t.Fatalf("result = %+v", r)
+	}
+
+	for _, options := range []map[string]string{
+		{},
+		{"topic": "devices/a", "qos": "3"},
+		{"topic": "devices/a", "retain": "maybe"},
+	} {
+		_, err := Convert(context.Background(), &module.ConvertRequest{SourceProtocol: "text", DestinationProtocol: "mqtt", Data: json.RawMessage(`"a"`), Options: options})
+		if errorStatus(err) != http.StatusBadRequest {
+			t.Errorf("options %v: err = %v, want 400", options, err)
+		}
+	}
+
+	// 发布失败的错误原样返回
+	p.err = module.NewError(http.StatusForbidden, module.ErrCodeForbidden, "denied")
+	_, err = Convert(context.Background(), &module.ConvertRequest{SourceProtocol: "text", DestinationProtocol: "mqtt", Data: json.RawMessage(`"a"`), Options: map[string]string{"topic": "secret"}})
+	if errorStatus(err) != http.StatusForbidden {
+		t.Fatalf("publisher error = %v, want 403", err)
+	}
+
+	MQTTPublisher = nil
+	_, err = Convert(context.Background(), &module.ConvertRequest{SourceProtocol: "text", DestinationProtocol: "mqtt", Data: json.RawMessage(`"a"`), Options: map[string]string{"topic": "devices/a"}})
+	if errorStatus(err) != http.StatusServiceUnavailable {
+		t.Fatalf("without publisher: err = %v, want 503", err)
+	}
+}
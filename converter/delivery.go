@@ -0,0 +1,106 @@
+package converter
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/networkProtocalTrans/module"
+	"github.com/networkProtocalTrans/services"
+)
+
+func init() {
+	for _, src := range []string{ProtocolHTTPJSON, EncodingText, EncodingBase64, EncodingHex} {
+		Register(src, ProtocolMQTT, toMQTT(src))
+		Register(src, ProtocolWebsocket, toWebsocket(src))
+	}
+}
+
+// MQTTPublisher 发布转换到 mqtt 的结果，由 router 设置为与 /api/v1/publish 相同的流程：
+// 拒绝 $ 开头的系统主题与通配符、按 publish.acl 授权、按 [validation] 校验负载后发布。未设置时不能转换到 mqtt
+var MQTTPublisher func(topic string, payload []byte, retain bool, qos byte) error
+
+// MQTTResult 发布到 MQTT 的结果
+type MQTTResult struct {
+	Topic  string `json:"topic"`
+	QoS    byte   `json:"qos"`
+	Retain bool   `json:"retain"`
+	Bytes  int    `json:"bytes"`
+}
+
+// WebsocketResult 广播到 websocket 的结果
+type WebsocketResult struct {
+	Path  string `json:"path"`
+	Bytes int    `json:"bytes"`
+}
+
+// toMQTT 将数据作为负载发布到内嵌 MQTT broker，options: topic(必填)、qos、retain、codec(发布前转换的编码)
+func toMQTT(src string) Converter {
+	return ConverterFunc(func(ctx context.Context, req *module.ConvertRequest) (any, error) {
+		topic := req.Options["topic"]
+		if topic == "" {
+			return nil, module.BadRequest(module.ErrCodeInvalidRequest, "options.topic is required")
+		}
+		qos, err := optionUint(req.Options, "qos", 2)
+		if err != nil {
+			return nil, err
+		}
+		retain, err := optionBool(req.Options, "retain")
+		if err != nil {
+			return nil, err
+		}
+		payload, err := requestPayload(src, req.Options["codec"], req)
+		if err != nil {
+			return nil, err
+		}
+
+		if MQTTPublisher == nil {
+			return nil, module.NewError(http.StatusServiceUnavailable, module.ErrCodeUnavailable, "mqtt publishing is not configured")
+		}
+		if err := MQTTPublisher(topic, payload, retain, byte(qos)); err != nil {
+			return nil, err
+		}
+		return &MQTTResult{Topic: topic, QoS: byte(qos), Retain: retain, Bytes: len(payload)}, nil
+	})
+}
+
+// toWebsocket 将数据广播给 websocket 客户端，options: path(为空时广播给所有客户端)、codec(发送前转换的编码)
+func toWebsocket(src string) Converter {
+	return ConverterFunc(func(ctx context.Context, req *module.ConvertRequest) (any, error) {
+		payload, err := requestPayload(src, req.Options["codec"], req)
+		if err != nil {
+			return nil, err
+		}
+
+		if services.WsServer == nil {
+			return nil, module.NewError(http.StatusServiceUnavailable, module.ErrCodeUnavailable, "websocket servicer is not running")
+		}
+		path := req.Options["path"]
+		services.WsServer.Broadcast(path, services.FrameType(payload), payload)
+		return &WebsocketResult{Path: path, Bytes: len(payload)}, nil
+	})
+}
+
+func optionUint(options map[string]string, key string, max uint64) (uint64, error) {
+	v, ok := options[key]
+	if !ok || v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 8)
+	if err != nil || n > max {
+		return 0, module.BadRequest(module.ErrCodeInvalidRequest, "options."+key+" must be between 0 and "+strconv.FormatUint(max, 10))
+	}
+	return n, nil
+}
+
+func optionBool(options map[string]string, key string) (bool, error) {
+	v, ok := options[key]
+	if !ok || v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, module.BadRequest(module.ErrCodeInvalidRequest, "options."+key+" must be a boolean")
+	}
+	return b, nil
+}
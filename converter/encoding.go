@@ -0,0 +1,100 @@
+package converter
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/networkProtocalTrans/module"
+)
+
+// 负载编码
+const (
+	EncodingJSON   = "json"
+	EncodingText   = "text"
+	EncodingBase64 = "base64"
+	EncodingHex    = "hex"
+)
+
+var encodings = []string{EncodingJSON, EncodingText, EncodingBase64, EncodingHex}
+
+func init() {
+	for _, src := range encodings {
+		for _, dst := range encodings {
+			if src != dst {
+				Register(src, dst, reencode(src, dst))
+			}
+		}
+	}
+}
+
+// reencode 将 data 按 src 编码解出原始字节后再按 dst 编码
+func reencode(src, dst string) Converter {
+	return ConverterFunc(func(ctx context.Context, req *module.ConvertRequest) (any, error) {
+		payload, err := DecodePayload(src, req.Data)
+		if err != nil {
+			return nil, err
+		}
+		return encodePayload(dst, payload)
+	})
+}
+
+// DecodePayload 按编码将请求数据还原为原始字节，json 编码下 data 为任意 JSON 值，其余编码下 data 为字符串
+func DecodePayload(encoding string, data json.RawMessage) ([]byte, error) {
+	if encoding == EncodingJSON || encoding == ProtocolHTTPJSON {
+		if !json.Valid(data) {
+			return nil, invalidData("data is not valid json")
+		}
+		return data, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, invalidData(fmt.Sprintf("data must be a %s string", encoding))
+	}
+	switch encoding {
+	case EncodingText:
+		return []byte(s), nil
+	case EncodingBase64:
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, invalidData(fmt.Sprintf("decode base64 failed: %v", err))
+		}
+		return b, nil
+	case EncodingHex:
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, invalidData(fmt.Sprintf("decode hex failed: %v", err))
+		}
+		return b, nil
+	}
+	return nil, module.BadRequest(module.ErrCodeUnsupported, fmt.Sprintf("unknown encoding %q", encoding))
+}
+
+// encodePayload 将原始字节按编码转为响应中的值
+func encodePayload(encoding string, payload []byte) (any, error) {
+	switch encoding {
+	case EncodingJSON:
+		if !json.Valid(payload) {
+			return nil, invalidData("payload is not valid json")
+		}
+		return json.RawMessage(payload), nil
+	case EncodingText:
+		if !utf8.Valid(payload) {
+			return nil, invalidData("payload is not valid utf-8 text")
+		}
+		return string(payload), nil
+	case EncodingBase64:
+		return base64.StdEncoding.EncodeToString(payload), nil
+	case EncodingHex:
+		return hex.EncodeToString(payload), nil
+	}
+	return nil, module.BadRequest(module.ErrCodeUnsupported, fmt.Sprintf("unknown encoding %q", encoding))
+}
+
+func invalidData(message string) error {
+	return module.BadRequest(module.ErrCodeInvalidData, message)
+}
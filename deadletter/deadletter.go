@@ -0,0 +1,463 @@
+package deadletter
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	"github.com/networkProtocalTrans/logger"
+	"github.com/rs/xid"
+)
+
+// ConfigPath 死信配置文件
+const ConfigPath = "./conf/deadletter.toml"
+
+// 内存中默认保留的死信条数
+const defaultHistory = 1000
+
+// 失败的处理阶段
+const (
+	// 负载不符合校验规则
+	StageValidation = "validation"
+	// 编码转换、路由转换或脚本执行失败
+	StageConversion = "conversion"
+	// 发送到目标失败
+	StageDelivery = "delivery"
+)
+
+// 内置 sink 类型，mqtt 与 websocket 由 services 注册
+const (
+	SinkMQTT      = "mqtt"
+	SinkWebsocket = "websocket"
+	SinkFile      = "file"
+)
+
+// HeaderLetter 发布到 MQTT sink 的死信带有该 header（MQTT v5 用户属性），
+// 带有该 header 的消息再次失败时只记录日志，避免死信循环
+const HeaderLetter = "dead-letter"
+
+var (
+	// ErrNotFound 死信不存在或已被删除
+	ErrNotFound = errors.New("dead letter not found")
+	// ErrNoRedriver 死信的目标或来源不支持重新投递
+	ErrNoRedriver = errors.New("dead letter cannot be redriven")
+	// ErrRedriving 死信正在重新投递
+	ErrRedriving = errors.New("dead letter is being redriven")
+)
+
+// Letter 未能处理的消息及失败原因
+type Letter struct {
+	ID string `json:"id"`
+	// validation, conversion, delivery
+	Stage string `json:"stage"`
+	Error string `json:"error"`
+	// 消息来源类型：mqtt, websocket, http, tcp, udp, modbus，未知时为空
+	Source string `json:"source,omitempty"`
+	// 来源 servicer 名称
+	Servicer string `json:"servicer,omitempty"`
+	// mqtt 主题、websocket / http 路径或 tcp / udp 对端地址
+	Topic string `json:"topic,omitempty"`
+	// 失败的处理方或目标，决定重新投递的方式：
+	// route:<规则>[:<目标序号>], webhook:<servicer>:<目标序号>, queue:<队列名称>, bridge:<websocket servicer>:<桥接序号>,
+	// tcp:<servicer>, udp:<servicer>, mqtt:<servicer>:<主题>, modbus:<servicer>；为空时在来源重新注入
+	Destination string `json:"destination,omitempty"`
+	// MQTT v5 用户属性或校验 tag 动作写入的 header
+	Headers map[string]string `json:"headers,omitempty"`
+	// 源主题过滤器中通配符匹配到的层级，重新投递路由目标时使用
+	Wildcards []string `json:"wildcards,omitempty"`
+	// 失败时的负载，序列化时 UTF-8 文本放在 payload，否则 base64 编码后放在 payload_base64
+	Payload []byte `json:"-"`
+	// 重新投递所需的原始数据，如持久化队列中的消息
+	Data json.RawMessage `json:"data,omitempty"`
+	// 收到消息与失败的时间
+	Received time.Time `json:"received"`
+	Failed   time.Time `json:"failed"`
+	// 重新投递的次数与最近一次的结果
+	Redrives       int        `json:"redrives,omitempty"`
+	LastRedrive    *time.Time `json:"last_redrive,omitempty"`
+	LastRedriveErr string     `json:"last_redrive_error,omitempty"`
+}
+
+// letterJSON Letter 的 JSON 形式
+type letterJSON struct {
+	*letterAlias
+	Payload       *string `json:"payload,omitempty"`
+	PayloadBase64 string  `json:"payload_base64,omitempty"`
+}
+
+type letterAlias Letter
+
+// MarshalJSON 负载为 UTF-8 文本时写入 payload，否则写入 payload_base64
+func (l *Letter) MarshalJSON() ([]byte, error) {
+	out := letterJSON{letterAlias: (*letterAlias)(l)}
+	if utf8.Valid(l.Payload) {
+		s := string(l.Payload)
+		out.Payload = &s
+	} else {
+		out.PayloadBase64 = base64.StdEncoding.EncodeToString(l.Payload)
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON 解析 MarshalJSON 的输出
+func (l *Letter) UnmarshalJSON(b []byte) error {
+	in := letterJSON{letterAlias: (*letterAlias)(l)}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+	switch {
+	case in.Payload != nil:
+		l.Payload = []byte(*in.Payload)
+	case in.PayloadBase64 != "":
+		p, err := base64.StdEncoding.DecodeString(in.PayloadBase64)
+		if err != nil {
+			return fmt.Errorf("payload_base64: %w", err)
+		}
+		l.Payload = p
+	}
+	return nil
+}
+
+// Kind 重新投递方式：Destination 中第一个 : 之前的部分，Destination 为空时为 Source
+func (l *Letter) Kind() string {
+	if l.Destination == "" {
+		return l.Source
+	}
+	kind, _, _ := strings.Cut(l.Destination, ":")
+	return kind
+}
+
+// Target 返回 Destination 中 kind 之后的部分
+func (l *Letter) Target() string {
+	_, target, _ := strings.Cut(l.Destination, ":")
+	return target
+}
+
+// Expand 替换 s 中的占位符：{stage} 阶段，{source} 来源类型，{servicer} 来源 servicer，为空的值替换为 unknown
+func (l *Letter) Expand(s string) string {
+	if !strings.Contains(s, "{") {
+		return s
+	}
+	or := func(v string) string {
+		if v == "" {
+			return "unknown"
+		}
+		return v
+	}
+	return strings.NewReplacer("{stage}", l.Stage, "{source}", or(l.Source), "{servicer}", or(l.Servicer)).Replace(s)
+}
+
+// Config 死信配置
+type Config struct {
+	// 内存中保留的最近死信条数，供 /api/v1/deadletters 查询与重新投递，默认 1000
+	History int          `toml:"history"`
+	Sinks   []SinkConfig `toml:"sink"`
+}
+
+// SinkConfig 死信输出
+type SinkConfig struct {
+	// mqtt, websocket, file
+	Type string `toml:"type" json:"type"`
+	// mqtt / websocket: servicer 名称，为空时使用同类型的默认 servicer
+	Servicer string `toml:"servicer" json:"servicer,omitempty"`
+	// mqtt: 发布主题，支持 {stage}、{source}、{servicer} 占位符
+	Topic  string `toml:"topic" json:"topic,omitempty"`
+	QoS    byte   `toml:"qos" json:"qos,omitempty"`
+	Retain bool   `toml:"retain" json:"retain,omitempty"`
+	// websocket: 频道，支持占位符
+	Channel string `toml:"channel" json:"channel,omitempty"`
+	// file: JSONL 文件路径，按 max_size（MB）轮转，保留 max_backups 个旧文件、max_age 天
+	Path       string `toml:"path" json:"path,omitempty"`
+	MaxSize    int    `toml:"max_size" json:"max_size,omitempty"`
+	MaxBackups int    `toml:"max_backups" json:"max_backups,omitempty"`
+	MaxAge     int    `toml:"max_age" json:"max_age,omitempty"`
+	Compress   bool   `toml:"compress" json:"compress,omitempty"`
+}
+
+// Sink 死信输出
+type Sink interface {
+	Write(l *Letter) error
+}
+
+// SinkFactory 根据配置创建 sink，在 servicer 加载完成后调用
+type SinkFactory func(config SinkConfig) (Sink, error)
+
+// Redriver 重新投递死信，返回 nil 表示消息已重新交给处理方
+type Redriver func(ctx context.Context, l *Letter) error
+
+var (
+	registryMu sync.RWMutex
+	sinks      = map[string]SinkFactory{}
+	redrivers  = map[string]Redriver{}
+)
+
+// RegisterSink 注册 sink 类型，重复注册时覆盖
+func RegisterSink(typ string, factory SinkFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	sinks[typ] = factory
+}
+
+// RegisterRedriver 注册 kind（见 Letter.Kind）的重新投递方式，重复注册时覆盖
+func RegisterRedriver(kind string, fn Redriver) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	redrivers[kind] = fn
+}
+
+func newSink(config SinkConfig) (Sink, error) {
+	registryMu.RLock()
+	factory, ok := sinks[config.Type]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sink type %q", config.Type)
+	}
+	return factory(config)
+}
+
+// Store 保存最近的死信并写入所有 sink
+type Store struct {
+	logger  *logger.AppLogger
+	history int
+	sinks   []Sink
+	types   []string
+
+	mu sync.Mutex
+	// 按失败时间排列，最早的在前
+	letters []*Letter
+	// 正在重新投递的死信 ID，同一死信同时只重新投递一次
+	redriving map[string]struct{}
+}
+
+// Default 由 InitDeadLetters 创建
+var Default *Store
+
+// New 根据配置创建 sink
+func New(log *logger.AppLogger, config *Config) (*Store, error) {
+	if config.History < 0 {
+		return nil, errors.New("history must not be negative")
+	}
+	s := &Store{logger: log, history: config.History, redriving: make(map[string]struct{})}
+	if s.history == 0 {
+		s.history = defaultHistory
+	}
+	for i, sc := range config.Sinks {
+		sink, err := newSink(sc)
+		if err != nil {
+			return nil, fmt.Errorf("sink #%d: %w", i+1, err)
+		}
+		s.sinks = append(s.sinks, sink)
+		s.types = append(s.types, sc.Type)
+	}
+	return s, nil
+}
+
+// Publish 将死信交给 Default，Default 未创建时只记录日志
+func Publish(ctx context.Context, l *Letter) {
+	if Default == nil {
+		logger.DefaultLogger.LogErrorf(ctx, "dead letter at %s from %s %s: %s", l.Stage, l.Source, l.Topic, l.Error)
+		return
+	}
+	Default.Publish(ctx, l)
+}
+
+// Publish 记录死信并写入所有 sink，ID 与时间为空时自动填充。sink 写入失败只记录日志
+func (s *Store) Publish(ctx context.Context, l *Letter) {
+	if l.ID == "" {
+		l.ID = xid.New().String()
+	}
+	if l.Failed.IsZero() {
+		l.Failed = time.Now()
+	}
+	if l.Received.IsZero() {
+		l.Received = l.Failed
+	}
+	if l.Headers[HeaderLetter] != "" {
+		s.logger.LogErrorf(ctx, "dead letter %s failed again at %s: %s", l.Headers[HeaderLetter], l.Stage, l.Error)
+		return
+	}
+	s.mu.Lock()
+	s.letters = append(s.letters, l)
+	if n := len(s.letters) - s.history; n > 0 {
+		s.letters = append([]*Letter(nil), s.letters[n:]...)
+	}
+	s.mu.Unlock()
+
+	s.logger.LogInfo(ctx, "dead letter",
+		"id", l.ID, "stage", l.Stage, "source", l.Source, "servicer", l.Servicer,
+		"topic", l.Topic, "destination", l.Destination, "error", l.Error)
+	for i, sink := range s.sinks {
+		if err := sink.Write(l); err != nil {
+			s.logger.LogErrorf(ctx, "dead letter %s: write to %s sink #%d failed: %v", l.ID, s.types[i], i+1, err)
+		}
+	}
+}
+
+// Filter 查询条件，为空的字段不限制
+type Filter struct {
+	Stage    string
+	Source   string
+	Servicer string
+	// Destination 前缀，如 route:temperature-alert
+	Destination string
+	// 最多返回的条数，0 表示不限制
+	Limit int
+}
+
+func (f *Filter) match(l *Letter) bool {
+	return (f.Stage == "" || l.Stage == f.Stage) &&
+		(f.Source == "" || l.Source == f.Source) &&
+		(f.Servicer == "" || l.Servicer == f.Servicer) &&
+		strings.HasPrefix(l.Destination, f.Destination)
+}
+
+// List 按失败时间从新到旧返回匹配的死信与匹配总数
+func (s *Store) List(f Filter) ([]*Letter, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	letters := []*Letter{}
+	total := 0
+	for i := len(s.letters) - 1; i >= 0; i-- {
+		l := s.letters[i]
+		if !f.match(l) {
+			continue
+		}
+		total++
+		if f.Limit == 0 || len(letters) < f.Limit {
+			c := *l
+			letters = append(letters, &c)
+		}
+	}
+	return letters, total
+}
+
+// Get 按 ID 查找死信，返回副本
+func (s *Store) Get(id string) (*Letter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(id)
+	if i < 0 {
+		return nil, false
+	}
+	c := *s.letters[i]
+	return &c, true
+}
+
+// Remove 删除死信，sink 中已写入的记录不受影响
+func (s *Store) Remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(id)
+	if i < 0 {
+		return false
+	}
+	s.letters = append(s.letters[:i], s.letters[i+1:]...)
+	return true
+}
+
+// index 返回死信的下标，调用方持有 s.mu
+func (s *Store) index(id string) int {
+	for i, l := range s.letters {
+		if l.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Redrive 按死信的 kind 重新投递，成功后从内存中删除，失败时保留并记录错误。
+// 同一死信正在重新投递时返回 ErrRedriving，避免并发请求重复投递。
+// 消息重新交给处理方后，异步进行的处理（如队列发送）再次失败时产生新的死信
+func (s *Store) Redrive(ctx context.Context, id string) (*Letter, error) {
+	l, err := s.claim(id)
+	if err != nil {
+		return l, err
+	}
+	defer func() {
+		s.mu.Lock()
+		delete(s.redriving, id)
+		s.mu.Unlock()
+	}()
+	registryMu.RLock()
+	fn, ok := redrivers[l.Kind()]
+	registryMu.RUnlock()
+	if !ok {
+		return l, fmt.Errorf("%w: unsupported %q", ErrNoRedriver, l.Kind())
+	}
+
+	err = fn(ctx, l)
+	now := time.Now()
+	l.Redrives++
+	l.LastRedrive = &now
+	l.LastRedriveErr = ""
+	if err != nil {
+		l.LastRedriveErr = err.Error()
+	}
+	s.mu.Lock()
+	if i := s.index(id); i >= 0 {
+		if err != nil {
+			s.letters[i] = l
+		} else {
+			s.letters = append(s.letters[:i], s.letters[i+1:]...)
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return l, err
+	}
+	s.logger.LogInfo(ctx, "dead letter redriven", "id", l.ID, "destination", l.Destination, "redrives", l.Redrives)
+	return l, nil
+}
+
+// claim 标记死信正在重新投递并返回其副本
+func (s *Store) claim(id string) (*Letter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(id)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	c := *s.letters[i]
+	if _, ok := s.redriving[id]; ok {
+		return &c, ErrRedriving
+	}
+	s.redriving[id] = struct{}{}
+	return &c, nil
+}
+
+// LoadConfig 加载死信配置，配置文件不存在时返回空配置
+func LoadConfig(path string) (*Config, error) {
+	var config Config
+	if _, err := toml.DecodeFile(path, &config); err != nil {
+		if os.IsNotExist(err) {
+			return &config, nil
+		}
+		return nil, fmt.Errorf("load dead letter config %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// InitDeadLetters 加载死信配置并创建 sink，需在 services.InitServices 之后、servicer 启动之前调用
+func InitDeadLetters(ctx context.Context) {
+	log := logger.DefaultLogger
+	config, err := LoadConfig(ConfigPath)
+	if err != nil {
+		log.LogFatal(ctx, "Failed to load dead letter config", "error", err)
+	}
+	s, err := New(log, config)
+	if err != nil {
+		log.LogFatal(ctx, "Failed to create dead letter sinks", "error", err)
+	}
+	Default = s
+	if len(s.sinks) > 0 {
+		log.LogInfo(ctx, "dead letter sinks loaded", "sinks", strings.Join(s.types, ","), "history", s.history)
+	}
+}
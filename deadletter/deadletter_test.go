@@ -0,0 +1,355 @@
+package deadletter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/networkProtocalTrans/logger"
+)
+
+func newTestStore(t *testing.T, config *Config) *Store {
+	t.Helper()
+	s, err := New(&logger.AppLogger{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLetterJSON(t *testing.T) {
+	received := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name    string
+		payload []byte
+		field   string
+	}{
+		{"text", []byte(`{"t":21}`), "payload"},
+		{"binary", []byte{0xff, 0x00, 0x01}, "payload_base64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &Letter{ID: "1", Stage: StageDelivery, Destination: "route:a:1", Payload: tt.payload, Received: received, Failed: received}
+			b, err := json.Marshal(l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var raw map[string]any
+			json.Unmarshal(b, &raw)
+			if _, ok := raw[tt.field]; !ok {
+				t.Fatalf("%s has no %s field", b, tt.field)
+			}
+			var got Letter
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&got, l) {
+				t.Fatalf("round trip = %+v, want %+v", got, l)
+			}
+		})
+	}
+
+	var l Letter
+	if err := json.Unmarshal([]byte(`{"payload_base64": "!"}`), &l); err == nil {
+		t.Fatal("invalid payload_base64 decoded")
+	}
+}
+
+func TestLetterKindAndExpand(t *testing.T) {
+	tests := []struct {
+		letter Letter
+		kind   string
+		target string
+	}{
+		{Letter{Destination: "route:alerts:2"}, "route", "alerts:2"},
+		{Letter{Destination: "queue:route:alerts:1"}, "queue", "route:alerts:1"},
+		{Letter{Destination: "bridge:ws:1"}, "bridge", "ws:1"},
+		{Letter{Source: "mqtt"}, "mqtt", ""},
+	}
+	for _, tt := range tests {
+		if kind, target := tt.letter.Kind(), tt.letter.Target(); kind != tt.kind || target != tt.target {
+			t.Errorf("%+v: kind %q target %q, want %q %q", tt.letter, kind, target, tt.kind, tt.target)
+		}
+	}
+
+	l := &Letter{Stage: StageValidation, Source: "websocket"}
+	if got := l.Expand("deadletters/{stage}/{source}/{servicer}"); got != "deadletters/validation/websocket/unknown" {
+		t.Fatalf("Expand = %q", got)
+	}
+}
+
+func TestStorePublishAndList(t *testing.T) {
+	s := newTestStore(t, &Config{History: 3})
+	ctx := context.Background()
+	for i, l := range []*Letter{
+		{Stage: StageValidation, Source: "mqtt", Servicer: "m1"},
+		{Stage: StageDelivery, Source: "mqtt", Servicer: "m1", Destination: "route:alerts:1"},
+		{Stage: StageDelivery, Source: "http", Destination: "route:alerts:2"},
+		{Stage: StageConversion, Source: "websocket", Servicer: "ws", Destination: "route:other"},
+	} {
+		l.Topic = string(rune('a' + i))
+		s.Publish(ctx, l)
+		if l.ID == "" || l.Failed.IsZero() || !l.Received.Equal(l.Failed) {
+			t.Fatalf("published letter = %+v", l)
+		}
+	}
+
+	// 超过 history 时删除最早的死信
+	letters, total := s.List(Filter{})
+	if total != 3 || letters[0].Topic != "d" || letters[2].Topic != "b" {
+		t.Fatalf("List = %d letters, first %q last %q", total, letters[0].Topic, letters[len(letters)-1].Topic)
+	}
+	tests := []struct {
+		filter Filter
+		topics []string
+		total  int
+	}{
+		{Filter{Stage: StageDelivery}, []string{"c", "b"}, 2},
+		{Filter{Source: "mqtt"}, []string{"b"}, 1},
+		{Filter{Servicer: "ws"}, []string{"d"}, 1},
+		{Filter{Destination: "route:alerts"}, []string{"c", "b"}, 2},
+		{Filter{Destination: "route:alerts", Limit: 1}, []string{"c"}, 2},
+		{Filter{Stage: StageValidation}, nil, 0},
+	}
+	for _, tt := range tests {
+		letters, total := s.List(tt.filter)
+		var topics []string
+		for _, l := range letters {
+			topics = append(topics, l.Topic)
+		}
+		if total != tt.total || !reflect.DeepEqual(topics, tt.topics) {
+			t.Errorf("List(%+v) = %v (%d), want %v (%d)", tt.filter, topics, total, tt.topics, tt.total)
+		}
+	}
+
+	// 返回的是副本
+	letters[0].Error = "changed"
+	if l, ok := s.Get(letters[0].ID); !ok || l.Error != "" {
+		t.Fatalf("Get after modifying a listed letter = %+v, %v", l, ok)
+	}
+	if !s.Remove(letters[0].ID) || s.Remove(letters[0].ID) {
+		t.Fatal("Remove did not remove the letter exactly once")
+	}
+	if _, ok := s.Get(letters[0].ID); ok {
+		t.Fatal("removed letter still found")
+	}
+}
+
+func TestStoreSkipsRepeatedLetters(t *testing.T) {
+	s := newTestStore(t, &Config{})
+	s.Publish(context.Background(), &Letter{Stage: StageDelivery, Headers: map[string]string{HeaderLetter: "previous"}})
+	if _, total := s.List(Filter{}); total != 0 {
+		t.Fatalf("letter of a dead letter stored, total = %d", total)
+	}
+}
+
+// testSink 记录写入的死信，err 不为空时返回错误
+type testSink struct {
+	mu      sync.Mutex
+	letters []*Letter
+	err     error
+}
+
+func (s *testSink) Write(l *Letter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.letters = append(s.letters, l)
+	return s.err
+}
+
+func TestSinks(t *testing.T) {
+	failing := &testSink{err: errors.New("sink unavailable")}
+	RegisterSink("test-failing", func(config SinkConfig) (Sink, error) { return failing, nil })
+	path := filepath.Join(t.TempDir(), "deadletters", "letters.jsonl")
+	s := newTestStore(t, &Config{Sinks: []SinkConfig{
+		{Type: "test-failing"},
+		{Type: SinkFile, Path: path},
+	}})
+
+	ctx := context.Background()
+	s.Publish(ctx, &Letter{Stage: StageDelivery, Topic: "a", Payload: []byte("text")})
+	s.Publish(ctx, &Letter{Stage: StageDelivery, Topic: "b", Payload: []byte{0xff}})
+
+	// 一个 sink 失败不影响其他 sink 与内存中的记录
+	if len(failing.letters) != 2 {
+		t.Fatalf("failing sink received %d letters", len(failing.letters))
+	}
+	if _, total := s.List(Filter{}); total != 2 {
+		t.Fatalf("stored %d letters", total)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []Letter
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var l Letter
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, l)
+	}
+	if len(lines) != 2 || lines[0].Topic != "a" || string(lines[0].Payload) != "text" ||
+		lines[1].Topic != "b" || string(lines[1].Payload) != "\xff" {
+		t.Fatalf("file sink lines = %+v", lines)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"negative history", Config{History: -1}},
+		{"unknown sink", Config{Sinks: []SinkConfig{{Type: "kafka"}}}},
+		{"file sink without path", Config{Sinks: []SinkConfig{{Type: SinkFile}}}},
+	}
+	for _, tt := range tests {
+		if _, err := New(&logger.AppLogger{}, &tt.config); err == nil {
+			t.Errorf("%s: New succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := LoadConfig(filepath.Join(t.TempDir(), "missing.toml"))
+	if err != nil || config.History != 0 || len(config.Sinks) != 0 {
+		t.Fatalf("missing config = %+v, %v", config, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "deadletter.toml")
+	os.WriteFile(path, []byte(`
+history = 50
+[[sink]]
+type = "file"
+path = "./logs/deadletters.jsonl"
+max_size = 10
+`), 0o644)
+	config, err = LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{History: 50, Sinks: []SinkConfig{{Type: SinkFile, Path: "./logs/deadletters.jsonl", MaxSize: 10}}}
+	if !reflect.DeepEqual(config, want) {
+		t.Fatalf("config = %+v, want %+v", config, want)
+	}
+
+	os.WriteFile(path, []byte("history = "), 0o644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("invalid config loaded")
+	}
+}
+
+func TestRedrive(t *testing.T) {
+	var fail atomic.Bool
+	var calls atomic.Int32
+	RegisterRedriver("test-redrive", func(ctx context.Context, l *Letter) error {
+		calls.Add(1)
+		if l.Target() != "target" {
+			return errors.New("wrong target")
+		}
+		if fail.Load() {
+			return errors.New("destination unavailable")
+		}
+		return nil
+	})
+	s := newTestStore(t, &Config{})
+	ctx := context.Background()
+
+	if _, err := s.Redrive(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("redrive of a missing letter = %v, want %v", err, ErrNotFound)
+	}
+	unsupported := &Letter{Stage: StageDelivery, Destination: "unknown:target"}
+	s.Publish(ctx, unsupported)
+	if _, err := s.Redrive(ctx, unsupported.ID); !errors.Is(err, ErrNoRedriver) {
+		t.Fatalf("redrive of an unsupported letter = %v, want %v", err, ErrNoRedriver)
+	}
+
+	l := &Letter{Stage: StageDelivery, Destination: "test-redrive:target"}
+	s.Publish(ctx, l)
+	fail.Store(true)
+	for i := 1; i <= 2; i++ {
+		got, err := s.Redrive(ctx, l.ID)
+		if err == nil || got.Redrives != i || got.LastRedrive == nil || got.LastRedriveErr != "destination unavailable" {
+			t.Fatalf("failed redrive #%d = %+v, %v", i, got, err)
+		}
+	}
+	if got, ok := s.Get(l.ID); !ok || got.Redrives != 2 {
+		t.Fatalf("letter after failed redrives = %+v, %v", got, ok)
+	}
+
+	fail.Store(false)
+	got, err := s.Redrive(ctx, l.ID)
+	if err != nil || got.Redrives != 3 || got.LastRedriveErr != "" {
+		t.Fatalf("redrive = %+v, %v", got, err)
+	}
+	if _, ok := s.Get(l.ID); ok {
+		t.Fatal("letter kept after a successful redrive")
+	}
+	if _, err := s.Redrive(ctx, l.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second redrive = %v, want %v", err, ErrNotFound)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("redriver called %d times, want 3", n)
+	}
+}
+
+func TestConcurrentRedriveDeliversOnce(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var calls atomic.Int32
+	RegisterRedriver("test-slow", func(ctx context.Context, l *Letter) error {
+		if calls.Add(1) == 1 {
+			close(started)
+			<-release
+		}
+		return nil
+	})
+	s := newTestStore(t, &Config{})
+	l := &Letter{Stage: StageDelivery, Destination: "test-slow:target"}
+	s.Publish(context.Background(), l)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Redrive(context.Background(), l.ID)
+		done <- err
+	}()
+	<-started
+	got, err := s.Redrive(context.Background(), l.ID)
+	if !errors.Is(err, ErrRedriving) || got == nil || got.ID != l.ID {
+		t.Fatalf("concurrent redrive = %+v, %v, want %v", got, err, ErrRedriving)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("redriver called %d times, want 1", n)
+	}
+	if _, ok := s.Get(l.ID); ok {
+		t.Fatal("letter kept after a successful redrive")
+	}
+}
+
+func TestRedriveReleasesClaimAfterFailure(t *testing.T) {
+	RegisterRedriver("test-failing", func(ctx context.Context, l *Letter) error {
+		return errors.New("unavailable")
+	})
+	s := newTestStore(t, &Config{})
+	l := &Letter{Stage: StageDelivery, Destination: "test-failing:target"}
+	s.Publish(context.Background(), l)
+	for i := 0; i < 2; i++ {
+		if _, err := s.Redrive(context.Background(), l.ID); err == nil || errors.Is(err, ErrRedriving) {
+			t.Fatalf("redrive #%d = %v", i+1, err)
+		}
+	}
+}
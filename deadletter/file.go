@@ -0,0 +1,44 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+func init() {
+	RegisterSink(SinkFile, newFileSink)
+}
+
+// fileSink 将死信逐行以 JSON 追加到按大小轮转的文件
+type fileSink struct {
+	mu     sync.Mutex
+	writer *lumberjack.Logger
+}
+
+func newFileSink(config SinkConfig) (Sink, error) {
+	if config.Path == "" {
+		return nil, errors.New("file sink requires path")
+	}
+	return &fileSink{writer: &lumberjack.Logger{
+		Filename:   config.Path,
+		MaxSize:    config.MaxSize,
+		MaxBackups: config.MaxBackups,
+		MaxAge:     config.MaxAge,
+		Compress:   config.Compress,
+	}}, nil
+}
+
+// Write 追加一行死信
+func (f *fileSink) Write(l *Letter) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err = f.writer.Write(append(b, '\n'))
+	return err
+}
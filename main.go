@@ -2,13 +2,24 @@ package main
 
 import (
 	"context"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
+	"github.com/networkProtocalTrans/codec"
+	"github.com/networkProtocalTrans/deadletter"
 	applog "github.com/networkProtocalTrans/logger"
+	"github.com/networkProtocalTrans/queue"
 	"github.com/networkProtocalTrans/router"
+	"github.com/networkProtocalTrans/routing"
 	"github.com/networkProtocalTrans/services"
+	"github.com/networkProtocalTrans/validation"
 )
 
+// 优雅退出的最长等待时间
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	// 创建上下文
 	ctx := context.Background()
@@ -19,14 +30,45 @@ func main() {
 	log.LogInfo(ctx, "init logger successfully")
 	// log.LogError(ctx, "init logger failed")
 
+	// 加载编解码器，servicer 与路由规则可能引用 protobuf 消息
+	codec.InitCodecs(ctx)
+	// 加载入口消息的 JSON Schema 校验规则
+	validation.InitValidation(ctx)
 	// 初始化服务
 	services.InitServices(ctx)
+	// 创建死信 sink，sink 可引用 MQTT 与 websocket servicer
+	deadletter.InitDeadLetters(ctx)
+	// 加载路由规则
+	routing.InitRoutes(ctx)
 	// 初始化路由
-	r := router.InitRouter(ctx)
-	// 启动服务器
-	if err := r.Run(":8080"); err != nil {
-		log.LogFatal(ctx, "Server startup failed", "error", err)
-		return
+	apiConfig, err := router.LoadAPIConfig(router.APIConfigPath)
+	if err != nil {
+		log.LogFatal(ctx, "Failed to load HTTP API config", "error", err)
+	}
+	r := router.InitRouter(ctx, apiConfig)
+
+	// 启动所有 servicer，HTTP API 最后启动、最先关闭
+	sup := services.NewSupervisor(log, services.Servicers()...)
+	api, err := router.NewAPIServer(apiConfig, r)
+	if err != nil {
+		log.LogFatal(ctx, "Failed to create HTTP API server", "error", err)
 	}
+	sup.Add(api)
+	services.DefaultSupervisor = sup
+	sup.Start(ctx)
 	log.LogInfo(ctx, "Server started successfully")
+
+	// 等待退出信号
+	sigCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-sigCtx.Done()
+	log.LogInfo(ctx, "Received shutdown signal, shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+	sup.Stop(shutdownCtx)
+	// 结束路由队列转发，关闭所有持久化队列以释放数据文件
+	routing.StopRoutes()
+	queue.CloseAll()
+	log.LogInfo(ctx, "Server stopped")
 }
@@ -0,0 +1,21 @@
+package module
+
+import "encoding/json"
+
+// ConvertRequest 协议转换请求
+type ConvertRequest struct {
+	SourceProtocol      string `json:"source_protocol" binding:"required"`
+	DestinationProtocol string `json:"destination_protocol" binding:"required"`
+	// 待转换的数据，可以是任意 JSON 值
+	Data json.RawMessage `json:"data" binding:"required"`
+	// 目标协议参数，如 MQTT 的 topic/qos/retain、websocket 的 path
+	Options map[string]string `json:"options"`
+}
+
+// ConvertResponse 协议转换结果
+type ConvertResponse struct {
+	SourceProtocol      string `json:"source_protocol"`
+	DestinationProtocol string `json:"destination_protocol"`
+	ConvertedData       any    `json:"converted_data"`
+	Status              string `json:"status"`
+}
@@ -0,0 +1,44 @@
+package module
+
+import "net/http"
+
+// 错误码
+const (
+	ErrCodeInvalidRequest = "invalid_request"
+	ErrCodeUnsupported    = "unsupported"
+	ErrCodeInvalidData    = "invalid_data"
+	ErrCodeUnavailable    = "unavailable"
+	ErrCodeNotFound       = "not_found"
+	ErrCodeForbidden      = "forbidden"
+	ErrCodeInternal       = "internal_error"
+	// 负载不符合 JSON Schema，details 中给出各处错误
+	ErrCodeSchemaViolation = "schema_violation"
+)
+
+// Error 结构化的接口错误，Status 为返回的 HTTP 状态码
+type Error struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// 错误的详细信息，如 schema 校验的各处错误
+	Details any `json:"details,omitempty"`
+}
+
+// NewError 创建一个新的 Error 实例
+func NewError(status int, code, message string) *Error {
+	return &Error{
+		Status:  status,
+		Code:    code,
+		Message: message,
+	}
+}
+
+// BadRequest 创建请求参数错误
+func BadRequest(code, message string) *Error {
+	return NewError(http.StatusBadRequest, code, message)
+}
+
+// Error 实现 error 接口
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
@@ -0,0 +1,63 @@
+package module
+
+import "encoding/json"
+
+// 发布负载的编码
+const (
+	PayloadEncodingRaw    = "raw"
+	PayloadEncodingBase64 = "base64"
+	PayloadEncodingJSON   = "json"
+)
+
+// UserProperty MQTT v5 用户属性，同名属性可以出现多次
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// PublishRequest 向内嵌 MQTT broker 发布一条消息
+type PublishRequest struct {
+	// MQTT servicer 名称，为空时使用默认 MQTT servicer
+	Servicer string `json:"servicer"`
+	Topic    string `json:"topic"`
+	QoS      byte   `json:"qos"`
+	Retain   bool   `json:"retain"`
+	// 订阅者为 MQTT v5 客户端时随消息下发
+	UserProperties []UserProperty `json:"user_properties"`
+	// raw 时 payload 为字符串，base64 时为 base64 字符串，json 时为任意 JSON 值；
+	// 为空时字符串按 raw、其余值按 json 处理
+	Encoding string          `json:"encoding"`
+	Payload  json.RawMessage `json:"payload"`
+	// 同时发送给订阅了这些频道的 websocket 客户端
+	Channels []string `json:"channels"`
+}
+
+// PublishBatchRequest 批量发布，逐条处理，单条失败不影响其他消息
+type PublishBatchRequest struct {
+	Messages []PublishRequest `json:"messages"`
+}
+
+// PublishResult 单条消息的发布结果
+type PublishResult struct {
+	Topic string `json:"topic"`
+	// 发布时匹配的 MQTT 订阅数量
+	Subscribers int `json:"subscribers"`
+	Bytes       int `json:"bytes"`
+	// 已发送的 websocket 频道
+	Channels []string `json:"channels,omitempty"`
+}
+
+// PublishBatchResult 批量发布中一条消息的结果，失败时 Error 不为空
+type PublishBatchResult struct {
+	Index int `json:"index"`
+	*PublishResult
+	Error *Error `json:"error,omitempty"`
+}
+
+// PublishBatchResponse 批量发布结果
+type PublishBatchResponse struct {
+	Published   int                  `json:"published"`
+	Failed      int                  `json:"failed"`
+	Subscribers int                  `json:"subscribers"`
+	Results     []PublishBatchResult `json:"results"`
+}
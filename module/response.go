@@ -1,5 +1,7 @@
 package module
 
+import "encoding/json"
+
 // Response 接口定义了网络协议转换模块的响应行为
 type Response interface{
     // GetStatus 获取响应状态
@@ -31,6 +33,18 @@ func NewBaseResponse(status int, body []byte, headers map[string][]string) *Base
     }
 }
 
+// NewJSONResponse 将 data 序列化为 JSON 后创建响应
+func NewJSONResponse(status int, data any) *BaseResponse {
+    body, err := json.Marshal(data)
+    if err != nil {
+        status = 500
+        body = []byte(`{"error":{"code":"internal_error","message":"marshal response failed"}}`)
+    }
+    return NewBaseResponse(status, body, map[string][]string{
+        "Content-Type": {"application/json; charset=utf-8"},
+    })
+}
+
 // GetStatus 实现 Response 接口的获取响应状态方法
 func (r *BaseResponse) GetStatus() int {
     return r.Status
@@ -0,0 +1,718 @@
+package queue
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/networkProtocalTrans/logger"
+	"go.etcd.io/bbolt"
+)
+
+// 队列默认配置
+const (
+	// 数据目录，每个队列一个 <名称>.db 文件
+	DefaultDir              = "./data/queues"
+	defaultMaxMessages      = 100000
+	defaultMaxBytes         = 64 << 20
+	defaultRetryInterval    = 1000
+	defaultMaxRetryInterval = 60000
+	// 等待数据文件锁的超时
+	openTimeout = 5 * time.Second
+)
+
+// 队列已满时的处理方式
+const (
+	// 丢弃最早的消息，为新消息腾出空间
+	OverflowDropOldest = "drop_oldest"
+	// 拒绝新消息
+	OverflowReject = "reject"
+)
+
+// 转发状态
+const (
+	StateIdle       = "idle"
+	StateForwarding = "forwarding"
+	// 目标不可达，等待重试
+	StateRetrying = "retrying"
+	StateStopped  = "stopped"
+)
+
+var (
+	// ErrFull 队列已满且 overflow = reject
+	ErrFull = errors.New("queue is full")
+	// ErrExists 同名队列已打开
+	ErrExists = errors.New("queue already exists")
+	// ErrExpired 消息超过 max_age 未能发送
+	ErrExpired = errors.New("message expired in queue")
+	// ErrOverflow 队列已满，最早的消息被丢弃
+	ErrOverflow = errors.New("message dropped: queue is full")
+)
+
+var bucketName = []byte("messages")
+
+// Config 持久化队列配置。目标不可达时消息写入磁盘，恢复后按入队顺序重放，目标确认后才删除（至少一次）
+type Config struct {
+	// 数据目录，默认 ./data/queues
+	Dir string `toml:"dir" json:"dir,omitempty"`
+	// 最多保存的消息数，默认 100000
+	MaxMessages int `toml:"max_messages" json:"max_messages,omitempty"`
+	// 最多保存的消息字节数，默认 64MB
+	MaxBytes int64 `toml:"max_bytes" json:"max_bytes,omitempty"`
+	// 消息最长保存时间（秒），超过后不再转发，0 表示不限制
+	MaxAge int64 `toml:"max_age" json:"max_age,omitempty"`
+	// 队列已满时: drop_oldest（默认，丢弃最早的消息）, reject（拒绝新消息）
+	Overflow string `toml:"overflow" json:"overflow,omitempty"`
+	// 发送失败后的重试间隔（毫秒），每次失败翻倍，不超过 max_retry_interval，默认 1000 / 60000
+	RetryInterval    int `toml:"retry_interval" json:"retry_interval,omitempty"`
+	MaxRetryInterval int `toml:"max_retry_interval" json:"max_retry_interval,omitempty"`
+}
+
+// validate 校验配置并填充默认值
+func (c *Config) validate() error {
+	if c.Dir == "" {
+		c.Dir = DefaultDir
+	}
+	if c.MaxMessages < 0 || c.MaxBytes < 0 || c.MaxAge < 0 {
+		return errors.New("max_messages, max_bytes and max_age must not be negative")
+	}
+	if c.MaxMessages == 0 {
+		c.MaxMessages = defaultMaxMessages
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = defaultMaxBytes
+	}
+	switch c.Overflow {
+	case "":
+		c.Overflow = OverflowDropOldest
+	case OverflowDropOldest, OverflowReject:
+	default:
+		return fmt.Errorf("unknown overflow %q", c.Overflow)
+	}
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = defaultRetryInterval
+	}
+	if c.MaxRetryInterval < c.RetryInterval {
+		c.MaxRetryInterval = defaultMaxRetryInterval
+	}
+	return nil
+}
+
+// Entry 队列中的一条消息
+type Entry struct {
+	// 入队序号，队列内递增
+	ID      uint64    `json:"id"`
+	Created time.Time `json:"created"`
+	// 已失败的发送次数
+	Attempts int `json:"attempts"`
+	// 使用方编码的消息
+	Data json.RawMessage `json:"data"`
+}
+
+// Sender 发送消息，返回 nil 表示目标已确认，消息从队列删除；
+// 返回 Permanent 包装的错误时消息无法投递，删除后继续发送下一条；其余错误稍后重试同一条消息
+type Sender func(ctx context.Context, e *Entry) error
+
+// DiscardFunc 消息未能投递即被删除时调用，err 为不可重试的发送错误、ErrExpired 或 ErrOverflow
+type DiscardFunc func(e *Entry, err error)
+
+// permanentError 不可重试的发送错误
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent 标记不可重试的发送错误，如目标返回 4xx
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Stats 队列计数
+type Stats struct {
+	Enqueued  int64 `json:"enqueued"`
+	Delivered int64 `json:"delivered"`
+	// 发送失败后重试的次数
+	Retried int64 `json:"retried"`
+	// 队列满时丢弃或拒绝的消息数
+	Dropped int64 `json:"dropped"`
+	// 超过 max_age 未能发送而删除的消息数
+	Expired int64 `json:"expired"`
+	// 不可重试的错误导致删除的消息数
+	Failed int64 `json:"failed"`
+}
+
+// Status 队列状态，用于 /api/v1/queues
+type Status struct {
+	Name   string `json:"name"`
+	State  string `json:"state"`
+	Depth  int    `json:"depth"`
+	Bytes  int64  `json:"bytes"`
+	Config Config `json:"config"`
+	Stats  Stats  `json:"stats"`
+	// 最早一条消息的入队时间
+	Oldest      *time.Time `json:"oldest,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	NextRetry   *time.Time `json:"next_retry,omitempty"`
+}
+
+// Queue 单个目标的持久化队列，消息保存在 bolt 文件中，由 Run 按顺序转发
+type Queue struct {
+	name   string
+	config Config
+	send   Sender
+	logger *logger.AppLogger
+	db     *bbolt.DB
+
+	// 有新消息时通知转发协程
+	notify chan struct{}
+	// 立即结束重试等待
+	wake chan struct{}
+	// Close 时关闭，结束 Run
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	discard DiscardFunc
+	count   int
+	bytes   int64
+	running bool
+	closed  bool
+	// Run 返回时关闭
+	done        chan struct{}
+	state       string
+	lastError   string
+	lastErrorAt time.Time
+	nextRetry   time.Time
+
+	stats Stats
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]*Queue{}
+)
+
+// Open 打开或创建名为 name 的队列，已保存的消息在 Run 后继续转发
+func Open(name string, config Config, send Sender) (*Queue, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("queue %s: %w", name, err)
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		return nil, fmt.Errorf("queue %s: %w", name, ErrExists)
+	}
+
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("queue %s: %w", name, err)
+	}
+	path := filepath.Join(config.Dir, fileName(name))
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("queue %s: open %s: %w", name, path, err)
+	}
+	q := &Queue{
+		name:    name,
+		config:  config,
+		send:    send,
+		logger:  logger.DefaultLogger,
+		db:      db,
+		notify:  make(chan struct{}, 1),
+		wake:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		state:   StateStopped,
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketName)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			q.count++
+			q.bytes += int64(len(v))
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("queue %s: %w", name, err)
+	}
+	registry[name] = q
+	if q.count > 0 {
+		q.logger.LogInfo(context.Background(), "queue restored", "queue", name, "depth", q.count, "bytes", q.bytes)
+	}
+	return q, nil
+}
+
+// fileName 将队列名称转为文件名
+func fileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name) + ".db"
+}
+
+// Get 按名称查找队列
+func Get(name string) (*Queue, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	q, ok := registry[name]
+	return q, ok
+}
+
+// All 返回所有队列的状态，按名称排序
+func All() []Status {
+	registryMu.RLock()
+	queues := make([]*Queue, 0, len(registry))
+	for _, q := range registry {
+		queues = append(queues, q)
+	}
+	registryMu.RUnlock()
+	sort.Slice(queues, func(i, j int) bool { return queues[i].name < queues[j].name })
+
+	statuses := make([]Status, 0, len(queues))
+	for _, q := range queues {
+		statuses = append(statuses, q.Status())
+	}
+	return statuses
+}
+
+// Name 返回队列名称
+func (q *Queue) Name() string {
+	return q.name
+}
+
+// OnDiscard 设置消息未能投递即被删除时的回调，需在 Run 之前调用
+func (q *Queue) OnDiscard(fn DiscardFunc) {
+	q.mu.Lock()
+	q.discard = fn
+	q.mu.Unlock()
+}
+
+// discarded 对未能投递的消息调用回调，调用方不能持有 q.mu
+func (q *Queue) discarded(entries []*Entry, err error) {
+	q.mu.Lock()
+	fn := q.discard
+	q.mu.Unlock()
+	if fn == nil {
+		return
+	}
+	for _, e := range entries {
+		fn(e, err)
+	}
+}
+
+// Enqueue 将 v 编码为 JSON 后追加到队列尾部。
+// 队列已满时按 overflow 丢弃最早的消息，或返回 ErrFull
+func (q *Queue) Enqueue(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	var dropped []*Entry
+	err = q.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(&Entry{ID: id, Created: time.Now(), Data: data})
+		if err != nil {
+			return err
+		}
+		size := int64(len(value))
+		if size > q.config.MaxBytes {
+			return ErrFull
+		}
+		for q.count >= q.config.MaxMessages || q.bytes+size > q.config.MaxBytes {
+			if q.config.Overflow == OverflowReject {
+				return ErrFull
+			}
+			k, v := b.Cursor().First()
+			if k == nil {
+				break
+			}
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			q.count--
+			q.bytes -= int64(len(v))
+			var old Entry
+			if json.Unmarshal(v, &old) == nil {
+				dropped = append(dropped, &old)
+			}
+		}
+		if err := b.Put(key(id), value); err != nil {
+			return err
+		}
+		q.count++
+		q.bytes += size
+		return nil
+	})
+	q.mu.Unlock()
+	if len(dropped) > 0 {
+		atomic.AddInt64(&q.stats.Dropped, int64(len(dropped)))
+		q.discarded(dropped, ErrOverflow)
+	}
+	if err != nil {
+		if errors.Is(err, ErrFull) {
+			atomic.AddInt64(&q.stats.Dropped, 1)
+		}
+		return fmt.Errorf("queue %s: %w", q.name, err)
+	}
+	atomic.AddInt64(&q.stats.Enqueued, 1)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// key 序号的大端编码，bolt 按键的字节序遍历，即入队顺序
+func key(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+// Run 按入队顺序转发消息，直到 ctx 取消或队列关闭。发送失败时按退避间隔重试同一条消息，
+// 保证目标恢复后消息按原顺序到达
+func (q *Queue) Run(ctx context.Context) {
+	q.mu.Lock()
+	if q.running || q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.running = true
+	done := make(chan struct{})
+	q.done = done
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		q.running, q.state = false, StateStopped
+		q.mu.Unlock()
+		close(done)
+	}()
+
+	// Close 时取消进行中的发送
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-q.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	delay := time.Duration(q.config.RetryInterval) * time.Millisecond
+	for {
+		e, err := q.head()
+		if err != nil {
+			q.logger.LogErrorf(ctx, "queue %s read failed: %v", q.name, err)
+		}
+		if e == nil {
+			q.setState(StateIdle)
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.notify:
+			case <-q.wake:
+			}
+			continue
+		}
+
+		q.setState(StateForwarding)
+		err = q.send(ctx, e)
+		if err == nil {
+			q.remove(e.ID)
+			atomic.AddInt64(&q.stats.Delivered, 1)
+			delay = time.Duration(q.config.RetryInterval) * time.Millisecond
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		var perr *permanentError
+		if errors.As(err, &perr) {
+			q.remove(e.ID)
+			atomic.AddInt64(&q.stats.Failed, 1)
+			q.logger.LogErrorf(ctx, "queue %s dropped message %d: %v", q.name, e.ID, err)
+			q.discarded([]*Entry{e}, perr.err)
+			continue
+		}
+
+		atomic.AddInt64(&q.stats.Retried, 1)
+		q.retryLater(e, err, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-q.wake:
+			timer.Stop()
+		}
+		delay *= 2
+		if max := time.Duration(q.config.MaxRetryInterval) * time.Millisecond; delay > max {
+			delay = max
+		}
+	}
+}
+
+// head 删除已过期的消息后返回队首消息，队列为空时返回 nil。
+// 只读事务中查找队首，只有遇到过期或无法解析的消息时才开启写事务删除
+func (q *Queue) head() (*Entry, error) {
+	var e *Entry
+	var stale [][]byte
+	var expired []*Entry
+	err := q.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var entry Entry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				// 无法解析的消息无法投递，直接删除
+				q.logger.LogErrorf(context.Background(), "queue %s: drop corrupt message: %v", q.name, err)
+			} else if q.config.MaxAge <= 0 || time.Since(entry.Created) <= time.Duration(q.config.MaxAge)*time.Second {
+				e = &entry
+				return nil
+			} else {
+				expired = append(expired, &entry)
+			}
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil || len(stale) == 0 {
+		return e, err
+	}
+
+	q.mu.Lock()
+	err = q.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		for _, k := range stale {
+			v := b.Get(k)
+			if v == nil {
+				continue
+			}
+			q.count--
+			q.bytes -= int64(len(v))
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	q.mu.Unlock()
+	if len(expired) > 0 {
+		atomic.AddInt64(&q.stats.Expired, int64(len(expired)))
+		q.logger.LogInfo(context.Background(), "queue messages expired", "queue", q.name, "count", len(expired))
+		q.discarded(expired, ErrExpired)
+	}
+	return e, err
+}
+
+// remove 确认后删除消息，消息已因队列满被丢弃时忽略
+func (q *Queue) remove(id uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		k := key(id)
+		v := b.Get(k)
+		if v == nil {
+			return nil
+		}
+		q.count--
+		q.bytes -= int64(len(v))
+		return b.Delete(k)
+	})
+	if err != nil {
+		q.logger.LogErrorf(context.Background(), "queue %s: delete message %d failed: %v", q.name, id, err)
+	}
+}
+
+// retryLater 记录发送失败次数与错误
+func (q *Queue) retryLater(e *Entry, sendErr error, delay time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.state = StateRetrying
+	q.lastError, q.lastErrorAt = sendErr.Error(), now
+	q.nextRetry = now.Add(delay)
+
+	e.Attempts++
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		k := key(e.ID)
+		old := b.Get(k)
+		if old == nil {
+			return nil
+		}
+		value, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		q.bytes += int64(len(value) - len(old))
+		return b.Put(k, value)
+	})
+	if err != nil {
+		q.logger.LogErrorf(context.Background(), "queue %s: update message %d failed: %v", q.name, e.ID, err)
+	}
+	if e.Attempts == 1 {
+		q.logger.LogInfo(context.Background(), "queue destination unavailable, holding messages",
+			"queue", q.name, "depth", q.count, "error", sendErr.Error())
+	}
+}
+
+func (q *Queue) setState(state string) {
+	q.mu.Lock()
+	q.state = state
+	if state != StateRetrying {
+		q.nextRetry = time.Time{}
+	}
+	q.mu.Unlock()
+}
+
+// Retry 结束当前的重试等待，立即重新发送队首消息
+func (q *Queue) Retry() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close 结束 Run 并关闭数据文件，释放文件锁，之后可以用同一名称重新 Open。
+// 已保存的消息留在文件中，下次打开后继续转发
+func (q *Queue) Close() error {
+	q.closeOnce.Do(func() { close(q.closing) })
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	done := q.done
+	if !q.running {
+		done = nil
+	}
+	q.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+
+	registryMu.Lock()
+	if registry[q.name] == q {
+		delete(registry, q.name)
+	}
+	registryMu.Unlock()
+	if err := q.db.Close(); err != nil {
+		return fmt.Errorf("queue %s: %w", q.name, err)
+	}
+	return nil
+}
+
+// CloseAll 关闭所有队列，用于进程退出
+func CloseAll() {
+	registryMu.RLock()
+	queues := make([]*Queue, 0, len(registry))
+	for _, q := range registry {
+		queues = append(queues, q)
+	}
+	registryMu.RUnlock()
+	for _, q := range queues {
+		if err := q.Close(); err != nil {
+			q.logger.LogErrorf(context.Background(), "close queue failed: %v", err)
+		}
+	}
+}
+
+// Purge 删除队列中的所有消息，返回删除的消息数
+func (q *Queue) Purge() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := q.count
+	// 保留原 bucket 逐条删除，NextSequence 不会重置，清空后新消息的 ID 继续递增
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("queue %s: %w", q.name, err)
+	}
+	q.count, q.bytes = 0, 0
+	return n, nil
+}
+
+// Entries 按顺序返回队首最多 limit 条消息
+func (q *Queue) Entries(limit int) ([]Entry, error) {
+	entries := []Entry{}
+	err := q.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		for k, v := c.First(); k != nil && len(entries) < limit; k, v = c.Next() {
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				continue
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Status 返回队列状态与计数
+func (q *Queue) Status() Status {
+	q.mu.Lock()
+	s := Status{
+		Name:      q.name,
+		State:     q.state,
+		Depth:     q.count,
+		Bytes:     q.bytes,
+		Config:    q.config,
+		LastError: q.lastError,
+	}
+	if !q.lastErrorAt.IsZero() {
+		t := q.lastErrorAt
+		s.LastErrorAt = &t
+	}
+	if !q.nextRetry.IsZero() {
+		t := q.nextRetry
+		s.NextRetry = &t
+	}
+	q.mu.Unlock()
+
+	if entries, err := q.Entries(1); err == nil && len(entries) > 0 {
+		s.Oldest = &entries[0].Created
+	}
+	s.Stats = Stats{
+		Enqueued:  atomic.LoadInt64(&q.stats.Enqueued),
+		Delivered: atomic.LoadInt64(&q.stats.Delivered),
+		Retried:   atomic.LoadInt64(&q.stats.Retried),
+		Dropped:   atomic.LoadInt64(&q.stats.Dropped),
+		Expired:   atomic.LoadInt64(&q.stats.Expired),
+		Failed:    atomic.LoadInt64(&q.stats.Failed),
+	}
+	return s
+}
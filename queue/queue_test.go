@@ -0,0 +1,153 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/networkProtocalTrans/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.DefaultLogger = &logger.AppLogger{}
+	os.Exit(m.Run())
+}
+
+func TestCloseStopsRunAndReleasesFile(t *testing.T) {
+	dir := t.TempDir()
+	unavailable := errors.New("unavailable")
+	attempts := make(chan struct{}, 16)
+	q, err := Open("close-test", Config{Dir: dir, RetryInterval: 10}, func(ctx context.Context, e *Entry) error {
+		attempts <- struct{}{}
+		return unavailable
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := q.Enqueue(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.Run(context.Background())
+		close(done)
+	}()
+	<-attempts
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+	if _, ok := Get("close-test"); ok {
+		t.Fatal("closed queue is still registered")
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+
+	// 文件锁已释放，消息保留到下次打开
+	var got []int
+	q, err = Open("close-test", Config{Dir: dir}, func(ctx context.Context, e *Entry) error {
+		var v int
+		json.Unmarshal(e.Data, &v)
+		got = append(got, v)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer q.Close()
+	if s := q.Status(); s.Depth != 3 {
+		t.Fatalf("depth after reopen = %d, want 3", s.Depth)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go q.Run(ctx)
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Status().Depth > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if len(got) != 3 || got[0] != 0 || got[1] != 1 || got[2] != 2 {
+		t.Fatalf("delivered %v, want [0 1 2]", got)
+	}
+}
+
+func TestHeadDropsExpiredMessages(t *testing.T) {
+	q, err := Open("expire-test", Config{Dir: t.TempDir(), MaxAge: 1}, func(ctx context.Context, e *Entry) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	var discarded []error
+	q.OnDiscard(func(e *Entry, err error) { discarded = append(discarded, err) })
+
+	if err := q.Enqueue("old"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := q.Enqueue("new"); err != nil {
+		t.Fatal(err)
+	}
+	e, err := q.head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || string(e.Data) != `"new"` {
+		t.Fatalf("head = %+v, want the unexpired message", e)
+	}
+	if len(discarded) != 1 || !errors.Is(discarded[0], ErrExpired) {
+		t.Fatalf("discarded = %v, want one ErrExpired", discarded)
+	}
+	if s := q.Status(); s.Depth != 1 || s.Stats.Expired != 1 {
+		t.Fatalf("status = %+v", s)
+	}
+}
+
+func TestPurgeKeepsIDsIncreasing(t *testing.T) {
+	q, err := Open("purge-test", Config{Dir: t.TempDir()}, func(ctx context.Context, e *Entry) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 0; i < 3; i++ {
+		if err := q.Enqueue(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := q.Entries(10)
+	if err != nil || len(before) != 3 {
+		t.Fatalf("entries = %v, %v", before, err)
+	}
+
+	if n, err := q.Purge(); err != nil || n != 3 {
+		t.Fatalf("purge = %d, %v, want 3", n, err)
+	}
+	if entries, _ := q.Entries(10); len(entries) != 0 || q.Status().Depth != 0 {
+		t.Fatalf("after purge: entries %v, depth %d", entries, q.Status().Depth)
+	}
+
+	if err := q.Enqueue("after"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := q.Entries(10)
+	if err != nil || len(after) != 1 {
+		t.Fatalf("entries = %v, %v", after, err)
+	}
+	if after[0].ID <= before[2].ID {
+		t.Fatalf("id after purge = %d, want greater than %d", after[0].ID, before[2].ID)
+	}
+}
@@ -0,0 +1,103 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/module"
+)
+
+// 查询死信时默认与最多返回的条数
+const (
+	defaultDeadLetters = 100
+	maxDeadLetters     = 1000
+)
+
+// HandleListDeadLetters 按失败时间从新到旧列出死信，可按 stage、source、servicer、destination（前缀）过滤
+func HandleListDeadLetters(c *gin.Context) (module.Response, error) {
+	s, err := deadLetters()
+	if err != nil {
+		return nil, err
+	}
+	limit := defaultDeadLetters
+	if v := c.Query("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxDeadLetters {
+			return nil, module.BadRequest(module.ErrCodeInvalidRequest, fmt.Sprintf("limit must be in [1, %d]", maxDeadLetters))
+		}
+	}
+	letters, total := s.List(deadletter.Filter{
+		Stage:       c.Query("stage"),
+		Source:      c.Query("source"),
+		Servicer:    c.Query("servicer"),
+		Destination: c.Query("destination"),
+		Limit:       limit,
+	})
+	return module.NewJSONResponse(http.StatusOK, gin.H{
+		"total":       total,
+		"deadletters": letters,
+	}), nil
+}
+
+// HandleGetDeadLetter 返回一条死信
+func HandleGetDeadLetter(c *gin.Context) (module.Response, error) {
+	s, err := deadLetters()
+	if err != nil {
+		return nil, err
+	}
+	l, ok := s.Get(c.Param("id"))
+	if !ok {
+		return nil, deadLetterNotFound(c)
+	}
+	return module.NewJSONResponse(http.StatusOK, l), nil
+}
+
+// HandleRedriveDeadLetter 重新投递死信，成功后删除；无法重新投递或正在重新投递时返回 409，投递失败时返回 502 并保留死信
+func HandleRedriveDeadLetter(c *gin.Context) (module.Response, error) {
+	s, err := deadLetters()
+	if err != nil {
+		return nil, err
+	}
+	l, err := s.Redrive(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, deadletter.ErrNotFound):
+		return nil, deadLetterNotFound(c)
+	case errors.Is(err, deadletter.ErrNoRedriver):
+		return nil, module.NewError(http.StatusConflict, module.ErrCodeUnsupported, err.Error())
+	case errors.Is(err, deadletter.ErrRedriving):
+		return nil, module.NewError(http.StatusConflict, module.ErrCodeUnavailable, err.Error())
+	case err != nil:
+		e := module.NewError(http.StatusBadGateway, module.ErrCodeUnavailable, err.Error())
+		e.Details = l
+		return nil, e
+	}
+	return module.NewJSONResponse(http.StatusOK, l), nil
+}
+
+// HandleDeleteDeadLetter 删除死信，sink 中已写入的记录不受影响
+func HandleDeleteDeadLetter(c *gin.Context) (module.Response, error) {
+	s, err := deadLetters()
+	if err != nil {
+		return nil, err
+	}
+	if !s.Remove(c.Param("id")) {
+		return nil, deadLetterNotFound(c)
+	}
+	return module.NewJSONResponse(http.StatusOK, gin.H{
+		"id": c.Param("id"),
+	}), nil
+}
+
+func deadLetters() (*deadletter.Store, error) {
+	if deadletter.Default == nil {
+		return nil, module.NewError(http.StatusServiceUnavailable, module.ErrCodeUnavailable, "dead letters are not initialized")
+	}
+	return deadletter.Default, nil
+}
+
+func deadLetterNotFound(c *gin.Context) error {
+	return module.NewError(http.StatusNotFound, module.ErrCodeNotFound, fmt.Sprintf("unknown dead letter %q", c.Param("id")))
+}
@@ -0,0 +1,232 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/converter"
+	"github.com/networkProtocalTrans/logger"
+	"github.com/networkProtocalTrans/module"
+	"github.com/networkProtocalTrans/services"
+	"github.com/networkProtocalTrans/validation"
+)
+
+// 批量发布单次请求的最大消息数
+const maxPublishBatch = 1000
+
+// HandlePublish 向内嵌 MQTT broker 发布一条消息
+func HandlePublish(config *PublishConfig) func(c *gin.Context) (module.Response, error) {
+	return func(c *gin.Context) (module.Response, error) {
+		var req module.PublishRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			return nil, module.BadRequest(module.ErrCodeInvalidRequest, err.Error())
+		}
+		res, err := publish(config, &req)
+		if err != nil {
+			return nil, err
+		}
+		return module.NewJSONResponse(http.StatusOK, res), nil
+	}
+}
+
+// HandlePublishBatch 批量发布消息，全部成功时返回 200，部分失败时返回 207 并在 results 中给出各条错误
+func HandlePublishBatch(config *PublishConfig) func(c *gin.Context) (module.Response, error) {
+	return func(c *gin.Context) (module.Response, error) {
+		var req module.PublishBatchRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			return nil, module.BadRequest(module.ErrCodeInvalidRequest, err.Error())
+		}
+		if len(req.Messages) == 0 {
+			return nil, module.BadRequest(module.ErrCodeInvalidRequest, "messages is required")
+		}
+		if len(req.Messages) > maxPublishBatch {
+			return nil, module.BadRequest(module.ErrCodeInvalidRequest, fmt.Sprintf("at most %d messages per batch", maxPublishBatch))
+		}
+
+		res := &module.PublishBatchResponse{Results: make([]module.PublishBatchResult, 0, len(req.Messages))}
+		for i := range req.Messages {
+			r, err := publish(config, &req.Messages[i])
+			if err != nil {
+				res.Failed++
+				res.Results = append(res.Results, module.PublishBatchResult{Index: i, Error: err})
+				continue
+			}
+			res.Published++
+			res.Subscribers += r.Subscribers
+			res.Results = append(res.Results, module.PublishBatchResult{Index: i, PublishResult: r})
+		}
+		status := http.StatusOK
+		if res.Failed > 0 {
+			status = http.StatusMultiStatus
+		}
+		return module.NewJSONResponse(status, res), nil
+	}
+}
+
+// publish 校验并发布一条消息
+func publish(config *PublishConfig, req *module.PublishRequest) (*module.PublishResult, *module.Error) {
+	if err := validatePublish(req); err != nil {
+		return nil, err
+	}
+	if err := config.authorize(req); err != nil {
+		return nil, err
+	}
+	payload, err := publishPayload(req)
+	if err != nil {
+		var apiErr *module.Error
+		if errors.As(err, &apiErr) {
+			return nil, apiErr
+		}
+		return nil, module.BadRequest(module.ErrCodeInvalidData, err.Error())
+	}
+	return publishMessage(req, payload)
+}
+
+// convertPublisher 转换接口发布到 mqtt 时与发布接口相同：校验主题、按 publish.acl 授权并按 [validation] 校验负载
+func convertPublisher(config *PublishConfig) func(topic string, payload []byte, retain bool, qos byte) error {
+	return func(topic string, payload []byte, retain bool, qos byte) error {
+		req := &module.PublishRequest{Topic: topic, QoS: qos, Retain: retain}
+		if err := validatePublish(req); err != nil {
+			return err
+		}
+		if err := config.authorize(req); err != nil {
+			return err
+		}
+		if _, err := publishMessage(req, payload); err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+// publishMessage 将已授权的消息按 [validation] 校验后发布到 MQTT servicer 与 websocket 频道
+func publishMessage(req *module.PublishRequest, payload []byte) (*module.PublishResult, *module.Error) {
+	mqtt := services.MqttServer
+	if req.Servicer != "" {
+		var ok bool
+		if mqtt, ok = services.GetMqttServer(req.Servicer); !ok {
+			return nil, module.BadRequest(module.ErrCodeInvalidRequest, fmt.Sprintf("unknown mqtt servicer %q", req.Servicer))
+		}
+	}
+	if mqtt == nil {
+		return nil, module.NewError(http.StatusServiceUnavailable, module.ErrCodeUnavailable, "mqtt servicer is not running")
+	}
+	if len(req.Channels) > 0 && services.WsServer == nil {
+		return nil, module.NewError(http.StatusServiceUnavailable, module.ErrCodeUnavailable, "websocket servicer is not running")
+	}
+
+	var props packets.Properties
+	for _, p := range req.UserProperties {
+		props.User = append(props.User, packets.UserProperty{Key: p.Key, Val: p.Value})
+	}
+	if v := validation.DefaultValidator.Validate(validation.SourceMQTT, mqtt.Name(), req.Topic, payload); v != nil {
+		if v.Action != validation.ActionTag {
+			return nil, violationError(v, payload)
+		}
+		props.User = append(props.User, packets.UserProperty{Key: v.TagHeader, Val: v.Error()})
+	}
+	n, err := mqtt.PublishPacket(req.Topic, payload, req.Retain, req.QoS, props)
+	if errors.Is(err, services.ErrServicerNotRunning) {
+		return nil, module.NewError(http.StatusServiceUnavailable, module.ErrCodeUnavailable, "mqtt servicer is not running")
+	}
+	if err != nil {
+		return nil, module.NewError(http.StatusBadGateway, module.ErrCodeUnavailable, err.Error())
+	}
+	for _, channel := range req.Channels {
+		services.WsServer.PublishChannel(channel, payload)
+	}
+	return &module.PublishResult{
+		Topic:       req.Topic,
+		Subscribers: n,
+		Bytes:       len(payload),
+		Channels:    req.Channels,
+	}, nil
+}
+
+func validatePublish(req *module.PublishRequest) *module.Error {
+	if req.Topic == "" {
+		return module.BadRequest(module.ErrCodeInvalidRequest, "topic is required")
+	}
+	if !validPublishTopic(req.Topic) {
+		return module.BadRequest(module.ErrCodeInvalidRequest, fmt.Sprintf("invalid topic %q", req.Topic))
+	}
+	if req.QoS > 2 {
+		return module.BadRequest(module.ErrCodeInvalidRequest, fmt.Sprintf("qos %d is out of range [0, 2]", req.QoS))
+	}
+	for i, p := range req.UserProperties {
+		if p.Key == "" {
+			return module.BadRequest(module.ErrCodeInvalidRequest, fmt.Sprintf("user_properties[%d]: key is required", i))
+		}
+	}
+	for _, channel := range req.Channels {
+		if !validPublishTopic(channel) {
+			return module.BadRequest(module.ErrCodeInvalidRequest, fmt.Sprintf("invalid channel %q", channel))
+		}
+	}
+	return nil
+}
+
+// authorize 按 publish.acl 检查主题与频道的写权限，未配置 ACL 时拒绝
+func (c *PublishConfig) authorize(req *module.PublishRequest) *module.Error {
+	if len(c.ACL) == 0 {
+		return module.NewError(http.StatusForbidden, module.ErrCodeForbidden, "publishing is disabled: publish.acl is not configured")
+	}
+	if !c.ACL.Allows(req.Topic, true) {
+		return module.NewError(http.StatusForbidden, module.ErrCodeForbidden, fmt.Sprintf("publishing to %q is not allowed", req.Topic))
+	}
+	for _, channel := range req.Channels {
+		if !c.ACL.Allows(channel, true) {
+			return module.NewError(http.StatusForbidden, module.ErrCodeForbidden, fmt.Sprintf("publishing to channel %q is not allowed", channel))
+		}
+	}
+	return nil
+}
+
+// validPublishTopic 发布主题不能包含通配符，$ 开头的系统主题不允许通过接口发布
+func validPublishTopic(topic string) bool {
+	return topic != "" && !strings.HasPrefix(topic, "$") && server.IsValidFilter(topic, true)
+}
+
+// publishPayload 按 encoding 解码 payload，未提供 payload 时为空负载
+func publishPayload(req *module.PublishRequest) ([]byte, error) {
+	if len(req.Payload) == 0 || string(req.Payload) == "null" {
+		return nil, nil
+	}
+	encoding := req.Encoding
+	if encoding == "" {
+		encoding = module.PayloadEncodingJSON
+		if req.Payload[0] == '"' {
+			encoding = module.PayloadEncodingRaw
+		}
+	}
+	switch encoding {
+	case module.PayloadEncodingRaw:
+		return converter.DecodePayload(converter.EncodingText, req.Payload)
+	case module.PayloadEncodingBase64:
+		return converter.DecodePayload(converter.EncodingBase64, req.Payload)
+	case module.PayloadEncodingJSON:
+		return converter.DecodePayload(converter.EncodingJSON, req.Payload)
+	}
+	return nil, module.BadRequest(module.ErrCodeUnsupported, fmt.Sprintf("unknown encoding %q", encoding))
+}
+
+// violationError 未通过校验的消息返回 422，error_topic 动作同时将错误发布到错误主题
+func violationError(v *validation.Violation, payload []byte) *module.Error {
+	message := v.Error()
+	if v.Action == validation.ActionErrorTopic {
+		if err := services.PublishViolation(v, payload); err != nil {
+			logger.DefaultLogger.LogErrorf(context.Background(), "publish validation error to %s failed: %v", v.ErrorTopic, err)
+		} else {
+			message += ", published to " + v.ErrorTopic
+		}
+	}
+	e := module.NewError(http.StatusUnprocessableEntity, module.ErrCodeSchemaViolation, message)
+	e.Details = v
+	return e
+}
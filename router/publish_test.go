@@ -0,0 +1,177 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/converter"
+	"github.com/networkProtocalTrans/logger"
+	"github.com/networkProtocalTrans/module"
+	"github.com/networkProtocalTrans/services"
+	"github.com/networkProtocalTrans/validation"
+)
+
+func TestPublishAuthorize(t *testing.T) {
+	config := &PublishConfig{ACL: services.ACL{
+		"devices/#":        services.AccessWrite,
+		"devices/+/config": services.AccessDeny,
+		"alerts/#":         services.AccessReadWrite,
+		"readonly/#":       services.AccessRead,
+	}}
+	tests := []struct {
+		topic    string
+		channels []string
+		allowed  bool
+	}{
+		{topic: "devices/a/command", allowed: true},
+		{topic: "devices/a/config", allowed: false},
+		{topic: "readonly/a", allowed: false},
+		{topic: "other", allowed: false},
+		{topic: "devices/a/command", channels: []string{"alerts/a"}, allowed: true},
+		{topic: "devices/a/command", channels: []string{"other"}, allowed: false},
+	}
+	for _, tt := range tests {
+		err := config.authorize(&module.PublishRequest{Topic: tt.topic, Channels: tt.channels})
+		if tt.allowed != (err == nil) {
+			t.Errorf("authorize(%q, %v) = %v, allowed %v", tt.topic, tt.channels, err, tt.allowed)
+		}
+		if err != nil && err.Status != http.StatusForbidden {
+			t.Errorf("authorize(%q) status = %d, want 403", tt.topic, err.Status)
+		}
+	}
+
+	if err := (&PublishConfig{}).authorize(&module.PublishRequest{Topic: "devices/a"}); err == nil {
+		t.Fatal("publishing without publish.acl: expected an error")
+	}
+}
+
+func TestPublishRejectsSystemTopics(t *testing.T) {
+	config := &PublishConfig{ACL: services.ACL{"#": services.AccessWrite}}
+	for _, req := range []module.PublishRequest{
+		{Topic: "$SYS/broker/uptime"},
+		{Topic: "devices/a", Channels: []string{"$share/a"}},
+		{Topic: "devices/+"},
+	} {
+		if _, err := publish(config, &req); err == nil || err.Status != http.StatusBadRequest {
+			t.Errorf("publish(%q, %v) = %v, want 400", req.Topic, req.Channels, err)
+		}
+	}
+}
+
+// startTestMqtt 启动只接受匿名连接的 MQTT servicer 并设为默认 servicer
+func startTestMqtt(t *testing.T) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mqtt.toml")
+	os.WriteFile(path, []byte(`
+[server]
+name = "mqtt-test"
+address = "127.0.0.1:0"
+[auth]
+type = "none"
+[mqtt]
+allow_anonymous = true
+`), 0o644)
+	m, err := services.NewMqttServer(context.Background(), &logger.AppLogger{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Start(context.Background())
+	}()
+	for deadline := time.Now().Add(5 * time.Second); m.Health() != nil; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("mqtt servicer not ready")
+		}
+	}
+	prev := services.MqttServer
+	services.MqttServer = m
+	t.Cleanup(func() {
+		services.MqttServer = prev
+		m.Stop(context.Background())
+		<-done
+	})
+}
+
+func TestConvertPublishesThroughPublishACL(t *testing.T) {
+	schema := filepath.Join(t.TempDir(), "telemetry.json")
+	os.WriteFile(schema, []byte(`{"type":"object","required":["value"],"properties":{"value":{"type":"number"}}}`), 0o644)
+	v, err := validation.New(&validation.Config{Rules: []validation.RuleConfig{
+		{Name: "telemetry", Source: validation.SourceMQTT, Topic: "telemetry/+", Schema: schema},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevValidator, prevPublisher := validation.DefaultValidator, converter.MQTTPublisher
+	validation.DefaultValidator = v
+	converter.MQTTPublisher = convertPublisher(&PublishConfig{ACL: services.ACL{
+		"#":              services.AccessWrite,
+		"devices/secret": services.AccessDeny,
+	}})
+	t.Cleanup(func() {
+		validation.DefaultValidator, converter.MQTTPublisher = prevValidator, prevPublisher
+	})
+
+	startTestMqtt(t)
+	received := make(chan string, 4)
+	services.MqttServer.Subscribe("#", func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk.TopicName + " " + string(pk.Payload)
+	})
+
+	tests := []struct {
+		topic  string
+		data   string
+		status int
+	}{
+		{"devices/a", `{"value":1}`, http.StatusOK},
+		{"$SYS/broker/uptime", `{"value":1}`, http.StatusBadRequest},
+		{"devices/+", `{"value":1}`, http.StatusBadRequest},
+		{"devices/#", `{"value":1}`, http.StatusBadRequest},
+		{"devices/secret", `{"value":1}`, http.StatusForbidden},
+		{"telemetry/a", `{"value":"hot"}`, http.StatusUnprocessableEntity},
+		{"telemetry/a", `{"value":21.5}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		_, err := converter.Convert(context.Background(), &module.ConvertRequest{
+			SourceProtocol:      "json",
+			DestinationProtocol: "mqtt",
+			Data:                json.RawMessage(tt.data),
+			Options:             map[string]string{"topic": tt.topic},
+		})
+		status := http.StatusOK
+		var apiErr *module.Error
+		if errors.As(err, &apiErr) {
+			status = apiErr.Status
+		} else if err != nil {
+			t.Fatalf("convert to %s: %v", tt.topic, err)
+		}
+		if status != tt.status {
+			t.Errorf("convert to %s %s: status %d (%v), want %d", tt.topic, tt.data, status, err, tt.status)
+		}
+	}
+
+	for _, want := range []string{`devices/a {"value":1}`, `telemetry/a {"value":21.5}`} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("received %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q not published", want)
+		}
+	}
+	select {
+	case got := <-received:
+		t.Fatalf("rejected conversion published %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
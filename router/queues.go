@@ -0,0 +1,83 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/networkProtocalTrans/module"
+	"github.com/networkProtocalTrans/queue"
+)
+
+// 查看队列时默认与最多返回的消息数
+const (
+	defaultQueueEntries = 20
+	maxQueueEntries     = 1000
+)
+
+// HandleListQueues 列出所有持久化队列的状态与计数
+func HandleListQueues(c *gin.Context) (module.Response, error) {
+	return module.NewJSONResponse(http.StatusOK, gin.H{
+		"queues": queue.All(),
+	}), nil
+}
+
+// HandleGetQueue 返回队列状态与队首的消息，limit 为返回的消息数
+func HandleGetQueue(c *gin.Context) (module.Response, error) {
+	q, err := lookupQueue(c)
+	if err != nil {
+		return nil, err
+	}
+	limit := defaultQueueEntries
+	if s := c.Query("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 || limit > maxQueueEntries {
+			return nil, module.BadRequest(module.ErrCodeInvalidRequest, fmt.Sprintf("limit must be in [0, %d]", maxQueueEntries))
+		}
+	}
+	entries, err := q.Entries(limit)
+	if err != nil {
+		return nil, err
+	}
+	return module.NewJSONResponse(http.StatusOK, gin.H{
+		"queue":   q.Status(),
+		"entries": entries,
+	}), nil
+}
+
+// HandleRetryQueue 结束重试等待，立即重新发送队首消息
+func HandleRetryQueue(c *gin.Context) (module.Response, error) {
+	q, err := lookupQueue(c)
+	if err != nil {
+		return nil, err
+	}
+	q.Retry()
+	return module.NewJSONResponse(http.StatusAccepted, gin.H{
+		"queue": q.Name(),
+	}), nil
+}
+
+// HandlePurgeQueue 删除队列中的所有消息
+func HandlePurgeQueue(c *gin.Context) (module.Response, error) {
+	q, err := lookupQueue(c)
+	if err != nil {
+		return nil, err
+	}
+	n, err := q.Purge()
+	if err != nil {
+		return nil, err
+	}
+	return module.NewJSONResponse(http.StatusOK, gin.H{
+		"queue":  q.Name(),
+		"purged": n,
+	}), nil
+}
+
+func lookupQueue(c *gin.Context) (*queue.Queue, error) {
+	name := c.Param("name")
+	q, ok := queue.Get(name)
+	if !ok {
+		return nil, module.NewError(http.StatusNotFound, module.ErrCodeNotFound, fmt.Sprintf("unknown queue %q", name))
+	}
+	return q, nil
+}
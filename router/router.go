@@ -2,37 +2,77 @@ package router
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/networkProtocalTrans/codec"
+	"github.com/networkProtocalTrans/converter"
 	"github.com/networkProtocalTrans/logger"
 	"github.com/networkProtocalTrans/module"
+	"github.com/networkProtocalTrans/routing"
 	"github.com/networkProtocalTrans/services"
+	"github.com/networkProtocalTrans/validation"
 )
 
 // 初始化路由
-func InitRouter(ctx context.Context) *gin.Engine {
+func InitRouter(ctx context.Context, config *APIConfig) *gin.Engine {
 	// 创建默认的gin路由引擎
 	r := gin.Default()
 
 	// 设置跨域中间件
 	r.Use(CORSMiddleware())
 
+	// 转换接口发布到 mqtt 时使用发布接口的校验与授权
+	converter.MQTTPublisher = convertPublisher(&config.Publish)
+
 	// API版本v1分组
 	v1 := r.Group("/api/v1")
 	{
 		// 协议转换相关路由
-		v1.POST("/convert", HandleProtocolConversion)
-
-		// 健康检查
-		v1.GET("/health", func(c *gin.Context) {
+		v1.POST("/convert", RequestPanicHandler(HandleProtocolConversion))
+		v1.GET("/convert/pairs", func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{
-				"status": "ok",
+				"pairs": converter.Pairs(),
+				// 编解码器之间可任意转换，也可作为 mqtt / websocket 的源协议
+				"codecs":            codec.Names(),
+				"protobuf_messages": codec.ProtobufMessages(),
 			})
 		})
+
+		// 健康检查
+		v1.GET("/health", HandleHealth)
+
+		// 路由规则
+		v1.GET("/routes", RequestPanicHandler(HandleListRoutes))
+		v1.POST("/ingest/*path", RequestPanicHandler(HandleIngest))
+
+		// 目标的持久化队列
+		v1.GET("/queues", RequestPanicHandler(HandleListQueues))
+		v1.GET("/queues/:name", RequestPanicHandler(HandleGetQueue))
+		v1.POST("/queues/:name/retry", RequestPanicHandler(HandleRetryQueue))
+		v1.DELETE("/queues/:name", RequestPanicHandler(HandlePurgeQueue))
+
+		// 转换、校验或发送失败的死信
+		v1.GET("/deadletters", RequestPanicHandler(HandleListDeadLetters))
+		v1.GET("/deadletters/:id", RequestPanicHandler(HandleGetDeadLetter))
+		v1.POST("/deadletters/:id/redrive", RequestPanicHandler(HandleRedriveDeadLetter))
+		v1.DELETE("/deadletters/:id", RequestPanicHandler(HandleDeleteDeadLetter))
+
+		// 向内嵌 MQTT broker 发布消息
+		v1.POST("/publish", RequestPanicHandler(HandlePublish(&config.Publish)))
+		v1.POST("/publish/batch", RequestPanicHandler(HandlePublishBatch(&config.Publish)))
 	}
-	ws := r.Group("/ws")
-	{
+	// 以 SSE 推送默认 MQTT servicer 上的消息
+	if services.MqttServer != nil {
+		sse := services.NewSSEBroker(logger.DefaultLogger, services.MqttServer, config.SSE)
+		r.GET("/sse/*topic", HandleSSE(sse, config.SSE.HeartbeatInterval()))
+	}
+	// 默认 websocket servicer 同时挂载在 API 路由上
+	if services.WsServer != nil {
+		ws := r.Group("/ws")
 		// ws.GET("/test", RequestPanicHandler(controller.WSTestHandler))
 		/*
 		  /ws接收http协议后，前端js转为websocket协议，然后发送给后端/ws/echo
@@ -43,43 +83,91 @@ func InitRouter(ctx context.Context) *gin.Engine {
 	return r
 }
 
-// 处理协议转换的函数
-func HandleProtocolConversion(c *gin.Context) {
-	// TODO: 实现协议转换逻辑
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Protocol conversion endpoint",
+// HandleHealth 返回整体与各 servicer 的健康状态，存在不健康的 servicer 时返回 503
+func HandleHealth(c *gin.Context) {
+	var servicers []services.ServicerStatus
+	if services.DefaultSupervisor != nil {
+		servicers = services.DefaultSupervisor.Status()
+	}
+	status, code := "ok", http.StatusOK
+	for _, s := range servicers {
+		if !s.Healthy {
+			status, code = "degraded", http.StatusServiceUnavailable
+			break
+		}
+	}
+	c.JSON(code, gin.H{
+		"status":    status,
+		"servicers": servicers,
 	})
 }
 
-func HandlePanic(c *gin.Context) {
+// HandleListRoutes 列出 conf/routes 中加载的规则及其统计
+func HandleListRoutes(c *gin.Context) (module.Response, error) {
+	routes := []routing.RouteStatus{}
+	if routing.DefaultEngine != nil {
+		routes = routing.DefaultEngine.Routes()
+	}
+	return module.NewJSONResponse(http.StatusOK, gin.H{
+		"routes": routes,
+	}), nil
+}
+
+// HandleIngest 将请求体交给源类型为 http、路径匹配的路由规则
+func HandleIngest(c *gin.Context) (module.Response, error) {
 	ctx := c.Request.Context()
-	if r := recover(); r != nil {
-		logger.DefaultLogger.LogFatalf(ctx, "gin router handler panic +%v", r)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Internal Server Error",
-		})
-		// 解析请求参数
-		var requestData struct {
-			SourceProtocol      string `json:"source_protocol"`
-			DestinationProtocol string `json:"destination_protocol"`
-			Data                string `json:"data"`
+	if routing.DefaultEngine == nil {
+		return nil, module.NewError(http.StatusNotFound, module.ErrCodeNotFound, routing.ErrNoRoute.Error())
+	}
+	payload, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, module.BadRequest(module.ErrCodeInvalidRequest, err.Error())
+	}
+	if v := validation.DefaultValidator.Validate(validation.SourceHTTP, "", c.Param("path"), payload); v != nil {
+		if v.Action != validation.ActionTag {
+			return nil, violationError(v, payload)
 		}
+		ctx = validation.NewContext(ctx, v)
+	}
+	n, err := routing.DefaultEngine.HandleHTTP(ctx, c.Param("path"), payload)
+	if errors.Is(err, routing.ErrNoRoute) {
+		return nil, module.NewError(http.StatusNotFound, module.ErrCodeNotFound, fmt.Sprintf("no route for %s", c.Param("path")))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return module.NewJSONResponse(http.StatusAccepted, gin.H{
+		"routes": n,
+	}), nil
+}
 
-		if err := c.ShouldBindJSON(&requestData); err != nil {
-			logger.DefaultLogger.LogErrorf(ctx, "Failed to parse request parameters: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "Invalid request parameters",
-			})
-			return
-		}
+// 处理协议转换的函数
+func HandleProtocolConversion(c *gin.Context) (module.Response, error) {
+	ctx := c.Request.Context()
+	var req module.ConvertRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return nil, module.BadRequest(module.ErrCodeInvalidRequest, err.Error())
+	}
 
-		// 返回转换结果
-		c.JSON(http.StatusOK, gin.H{
-			"source_protocol":      requestData.SourceProtocol,
-			"destination_protocol": requestData.DestinationProtocol,
-			"original_data":        requestData.Data,
-			"converted_data":       "转换后的数据", // TODO: 替换为实际转换后的数据
-			"status":               "success",
+	converted, err := converter.Convert(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	return module.NewJSONResponse(http.StatusOK, &module.ConvertResponse{
+		SourceProtocol:      req.SourceProtocol,
+		DestinationProtocol: req.DestinationProtocol,
+		ConvertedData:       converted,
+		Status:              "success",
+	}), nil
+}
+
+func HandlePanic(c *gin.Context) {
+	ctx := c.Request.Context()
+	if r := recover(); r != nil {
+		logger.DefaultLogger.LogErrorf(ctx, "gin router handler panic +%v", r)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"error": module.NewError(http.StatusInternalServerError, module.ErrCodeInternal, "Internal Server Error"),
 		})
 	}
 }
@@ -88,12 +176,26 @@ type RequestHandler func(c *gin.Context) (res module.Response, err error)
 
 func RequestPanicHandler(fn RequestHandler) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		defer HandlePanic(c)
 		ctx := c.Request.Context()
-		if res, err := fn(c); err != nil {
+		res, err := fn(c)
+		if err != nil {
 			logger.DefaultLogger.LogErrorf(ctx, "RequestHandler failed with error +%v", err)
-		} else {
-			// 返回结果
-			c.JSON(res.GetStatus(), res.GetBody())
+			var apiErr *module.Error
+			if !errors.As(err, &apiErr) {
+				apiErr = module.NewError(http.StatusInternalServerError, module.ErrCodeInternal, err.Error())
+			}
+			c.JSON(apiErr.Status, gin.H{
+				"error": apiErr,
+			})
+			return
+		}
+		// 返回结果
+		for key, values := range res.GetHeaders() {
+			for _, value := range values {
+				c.Writer.Header().Add(key, value)
+			}
 		}
+		c.Data(res.GetStatus(), c.Writer.Header().Get("Content-Type"), res.GetBody())
 	}
 }
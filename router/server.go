@@ -0,0 +1,131 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gin-gonic/gin"
+	"github.com/networkProtocalTrans/logger"
+	"github.com/networkProtocalTrans/services"
+	"github.com/networkProtocalTrans/util"
+)
+
+// APIConfigPath HTTP API 配置文件路径
+const APIConfigPath = "./conf/api.toml"
+
+// APIConfig HTTP API 配置
+type APIConfig struct {
+	Server struct {
+		Address string `toml:"address"`
+	} `toml:"server"`
+	TLS     util.TLSConfig     `toml:"tls"`
+	SSE     services.SSEConfig `toml:"sse"`
+	Publish PublishConfig      `toml:"publish"`
+}
+
+// PublishConfig 发布接口配置
+type PublishConfig struct {
+	// 发布接口可以写入的主题与频道，规则与 MQTT ACL 相同（w、rw 允许发布，deny 优先），
+	// 未配置时拒绝所有发布；$ 开头的系统主题总是拒绝
+	ACL services.ACL `toml:"acl"`
+}
+
+// LoadAPIConfig 读取 HTTP API 配置文件
+func LoadAPIConfig(configPath string) (*APIConfig, error) {
+	var config APIConfig
+	if _, err := toml.DecodeFile(configPath, &config); err != nil {
+		return nil, fmt.Errorf("load api config %s: %w", configPath, err)
+	}
+	if config.Server.Address == "" {
+		return nil, fmt.Errorf("invalid api config %s: server.address is required", configPath)
+	}
+	if err := config.Publish.ACL.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid api config %s: publish.acl: %w", configPath, err)
+	}
+	if err := config.SSE.ACL.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid api config %s: sse.acl: %w", configPath, err)
+	}
+	return &config, nil
+}
+
+// apiServer 以 servicer 的形式运行 gin HTTP API，便于与其他 servicer 一同由 Supervisor 管理
+type apiServer struct {
+	config    *APIConfig
+	tlsConfig *tls.Config
+	engine    *gin.Engine
+
+	mu         sync.Mutex
+	httpServer *http.Server
+}
+
+// NewAPIServer 根据配置创建 HTTP API servicer
+func NewAPIServer(config *APIConfig, engine *gin.Engine) (*apiServer, error) {
+	tlsConfig, err := config.TLS.Load()
+	if err != nil {
+		return nil, fmt.Errorf("api tls: %w", err)
+	}
+	return &apiServer{
+		config:    config,
+		tlsConfig: tlsConfig,
+		engine:    engine,
+	}, nil
+}
+
+// Name 返回 servicer 名称
+func (a *apiServer) Name() string {
+	return "api"
+}
+
+// Start 启动 HTTP API 并阻塞，直到 ctx 取消或 Stop 被调用
+func (a *apiServer) Start(ctx context.Context) error {
+	lns, err := a.config.TLS.Listen(a.config.Server.Address, a.tlsConfig)
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{Handler: a.engine}
+	a.mu.Lock()
+	a.httpServer = httpServer
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.httpServer = nil
+		a.mu.Unlock()
+	}()
+
+	stop := context.AfterFunc(ctx, func() {
+		httpServer.Close()
+	})
+	defer stop()
+
+	logger.DefaultLogger.LogInfo(ctx, "Starting HTTP API server",
+		"address", a.config.Server.Address,
+		"tls", a.tlsConfig != nil,
+		"tls_address", a.config.TLS.Address,
+	)
+	return util.ServeHTTP(httpServer, lns)
+}
+
+// Stop 优雅关闭 HTTP API，等待进行中的请求完成
+func (a *apiServer) Stop(ctx context.Context) error {
+	a.mu.Lock()
+	httpServer := a.httpServer
+	a.mu.Unlock()
+	if httpServer == nil {
+		return nil
+	}
+	return httpServer.Shutdown(ctx)
+}
+
+// Health 服务运行中时返回 nil
+func (a *apiServer) Health() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.httpServer == nil {
+		return services.ErrServicerNotRunning
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/networkProtocalTrans/module"
+	"github.com/networkProtocalTrans/services"
+)
+
+// HandleSSE 以 Server-Sent Events 推送 MQTT 主题过滤器上的消息，路径即主题过滤器（+ 需 URL 编码为 %2B，# 为 %23）。
+// 事件数据与 websocket 频道消息结构相同，重连时通过 Last-Event-ID 请求头或 last_event_id 参数续传
+func HandleSSE(broker *services.SSEBroker, heartbeat time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := strings.TrimPrefix(c.Param("topic"), "/")
+		lastEventID := c.GetHeader("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = c.Query("last_event_id")
+		}
+		var lastID uint64
+		if lastEventID != "" {
+			var err error
+			if lastID, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": module.BadRequest(module.ErrCodeInvalidRequest, "invalid Last-Event-ID"),
+				})
+				return
+			}
+		}
+
+		sub, err := broker.Subscribe(filter, lastID, lastEventID != "")
+		if errors.Is(err, services.ErrSSENotAllowed) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": module.NewError(http.StatusForbidden, module.ErrCodeForbidden, fmt.Sprintf("subscribing to %q is not allowed", filter)),
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": module.BadRequest(module.ErrCodeInvalidRequest, err.Error()),
+			})
+			return
+		}
+		defer sub.Close()
+
+		header := c.Writer.Header()
+		header.Set("Content-Type", "text/event-stream")
+		header.Set("Cache-Control", "no-cache")
+		header.Set("Connection", "keep-alive")
+		// 禁止反向代理缓冲
+		header.Set("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+
+		for _, ev := range sub.Replay {
+			renderSSE(c, ev)
+		}
+		c.Writer.Flush()
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case ev, ok := <-sub.Events():
+				if !ok {
+					return
+				}
+				renderSSE(c, ev)
+				c.Writer.Flush()
+			case <-ticker.C:
+				// 注释行作为心跳，保持连接并让客户端及时发现断线
+				if _, err := c.Writer.WriteString(": heartbeat\n\n"); err != nil {
+					return
+				}
+				c.Writer.Flush()
+			}
+		}
+	}
+}
+
+func renderSSE(c *gin.Context, ev services.SSEEvent) {
+	sse.Encode(c.Writer, sse.Event{
+		Id:    strconv.FormatUint(ev.ID, 10),
+		Event: "message",
+		Data:  string(ev.Data),
+	})
+}
@@ -0,0 +1,40 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/networkProtocalTrans/logger"
+	"github.com/networkProtocalTrans/services"
+)
+
+func TestSSERejectsFilters(t *testing.T) {
+	startTestMqtt(t)
+	broker := services.NewSSEBroker(&logger.AppLogger{}, services.MqttServer, services.SSEConfig{
+		ACL: services.ACL{"devices/#": services.AccessRead},
+	})
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/sse/*topic", HandleSSE(broker, time.Second))
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/sse/%24SYS/%23", http.StatusBadRequest},
+		{"/sse/%24share/group/devices/%23", http.StatusBadRequest},
+		{"/sse/devices/a?last_event_id=abc", http.StatusBadRequest},
+		{"/sse/other/%23", http.StatusForbidden},
+		{"/sse/%23", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("GET %s = %d %s, want %d", tt.path, w.Code, w.Body, tt.status)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package routing
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+	"github.com/networkProtocalTrans/queue"
+	"github.com/networkProtocalTrans/script"
+)
+
+// 路由规则配置文件目录
+const RouteConfigDir = "./conf/routes"
+
+// 路由源类型
+const (
+	SourceMQTT      = "mqtt"
+	SourceWebsocket = "websocket"
+	SourceHTTP      = "http"
+	SourceTCP       = "tcp"
+	SourceUDP       = "udp"
+)
+
+// 过滤条件的组合方式
+const (
+	MatchAll = "all"
+	MatchAny = "any"
+)
+
+// RouteFile 路由规则文件，一个文件可包含多条规则
+type RouteFile struct {
+	Routes []RouteConfig `toml:"route"`
+}
+
+// RouteConfig 一条路由规则：源 -> 过滤 -> 转换 -> 目标
+type RouteConfig struct {
+	// 规则名称，所有规则文件中唯一
+	Name         string              `toml:"name" json:"name"`
+	Source       SourceConfig        `toml:"source" json:"source"`
+	Filter       FilterConfig        `toml:"filter" json:"filter"`
+	Transforms   []TransformConfig   `toml:"transform" json:"transforms,omitempty"`
+	Destinations []DestinationConfig `toml:"destination" json:"destinations"`
+}
+
+// SourceConfig 消息来源
+type SourceConfig struct {
+	// mqtt, websocket, http, tcp, udp
+	Type string `toml:"type" json:"type"`
+	// servicer 名称，为空时使用同类型的默认 servicer，http 类型不使用，tcp / udp 类型必须指定
+	Servicer string `toml:"servicer" json:"servicer,omitempty"`
+	// mqtt 主题过滤器
+	Topic string `toml:"topic" json:"topic,omitempty"`
+	// websocket 连接路径，或 http 类型在 /api/v1/ingest 下的路径
+	Path string `toml:"path" json:"path,omitempty"`
+}
+
+// FilterConfig 过滤条件，未配置条件时所有消息都通过
+type FilterConfig struct {
+	// 条件组合方式: all（全部满足）, any（任一满足），默认 all
+	Match      string      `toml:"match" json:"match,omitempty"`
+	Conditions []Condition `toml:"condition" json:"conditions,omitempty"`
+}
+
+// Condition 对 JSON 负载字段的判断
+type Condition struct {
+	// 以 . 分隔的字段路径，数组下标为数字，为空时表示整个负载
+	Field string `toml:"field" json:"field,omitempty"`
+	// eq, ne, gt, gte, lt, lte, contains, exists, not_exists
+	Op    string `toml:"op" json:"op"`
+	Value any    `toml:"value" json:"value,omitempty"`
+}
+
+// TransformConfig 转换阶段，按配置顺序依次执行
+type TransformConfig struct {
+	// select, set, template, transcode, script
+	Type string `toml:"type" json:"type"`
+	// select: 取出的字段路径
+	Path string `toml:"path" json:"path,omitempty"`
+	// set: 写入 JSON 对象的字段，字符串值支持主题占位符
+	Fields map[string]any `toml:"fields" json:"fields,omitempty"`
+	// template: Go text/template 模板
+	Template string `toml:"template" json:"template,omitempty"`
+	// transcode: 负载的源编码与目标编码（json、msgpack、cbor、xml、protobuf:<消息全名>）
+	From string `toml:"from" json:"from,omitempty"`
+	To   string `toml:"to" json:"to,omitempty"`
+	// script: 对主题、headers 与解码后的负载执行的脚本，返回 null 时消息计为 filtered。
+	// 修改后的主题可在目标中通过 {topic} 引用
+	Script *script.Config `toml:"script" json:"script,omitempty"`
+}
+
+// DestinationConfig 消息目标
+type DestinationConfig struct {
+	// mqtt, websocket, webhook, tcp, udp
+	Type string `toml:"type" json:"type"`
+	// servicer 名称，为空时使用同类型的默认 servicer；webhook、tcp、udp 目标必须指定
+	Servicer string `toml:"servicer" json:"servicer,omitempty"`
+	// mqtt 发布主题，支持占位符
+	Topic  string `toml:"topic" json:"topic,omitempty"`
+	QoS    byte   `toml:"qos" json:"qos,omitempty"`
+	Retain bool   `toml:"retain" json:"retain,omitempty"`
+	// websocket 广播路径
+	Path string `toml:"path" json:"path,omitempty"`
+	// websocket 频道，支持占位符，与 path 二选一
+	Channel string `toml:"channel" json:"channel,omitempty"`
+	// 持久化队列，队列名称为 route:<规则名称>:<目标序号>。配置后消息先写入队列再按顺序发送，
+	// 目标不可达（servicer 未运行，或 websocket / tcp / udp 没有连接的接收方）时保留在队列中，恢复后重放；
+	// webhook 目标在 webhook servicer 的 [target.queue] 中配置
+	Queue *queue.Config `toml:"queue" json:"queue,omitempty"`
+}
+
+// loadedRoute 规则及其所在文件
+type loadedRoute struct {
+	config RouteConfig
+	file   string
+}
+
+// loadRouteFiles 按文件名顺序读取目录下所有规则
+func loadRouteFiles(dir string) ([]loadedRoute, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.toml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var routes []loadedRoute
+	names := make(map[string]string)
+	for _, file := range files {
+		var rf RouteFile
+		if _, err := toml.DecodeFile(file, &rf); err != nil {
+			return nil, fmt.Errorf("load route file %s: %w", file, err)
+		}
+		for i, rc := range rf.Routes {
+			if rc.Name == "" {
+				return nil, fmt.Errorf("route file %s: route #%d: name is required", file, i+1)
+			}
+			if prev, ok := names[rc.Name]; ok {
+				return nil, fmt.Errorf("route file %s: duplicate route name %q, already defined in %s", file, rc.Name, prev)
+			}
+			names[rc.Name] = file
+			routes = append(routes, loadedRoute{config: rc, file: file})
+		}
+	}
+	return routes, nil
+}
@@ -0,0 +1,242 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/services"
+)
+
+// 内置目标类型
+const (
+	DestinationMQTT      = "mqtt"
+	DestinationWebsocket = "websocket"
+	DestinationWebhook   = "webhook"
+	DestinationTCP       = "tcp"
+	DestinationUDP       = "udp"
+)
+
+// ErrNoReceivers websocket、tcp、udp 目标没有连接的接收方，目标配置了队列时消息保留在队列中
+var ErrNoReceivers = errors.New("no connected receivers")
+
+// Destination 路由目标
+type Destination interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// DestinationFunc 函数形式的 Destination
+type DestinationFunc func(ctx context.Context, msg *Message) error
+
+// Send 实现 Destination
+func (f DestinationFunc) Send(ctx context.Context, msg *Message) error {
+	return f(ctx, msg)
+}
+
+// DestinationFactory 根据配置创建目标，在 servicer 加载完成后调用
+type DestinationFactory func(config DestinationConfig) (Destination, error)
+
+var (
+	destinationMu sync.RWMutex
+	destinations  = map[string]DestinationFactory{}
+)
+
+// RegisterDestination 注册目标类型，重复注册时覆盖
+func RegisterDestination(typ string, factory DestinationFactory) {
+	destinationMu.Lock()
+	defer destinationMu.Unlock()
+	destinations[typ] = factory
+}
+
+// DestinationTypes 返回已注册的目标类型
+func DestinationTypes() []string {
+	destinationMu.RLock()
+	defer destinationMu.RUnlock()
+	types := make([]string, 0, len(destinations))
+	for typ := range destinations {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func newDestination(config DestinationConfig) (Destination, error) {
+	destinationMu.RLock()
+	factory, ok := destinations[config.Type]
+	destinationMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown destination type %q", config.Type)
+	}
+	return factory(config)
+}
+
+func init() {
+	RegisterDestination(DestinationMQTT, newMQTTDestination)
+	RegisterDestination(DestinationWebsocket, newWebsocketDestination)
+	RegisterDestination(DestinationWebhook, newWebhookDestination)
+	RegisterDestination(DestinationTCP, newSocketDestination(DestinationTCP))
+	RegisterDestination(DestinationUDP, newSocketDestination(DestinationUDP))
+}
+
+// mqttEndpoint 路由使用的 MQTT servicer 能力
+type mqttEndpoint interface {
+	Name() string
+	Publish(topic string, payload []byte, retain bool, qos byte) error
+	PublishPacket(topic string, payload []byte, retain bool, qos byte, props packets.Properties) (int, error)
+	Subscribe(filter string, handler server.InlineSubFn) (int, error)
+}
+
+// websocketEndpoint 路由使用的 websocket servicer 能力
+type websocketEndpoint interface {
+	Name() string
+	OnMessage(handler services.MessageHandler)
+	Broadcast(path string, messageType int, message []byte)
+	BroadcastWait(path string, messageType int, message []byte) int
+	PublishChannel(channel string, payload []byte)
+	PublishChannelWait(channel string, payload []byte) int
+}
+
+// resolveMQTT 按名称查找 MQTT servicer，名称为空时使用默认 MQTT servicer
+func resolveMQTT(name string) (mqttEndpoint, error) {
+	if name == "" {
+		if services.MqttServer == nil {
+			return nil, fmt.Errorf("no mqtt servicer is configured")
+		}
+		return services.MqttServer, nil
+	}
+	m, ok := services.GetMqttServer(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown mqtt servicer %q", name)
+	}
+	return m, nil
+}
+
+// resolveWebsocket 按名称查找 websocket servicer，名称为空时使用默认 websocket servicer
+func resolveWebsocket(name string) (websocketEndpoint, error) {
+	if name == "" {
+		if services.WsServer == nil {
+			return nil, fmt.Errorf("no websocket servicer is configured")
+		}
+		return services.WsServer, nil
+	}
+	ws, ok := services.GetWebsocketServer(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown websocket servicer %q", name)
+	}
+	return ws, nil
+}
+
+// socketEndpoint 路由使用的 tcp / udp servicer 能力
+type socketEndpoint interface {
+	Name() string
+	OnFrame(handler services.FrameHandler)
+	Send(payload []byte) (int, error)
+}
+
+// resolveSocket 按名称查找 tcp 或 udp servicer
+func resolveSocket(network, name string) (socketEndpoint, error) {
+	sock, ok := services.GetSocketServer(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown %s servicer %q", network, name)
+	}
+	if sock.Network() != network {
+		return nil, fmt.Errorf("servicer %q is not a %s servicer", name, network)
+	}
+	return sock, nil
+}
+
+func newMQTTDestination(config DestinationConfig) (Destination, error) {
+	if config.Topic == "" {
+		return nil, fmt.Errorf("mqtt destination requires topic")
+	}
+	if config.QoS > 2 {
+		return nil, fmt.Errorf("mqtt destination qos %d is out of range [0, 2]", config.QoS)
+	}
+	m, err := resolveMQTT(config.Servicer)
+	if err != nil {
+		return nil, err
+	}
+	return DestinationFunc(func(ctx context.Context, msg *Message) error {
+		topic := msg.Expand(config.Topic)
+		if len(msg.Headers) == 0 {
+			return m.Publish(topic, msg.Payload, config.Retain, config.QoS)
+		}
+		props := packets.Properties{User: services.UserProperties(msg.Headers)}
+		_, err := m.PublishPacket(topic, msg.Payload, config.Retain, config.QoS, props)
+		return err
+	}), nil
+}
+
+func newWebsocketDestination(config DestinationConfig) (Destination, error) {
+	if (config.Path == "") == (config.Channel == "") {
+		return nil, fmt.Errorf("websocket destination requires exactly one of path and channel")
+	}
+	ws, err := resolveWebsocket(config.Servicer)
+	if err != nil {
+		return nil, err
+	}
+	// 配置了队列时等待消息分发，没有接收方的消息留在队列中
+	if config.Queue != nil {
+		return DestinationFunc(func(ctx context.Context, msg *Message) error {
+			var n int
+			if config.Channel != "" {
+				n = ws.PublishChannelWait(msg.Expand(config.Channel), msg.Payload)
+			} else {
+				n = ws.BroadcastWait(config.Path, services.FrameType(msg.Payload), msg.Payload)
+			}
+			if n == 0 {
+				return ErrNoReceivers
+			}
+			return nil
+		}), nil
+	}
+	return DestinationFunc(func(ctx context.Context, msg *Message) error {
+		if config.Channel != "" {
+			ws.PublishChannel(msg.Expand(config.Channel), msg.Payload)
+			return nil
+		}
+		ws.Broadcast(config.Path, services.FrameType(msg.Payload), msg.Payload)
+		return nil
+	}), nil
+}
+
+// newWebhookDestination 将消息交给 webhook servicer 发送，发送在 servicer 中异步进行
+func newWebhookDestination(config DestinationConfig) (Destination, error) {
+	if config.Servicer == "" {
+		return nil, fmt.Errorf("webhook destination requires servicer")
+	}
+	if config.Queue != nil {
+		return nil, fmt.Errorf("webhook destination does not support queue, configure [target.queue] in webhook servicer %q", config.Servicer)
+	}
+	w, ok := services.GetWebhookServer(config.Servicer)
+	if !ok {
+		return nil, fmt.Errorf("unknown webhook servicer %q", config.Servicer)
+	}
+	return DestinationFunc(func(ctx context.Context, msg *Message) error {
+		return w.Deliver(msg.Source, msg.Servicer, msg.Topic, msg.Payload)
+	}), nil
+}
+
+// newSocketDestination 将消息编码为帧发送给 tcp / udp servicer 的所有对端
+func newSocketDestination(network string) DestinationFactory {
+	return func(config DestinationConfig) (Destination, error) {
+		if config.Servicer == "" {
+			return nil, fmt.Errorf("%s destination requires servicer", network)
+		}
+		sock, err := resolveSocket(network, config.Servicer)
+		if err != nil {
+			return nil, err
+		}
+		return DestinationFunc(func(ctx context.Context, msg *Message) error {
+			n, err := sock.Send(msg.Payload)
+			if err == nil && n == 0 && config.Queue != nil {
+				return ErrNoReceivers
+			}
+			return err
+		}), nil
+	}
+}
@@ -0,0 +1,385 @@
+package routing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/logger"
+	"github.com/networkProtocalTrans/services"
+)
+
+// testServicers 进程内只加载一次的 servicer，servicer 注册后无法注销
+type testServicers struct {
+	// websocket servicer 的连接地址前缀，后接 /ws/<路径>
+	wsURL string
+	tcp   string
+	udp   string
+	// webhook 目标收到的请求体
+	webhooks chan []byte
+}
+
+var (
+	servicersOnce sync.Once
+	servicersErr  error
+	servicers     *testServicers
+	// 引擎停止后源订阅仍然保留，-count 多次运行时每次使用不同的源主题
+	fanOutRuns int
+)
+
+// loadTestServicers 加载并启动 mqtt-route、ws-route、webhook-route、tcp-route 与 udp-route
+func loadTestServicers(t *testing.T) *testServicers {
+	t.Helper()
+	servicersOnce.Do(func() {
+		servicers, servicersErr = startTestServicers()
+	})
+	if servicersErr != nil {
+		t.Fatal(servicersErr)
+	}
+	return servicers
+}
+
+func startTestServicers() (*testServicers, error) {
+	ts := &testServicers{webhooks: make(chan []byte, 16)}
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ts.webhooks <- body
+	}))
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	ts.tcp = tcp.Addr().String()
+	tcp.Close()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	ts.udp = udp.LocalAddr().String()
+	udp.Close()
+
+	dir, err := os.MkdirTemp("", "routing-servicers")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	configs := map[string]string{
+		"mqtt-route": `
+type = "mqtt"
+[server]
+name = "mqtt-route"
+address = "127.0.0.1:0"
+[auth]
+type = "none"
+[mqtt]
+allow_anonymous = true
+`,
+		"ws-route": `
+type = "websocket"
+[server]
+name = "ws-route"
+[cors]
+allow_all = true
+`,
+		"webhook-route": fmt.Sprintf(`
+type = "webhook"
+[server]
+name = "webhook-route"
+[[target]]
+url = %q
+method = "POST"
+timeout = 5
+`, hook.URL),
+		"tcp-route": fmt.Sprintf(`
+type = "tcp"
+[server]
+name = "tcp-route"
+address = %q
+[framing]
+type = "delimiter"
+delimiter = "\n"
+`, ts.tcp),
+		"udp-route": fmt.Sprintf(`
+type = "udp"
+[server]
+name = "udp-route"
+address = %q
+[framing]
+type = "delimiter"
+delimiter = "\n"
+`, ts.udp),
+	}
+	for name, config := range configs {
+		if err := os.WriteFile(filepath.Join(dir, name+".toml"), []byte(config), 0o644); err != nil {
+			return nil, err
+		}
+	}
+	if err := services.LoadServicers(context.Background(), &logger.AppLogger{}, dir); err != nil {
+		return nil, err
+	}
+	for name := range configs {
+		s, _ := services.GetServicer(name)
+		go s.Start(context.Background())
+		deadline := time.Now().Add(5 * time.Second)
+		for s.Health() != nil {
+			if time.Now().After(deadline) {
+				return nil, fmt.Errorf("servicer %s did not start", name)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	ws, _ := services.GetWebsocketServer("ws-route")
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.GET("/ws/*path", ws.HandleConnections)
+	ts.wsURL = "ws" + strings.TrimPrefix(httptest.NewServer(engine).URL, "http")
+	return ts, nil
+}
+
+// dialTestWebsocket 连接 ws-route 上的 path
+func dialTestWebsocket(t *testing.T, ts *testServicers, path string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(ts.wsURL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readWebsocket(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(message)
+}
+
+func TestMQTTSourceFanOut(t *testing.T) {
+	ts := loadTestServicers(t)
+	m, _ := services.GetMqttServer("mqtt-route")
+
+	received := make(chan packets.Packet, 4)
+	id, err := m.Subscribe("out/#", func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Unsubscribe("out/#", id) })
+
+	byPath := dialTestWebsocket(t, ts, "/ws/readings")
+	byChannel := dialTestWebsocket(t, ts, "/ws/channels")
+	byChannel.WriteJSON(services.ChannelMessage{Action: services.ChannelActionSubscribe, Channel: "rooms/+", ID: "1"})
+	if ack := readWebsocket(t, byChannel); !strings.Contains(ack, services.ChannelActionAck) {
+		t.Fatalf("subscribe reply = %s", ack)
+	}
+
+	fanOutRuns++
+	startTestEngine(t, strings.ReplaceAll(`
+[[route]]
+name = "mqtt-fanout"
+[route.source]
+type = "mqtt"
+servicer = "mqtt-route"
+topic = "sensors/RUN/+/temp"
+[[route.destination]]
+type = "mqtt"
+servicer = "mqtt-route"
+topic = "out/{1}"
+[[route.destination]]
+type = "websocket"
+servicer = "ws-route"
+path = "/ws/readings"
+[[route.destination]]
+type = "websocket"
+servicer = "ws-route"
+channel = "rooms/{1}"
+[[route.destination]]
+type = "webhook"
+servicer = "webhook-route"
+`, "RUN", strconv.Itoa(fanOutRuns)))
+	_, err = m.PublishPacket(fmt.Sprintf("sensors/%d/a/temp", fanOutRuns), []byte(`{"t":21}`), false, 0, packets.Properties{
+		User: []packets.UserProperty{{Key: "unit", Val: "c"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case pk := <-received:
+		if pk.TopicName != "out/a" || string(pk.Payload) != `{"t":21}` || services.HeadersOf(pk.Properties.User)["unit"] != "c" {
+			t.Fatalf("mqtt destination received %s %q %v", pk.TopicName, pk.Payload, pk.Properties.User)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mqtt destination received nothing")
+	}
+	if got := readWebsocket(t, byPath); got != `{"t":21}` {
+		t.Fatalf("websocket path destination received %s", got)
+	}
+	var msg services.ChannelMessage
+	if err := json.Unmarshal([]byte(readWebsocket(t, byChannel)), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Action != services.ChannelActionMessage || msg.Channel != "rooms/a" || string(msg.Data) != `{"t":21}` {
+		t.Fatalf("websocket channel destination received %+v", msg)
+	}
+	select {
+	case body := <-ts.webhooks:
+		if string(body) != `{"t":21}` {
+			t.Fatalf("webhook destination received %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook destination received nothing")
+	}
+}
+
+func TestSocketSourceAndDestination(t *testing.T) {
+	ts := loadTestServicers(t)
+	startTestEngine(t, `
+[[route]]
+name = "tcp-echo"
+[route.source]
+type = "tcp"
+servicer = "tcp-route"
+[[route.transform]]
+type = "template"
+template = 'tcp {{.Payload}}'
+[[route.destination]]
+type = "tcp"
+servicer = "tcp-route"
+
+[[route]]
+name = "udp-echo"
+[route.source]
+type = "udp"
+servicer = "udp-route"
+[[route.transform]]
+type = "template"
+template = 'udp {{.Payload}}'
+[[route.destination]]
+type = "udp"
+servicer = "udp-route"
+`)
+
+	// 收到帧的连接同时是目标的接收方
+	tcp, err := net.Dial("tcp", ts.tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	tcp.Write([]byte("ping\n"))
+	tcp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(tcp).ReadString('\n')
+	if err != nil || line != "tcp ping\n" {
+		t.Fatalf("tcp destination sent %q, %v", line, err)
+	}
+
+	udp, err := net.Dial("udp", ts.udp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.Write([]byte("ping\n"))
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := udp.Read(buf)
+	if err != nil || string(buf[:n]) != "udp ping\n" {
+		t.Fatalf("udp destination sent %q, %v", buf[:n], err)
+	}
+}
+
+func TestQueuedWebsocketDestinationWaitsForReceivers(t *testing.T) {
+	ts := loadTestServicers(t)
+	e := startTestEngine(t, strings.ReplaceAll(`
+[[route]]
+name = "ws-queued"
+[route.source]
+type = "http"
+path = "/ws-queued"
+[[route.destination]]
+type = "websocket"
+servicer = "ws-route"
+path = "/ws/queued"
+[route.destination.queue]
+dir = "DIR"
+retry_interval = 10
+max_retry_interval = 20
+`, "DIR", filepath.ToSlash(t.TempDir())))
+
+	// 没有连接的客户端时消息留在队列中
+	e.HandleHTTP(context.Background(), "/ws-queued", []byte("first"))
+	time.Sleep(50 * time.Millisecond)
+	conn := dialTestWebsocket(t, ts, "/ws/queued")
+	if got := readWebsocket(t, conn); got != "first" {
+		t.Fatalf("websocket destination received %s", got)
+	}
+}
+
+func TestDestinationConfigErrors(t *testing.T) {
+	loadTestServicers(t)
+	tests := []struct {
+		name   string
+		source string
+		dest   string
+		want   string
+	}{
+		{"mqtt loop", `type = "mqtt"
+servicer = "mqtt-route"
+topic = "sensors/#"`, `type = "mqtt"
+servicer = "mqtt-route"
+topic = "sensors/{1}"`, "would loop"},
+		{"mqtt without topic", "", `type = "mqtt"
+servicer = "mqtt-route"`, "requires topic"},
+		{"mqtt qos", "", `type = "mqtt"
+servicer = "mqtt-route"
+topic = "a"
+qos = 3`, "out of range"},
+		{"unknown mqtt servicer", "", `type = "mqtt"
+servicer = "missing"
+topic = "a"`, "unknown mqtt servicer"},
+		{"websocket path and channel", "", `type = "websocket"
+servicer = "ws-route"
+path = "/ws/a"
+channel = "a"`, "exactly one of path and channel"},
+		{"webhook without servicer", "", `type = "webhook"`, "requires servicer"},
+		{"webhook with queue", "", `type = "webhook"
+servicer = "webhook-route"
+[route.destination.queue]`, "does not support queue"},
+		{"socket of another network", "", `type = "udp"
+servicer = "tcp-route"`, "is not a udp servicer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := tt.source
+			if source == "" {
+				source = "type = \"http\"\npath = \"/a\""
+			}
+			routes := fmt.Sprintf("[[route]]\nname = \"a\"\n[route.source]\n%s\n[[route.destination]]\n%s\n", source, tt.dest)
+			_, err := NewEngine(&logger.AppLogger{}, writeRoutes(t, routes))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("NewEngine error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
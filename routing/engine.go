@@ -0,0 +1,426 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/logger"
+	"github.com/networkProtocalTrans/queue"
+	"github.com/networkProtocalTrans/script"
+	"github.com/networkProtocalTrans/services"
+	"github.com/networkProtocalTrans/validation"
+)
+
+// ErrNoRoute 没有规则匹配 http 源路径
+var ErrNoRoute = errors.New("no route matches")
+
+// DefaultEngine 由 InitRoutes 创建的路由引擎
+var DefaultEngine *Engine
+
+func init() {
+	deadletter.RegisterRedriver("route", func(ctx context.Context, l *deadletter.Letter) error {
+		if DefaultEngine == nil {
+			return ErrNoRoute
+		}
+		return DefaultEngine.redrive(ctx, l)
+	})
+}
+
+// InitRoutes 加载 conf/routes 下的规则并接入各 servicer，需在 services.InitServices 之后、servicer 启动之前调用
+func InitRoutes(ctx context.Context) {
+	log := logger.DefaultLogger
+	engine, err := NewEngine(log, RouteConfigDir)
+	if err != nil {
+		log.LogFatal(ctx, "Failed to load routes", "error", err)
+	}
+	if err := engine.Start(ctx); err != nil {
+		log.LogFatal(ctx, "Failed to start routes", "error", err)
+	}
+	DefaultEngine = engine
+}
+
+// StopRoutes 停止默认路由引擎的队列转发，需在 servicer 停止之后调用
+func StopRoutes() {
+	if DefaultEngine != nil {
+		DefaultEngine.Stop()
+	}
+}
+
+// RouteStats 规则的消息计数
+type RouteStats struct {
+	// 进入规则的消息数
+	Received int64 `json:"received"`
+	// 被过滤条件丢弃的消息数
+	Filtered int64 `json:"filtered"`
+	// 成功发送到目标的次数，配置了队列的目标为写入队列的次数
+	Delivered int64 `json:"delivered"`
+	// 转换或发送失败的次数
+	Failed int64 `json:"failed"`
+}
+
+// RouteStatus 规则配置与运行统计，用于 /api/v1/routes
+type RouteStatus struct {
+	RouteConfig
+	File  string     `json:"file"`
+	Stats RouteStats `json:"stats"`
+}
+
+// route 已编译的规则
+type route struct {
+	config       RouteConfig
+	file         string
+	transforms   []Transform
+	destinations []Destination
+	// 配置了队列的目标的队列，由 Start 启动转发
+	queues []*queue.Queue
+	stats  RouteStats
+}
+
+// Engine 按规则在 servicer 之间转发消息
+type Engine struct {
+	logger *logger.AppLogger
+	routes []*route
+	// http 源路径 -> 规则
+	httpRoutes map[string][]*route
+	// 结束队列转发，由 Stop 调用
+	cancel context.CancelFunc
+	queues sync.WaitGroup
+}
+
+// NewEngine 加载并编译 dir 下的规则，目录不存在时没有规则
+func NewEngine(log *logger.AppLogger, dir string) (*Engine, error) {
+	loaded, err := loadRouteFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	e := &Engine{
+		logger:     log,
+		httpRoutes: make(map[string][]*route),
+	}
+	for _, lr := range loaded {
+		r, err := compileRoute(lr.config)
+		if err != nil {
+			return nil, fmt.Errorf("route %q (%s): %w", lr.config.Name, lr.file, err)
+		}
+		r.file = lr.file
+		e.routes = append(e.routes, r)
+	}
+	return e, nil
+}
+
+func compileRoute(config RouteConfig) (*route, error) {
+	switch config.Source.Type {
+	case SourceMQTT:
+		if !server.IsValidFilter(config.Source.Topic, false) {
+			return nil, fmt.Errorf("invalid source topic %q", config.Source.Topic)
+		}
+	case SourceWebsocket, SourceHTTP:
+		if config.Source.Path == "" {
+			return nil, fmt.Errorf("%s source requires path", config.Source.Type)
+		}
+	case SourceTCP, SourceUDP:
+		if config.Source.Servicer == "" {
+			return nil, fmt.Errorf("%s source requires servicer", config.Source.Type)
+		}
+	default:
+		return nil, fmt.Errorf("unknown source type %q", config.Source.Type)
+	}
+	if err := config.Filter.validate(); err != nil {
+		return nil, err
+	}
+	if len(config.Destinations) == 0 {
+		return nil, errors.New("at least one destination is required")
+	}
+
+	r := &route{config: config}
+	for i, tc := range config.Transforms {
+		t, err := newTransform(tc)
+		if err != nil {
+			return nil, fmt.Errorf("transform #%d: %w", i+1, err)
+		}
+		r.transforms = append(r.transforms, t)
+	}
+	for i, dc := range config.Destinations {
+		if loops(config.Source, dc) {
+			return nil, fmt.Errorf("destination #%d: topic %q matches the source topic and would loop", i+1, dc.Topic)
+		}
+		d, err := newDestination(dc)
+		if err != nil {
+			return nil, fmt.Errorf("destination #%d: %w", i+1, err)
+		}
+		if dc.Queue != nil {
+			qd, err := newQueuedDestination(queueName(config.Name, i), *dc.Queue, d)
+			if err != nil {
+				return nil, fmt.Errorf("destination #%d: %w", i+1, err)
+			}
+			r.queues = append(r.queues, qd.queue)
+			d = qd
+		}
+		r.destinations = append(r.destinations, d)
+	}
+	return r, nil
+}
+
+// loops 判断 mqtt 目标是否会发布回同一 servicer 上被源订阅的主题
+func loops(source SourceConfig, dest DestinationConfig) bool {
+	if source.Type != SourceMQTT || dest.Type != DestinationMQTT {
+		return false
+	}
+	src, err := resolveMQTT(source.Servicer)
+	if err != nil {
+		return false
+	}
+	dst, err := resolveMQTT(dest.Servicer)
+	if err != nil || src.Name() != dst.Name() {
+		return false
+	}
+	_, matched := auth.MatchTopic(source.Topic, dest.Topic)
+	return matched
+}
+
+// Start 为各规则建立源订阅并启动队列转发，队列转发在 ctx 取消或 Stop 时结束
+func (e *Engine) Start(ctx context.Context) error {
+	ctx, e.cancel = context.WithCancel(ctx)
+	for _, r := range e.routes {
+		r := r
+		src := r.config.Source
+		switch src.Type {
+		case SourceMQTT:
+			m, err := resolveMQTT(src.Servicer)
+			if err != nil {
+				return fmt.Errorf("route %q: %w", r.config.Name, err)
+			}
+			if _, err := m.Subscribe(src.Topic, func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+				wildcards, _ := auth.MatchTopic(src.Topic, pk.TopicName)
+				e.process(context.Background(), r, &Message{
+					Source:    SourceMQTT,
+					Servicer:  m.Name(),
+					Topic:     pk.TopicName,
+					Wildcards: wildcards,
+					Headers:   services.HeadersOf(pk.Properties.User),
+					Payload:   pk.Payload,
+				})
+			}); err != nil {
+				return fmt.Errorf("route %q: subscribe %s: %w", r.config.Name, src.Topic, err)
+			}
+		case SourceWebsocket:
+			ws, err := resolveWebsocket(src.Servicer)
+			if err != nil {
+				return fmt.Errorf("route %q: %w", r.config.Name, err)
+			}
+			ws.OnMessage(func(ctx context.Context, path string, messageType int, message []byte) {
+				if path != src.Path {
+					return
+				}
+				e.process(ctx, r, &Message{
+					Source:   SourceWebsocket,
+					Servicer: ws.Name(),
+					Topic:    path,
+					Headers:  validation.Headers(ctx),
+					Payload:  message,
+				})
+			})
+		case SourceHTTP:
+			e.httpRoutes[src.Path] = append(e.httpRoutes[src.Path], r)
+		case SourceTCP, SourceUDP:
+			sock, err := resolveSocket(src.Type, src.Servicer)
+			if err != nil {
+				return fmt.Errorf("route %q: %w", r.config.Name, err)
+			}
+			sock.OnFrame(func(ctx context.Context, remote string, frame []byte) {
+				e.process(ctx, r, &Message{
+					Source:   src.Type,
+					Servicer: sock.Name(),
+					Topic:    remote,
+					Payload:  frame,
+				})
+			})
+		}
+		for _, q := range r.queues {
+			e.queues.Add(1)
+			go func(q *queue.Queue) {
+				defer e.queues.Done()
+				q.Run(ctx)
+			}(q)
+		}
+		e.logger.LogInfo(ctx, "route loaded", "route", r.config.Name, "file", r.file, "source", src.Type)
+	}
+	return nil
+}
+
+// Stop 结束队列转发并关闭规则的队列，未发送的消息留在队列文件中
+func (e *Engine) Stop() {
+	if e.cancel != nil {
+		e.cancel()
+	}
+	e.queues.Wait()
+	for _, r := range e.routes {
+		for _, q := range r.queues {
+			if err := q.Close(); err != nil {
+				e.logger.LogErrorf(context.Background(), "close route %s queue failed: %v", r.config.Name, err)
+			}
+		}
+	}
+}
+
+// HandleHTTP 将 http 源路径上收到的负载交给对应规则，返回匹配的规则数
+func (e *Engine) HandleHTTP(ctx context.Context, path string, payload []byte) (int, error) {
+	routes := e.httpRoutes[path]
+	if len(routes) == 0 {
+		return 0, ErrNoRoute
+	}
+	for _, r := range routes {
+		e.process(ctx, r, &Message{
+			Source:  SourceHTTP,
+			Topic:   path,
+			Headers: validation.Headers(ctx),
+			Payload: payload,
+		})
+	}
+	return len(routes), nil
+}
+
+// process 对消息依次执行过滤、转换，并发送到所有目标。转换或发送失败时以转换前的消息产生死信
+func (e *Engine) process(ctx context.Context, r *route, msg *Message) {
+	msg.Route = r.config.Name
+	atomic.AddInt64(&r.stats.Received, 1)
+	received := time.Now()
+	original := *msg
+	ok, err := e.transform(ctx, r, msg)
+	if err != nil {
+		atomic.AddInt64(&r.stats.Failed, 1)
+		e.logger.LogErrorf(ctx, "route %s transform failed: %v", r.config.Name, err)
+		deadletter.Publish(ctx, newLetter(&original, deadletter.StageConversion, "route:"+r.config.Name, received, err))
+		return
+	}
+	if ok {
+		e.deliver(ctx, r, msg, &original, received)
+	}
+}
+
+// transform 执行过滤与转换，消息被过滤或被脚本丢弃时返回 false
+func (e *Engine) transform(ctx context.Context, r *route, msg *Message) (bool, error) {
+	if !r.config.Filter.Accept(msg) {
+		atomic.AddInt64(&r.stats.Filtered, 1)
+		return false, nil
+	}
+	for _, t := range r.transforms {
+		if err := t.Apply(ctx, msg); err != nil {
+			if errors.Is(err, script.ErrDropped) {
+				atomic.AddInt64(&r.stats.Filtered, 1)
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// deliver 发送到所有目标，发送失败的目标以 original 产生死信
+func (e *Engine) deliver(ctx context.Context, r *route, msg, original *Message, received time.Time) {
+	for i, d := range r.destinations {
+		if err := d.Send(ctx, msg); err != nil {
+			atomic.AddInt64(&r.stats.Failed, 1)
+			e.logger.LogErrorf(ctx, "route %s destination %s failed: %v", r.config.Name, r.config.Destinations[i].Type, err)
+			deadletter.Publish(ctx, newLetter(original, deadletter.StageDelivery, fmt.Sprintf("route:%s:%d", r.config.Name, i+1), received, err))
+			continue
+		}
+		atomic.AddInt64(&r.stats.Delivered, 1)
+	}
+}
+
+// newLetter 由路由中的消息产生死信
+func newLetter(msg *Message, stage, destination string, received time.Time, err error) *deadletter.Letter {
+	return &deadletter.Letter{
+		Stage:       stage,
+		Error:       err.Error(),
+		Source:      msg.Source,
+		Servicer:    msg.Servicer,
+		Topic:       msg.Topic,
+		Destination: destination,
+		Headers:     msg.Headers,
+		Wildcards:   msg.Wildcards,
+		Payload:     msg.Payload,
+		Received:    received,
+	}
+}
+
+// redrive 重新执行 route:<规则>[:<目标序号>]：重新过滤与转换后发送到指定目标，未指定目标时发送到所有目标，
+// 此时发送失败的目标产生新的死信。消息被过滤时视为成功
+func (e *Engine) redrive(ctx context.Context, l *deadletter.Letter) error {
+	target := l.Target()
+	r, index := e.route(target), -1
+	if r == nil {
+		if i := strings.LastIndex(target, ":"); i > 0 {
+			n, err := strconv.Atoi(target[i+1:])
+			if r = e.route(target[:i]); r != nil && (err != nil || n < 1 || n > len(r.destinations)) {
+				return fmt.Errorf("route %q has no destination %q", target[:i], target[i+1:])
+			}
+			index = n - 1
+		}
+	}
+	if r == nil {
+		return fmt.Errorf("unknown route %q", target)
+	}
+	msg := &Message{
+		Route:     r.config.Name,
+		Source:    l.Source,
+		Servicer:  l.Servicer,
+		Topic:     l.Topic,
+		Wildcards: l.Wildcards,
+		Headers:   l.Headers,
+		Payload:   l.Payload,
+	}
+	original := *msg
+	ok, err := e.transform(ctx, r, msg)
+	if err != nil || !ok {
+		return err
+	}
+	if index < 0 {
+		e.deliver(ctx, r, msg, &original, l.Received)
+		return nil
+	}
+	if err := r.destinations[index].Send(ctx, msg); err != nil {
+		return err
+	}
+	atomic.AddInt64(&r.stats.Delivered, 1)
+	return nil
+}
+
+// route 按名称查找规则
+func (e *Engine) route(name string) *route {
+	for _, r := range e.routes {
+		if r.config.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// Routes 返回所有规则及其统计
+func (e *Engine) Routes() []RouteStatus {
+	statuses := make([]RouteStatus, 0, len(e.routes))
+	for _, r := range e.routes {
+		statuses = append(statuses, RouteStatus{
+			RouteConfig: r.config,
+			File:        r.file,
+			Stats: RouteStats{
+				Received:  atomic.LoadInt64(&r.stats.Received),
+				Filtered:  atomic.LoadInt64(&r.stats.Filtered),
+				Delivered: atomic.LoadInt64(&r.stats.Delivered),
+				Failed:    atomic.LoadInt64(&r.stats.Failed),
+			},
+		})
+	}
+	return statuses
+}
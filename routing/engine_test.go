@@ -0,0 +1,529 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.DefaultLogger = &logger.AppLogger{}
+	os.Exit(m.Run())
+}
+
+// testRecorder 记录 test 类型目标收到的消息，目标以 topic 区分，errs 中的错误由对应目标返回
+type testRecorder struct {
+	mu       sync.Mutex
+	messages map[string][]Message
+	errs     map[string]error
+}
+
+var recorder = &testRecorder{}
+
+func init() {
+	RegisterDestination("test", func(config DestinationConfig) (Destination, error) {
+		if config.Topic == "" {
+			return nil, errors.New("test destination requires topic")
+		}
+		return DestinationFunc(func(ctx context.Context, msg *Message) error {
+			return recorder.send(config.Topic, msg)
+		}), nil
+	})
+}
+
+func (r *testRecorder) send(key string, msg *Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.errs[key]; err != nil {
+		return err
+	}
+	r.messages[key] = append(r.messages[key], *msg)
+	return nil
+}
+
+// reset 清空记录，测试结束时再次清空
+func (r *testRecorder) reset(t *testing.T) {
+	clear := func() {
+		r.mu.Lock()
+		r.messages = make(map[string][]Message)
+		r.errs = make(map[string]error)
+		r.mu.Unlock()
+	}
+	clear()
+	t.Cleanup(clear)
+}
+
+func (r *testRecorder) fail(key string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errs[key] = err
+}
+
+func (r *testRecorder) get(key string) []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Message(nil), r.messages[key]...)
+}
+
+// payloads 返回目标收到的负载
+func (r *testRecorder) payloads(key string) []string {
+	var payloads []string
+	for _, msg := range r.get(key) {
+		payloads = append(payloads, string(msg.Payload))
+	}
+	return payloads
+}
+
+// writeRoutes 将规则写入临时目录，返回目录
+func writeRoutes(t *testing.T, routes string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "routes.toml"), []byte(routes), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// startTestEngine 加载并启动规则，测试结束时停止
+func startTestEngine(t *testing.T, routes string) *Engine {
+	t.Helper()
+	e, err := NewEngine(&logger.AppLogger{}, writeRoutes(t, routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Stop)
+	return e
+}
+
+// useTestDeadLetters 将死信记录到新的 Store、将 e 设为默认引擎，测试结束时恢复
+func useTestDeadLetters(t *testing.T, e *Engine) *deadletter.Store {
+	t.Helper()
+	store, err := deadletter.New(&logger.AppLogger{}, &deadletter.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevStore, prevEngine := deadletter.Default, DefaultEngine
+	deadletter.Default, DefaultEngine = store, e
+	t.Cleanup(func() { deadletter.Default, DefaultEngine = prevStore, prevEngine })
+	return store
+}
+
+func routeStats(t *testing.T, e *Engine, name string) RouteStats {
+	t.Helper()
+	for _, s := range e.Routes() {
+		if s.Name == name {
+			return s.Stats
+		}
+	}
+	t.Fatalf("route %q not found", name)
+	return RouteStats{}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestEngineFilterAndFanOut(t *testing.T) {
+	recorder.reset(t)
+	e := startTestEngine(t, `
+[[route]]
+name = "readings"
+[route.source]
+type = "http"
+path = "/readings"
+[route.filter]
+[[route.filter.condition]]
+field = "temp"
+op = "gte"
+value = 20
+[[route.transform]]
+type = "set"
+fields = { route = "{route}", path = "{topic}" }
+[[route.destination]]
+type = "test"
+topic = "a"
+[[route.destination]]
+type = "test"
+topic = "b"
+`)
+	ctx := context.Background()
+	if _, err := e.HandleHTTP(ctx, "/other", []byte(`{}`)); !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("unknown path error = %v, want %v", err, ErrNoRoute)
+	}
+	for _, payload := range []string{`{"temp": 25}`, `{"temp": 10}`, `temp=25`} {
+		if n, err := e.HandleHTTP(ctx, "/readings", []byte(payload)); n != 1 || err != nil {
+			t.Fatalf("HandleHTTP(%s) = %d, %v", payload, n, err)
+		}
+	}
+
+	want := `{"path":"/readings","route":"readings","temp":25}`
+	for _, key := range []string{"a", "b"} {
+		msgs := recorder.get(key)
+		if len(msgs) != 1 || string(msgs[0].Payload) != want {
+			t.Fatalf("destination %s received %v, want %s", key, recorder.payloads(key), want)
+		}
+		if msgs[0].Source != SourceHTTP || msgs[0].Topic != "/readings" || msgs[0].Route != "readings" {
+			t.Errorf("destination %s message = %+v", key, msgs[0])
+		}
+	}
+	if s := routeStats(t, e, "readings"); s != (RouteStats{Received: 3, Filtered: 2, Delivered: 2}) {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestEngineTransformChain(t *testing.T) {
+	recorder.reset(t)
+	e := startTestEngine(t, `
+[[route]]
+name = "chain"
+[route.source]
+type = "http"
+path = "/chain"
+[[route.transform]]
+type = "select"
+path = "data"
+[[route.transform]]
+type = "set"
+fields = { device = "{route}" }
+[[route.transform]]
+type = "script"
+[route.transform.script]
+source = """
+function transform(msg) {
+	if (msg.payload.t < 0) return null
+	msg.topic = "alerts/" + msg.payload.device
+	return msg
+}
+"""
+[[route.transform]]
+type = "template"
+template = '{{.Topic}} {{.JSON.device}} {{.JSON.t}}'
+[[route.destination]]
+type = "test"
+topic = "out"
+`)
+	ctx := context.Background()
+	e.HandleHTTP(ctx, "/chain", []byte(`{"data": {"t": 5}}`))
+	e.HandleHTTP(ctx, "/chain", []byte(`{"data": {"t": -1}}`))
+
+	msgs := recorder.get("out")
+	if len(msgs) != 1 || string(msgs[0].Payload) != "alerts/chain chain 5" || msgs[0].Topic != "alerts/chain" {
+		t.Fatalf("received %v", recorder.payloads("out"))
+	}
+	// 脚本丢弃的消息计为 filtered
+	if s := routeStats(t, e, "chain"); s != (RouteStats{Received: 2, Filtered: 1, Delivered: 1}) {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestEngineTransformFailure(t *testing.T) {
+	recorder.reset(t)
+	e := startTestEngine(t, `
+[[route]]
+name = "broken"
+[route.source]
+type = "http"
+path = "/broken"
+[[route.transform]]
+type = "select"
+path = "data"
+[[route.destination]]
+type = "test"
+topic = "out"
+`)
+	store := useTestDeadLetters(t, e)
+	e.HandleHTTP(context.Background(), "/broken", []byte(`{"value": 1}`))
+
+	if msgs := recorder.get("out"); len(msgs) != 0 {
+		t.Fatalf("delivered %v after failed transform", recorder.payloads("out"))
+	}
+	if s := routeStats(t, e, "broken"); s != (RouteStats{Received: 1, Failed: 1}) {
+		t.Fatalf("stats = %+v", s)
+	}
+	letters, total := store.List(deadletter.Filter{})
+	if total != 1 {
+		t.Fatalf("dead letters = %d, want 1", total)
+	}
+	l := letters[0]
+	if l.Stage != deadletter.StageConversion || l.Destination != "route:broken" || l.Source != SourceHTTP ||
+		l.Topic != "/broken" || string(l.Payload) != `{"value": 1}` || !strings.Contains(l.Error, "data") {
+		t.Fatalf("dead letter = %+v", l)
+	}
+}
+
+func TestEngineDeliveryFailureAndRedrive(t *testing.T) {
+	recorder.reset(t)
+	e := startTestEngine(t, `
+[[route]]
+name = "fanout"
+[route.source]
+type = "http"
+path = "/fanout"
+[[route.transform]]
+type = "template"
+template = 'wrapped {{.Payload}}'
+[[route.destination]]
+type = "test"
+topic = "flaky"
+[[route.destination]]
+type = "test"
+topic = "stable"
+`)
+	store := useTestDeadLetters(t, e)
+	recorder.fail("flaky", errors.New("connection refused"))
+	e.HandleHTTP(context.Background(), "/fanout", []byte("hello"))
+
+	// 一个目标失败不影响其他目标
+	if got := recorder.payloads("stable"); len(got) != 1 || got[0] != "wrapped hello" {
+		t.Fatalf("stable destination received %v", got)
+	}
+	if s := routeStats(t, e, "fanout"); s != (RouteStats{Received: 1, Delivered: 1, Failed: 1}) {
+		t.Fatalf("stats = %+v", s)
+	}
+	letters, total := store.List(deadletter.Filter{Destination: "route:fanout"})
+	if total != 1 {
+		t.Fatalf("dead letters = %d, want 1", total)
+	}
+	l := letters[0]
+	// 死信保存转换前的负载
+	if l.Stage != deadletter.StageDelivery || l.Destination != "route:fanout:1" ||
+		string(l.Payload) != "hello" || l.Error != "connection refused" {
+		t.Fatalf("dead letter = %+v", l)
+	}
+
+	// 目标仍不可用时重新投递失败，死信保留
+	if _, err := store.Redrive(context.Background(), l.ID); err == nil {
+		t.Fatal("redrive succeeded while the destination is failing")
+	}
+	if got, ok := store.Get(l.ID); !ok || got.Redrives != 1 || got.LastRedriveErr != "connection refused" {
+		t.Fatalf("dead letter after failed redrive = %+v, %v", got, ok)
+	}
+
+	// 恢复后只重新投递到失败的目标
+	recorder.fail("flaky", nil)
+	if _, err := store.Redrive(context.Background(), l.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := recorder.payloads("flaky"); len(got) != 1 || got[0] != "wrapped hello" {
+		t.Fatalf("flaky destination received %v", got)
+	}
+	if got := recorder.payloads("stable"); len(got) != 1 {
+		t.Fatalf("stable destination received %v after redrive", got)
+	}
+	if _, ok := store.Get(l.ID); ok {
+		t.Fatal("dead letter kept after successful redrive")
+	}
+}
+
+func TestEngineRedriveErrors(t *testing.T) {
+	recorder.reset(t)
+	e := startTestEngine(t, `
+[[route]]
+name = "single"
+[route.source]
+type = "http"
+path = "/single"
+[[route.destination]]
+type = "test"
+topic = "out"
+`)
+	tests := []struct {
+		destination string
+		want        string
+	}{
+		{"route:missing", "unknown route"},
+		{"route:single:2", "has no destination"},
+		{"route:single:x", "has no destination"},
+	}
+	for _, tt := range tests {
+		err := e.redrive(context.Background(), &deadletter.Letter{Destination: tt.destination, Payload: []byte("1")})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("redrive %s = %v, want %q", tt.destination, err, tt.want)
+		}
+	}
+	// 未指定目标时发送到所有目标
+	if err := e.redrive(context.Background(), &deadletter.Letter{Destination: "route:single", Payload: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := recorder.payloads("out"); len(got) != 1 || got[0] != "1" {
+		t.Fatalf("received %v", got)
+	}
+}
+
+func TestEngineQueuedDestination(t *testing.T) {
+	recorder.reset(t)
+	e := startTestEngine(t, strings.ReplaceAll(`
+[[route]]
+name = "queued"
+[route.source]
+type = "http"
+path = "/queued"
+[[route.destination]]
+type = "test"
+topic = "out"
+[route.destination.queue]
+dir = "DIR"
+retry_interval = 10
+max_retry_interval = 20
+`, "DIR", filepath.ToSlash(t.TempDir())))
+	store := useTestDeadLetters(t, e)
+	ctx := context.Background()
+
+	// 没有接收方时消息留在队列中，恢复后按顺序发送
+	recorder.fail("out", ErrNoReceivers)
+	e.HandleHTTP(ctx, "/queued", []byte("1"))
+	e.HandleHTTP(ctx, "/queued", []byte("2"))
+	time.Sleep(50 * time.Millisecond)
+	if s := routeStats(t, e, "queued"); s != (RouteStats{Received: 2, Delivered: 2}) {
+		t.Fatalf("stats = %+v", s)
+	}
+	if got := recorder.payloads("out"); len(got) != 0 {
+		t.Fatalf("received %v while the destination has no receivers", got)
+	}
+	recorder.fail("out", nil)
+	waitFor(t, func() bool { return len(recorder.get("out")) == 2 })
+	if got := recorder.payloads("out"); got[0] != "1" || got[1] != "2" {
+		t.Fatalf("received %v, want [1 2]", got)
+	}
+
+	// 其他错误无法重试，消息从队列删除并产生死信
+	recorder.fail("out", errors.New("payload rejected"))
+	e.HandleHTTP(ctx, "/queued", []byte("3"))
+	waitFor(t, func() bool {
+		_, total := store.List(deadletter.Filter{})
+		return total == 1
+	})
+	letters, _ := store.List(deadletter.Filter{})
+	l := letters[0]
+	if l.Stage != deadletter.StageDelivery || l.Destination != "queue:route:queued:1" ||
+		string(l.Payload) != "3" || len(l.Data) == 0 || l.Error != "payload rejected" {
+		t.Fatalf("dead letter = %+v", l)
+	}
+
+	// 重新投递时写回队列
+	recorder.fail("out", nil)
+	if _, err := store.Redrive(ctx, l.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(recorder.get("out")) == 3 })
+	if got := recorder.payloads("out"); got[2] != "3" {
+		t.Fatalf("received %v after redrive", got)
+	}
+}
+
+func TestNewEngineErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes string
+		want   string
+	}{
+		{"missing name", `
+[[route]]
+[route.source]
+type = "http"
+path = "/a"`, "name is required"},
+		{"duplicate name", `
+[[route]]
+name = "a"
+[route.source]
+type = "http"
+path = "/a"
+[[route.destination]]
+type = "test"
+topic = "out"
+[[route]]
+name = "a"`, "duplicate route name"},
+		{"unknown source", `
+[[route]]
+name = "a"
+[route.source]
+type = "amqp"`, "unknown source type"},
+		{"invalid source topic", `
+[[route]]
+name = "a"
+[route.source]
+type = "mqtt"
+topic = "a/#/b"`, "invalid source topic"},
+		{"websocket without path", `
+[[route]]
+name = "a"
+[route.source]
+type = "websocket"`, "requires path"},
+		{"tcp without servicer", `
+[[route]]
+name = "a"
+[route.source]
+type = "tcp"`, "requires servicer"},
+		{"invalid filter", `
+[[route]]
+name = "a"
+[route.source]
+type = "http"
+path = "/a"
+[[route.filter.condition]]
+field = "a"
+op = "like"`, "invalid filter op"},
+		{"no destination", `
+[[route]]
+name = "a"
+[route.source]
+type = "http"
+path = "/a"`, "at least one destination"},
+		{"unknown transform", `
+[[route]]
+name = "a"
+[route.source]
+type = "http"
+path = "/a"
+[[route.transform]]
+type = "rename"
+[[route.destination]]
+type = "test"
+topic = "out"`, "transform #1"},
+		{"unknown destination", `
+[[route]]
+name = "a"
+[route.source]
+type = "http"
+path = "/a"
+[[route.destination]]
+type = "test"
+topic = "out"
+[[route.destination]]
+type = "kafka"`, "destination #2"},
+		{"destination config", `
+[[route]]
+name = "a"
+[route.source]
+type = "http"
+path = "/a"
+[[route.destination]]
+type = "test"`, "requires topic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewEngine(&logger.AppLogger{}, writeRoutes(t, tt.routes))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("NewEngine error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package routing
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// 过滤条件操作符
+const (
+	OpEq        = "eq"
+	OpNe        = "ne"
+	OpGt        = "gt"
+	OpGte       = "gte"
+	OpLt        = "lt"
+	OpLte       = "lte"
+	OpContains  = "contains"
+	OpExists    = "exists"
+	OpNotExists = "not_exists"
+)
+
+// validate 校验过滤配置
+func (f *FilterConfig) validate() error {
+	switch strings.ToLower(f.Match) {
+	case "", MatchAll, MatchAny:
+	default:
+		return fmt.Errorf("invalid filter match %q", f.Match)
+	}
+	for _, c := range f.Conditions {
+		switch c.Op {
+		case OpEq, OpNe, OpContains:
+		case OpGt, OpGte, OpLt, OpLte:
+			if _, ok := toFloat(c.Value); !ok {
+				return fmt.Errorf("filter condition %q %s requires a numeric value", c.Field, c.Op)
+			}
+		case OpExists, OpNotExists:
+		default:
+			return fmt.Errorf("invalid filter op %q", c.Op)
+		}
+	}
+	return nil
+}
+
+// Accept 判断消息是否通过过滤，负载不是 JSON 时只有对整个负载的 contains 条件可以满足
+func (f *FilterConfig) Accept(msg *Message) bool {
+	if len(f.Conditions) == 0 {
+		return true
+	}
+	doc, err := msg.JSON()
+	matchAny := strings.ToLower(f.Match) == MatchAny
+	for _, c := range f.Conditions {
+		ok := c.match(doc, err == nil, msg.Payload)
+		if matchAny && ok {
+			return true
+		}
+		if !matchAny && !ok {
+			return false
+		}
+	}
+	return !matchAny
+}
+
+func (c *Condition) match(doc any, isJSON bool, raw []byte) bool {
+	if !isJSON {
+		return c.Op == OpContains && c.Field == "" && strings.Contains(string(raw), fmt.Sprint(c.Value))
+	}
+	v, found := lookup(doc, c.Field)
+	switch c.Op {
+	case OpExists:
+		return found
+	case OpNotExists:
+		return !found
+	}
+	if !found {
+		return false
+	}
+
+	switch c.Op {
+	case OpEq:
+		return equal(v, c.Value)
+	case OpNe:
+		return !equal(v, c.Value)
+	case OpContains:
+		switch node := v.(type) {
+		case string:
+			return strings.Contains(node, fmt.Sprint(c.Value))
+		case []any:
+			for _, item := range node {
+				if equal(item, c.Value) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	a, ok := toFloat(v)
+	if !ok {
+		return false
+	}
+	b, _ := toFloat(c.Value)
+	switch c.Op {
+	case OpGt:
+		return a > b
+	case OpGte:
+		return a >= b
+	case OpLt:
+		return a < b
+	case OpLte:
+		return a <= b
+	}
+	return false
+}
+
+// equal 比较 JSON 值与配置值，数值统一按 float64 比较
+func equal(v, want any) bool {
+	if a, ok := toFloat(v); ok {
+		b, ok := toFloat(want)
+		return ok && a == b
+	}
+	return reflect.DeepEqual(v, want)
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
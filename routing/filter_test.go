@@ -0,0 +1,95 @@
+package routing
+
+import "testing"
+
+func TestFilterAccept(t *testing.T) {
+	doc := `{"temp": 25.5, "count": 3, "status": "alarm", "tags": ["a", "b", 7], "nested": {"items": [{"id": "x"}]}, "null": null}`
+	tests := []struct {
+		name    string
+		filter  FilterConfig
+		payload string
+		want    bool
+	}{
+		{"no conditions", FilterConfig{}, "not json", true},
+		{"eq string", FilterConfig{Conditions: []Condition{{Field: "status", Op: OpEq, Value: "alarm"}}}, doc, true},
+		{"eq int against float", FilterConfig{Conditions: []Condition{{Field: "count", Op: OpEq, Value: int64(3)}}}, doc, true},
+		{"eq mismatched type", FilterConfig{Conditions: []Condition{{Field: "count", Op: OpEq, Value: "3"}}}, doc, false},
+		{"eq null", FilterConfig{Conditions: []Condition{{Field: "null", Op: OpEq, Value: nil}}}, doc, true},
+		{"ne", FilterConfig{Conditions: []Condition{{Field: "status", Op: OpNe, Value: "ok"}}}, doc, true},
+		{"ne missing field", FilterConfig{Conditions: []Condition{{Field: "missing", Op: OpNe, Value: "ok"}}}, doc, false},
+		{"gt", FilterConfig{Conditions: []Condition{{Field: "temp", Op: OpGt, Value: int64(25)}}}, doc, true},
+		{"gt equal", FilterConfig{Conditions: []Condition{{Field: "temp", Op: OpGt, Value: 25.5}}}, doc, false},
+		{"gte equal", FilterConfig{Conditions: []Condition{{Field: "temp", Op: OpGte, Value: 25.5}}}, doc, true},
+		{"lt", FilterConfig{Conditions: []Condition{{Field: "count", Op: OpLt, Value: int64(3)}}}, doc, false},
+		{"lte", FilterConfig{Conditions: []Condition{{Field: "count", Op: OpLte, Value: int64(3)}}}, doc, true},
+		{"gt on string field", FilterConfig{Conditions: []Condition{{Field: "status", Op: OpGt, Value: int64(0)}}}, doc, false},
+		{"contains substring", FilterConfig{Conditions: []Condition{{Field: "status", Op: OpContains, Value: "lar"}}}, doc, true},
+		{"contains array item", FilterConfig{Conditions: []Condition{{Field: "tags", Op: OpContains, Value: int64(7)}}}, doc, true},
+		{"contains missing array item", FilterConfig{Conditions: []Condition{{Field: "tags", Op: OpContains, Value: "c"}}}, doc, false},
+		{"contains on number", FilterConfig{Conditions: []Condition{{Field: "count", Op: OpContains, Value: "3"}}}, doc, false},
+		{"nested path with index", FilterConfig{Conditions: []Condition{{Field: "nested.items.0.id", Op: OpEq, Value: "x"}}}, doc, true},
+		{"index out of range", FilterConfig{Conditions: []Condition{{Field: "nested.items.1.id", Op: OpExists}}}, doc, false},
+		{"exists", FilterConfig{Conditions: []Condition{{Field: "null", Op: OpExists}}}, doc, true},
+		{"not exists", FilterConfig{Conditions: []Condition{{Field: "missing", Op: OpNotExists}}}, doc, true},
+		{"whole payload", FilterConfig{Conditions: []Condition{{Op: OpEq, Value: int64(42)}}}, "42", true},
+		{"all", FilterConfig{Conditions: []Condition{
+			{Field: "temp", Op: OpGt, Value: int64(20)},
+			{Field: "status", Op: OpEq, Value: "ok"},
+		}}, doc, false},
+		{"any", FilterConfig{Match: MatchAny, Conditions: []Condition{
+			{Field: "temp", Op: OpGt, Value: int64(30)},
+			{Field: "status", Op: OpEq, Value: "alarm"},
+		}}, doc, true},
+		{"any none match", FilterConfig{Match: "ANY", Conditions: []Condition{
+			{Field: "temp", Op: OpGt, Value: int64(30)},
+			{Field: "status", Op: OpEq, Value: "ok"},
+		}}, doc, false},
+		{"not json", FilterConfig{Conditions: []Condition{{Field: "temp", Op: OpExists}}}, "temp=25", false},
+		{"not json not exists", FilterConfig{Conditions: []Condition{{Field: "temp", Op: OpNotExists}}}, "temp=25", false},
+		{"not json contains", FilterConfig{Conditions: []Condition{{Op: OpContains, Value: "temp="}}}, "temp=25", true},
+		{"not json contains field", FilterConfig{Conditions: []Condition{{Field: "temp", Op: OpContains, Value: "temp="}}}, "temp=25", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.filter.validate(); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.filter.Accept(&Message{Payload: []byte(tt.payload)}); got != tt.want {
+				t.Fatalf("Accept(%s) = %v, want %v", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter FilterConfig
+	}{
+		{"invalid match", FilterConfig{Match: "some"}},
+		{"invalid op", FilterConfig{Conditions: []Condition{{Field: "a", Op: "regex"}}}},
+		{"non-numeric comparison", FilterConfig{Conditions: []Condition{{Field: "a", Op: OpGt, Value: "10"}}}},
+		{"missing comparison value", FilterConfig{Conditions: []Condition{{Field: "a", Op: OpLte}}}},
+	}
+	for _, tt := range tests {
+		if err := tt.filter.validate(); err == nil {
+			t.Errorf("%s: validate succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestMessageExpand(t *testing.T) {
+	msg := &Message{Route: "r1", Topic: "sensors/a/temp", Wildcards: []string{"a", "temp"}}
+	tests := map[string]string{
+		"out/{topic}":     "out/sensors/a/temp",
+		"{route}/{1}/{2}": "r1/a/temp",
+		"{3}":             "{3}",
+		"no placeholders": "no placeholders",
+		"{route}-{route}": "r1-r1",
+	}
+	for in, want := range tests {
+		if got := msg.Expand(in); got != want {
+			t.Errorf("Expand(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Message 在路由中流转的消息
+type Message struct {
+	// 规则名称
+	Route string `json:"route"`
+	// 源类型与 servicer 名称
+	Source   string `json:"source"`
+	Servicer string `json:"servicer,omitempty"`
+	// mqtt 主题、websocket 路径或 http 路径
+	Topic string `json:"topic"`
+	// 源主题过滤器中 + 与 # 匹配到的主题层级
+	Wildcards []string `json:"wildcards,omitempty"`
+	// mqtt 源为 MQTT v5 用户属性，websocket / http 源为校验规则 tag 动作写入的 header，
+	// 可由 script 转换修改，mqtt 目标以用户属性发布
+	Headers map[string]string `json:"headers,omitempty"`
+	Payload []byte            `json:"payload"`
+}
+
+// Expand 替换 s 中的占位符：{topic} 为源主题，{route} 为规则名称，{1}、{2}… 为通配符匹配到的层级
+func (m *Message) Expand(s string) string {
+	if !strings.Contains(s, "{") {
+		return s
+	}
+	pairs := []string{"{topic}", m.Topic, "{route}", m.Route}
+	for i, w := range m.Wildcards {
+		pairs = append(pairs, "{"+strconv.Itoa(i+1)+"}", w)
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+// JSON 将负载解析为 JSON 值
+func (m *Message) JSON() (any, error) {
+	var v any
+	if err := json.Unmarshal(m.Payload, &v); err != nil {
+		return nil, fmt.Errorf("payload is not valid json: %w", err)
+	}
+	return v, nil
+}
+
+// lookup 按 . 分隔的路径取出 JSON 值中的字段，path 为空时返回 v 本身
+func lookup(v any, path string) (any, bool) {
+	if path == "" {
+		return v, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			child, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			v = child
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
@@ -0,0 +1,54 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/queue"
+	"github.com/networkProtocalTrans/services"
+)
+
+// queuedDestination 消息先写入持久化队列，由队列按入队顺序发送给目标，目标确认后删除
+type queuedDestination struct {
+	queue *queue.Queue
+}
+
+// newQueuedDestination 打开目标的队列。servicer 未运行与没有接收方时稍后重试，其余错误视为无法投递
+func newQueuedDestination(name string, config queue.Config, d Destination) (*queuedDestination, error) {
+	q, err := queue.Open(name, config, func(ctx context.Context, e *queue.Entry) error {
+		var msg Message
+		if err := json.Unmarshal(e.Data, &msg); err != nil {
+			return queue.Permanent(err)
+		}
+		err := d.Send(ctx, &msg)
+		if err == nil || errors.Is(err, services.ErrServicerNotRunning) || errors.Is(err, ErrNoReceivers) {
+			return err
+		}
+		return queue.Permanent(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 队列删除的消息已经过转换，重新投递时写回队列
+	q.OnDiscard(func(e *queue.Entry, err error) {
+		var msg Message
+		json.Unmarshal(e.Data, &msg)
+		l := newLetter(&msg, deadletter.StageDelivery, "queue:"+name, e.Created, err)
+		l.Data = e.Data
+		deadletter.Publish(context.Background(), l)
+	})
+	return &queuedDestination{queue: q}, nil
+}
+
+// Send 将消息写入队列，队列已满且 overflow = reject 时返回错误
+func (d *queuedDestination) Send(ctx context.Context, msg *Message) error {
+	return d.queue.Enqueue(msg)
+}
+
+// queueName 规则目标的队列名称
+func queueName(route string, index int) string {
+	return fmt.Sprintf("route:%s:%d", route, index+1)
+}
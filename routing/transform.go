@@ -0,0 +1,223 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"text/template"
+
+	"github.com/networkProtocalTrans/codec"
+	"github.com/networkProtocalTrans/script"
+)
+
+// 内置转换类型
+const (
+	TransformSelect    = "select"
+	TransformSet       = "set"
+	TransformTemplate  = "template"
+	TransformTranscode = "transcode"
+	TransformScript    = "script"
+)
+
+// Transform 转换阶段，修改消息负载
+type Transform interface {
+	Apply(ctx context.Context, msg *Message) error
+}
+
+// TransformFunc 函数形式的 Transform
+type TransformFunc func(ctx context.Context, msg *Message) error
+
+// Apply 实现 Transform
+func (f TransformFunc) Apply(ctx context.Context, msg *Message) error {
+	return f(ctx, msg)
+}
+
+// TransformFactory 根据配置创建转换阶段
+type TransformFactory func(config TransformConfig) (Transform, error)
+
+var (
+	transformMu sync.RWMutex
+	transforms  = map[string]TransformFactory{}
+)
+
+// RegisterTransform 注册转换类型，重复注册时覆盖
+func RegisterTransform(typ string, factory TransformFactory) {
+	transformMu.Lock()
+	defer transformMu.Unlock()
+	transforms[typ] = factory
+}
+
+// TransformTypes 返回已注册的转换类型
+func TransformTypes() []string {
+	transformMu.RLock()
+	defer transformMu.RUnlock()
+	types := make([]string, 0, len(transforms))
+	for typ := range transforms {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func newTransform(config TransformConfig) (Transform, error) {
+	transformMu.RLock()
+	factory, ok := transforms[config.Type]
+	transformMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown transform type %q", config.Type)
+	}
+	return factory(config)
+}
+
+func init() {
+	RegisterTransform(TransformSelect, newSelectTransform)
+	RegisterTransform(TransformSet, newSetTransform)
+	RegisterTransform(TransformTemplate, newTemplateTransform)
+	RegisterTransform(TransformTranscode, newTranscodeTransform)
+	RegisterTransform(TransformScript, newScriptTransform)
+}
+
+// newSelectTransform 以 JSON 负载中 path 处的值作为新负载
+func newSelectTransform(config TransformConfig) (Transform, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("select transform requires path")
+	}
+	return TransformFunc(func(ctx context.Context, msg *Message) error {
+		doc, err := msg.JSON()
+		if err != nil {
+			return err
+		}
+		v, ok := lookup(doc, config.Path)
+		if !ok {
+			return fmt.Errorf("field %q not found", config.Path)
+		}
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		msg.Payload = payload
+		return nil
+	}), nil
+}
+
+// newSetTransform 向 JSON 对象负载写入字段，负载为空时视为空对象
+func newSetTransform(config TransformConfig) (Transform, error) {
+	if len(config.Fields) == 0 {
+		return nil, fmt.Errorf("set transform requires fields")
+	}
+	return TransformFunc(func(ctx context.Context, msg *Message) error {
+		obj := map[string]any{}
+		if len(msg.Payload) > 0 {
+			if err := json.Unmarshal(msg.Payload, &obj); err != nil {
+				return fmt.Errorf("set transform requires a json object payload: %w", err)
+			}
+		}
+		for key, value := range config.Fields {
+			if s, ok := value.(string); ok {
+				value = msg.Expand(s)
+			}
+			obj[key] = value
+		}
+		payload, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		msg.Payload = payload
+		return nil
+	}), nil
+}
+
+// templateData template 转换中可使用的数据
+type templateData struct {
+	Route     string
+	Source    string
+	Servicer  string
+	Topic     string
+	Wildcards []string
+	// 负载原文
+	Payload string
+	// 解析后的 JSON 负载，负载不是 JSON 时为 nil
+	JSON any
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// newTemplateTransform 以 Go text/template 的渲染结果作为新负载
+func newTemplateTransform(config TransformConfig) (Transform, error) {
+	tmpl, err := template.New("transform").Funcs(templateFuncs).Option("missingkey=error").Parse(config.Template)
+	if err != nil {
+		return nil, fmt.Errorf("parse template: %w", err)
+	}
+	return TransformFunc(func(ctx context.Context, msg *Message) error {
+		data := templateData{
+			Route:     msg.Route,
+			Source:    msg.Source,
+			Servicer:  msg.Servicer,
+			Topic:     msg.Topic,
+			Wildcards: msg.Wildcards,
+			Payload:   string(msg.Payload),
+		}
+		data.JSON, _ = msg.JSON()
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return err
+		}
+		msg.Payload = buf.Bytes()
+		return nil
+	}), nil
+}
+
+// newTranscodeTransform 将负载由 from 编码转为 to 编码
+func newTranscodeTransform(config TransformConfig) (Transform, error) {
+	if config.From == "" || config.To == "" {
+		return nil, fmt.Errorf("transcode transform requires from and to")
+	}
+	from, err := codec.Get(config.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := codec.Get(config.To)
+	if err != nil {
+		return nil, err
+	}
+	return TransformFunc(func(ctx context.Context, msg *Message) error {
+		payload, err := codec.Transcode(from, to, msg.Payload)
+		if err != nil {
+			return err
+		}
+		msg.Payload = payload
+		return nil
+	}), nil
+}
+
+// newScriptTransform 执行脚本修改主题、headers 与负载，脚本丢弃消息时返回 script.ErrDropped
+func newScriptTransform(config TransformConfig) (Transform, error) {
+	if config.Script == nil {
+		return nil, fmt.Errorf("script transform requires script")
+	}
+	s, err := script.New("transform", *config.Script)
+	if err != nil {
+		return nil, err
+	}
+	return TransformFunc(func(ctx context.Context, msg *Message) error {
+		out, err := s.Run(&script.Message{
+			Topic:   msg.Topic,
+			Source:  msg.Source,
+			Headers: msg.Headers,
+			Payload: msg.Payload,
+		})
+		if err != nil {
+			return err
+		}
+		msg.Topic, msg.Headers, msg.Payload = out.Topic, out.Headers, out.Payload
+		return nil
+	}), nil
+}
@@ -0,0 +1,122 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/networkProtocalTrans/codec"
+	"github.com/networkProtocalTrans/script"
+)
+
+func TestTransforms(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TransformConfig
+		payload string
+		want    string
+	}{
+		{"select object", TransformConfig{Type: TransformSelect, Path: "data"}, `{"data": {"t": 1}}`, `{"t":1}`},
+		{"select array item", TransformConfig{Type: TransformSelect, Path: "list.1"}, `{"list": ["a", "b"]}`, `"b"`},
+		{"set placeholders", TransformConfig{Type: TransformSet, Fields: map[string]any{"device": "{1}", "route": "{route}", "n": int64(1)}},
+			`{"t": 1}`, `{"device":"a","n":1,"route":"r1","t":1}`},
+		{"set empty payload", TransformConfig{Type: TransformSet, Fields: map[string]any{"topic": "{topic}"}}, ``, `{"topic":"sensors/a"}`},
+		{"template", TransformConfig{Type: TransformTemplate, Template: `{{.Route}} {{index .Wildcards 0}} {{.JSON.t}} {{json .JSON}}`},
+			`{"t": 1}`, `r1 a 1 {"t":1}`},
+		{"template raw payload", TransformConfig{Type: TransformTemplate, Template: `<{{.Payload}}>`}, `plain`, `<plain>`},
+		{"transcode", TransformConfig{Type: TransformTranscode, From: codec.JSON, To: codec.XML}, `{"t": 1}`, `<t>1</t>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := newTransform(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := &Message{Route: "r1", Topic: "sensors/a", Wildcards: []string{"a"}, Payload: []byte(tt.payload)}
+			if err := tr.Apply(context.Background(), msg); err != nil {
+				t.Fatal(err)
+			}
+			if string(msg.Payload) != tt.want {
+				t.Fatalf("payload = %s, want %s", msg.Payload, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TransformConfig
+		payload string
+	}{
+		{"select not json", TransformConfig{Type: TransformSelect, Path: "a"}, `a=1`},
+		{"select missing field", TransformConfig{Type: TransformSelect, Path: "a.b"}, `{"a": 1}`},
+		{"set non-object", TransformConfig{Type: TransformSet, Fields: map[string]any{"a": 1}}, `[1]`},
+		{"template missing key", TransformConfig{Type: TransformTemplate, Template: `{{.JSON.missing}}`}, `{"a": 1}`},
+		{"transcode invalid input", TransformConfig{Type: TransformTranscode, From: codec.JSON, To: codec.MsgPack}, `{`},
+		{"script throws", TransformConfig{Type: TransformScript, Script: &script.Config{
+			Source: `function transform(msg) { throw new Error("bad") }`,
+		}}, `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := newTransform(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := &Message{Payload: []byte(tt.payload)}
+			if err := tr.Apply(context.Background(), msg); err == nil {
+				t.Fatalf("Apply succeeded with payload %s", msg.Payload)
+			}
+		})
+	}
+}
+
+func TestNewTransformErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TransformConfig
+	}{
+		{"unknown type", TransformConfig{Type: "rename"}},
+		{"select without path", TransformConfig{Type: TransformSelect}},
+		{"set without fields", TransformConfig{Type: TransformSet}},
+		{"invalid template", TransformConfig{Type: TransformTemplate, Template: "{{.Topic"}},
+		{"transcode without to", TransformConfig{Type: TransformTranscode, From: codec.JSON}},
+		{"transcode unknown codec", TransformConfig{Type: TransformTranscode, From: codec.JSON, To: "yaml"}},
+		{"script without script", TransformConfig{Type: TransformScript}},
+		{"script syntax error", TransformConfig{Type: TransformScript, Script: &script.Config{Source: "function transform(msg) {"}}},
+	}
+	for _, tt := range tests {
+		if _, err := newTransform(tt.config); err == nil {
+			t.Errorf("%s: newTransform succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestScriptTransform(t *testing.T) {
+	tr, err := newTransform(TransformConfig{Type: TransformScript, Script: &script.Config{Source: `
+function transform(msg) {
+	if (msg.payload.skip) return null
+	msg.topic = "alerts/" + msg.topic
+	msg.headers.source = msg.source
+	msg.payload.t = msg.payload.t * 2
+	return msg
+}`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &Message{Source: SourceMQTT, Topic: "sensors/a", Headers: map[string]string{"unit": "c"}, Payload: []byte(`{"t": 2}`)}
+	if err := tr.Apply(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Topic != "alerts/sensors/a" || string(msg.Payload) != `{"t":4}` ||
+		!reflect.DeepEqual(msg.Headers, map[string]string{"unit": "c", "source": SourceMQTT}) {
+		t.Fatalf("message = %s %v %s", msg.Topic, msg.Headers, msg.Payload)
+	}
+
+	msg = &Message{Topic: "sensors/a", Payload: []byte(`{"skip": true}`)}
+	if err := tr.Apply(context.Background(), msg); !errors.Is(err, script.ErrDropped) {
+		t.Fatalf("dropped message error = %v, want %v", err, script.ErrDropped)
+	}
+}
@@ -0,0 +1,344 @@
+package script
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/metrics"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dop251/goja"
+	"github.com/networkProtocalTrans/codec"
+	"github.com/networkProtocalTrans/logger"
+)
+
+// 脚本默认配置
+const (
+	defaultTimeout      = 100
+	defaultMaxCallStack = 256
+)
+
+// CodecText payload 为 UTF-8 字符串，不经过编解码器
+const CodecText = "text"
+
+// transformFunc 脚本中处理消息的函数名
+const transformFunc = "transform"
+
+// ErrDropped 脚本返回 null、undefined 或 false，消息不再转发
+var ErrDropped = errors.New("message dropped by script")
+
+// Config 脚本配置。脚本定义 function transform(msg)，msg 包含 topic、source、headers 与解码后的 payload，
+// 返回修改后的 msg（或新的 {topic, headers, payload} 对象），返回 null 时丢弃消息
+type Config struct {
+	// 内联脚本源码，与 file 二选一
+	Source string `toml:"source" json:"source,omitempty"`
+	// 脚本文件路径
+	File string `toml:"file" json:"file,omitempty"`
+	// 解码与编码 payload 的编解码器（json、msgpack、cbor、xml、protobuf:<消息全名>）或 text，默认 json
+	Codec string `toml:"codec" json:"codec,omitempty"`
+	// 单次执行超时（毫秒），默认 100
+	Timeout int `toml:"timeout" json:"timeout,omitempty"`
+	// 单次执行期间进程堆内存的增长上限（字节），超过时中断脚本，0 表示不限制。
+	// 这是进程级的粗略保护而不是脚本的内存配额：goja 无法统计单个运行时的分配，
+	// 采样的是整个进程的堆，同时运行的其他脚本与 goroutine 的分配也会计入，GC 回收又会抵消增长，
+	// 应设为远大于脚本正常用量的值，只用于拦截失控的分配
+	MaxMemory int64 `toml:"max_memory" json:"max_memory,omitempty"`
+	// 最大调用栈深度，默认 256
+	MaxCallStack int `toml:"max_call_stack" json:"max_call_stack,omitempty"`
+}
+
+// Message 脚本处理的消息
+type Message struct {
+	Topic   string
+	Source  string
+	Headers map[string]string
+	Payload []byte
+}
+
+// Script 编译后的脚本，可并发执行，每次执行使用独立的 goja 运行时
+type Script struct {
+	name    string
+	program *goja.Program
+	codec   codec.Codec
+	config  Config
+	// 空闲的运行时，被中断过的运行时不再放回
+	pool sync.Pool
+}
+
+// vm 已执行过脚本顶层代码的运行时
+type vm struct {
+	runtime   *goja.Runtime
+	transform goja.Callable
+}
+
+var (
+	// programs 按源码哈希缓存编译结果，多处引用同一脚本只编译一次
+	programsMu sync.Mutex
+	programs   = map[[sha256.Size]byte]*goja.Program{}
+)
+
+// New 按配置编译脚本，name 用于错误信息与日志
+func New(name string, config Config) (*Script, error) {
+	source := config.Source
+	switch {
+	case config.File != "" && source != "":
+		return nil, fmt.Errorf("script %s: source and file are mutually exclusive", name)
+	case config.File != "":
+		b, err := os.ReadFile(config.File)
+		if err != nil {
+			return nil, fmt.Errorf("script %s: %w", name, err)
+		}
+		source, name = string(b), config.File
+	case source == "":
+		return nil, fmt.Errorf("script %s: source or file is required", name)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.MaxCallStack <= 0 {
+		config.MaxCallStack = defaultMaxCallStack
+	}
+
+	s := &Script{name: name, config: config}
+	if config.Codec != CodecText {
+		codecName := config.Codec
+		if codecName == "" {
+			codecName = codec.JSON
+		}
+		c, err := codec.Get(codecName)
+		if err != nil {
+			return nil, fmt.Errorf("script %s: %w", name, err)
+		}
+		s.codec = c
+	}
+	program, err := compile(name, source)
+	if err != nil {
+		return nil, err
+	}
+	s.program = program
+
+	// 预先创建一个运行时，顶层代码的错误与缺少 transform 函数在加载时报告
+	v, err := s.newVM()
+	if err != nil {
+		return nil, err
+	}
+	s.pool.Put(v)
+	return s, nil
+}
+
+func compile(name, source string) (*goja.Program, error) {
+	key := sha256.Sum256([]byte(source))
+	programsMu.Lock()
+	defer programsMu.Unlock()
+	if p, ok := programs[key]; ok {
+		return p, nil
+	}
+	p, err := goja.Compile(name, source, true)
+	if err != nil {
+		return nil, fmt.Errorf("compile script %s: %w", name, err)
+	}
+	programs[key] = p
+	return p, nil
+}
+
+func (s *Script) newVM() (*vm, error) {
+	rt := goja.New()
+	rt.SetMaxCallStackSize(s.config.MaxCallStack)
+	console := rt.NewObject()
+	console.Set("log", func(call goja.FunctionCall) goja.Value {
+		args := make([]any, len(call.Arguments))
+		for i, a := range call.Arguments {
+			args[i] = a.Export()
+		}
+		logger.DefaultLogger.LogInfo(context.Background(), "script log", "script", s.name, "args", args)
+		return goja.Undefined()
+	})
+	rt.Set("console", console)
+
+	if _, err := s.run(rt, func() (goja.Value, error) { return rt.RunProgram(s.program) }); err != nil {
+		return nil, fmt.Errorf("script %s: %w", s.name, err)
+	}
+	fn, ok := goja.AssertFunction(rt.Get(transformFunc))
+	if !ok {
+		return nil, fmt.Errorf("script %s: function %s(msg) is not defined", s.name, transformFunc)
+	}
+	return &vm{runtime: rt, transform: fn}, nil
+}
+
+// Run 执行脚本，返回处理后的消息，脚本丢弃消息时返回 ErrDropped
+func (s *Script) Run(msg *Message) (*Message, error) {
+	v, _ := s.pool.Get().(*vm)
+	if v == nil {
+		var err error
+		if v, err = s.newVM(); err != nil {
+			return nil, err
+		}
+	}
+
+	payload, err := s.decode(msg.Payload)
+	if err != nil {
+		s.pool.Put(v)
+		return nil, fmt.Errorf("script %s: decode payload: %w", s.name, err)
+	}
+	headers := make(map[string]any, len(msg.Headers))
+	for k, val := range msg.Headers {
+		headers[k] = val
+	}
+	in := toJS(v.runtime, map[string]any{
+		"topic":   msg.Topic,
+		"source":  msg.Source,
+		"headers": headers,
+		"payload": payload,
+	})
+
+	result, err := s.run(v.runtime, func() (goja.Value, error) { return v.transform(goja.Undefined(), in) })
+	var interrupted *goja.InterruptedError
+	if errors.As(err, &interrupted) {
+		// 被中断的运行时状态不可预期，丢弃
+		return nil, fmt.Errorf("script %s: %v", s.name, interrupted.Value())
+	}
+	s.pool.Put(v)
+	if err != nil {
+		return nil, fmt.Errorf("script %s: %w", s.name, err)
+	}
+	return s.result(msg, result)
+}
+
+// run 在超时与内存限制下执行 fn
+func (s *Script) run(rt *goja.Runtime, fn func() (goja.Value, error)) (goja.Value, error) {
+	fired := make(chan struct{})
+	timer := time.AfterFunc(time.Duration(s.config.Timeout)*time.Millisecond, func() {
+		defer close(fired)
+		rt.Interrupt(fmt.Sprintf("timeout after %dms", s.config.Timeout))
+	})
+	done := make(chan struct{})
+	var watcher sync.WaitGroup
+	if s.config.MaxMemory > 0 {
+		watcher.Add(1)
+		go func() {
+			defer watcher.Done()
+			watchMemory(rt, s.config.MaxMemory, done)
+		}()
+	}
+
+	v, err := fn()
+	// 计时器与内存采样都退出后再清除中断，迟到的中断不会留在放回池中的运行时上
+	if !timer.Stop() {
+		<-fired
+	}
+	close(done)
+	watcher.Wait()
+	rt.ClearInterrupt()
+	return v, err
+}
+
+// heapMetric 堆上存活与未回收对象占用的字节数
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// watchMemory 定期采样堆内存，增长超过 limit 时中断脚本
+func watchMemory(rt *goja.Runtime, limit int64, done <-chan struct{}) {
+	sample := []metrics.Sample{{Name: heapMetric}}
+	metrics.Read(sample)
+	base := sample[0].Value.Uint64()
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			metrics.Read(sample)
+			if used := sample[0].Value.Uint64(); used > base && int64(used-base) > limit {
+				rt.Interrupt(fmt.Sprintf("memory limit of %d bytes exceeded", limit))
+				return
+			}
+		}
+	}
+}
+
+func (s *Script) decode(payload []byte) (any, error) {
+	if s.codec == nil {
+		if !utf8.Valid(payload) {
+			return nil, errors.New("payload is not valid utf-8 text")
+		}
+		return string(payload), nil
+	}
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	return s.codec.Decode(payload)
+}
+
+func (s *Script) encode(v any) ([]byte, error) {
+	if s.codec == nil {
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("payload must be a string, got %T", v)
+		}
+		return []byte(str), nil
+	}
+	return s.codec.Encode(v)
+}
+
+// toJS 将通用值转为原生 JS 值，脚本中的对象与数组可以正常增删元素
+func toJS(rt *goja.Runtime, v any) goja.Value {
+	switch x := v.(type) {
+	case map[string]any:
+		obj := rt.NewObject()
+		for k, e := range x {
+			obj.Set(k, toJS(rt, e))
+		}
+		return obj
+	case []any:
+		items := make([]any, len(x))
+		for i, e := range x {
+			items[i] = toJS(rt, e)
+		}
+		return rt.NewArray(items...)
+	}
+	return rt.ToValue(v)
+}
+
+// result 将脚本返回值转为消息
+func (s *Script) result(in *Message, v goja.Value) (*Message, error) {
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+		return nil, ErrDropped
+	}
+	exported := v.Export()
+	if exported == false {
+		return nil, ErrDropped
+	}
+	obj, ok := exported.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("script %s: %s must return an object or null", s.name, transformFunc)
+	}
+
+	out := &Message{Topic: in.Topic, Source: in.Source, Headers: in.Headers, Payload: in.Payload}
+	if topic, ok := obj["topic"]; ok {
+		if out.Topic, ok = topic.(string); !ok {
+			return nil, fmt.Errorf("script %s: topic must be a string", s.name)
+		}
+	}
+	if headers, ok := obj["headers"]; ok && headers != nil {
+		m, ok := headers.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("script %s: headers must be an object", s.name)
+		}
+		out.Headers = make(map[string]string, len(m))
+		for k, val := range m {
+			out.Headers[k] = fmt.Sprint(val)
+		}
+	}
+	if payload, ok := obj["payload"]; ok {
+		b, err := s.encode(payload)
+		if err != nil {
+			return nil, fmt.Errorf("script %s: encode payload: %w", s.name, err)
+		}
+		out.Payload = b
+	}
+	return out, nil
+}
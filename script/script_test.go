@@ -0,0 +1,211 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/networkProtocalTrans/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.DefaultLogger = &logger.AppLogger{}
+	os.Exit(m.Run())
+}
+
+func TestNewErrors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "transform.js")
+	os.WriteFile(file, []byte("function transform(msg) { return msg; }"), 0o644)
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"no source", Config{}},
+		{"source and file", Config{Source: "function transform(msg) { return msg; }", File: file}},
+		{"missing file", Config{File: filepath.Join(t.TempDir(), "missing.js")}},
+		{"syntax error", Config{Source: "function transform(msg) {"}},
+		{"no transform", Config{Source: "function other(msg) { return msg; }"}},
+		{"top level error", Config{Source: "throw new Error('boom'); function transform(msg) { return msg; }"}},
+		{"unknown codec", Config{Source: "function transform(msg) { return msg; }", Codec: "yaml"}},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.name, tt.config); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	if _, err := New("file", Config{File: file}); err != nil {
+		t.Fatalf("script file: %v", err)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	in := &Message{Topic: "sensors/a", Source: "mqtt", Headers: map[string]string{"unit": "c"}, Payload: []byte(`{"value":215}`)}
+	tests := []struct {
+		name   string
+		source string
+		codec  string
+		in     *Message
+		want   *Message
+		err    error
+	}{
+		{
+			name:   "modify payload and headers",
+			source: `function transform(msg) { msg.payload.value = msg.payload.value / 10; msg.headers.scaled = "true"; return msg; }`,
+			in:     in,
+			want:   &Message{Topic: "sensors/a", Source: "mqtt", Headers: map[string]string{"unit": "c", "scaled": "true"}, Payload: []byte(`{"value":21.5}`)},
+		},
+		{
+			name:   "new object keeps unset fields",
+			source: `function transform(msg) { return {topic: "sensors/" + msg.source}; }`,
+			in:     in,
+			want:   &Message{Topic: "sensors/mqtt", Source: "mqtt", Headers: in.Headers, Payload: in.Payload},
+		},
+		{
+			name:   "text codec",
+			source: `function transform(msg) { msg.payload = msg.payload.toUpperCase(); return msg; }`,
+			codec:  CodecText,
+			in:     &Message{Topic: "a", Payload: []byte("on")},
+			want:   &Message{Topic: "a", Headers: map[string]string{}, Payload: []byte("ON")},
+		},
+		{
+			name:   "msgpack codec",
+			source: `function transform(msg) { msg.payload.a += 1; return msg; }`,
+			codec:  "msgpack",
+			in:     &Message{Topic: "a", Payload: []byte{0x81, 0xa1, 'a', 0x01}},
+			want:   &Message{Topic: "a", Headers: map[string]string{}, Payload: []byte{0x81, 0xa1, 'a', 0x02}},
+		},
+		{name: "drop with null", source: `function transform(msg) { return null; }`, in: in, err: ErrDropped},
+		{name: "drop with false", source: `function transform(msg) { return false; }`, in: in, err: ErrDropped},
+		{name: "drop with undefined", source: `function transform(msg) {}`, in: in, err: ErrDropped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(tt.name, Config{Source: tt.source, Codec: tt.codec})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.Run(tt.in)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		codec  string
+		in     *Message
+	}{
+		{"throws", `function transform(msg) { throw new Error("bad"); }`, "", &Message{Payload: []byte("1")}},
+		{"returns a string", `function transform(msg) { return "a"; }`, "", &Message{Payload: []byte("1")}},
+		{"topic not a string", `function transform(msg) { msg.topic = 1; return msg; }`, "", &Message{Payload: []byte("1")}},
+		{"headers not an object", `function transform(msg) { msg.headers = 1; return msg; }`, "", &Message{Payload: []byte("1")}},
+		{"invalid json payload", `function transform(msg) { return msg; }`, "", &Message{Payload: []byte("{")}},
+		{"invalid text payload", `function transform(msg) { return msg; }`, CodecText, &Message{Payload: []byte{0xff}}},
+		{"text payload not a string", `function transform(msg) { msg.payload = 1; return msg; }`, CodecText, &Message{Payload: []byte("a")}},
+		{"call stack", `function f(n) { return f(n + 1); } function transform(msg) { f(0); return msg; }`, "", &Message{Payload: []byte("1")}},
+	}
+	for _, tt := range tests {
+		s, err := New(tt.name, Config{Source: tt.source, Codec: tt.codec})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if out, err := s.Run(tt.in); err == nil || errors.Is(err, ErrDropped) {
+			t.Errorf("%s: got %+v, %v, want an error", tt.name, out, err)
+		}
+	}
+}
+
+func TestTimeoutDiscardsRuntime(t *testing.T) {
+	s, err := New("timeout", Config{Source: `
+var calls = 0;
+function transform(msg) {
+	calls++;
+	if (msg.payload.loop) { while (true) {} }
+	msg.payload.calls = calls;
+	return msg;
+}`, Timeout: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 顶层状态随运行时复用
+	for want := 1; want <= 2; want++ {
+		out, err := s.Run(&Message{Payload: []byte(`{}`)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(out.Payload); got != fmt.Sprintf(`{"calls":%d}`, want) {
+			t.Fatalf("run %d payload = %s", want, got)
+		}
+	}
+
+	if _, err := s.Run(&Message{Payload: []byte(`{"loop":true}`)}); err == nil || !strings.Contains(err.Error(), "timeout after 20ms") {
+		t.Fatalf("endless loop: err = %v, want a timeout", err)
+	}
+	// 被中断的运行时被丢弃，之后的执行使用新的运行时
+	out, err := s.Run(&Message{Payload: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out.Payload) != `{"calls":1}` {
+		t.Fatalf("payload after timeout = %s, want a fresh runtime", out.Payload)
+	}
+}
+
+func TestTimerDoesNotInterruptPooledRuntime(t *testing.T) {
+	// 执行时间接近超时的脚本，计时器在执行结束前后触发，放回池中的运行时不能带着中断标志
+	s, err := New("deadline", Config{Source: `
+function transform(msg) {
+	var end = Date.now() + msg.payload.ms;
+	while (Date.now() < end) {}
+	return msg;
+}`, Timeout: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		s.Run(&Message{Payload: []byte(`{"ms":2}`)})
+		if _, err := s.Run(&Message{Payload: []byte(`{"ms":0}`)}); err != nil {
+			t.Fatalf("run %d: fast script failed after a slow one: %v", i, err)
+		}
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	s, err := New("memory", Config{Source: `
+function transform(msg) {
+	var chunks = [];
+	while (true) { chunks.push(new Array(4096).fill(msg.payload)); }
+}`, Timeout: 5000, MaxMemory: 8 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Run(&Message{Payload: []byte("1")}); err == nil || !strings.Contains(err.Error(), "memory limit") {
+		t.Fatalf("err = %v, want the memory limit", err)
+	}
+}
+
+func TestCompileCache(t *testing.T) {
+	source := "function transform(msg) { return msg; }"
+	a, err := New("a", Config{Source: source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New("b", Config{Source: source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.program != b.program {
+		t.Fatal("same source compiled twice")
+	}
+}
@@ -0,0 +1,270 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/codec"
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/logger"
+	"github.com/networkProtocalTrans/script"
+	"github.com/networkProtocalTrans/util"
+	"github.com/networkProtocalTrans/validation"
+)
+
+// BridgeConfig MQTT 主题与 websocket 路径的映射
+type BridgeConfig struct {
+	// 桥接的 MQTT servicer 名称，为空时使用默认 MQTT servicer
+	MQTT string `toml:"mqtt"`
+	// 订阅的 MQTT 主题过滤器，匹配的消息转发给 Path 上的客户端，为空则不转发
+	Topic string `toml:"topic"`
+	// websocket 连接路径
+	Path string `toml:"path"`
+	// Path 上收到的消息发布到的 MQTT 主题，为空则不发布。
+	// 可包含 {cn} 占位符，替换为客户端证书 CN，未出示证书的连接不转发
+	PublishTopic string `toml:"publish_topic"`
+	QoS          byte   `toml:"qos"`
+	Retain       bool   `toml:"retain"`
+	// MQTT 侧与 websocket 侧的负载编码（json、msgpack、cbor、xml、protobuf:<消息全名>），
+	// 需同时配置，转发时由一侧编码转为另一侧编码；都为空时原样转发
+	MQTTCodec      string `toml:"mqtt_codec"`
+	WebsocketCodec string `toml:"websocket_codec"`
+	// 对 MQTT 侧消息执行的脚本：MQTT 到 websocket 方向在编码转换前执行，websocket 到 MQTT 方向在编码转换后执行，
+	// 脚本的 codec 为空时使用 mqtt_codec（未配置时为 json）。脚本可修改发布主题与 headers（MQTT v5 用户属性），
+	// 返回 null 时不转发
+	Script *script.Config `toml:"script"`
+}
+
+// cnPlaceholder publish_topic 中替换为客户端证书 CN 的占位符
+const cnPlaceholder = "{cn}"
+
+// bridge 在内嵌 MQTT broker 与 websocket 服务之间双向转发消息
+type bridge struct {
+	mqtt   *mqttServer
+	ws     *websocketServer
+	rule   BridgeConfig
+	logger *logger.AppLogger
+	// 未配置编码转换时为 nil
+	mqttCodec, wsCodec codec.Codec
+	// 未配置脚本时为 nil
+	script *script.Script
+	// 在 websocket servicer 的 [[bridge]] 中的序号，从 1 开始
+	index int
+}
+
+func NewBridge(log *logger.AppLogger, mqtt *mqttServer, ws *websocketServer, rule BridgeConfig, index int) *bridge {
+	return &bridge{
+		mqtt:   mqtt,
+		ws:     ws,
+		rule:   rule,
+		logger: log,
+		index:  index,
+	}
+}
+
+// Start 建立 MQTT 订阅并注册 websocket 消息处理
+func (b *bridge) Start(ctx context.Context) error {
+	rule := b.rule
+	if rule.MQTTCodec != "" || rule.WebsocketCodec != "" {
+		if rule.MQTTCodec == "" || rule.WebsocketCodec == "" {
+			return fmt.Errorf("bridge %s: mqtt_codec and websocket_codec must be set together", rule.Path)
+		}
+		var err error
+		if b.mqttCodec, err = codec.Get(rule.MQTTCodec); err != nil {
+			return fmt.Errorf("bridge %s: %w", rule.Path, err)
+		}
+		if b.wsCodec, err = codec.Get(rule.WebsocketCodec); err != nil {
+			return fmt.Errorf("bridge %s: %w", rule.Path, err)
+		}
+	}
+	if rule.Script != nil {
+		config := *rule.Script
+		if config.Codec == "" {
+			config.Codec = rule.MQTTCodec
+		}
+		var err error
+		if b.script, err = script.New("bridge "+rule.Path, config); err != nil {
+			return err
+		}
+	}
+	if rule.Topic != "" {
+		if _, err := b.mqtt.Subscribe(rule.Topic, func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+			headers := HeadersOf(pk.Properties.User)
+			if err := b.relayMQTT(pk.TopicName, headers, pk.Payload); err != nil {
+				b.failed(ctx, ServicerTypeMQTT, b.mqtt.Name(), pk.TopicName, headers, pk.Payload, err)
+			}
+		}); err != nil {
+			return err
+		}
+		b.logger.LogInfo(ctx, "bridge mqtt to websocket",
+			"mqtt", b.mqtt.Name(), "topic", rule.Topic,
+			"websocket", b.ws.Name(), "path", rule.Path)
+	}
+
+	if rule.PublishTopic != "" {
+		b.ws.OnMessage(b.forward)
+	}
+	return nil
+}
+
+// relayMQTT 对 MQTT 消息执行脚本与编码转换后广播到 websocket 路径
+func (b *bridge) relayMQTT(topic string, headers map[string]string, payload []byte) error {
+	msg, err := runScript(b.script, &script.Message{
+		Topic:   topic,
+		Source:  "mqtt",
+		Headers: headers,
+		Payload: payload,
+	})
+	if err != nil {
+		return fmt.Errorf("script failed for %s: %w", topic, err)
+	}
+	payload, err = b.transcode(b.mqttCodec, b.wsCodec, msg.Payload)
+	if err != nil {
+		return fmt.Errorf("convert message from %s failed: %w", topic, err)
+	}
+	b.ws.Broadcast(b.rule.Path, FrameType(payload), payload)
+	return nil
+}
+
+// forward 将 websocket 消息发布到对应的 MQTT 主题
+func (b *bridge) forward(ctx context.Context, path string, messageType int, message []byte) {
+	if b.rule.Path != path {
+		return
+	}
+	topic := b.rule.PublishTopic
+	if strings.Contains(topic, cnPlaceholder) {
+		identity := util.ClientIdentityFrom(ctx)
+		if identity == nil || identity.CommonName == "" {
+			b.logger.LogInfo(ctx, "bridge dropped message without client certificate", "path", path, "topic", topic)
+			return
+		}
+		topic = strings.ReplaceAll(topic, cnPlaceholder, identity.CommonName)
+	}
+	// tag 校验动作写入的 headers 作为 MQTT v5 用户属性发布
+	headers := validation.Headers(ctx)
+	if err := b.relayWebsocket(topic, headers, message); err != nil {
+		b.failed(ctx, ServicerTypeWebsocket, b.ws.Name(), path, headers, message, err)
+	}
+}
+
+// relayWebsocket 对 websocket 消息执行编码转换与脚本后发布到 MQTT 主题，发布失败的错误标记为发送阶段
+func (b *bridge) relayWebsocket(topic string, headers map[string]string, message []byte) error {
+	message, err := b.transcode(b.wsCodec, b.mqttCodec, message)
+	if err != nil {
+		return fmt.Errorf("convert message to %s failed: %w", topic, err)
+	}
+	msg, err := runScript(b.script, &script.Message{
+		Topic:   topic,
+		Source:  "websocket",
+		Headers: headers,
+		Payload: message,
+	})
+	if err != nil {
+		return fmt.Errorf("script failed for %s: %w", topic, err)
+	}
+	if len(msg.Headers) == 0 {
+		err = b.mqtt.Publish(msg.Topic, msg.Payload, b.rule.Retain, b.rule.QoS)
+	} else {
+		_, err = b.mqtt.PublishPacket(msg.Topic, msg.Payload, b.rule.Retain, b.rule.QoS, packets.Properties{User: UserProperties(msg.Headers)})
+	}
+	if err != nil {
+		return deliveryFailed(fmt.Errorf("publish to %s failed: %w", msg.Topic, err))
+	}
+	return nil
+}
+
+// redriveWebsocket 重新发布 websocket 消息，发布主题依赖客户端证书时无法重新投递
+func (b *bridge) redriveWebsocket(headers map[string]string, message []byte) error {
+	if strings.Contains(b.rule.PublishTopic, cnPlaceholder) {
+		return fmt.Errorf("publish_topic %s depends on the client certificate", b.rule.PublishTopic)
+	}
+	return b.relayWebsocket(b.rule.PublishTopic, headers, message)
+}
+
+// destination 死信中的桥接标识 bridge:<websocket servicer>:<序号>
+func (b *bridge) destination() string {
+	return fmt.Sprintf("bridge:%s:%d", b.ws.Name(), b.index)
+}
+
+// failed 记录转发失败并产生死信，脚本丢弃的消息不记录
+func (b *bridge) failed(ctx context.Context, source, servicer, topic string, headers map[string]string, payload []byte, err error) {
+	if errors.Is(err, script.ErrDropped) {
+		return
+	}
+	b.logger.LogErrorf(ctx, "bridge %s: %v", b.rule.Path, err)
+	deadletter.Publish(ctx, &deadletter.Letter{
+		Stage:       stageOf(err),
+		Error:       err.Error(),
+		Source:      source,
+		Servicer:    servicer,
+		Topic:       topic,
+		Destination: b.destination(),
+		Headers:     headers,
+		Payload:     payload,
+	})
+}
+
+// runScript 执行脚本，s 为 nil 时原样返回
+func runScript(s *script.Script, msg *script.Message) (*script.Message, error) {
+	if s == nil {
+		return msg, nil
+	}
+	return s.Run(msg)
+}
+
+// ignoreDropped 脚本丢弃消息不视为失败
+func ignoreDropped(err error) error {
+	if errors.Is(err, script.ErrDropped) {
+		return nil
+	}
+	return err
+}
+
+// HeadersOf 将 MQTT v5 用户属性转为 headers，同名属性保留最后一个
+func HeadersOf(props []packets.UserProperty) map[string]string {
+	if len(props) == 0 {
+		return nil
+	}
+	headers := make(map[string]string, len(props))
+	for _, p := range props {
+		headers[p.Key] = p.Val
+	}
+	return headers
+}
+
+// UserProperties 将 headers 按名称排序转为 MQTT v5 用户属性
+func UserProperties(headers map[string]string) []packets.UserProperty {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	props := make([]packets.UserProperty, 0, len(keys))
+	for _, k := range keys {
+		props = append(props, packets.UserProperty{Key: k, Val: headers[k]})
+	}
+	return props
+}
+
+// transcode 按桥接配置转换负载编码，未配置时原样返回
+func (b *bridge) transcode(src, dst codec.Codec, payload []byte) ([]byte, error) {
+	if src == nil {
+		return payload, nil
+	}
+	return codec.Transcode(src, dst, payload)
+}
+
+// FrameType 根据负载内容选择 websocket 帧类型
+func FrameType(payload []byte) int {
+	if utf8.Valid(payload) {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// CoAP 报文类型（RFC 7252 3）
+const (
+	coapConfirmable     uint8 = 0
+	coapNonConfirmable  uint8 = 1
+	coapAcknowledgement uint8 = 2
+	coapReset           uint8 = 3
+)
+
+// CoAP 方法与响应码，取值为 class<<5 | detail
+const (
+	coapEmpty  uint8 = 0
+	coapGET    uint8 = 1
+	coapPOST   uint8 = 2
+	coapPUT    uint8 = 3
+	coapDELETE uint8 = 4
+
+	coapDeleted               uint8 = 2<<5 | 2
+	coapChanged               uint8 = 2<<5 | 4
+	coapContent               uint8 = 2<<5 | 5
+	coapBadRequest            uint8 = 4<<5 | 0
+	coapNotFound              uint8 = 4<<5 | 4
+	coapMethodNotAllowed      uint8 = 4<<5 | 5
+	coapRequestEntityTooLarge uint8 = 4<<5 | 13
+	coapInternalServerError   uint8 = 5<<5 | 0
+	coapServiceUnavailable    uint8 = 5<<5 | 3
+)
+
+// CoAP 选项编号
+const (
+	coapOptionObserve       uint16 = 6
+	coapOptionURIPath       uint16 = 11
+	coapOptionContentFormat uint16 = 12
+)
+
+// Content-Format 取值
+const (
+	coapFormatText        = 0
+	coapFormatOctetStream = 42
+	coapFormatJSON        = 50
+)
+
+const coapPayloadMarker = 0xff
+
+var errCoapMessage = errors.New("malformed coap message")
+
+type coapOption struct {
+	Number uint16
+	Value  []byte
+}
+
+// coapMessage CoAP 报文
+type coapMessage struct {
+	Type      uint8
+	Code      uint8
+	MessageID uint16
+	Token     []byte
+	Options   []coapOption
+	Payload   []byte
+}
+
+// isRequest 报文是否为请求（code class 0 且不为空报文）
+func (m *coapMessage) isRequest() bool {
+	return m.Code != coapEmpty && m.Code>>5 == 0
+}
+
+// option 返回第一个编号为 number 的选项
+func (m *coapMessage) option(number uint16) ([]byte, bool) {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return o.Value, true
+		}
+	}
+	return nil, false
+}
+
+// path 将 Uri-Path 选项拼接为以 / 分隔的路径
+func (m *coapMessage) path() string {
+	var segments []string
+	for _, o := range m.Options {
+		if o.Number == coapOptionURIPath {
+			segments = append(segments, string(o.Value))
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func (m *coapMessage) addUint(number uint16, v uint32) {
+	m.Options = append(m.Options, coapOption{Number: number, Value: encodeCoapUint(v)})
+}
+
+// encodeCoapUint 按 RFC 7252 3.2 以最短字节编码无符号整数
+func encodeCoapUint(v uint32) []byte {
+	switch {
+	case v == 0:
+		return nil
+	case v < 1<<8:
+		return []byte{byte(v)}
+	case v < 1<<16:
+		return []byte{byte(v >> 8), byte(v)}
+	case v < 1<<24:
+		return []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+	return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+func decodeCoapUint(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+// parseCoapMessage 解析 UDP 数据报中的 CoAP 报文
+func parseCoapMessage(data []byte) (*coapMessage, error) {
+	if len(data) < 4 || data[0]>>6 != 1 {
+		return nil, errCoapMessage
+	}
+	tkl := int(data[0] & 0x0f)
+	if tkl > 8 || len(data) < 4+tkl {
+		return nil, errCoapMessage
+	}
+	m := &coapMessage{
+		Type:      data[0] >> 4 & 0x03,
+		Code:      data[1],
+		MessageID: binary.BigEndian.Uint16(data[2:4]),
+		Token:     append([]byte(nil), data[4:4+tkl]...),
+	}
+
+	b := data[4+tkl:]
+	number := 0
+	for len(b) > 0 {
+		if b[0] == coapPayloadMarker {
+			if len(b) == 1 {
+				return nil, errCoapMessage
+			}
+			m.Payload = append([]byte(nil), b[1:]...)
+			break
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0x0f)
+		b = b[1:]
+		var err error
+		if delta, b, err = extendCoapNibble(delta, b); err != nil {
+			return nil, err
+		}
+		if length, b, err = extendCoapNibble(length, b); err != nil {
+			return nil, err
+		}
+		if len(b) < length {
+			return nil, errCoapMessage
+		}
+		number += delta
+		if number > 0xffff {
+			return nil, errCoapMessage
+		}
+		m.Options = append(m.Options, coapOption{Number: uint16(number), Value: append([]byte(nil), b[:length]...)})
+		b = b[length:]
+	}
+	return m, nil
+}
+
+// extendCoapNibble 处理选项 delta/length 的扩展字节
+func extendCoapNibble(v int, b []byte) (int, []byte, error) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, errCoapMessage
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, errCoapMessage
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case 15:
+		return 0, nil, errCoapMessage
+	}
+	return v, b, nil
+}
+
+// marshal 编码报文，选项按编号排序
+func (m *coapMessage) marshal() []byte {
+	buf := make([]byte, 4, 4+len(m.Token)+len(m.Payload)+16)
+	buf[0] = 1<<6 | m.Type<<4 | uint8(len(m.Token))
+	buf[1] = m.Code
+	binary.BigEndian.PutUint16(buf[2:4], m.MessageID)
+	buf = append(buf, m.Token...)
+
+	options := append([]coapOption(nil), m.Options...)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].Number < options[j].Number })
+	prev := 0
+	for _, o := range options {
+		delta, dext := splitCoapNibble(int(o.Number) - prev)
+		length, lext := splitCoapNibble(len(o.Value))
+		buf = append(buf, byte(delta<<4|length))
+		buf = append(buf, dext...)
+		buf = append(buf, lext...)
+		buf = append(buf, o.Value...)
+		prev = int(o.Number)
+	}
+	if len(m.Payload) > 0 {
+		buf = append(buf, coapPayloadMarker)
+		buf = append(buf, m.Payload...)
+	}
+	return buf
+}
+
+// splitCoapNibble 将 delta/length 拆分为 4 位值与扩展字节
+func splitCoapNibble(v int) (int, []byte) {
+	switch {
+	case v < 13:
+		return v, nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	}
+	ext := make([]byte, 2)
+	binary.BigEndian.PutUint16(ext, uint16(v-269))
+	return 14, ext
+}
@@ -0,0 +1,612 @@
+package services
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/logger"
+)
+
+const (
+	// RFC 7252 4.6 建议的最大报文大小
+	defaultCoapMessageSize = 1152
+	// 重复 CON 请求的去重时间，RFC 7252 EXCHANGE_LIFETIME
+	coapExchangeLifetime = 247 * time.Second
+	// Observe 序号为 24 位
+	coapObserveMask = 1<<24 - 1
+	// CON 通知的首次重传超时与最大重传次数，RFC 7252 ACK_TIMEOUT 与 MAX_RETRANSMIT
+	coapAckTimeout    = 2 * time.Second
+	coapMaxRetransmit = 4
+	// 默认每 24 小时以 CON 通知确认观察者仍然存在，RFC 7641 4.5 的上限
+	defaultCoapObserveConfirm = 86400
+)
+
+// CoAPConfig CoAP servicer 配置
+type CoAPConfig struct {
+	Type   string           `toml:"type"`
+	Server ServerConfig     `toml:"server"`
+	CoAP   CoAPConfigDetail `toml:"coap"`
+}
+
+type CoAPConfigDetail struct {
+	// 映射的 MQTT servicer 名称，为空时使用默认 MQTT servicer
+	MQTT string `toml:"mqtt"`
+	// 资源路径映射为 MQTT 主题时添加的前缀
+	TopicPrefix string `toml:"topic_prefix"`
+	// PUT/POST 发布消息的 QoS
+	QoS byte `toml:"qos"`
+	// 最大报文大小（字节），默认 1152
+	MaxMessageSize int `toml:"max_message_size"`
+	// 最大观察者数量，0 表示不限制
+	MaxObservers int `toml:"max_observers"`
+	// 以 CON 发送通知的间隔（秒），客户端重传后仍未确认或以 RST 回复时取消观察，默认 86400
+	ObserveConfirm int `toml:"observe_confirm"`
+}
+
+func init() {
+	RegisterServicerType(ServicerTypeCoAP, func(ctx context.Context, log *logger.AppLogger, configPath string) (Servicer, error) {
+		return NewCoapServer(ctx, log, configPath)
+	})
+}
+
+// coapObserver 一个 Observe 注册，对应一个 MQTT 内联订阅
+type coapObserver struct {
+	key    string
+	addr   net.Addr
+	token  []byte
+	filter string
+	subID  int
+	seq    uint32
+	// 最近一次通知的报文 ID，客户端以 RST 回复时取消观察
+	lastMID uint16
+	// 最近一次发送 CON 通知（或注册）的时间
+	confirmed time.Time
+	// 等待 ACK 的 CON 通知，没有时为 nil
+	pending *coapPending
+}
+
+// coapPending 等待客户端确认的 CON 通知
+type coapPending struct {
+	messageID uint16
+	data      []byte
+	// 已重传次数
+	retransmits int
+	timer       *time.Timer
+}
+
+// coapExchange 已处理的 CON 请求，重传时直接返回缓存的响应
+type coapExchange struct {
+	response []byte
+	expires  time.Time
+}
+
+// coapServer 将 CoAP 资源映射为 MQTT 主题：PUT/POST 发布，GET 读取保留消息，
+// DELETE 清除保留消息，Observe 订阅主题
+type coapServer struct {
+	logger *logger.AppLogger
+	config *CoAPConfig
+	mqtt   *mqttServer
+
+	// CON 通知的首次重传超时与最大重传次数
+	ackTimeout    time.Duration
+	maxRetransmit int
+
+	mu        sync.Mutex
+	conn      net.PacketConn
+	messageID uint16
+	observers map[string]*coapObserver
+	exchanges map[string]coapExchange
+}
+
+// NewCoapServer 根据配置文件创建 CoAP servicer 实例
+func NewCoapServer(ctx context.Context, log *logger.AppLogger, configPath string) (*coapServer, error) {
+	var config CoAPConfig
+	if _, err := toml.DecodeFile(configPath, &config); err != nil {
+		return nil, fmt.Errorf("load coap config %s: %w", configPath, err)
+	}
+	if config.Server.Address == "" {
+		return nil, fmt.Errorf("invalid coap config %s: server.address is required", configPath)
+	}
+	if config.CoAP.QoS > 2 {
+		return nil, fmt.Errorf("invalid coap config %s: coap.qos = %d is out of range [0, 2]", configPath, config.CoAP.QoS)
+	}
+	if config.CoAP.MaxMessageSize <= 0 {
+		config.CoAP.MaxMessageSize = defaultCoapMessageSize
+	}
+	if config.CoAP.ObserveConfirm <= 0 {
+		config.CoAP.ObserveConfirm = defaultCoapObserveConfirm
+	}
+	return &coapServer{
+		logger:        log,
+		config:        &config,
+		ackTimeout:    coapAckTimeout,
+		maxRetransmit: coapMaxRetransmit,
+		messageID:     uint16(time.Now().UnixNano()),
+		observers:     make(map[string]*coapObserver),
+		exchanges:     make(map[string]coapExchange),
+	}, nil
+}
+
+// LinkMQTT 设置资源映射的 MQTT servicer，需在 Start 之前调用
+func (c *coapServer) LinkMQTT(m *mqttServer) {
+	c.mqtt = m
+}
+
+// Name 返回 servicer 名称
+func (c *coapServer) Name() string {
+	return c.config.Server.Name
+}
+
+// Start 监听 UDP 并处理请求，阻塞直到 ctx 取消或 Stop 被调用
+func (c *coapServer) Start(ctx context.Context) error {
+	if c.mqtt == nil {
+		return errors.New("coap servicer requires a mqtt servicer")
+	}
+	conn, err := net.ListenPacket("udp", c.config.Server.Address)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	defer c.close(conn)
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	confirmCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go c.confirmLoop(confirmCtx)
+
+	c.logger.LogInfo(ctx, "Starting CoAP server",
+		"name", c.config.Server.Name,
+		"address", c.config.Server.Address,
+		"mqtt", c.mqtt.Name(),
+	)
+	buf := make([]byte, c.config.CoAP.MaxMessageSize+1)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		c.handlePacket(ctx, addr, buf[:n])
+	}
+}
+
+// close 取消所有观察并释放连接
+func (c *coapServer) close(conn net.PacketConn) {
+	conn.Close()
+	c.mu.Lock()
+	observers := c.observers
+	c.observers = make(map[string]*coapObserver)
+	c.exchanges = make(map[string]coapExchange)
+	if c.conn == conn {
+		c.conn = nil
+	}
+	for _, o := range observers {
+		o.stopPending()
+	}
+	c.mu.Unlock()
+	for _, o := range observers {
+		c.mqtt.Unsubscribe(o.filter, o.subID)
+	}
+}
+
+// Stop 关闭监听
+func (c *coapServer) Stop(ctx context.Context) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// Health 服务运行中时返回 nil
+func (c *coapServer) Health() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return ErrServicerNotRunning
+	}
+	return nil
+}
+
+func (c *coapServer) handlePacket(ctx context.Context, addr net.Addr, data []byte) {
+	confirmable := len(data) >= 4 && data[0]>>6 == 1 && data[0]>>4&0x03 == coapConfirmable
+	if len(data) > c.config.CoAP.MaxMessageSize {
+		if confirmable {
+			c.send(addr, &coapMessage{Type: coapAcknowledgement, Code: coapRequestEntityTooLarge, MessageID: binary.BigEndian.Uint16(data[2:4])})
+		}
+		return
+	}
+	req, err := parseCoapMessage(data)
+	if err != nil {
+		// 无法解析的 CON 报文以 RST 回复（RFC 7252 4.2），其余静默丢弃
+		if confirmable {
+			c.send(addr, &coapMessage{Type: coapReset, MessageID: binary.BigEndian.Uint16(data[2:4])})
+		}
+		return
+	}
+
+	switch {
+	case req.Type == coapReset:
+		c.cancelByReset(addr, req.MessageID)
+		return
+	case req.Type == coapAcknowledgement:
+		c.acknowledge(addr, req.MessageID)
+		return
+	case req.Code == coapEmpty:
+		// CoAP ping
+		if req.Type == coapConfirmable {
+			c.send(addr, &coapMessage{Type: coapReset, MessageID: req.MessageID})
+		}
+		return
+	case !req.isRequest():
+		return
+	}
+
+	key := addr.String() + "#" + fmt.Sprint(req.MessageID)
+	if req.Type == coapConfirmable {
+		c.mu.Lock()
+		ex, ok := c.exchanges[key]
+		c.mu.Unlock()
+		if ok && time.Now().Before(ex.expires) {
+			c.write(addr, ex.response)
+			return
+		}
+	}
+
+	resp := c.handleRequest(ctx, addr, req)
+	resp.Token = req.Token
+	if req.Type == coapConfirmable {
+		resp.Type, resp.MessageID = coapAcknowledgement, req.MessageID
+	} else {
+		resp.Type, resp.MessageID = coapNonConfirmable, c.nextMessageID()
+	}
+	data = resp.marshal()
+	if req.Type == coapConfirmable {
+		c.remember(key, data)
+	}
+	c.write(addr, data)
+}
+
+// remember 缓存 CON 请求的响应并清理过期记录
+func (c *coapServer) remember(key string, response []byte) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, ex := range c.exchanges {
+		if now.After(ex.expires) {
+			delete(c.exchanges, k)
+		}
+	}
+	c.exchanges[key] = coapExchange{response: response, expires: now.Add(coapExchangeLifetime)}
+}
+
+// handleRequest 将请求映射为 MQTT 操作并返回响应（不含类型、报文 ID 与 token）
+func (c *coapServer) handleRequest(ctx context.Context, addr net.Addr, req *coapMessage) *coapMessage {
+	topic := c.config.CoAP.TopicPrefix + req.path()
+
+	switch req.Code {
+	case coapPUT, coapPOST:
+		if !server.IsValidFilter(topic, true) || topic == "" {
+			return &coapMessage{Code: coapBadRequest, Payload: []byte("invalid topic")}
+		}
+		// PUT 设置资源状态，作为保留消息发布
+		if err := c.mqtt.Publish(topic, req.Payload, req.Code == coapPUT, c.config.CoAP.QoS); err != nil {
+			return c.errorResponse(ctx, err)
+		}
+		return &coapMessage{Code: coapChanged}
+
+	case coapDELETE:
+		if !server.IsValidFilter(topic, true) || topic == "" {
+			return &coapMessage{Code: coapBadRequest, Payload: []byte("invalid topic")}
+		}
+		// 发布空的保留消息以清除保留消息
+		if err := c.mqtt.Publish(topic, nil, true, c.config.CoAP.QoS); err != nil {
+			return c.errorResponse(ctx, err)
+		}
+		return &coapMessage{Code: coapDeleted}
+
+	case coapGET:
+		if !server.IsValidFilter(topic, false) {
+			return &coapMessage{Code: coapBadRequest, Payload: []byte("invalid topic filter")}
+		}
+		if v, ok := req.option(coapOptionObserve); ok {
+			switch decodeCoapUint(v) {
+			case 0:
+				return c.observe(ctx, addr, req.Token, topic)
+			case 1:
+				c.cancel(observerKey(addr, req.Token))
+			}
+		}
+		resp, ok := c.representation(topic)
+		if !ok {
+			return &coapMessage{Code: coapNotFound}
+		}
+		return resp
+	}
+	return &coapMessage{Code: coapMethodNotAllowed}
+}
+
+// isCoapWildcard 路径映射的主题过滤器是否含通配符
+func isCoapWildcard(filter string) bool {
+	return strings.ContainsAny(filter, "+#")
+}
+
+// representation 资源的当前表示：主题的保留消息，不存在时返回 false；
+// 含通配符的过滤器为所有匹配的保留消息组成的 JSON 数组，元素与 websocket 频道消息格式相同，带有各自的主题
+func (c *coapServer) representation(filter string) (*coapMessage, bool) {
+	if !isCoapWildcard(filter) {
+		payload, ok := c.mqtt.Retained(filter)
+		if !ok {
+			return nil, false
+		}
+		return contentResponse(payload), true
+	}
+	items := []json.RawMessage{}
+	for _, pk := range c.mqtt.RetainedMessages(filter) {
+		if item, err := encodeChannelMessage(pk.TopicName, pk.Payload); err == nil {
+			items = append(items, item)
+		}
+	}
+	payload, _ := json.Marshal(items)
+	return contentResponse(payload), true
+}
+
+// notification 匹配观察者过滤器的消息对应的通知，含通配符的过滤器以频道消息格式带上主题
+func notification(filter string, pk packets.Packet) *coapMessage {
+	if !isCoapWildcard(filter) {
+		return contentResponse(pk.Payload)
+	}
+	payload, err := encodeChannelMessage(pk.TopicName, pk.Payload)
+	if err != nil {
+		return contentResponse(pk.Payload)
+	}
+	return contentResponse(payload)
+}
+
+func (c *coapServer) errorResponse(ctx context.Context, err error) *coapMessage {
+	if errors.Is(err, ErrServicerNotRunning) {
+		return &coapMessage{Code: coapServiceUnavailable}
+	}
+	c.logger.LogErrorf(ctx, "coap request failed: %v", err)
+	return &coapMessage{Code: coapInternalServerError}
+}
+
+func observerKey(addr net.Addr, token []byte) string {
+	return addr.String() + "#" + string(token)
+}
+
+// observe 注册观察者：订阅主题过滤器，匹配的消息作为通知发送。响应中携带当前保留消息
+func (c *coapServer) observe(ctx context.Context, addr net.Addr, token []byte, filter string) *coapMessage {
+	key := observerKey(addr, token)
+	c.mu.Lock()
+	o, exists := c.observers[key]
+	full := !exists && c.config.CoAP.MaxObservers > 0 && len(c.observers) >= c.config.CoAP.MaxObservers
+	c.mu.Unlock()
+
+	if exists && o.filter != filter {
+		c.cancel(key)
+		exists = false
+	}
+	if full {
+		return &coapMessage{Code: coapServiceUnavailable, Payload: []byte("too many observers")}
+	}
+	if !exists {
+		o = &coapObserver{key: key, addr: addr, token: token, filter: filter, confirmed: time.Now()}
+		id, err := c.mqtt.Subscribe(filter, func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+			c.notify(o, notification(filter, pk))
+		})
+		if err != nil {
+			return c.errorResponse(ctx, err)
+		}
+		o.subID = id
+		c.mu.Lock()
+		c.observers[key] = o
+		c.mu.Unlock()
+		c.logger.LogInfo(ctx, "coap observer registered", "remote", addr.String(), "topic", filter)
+	}
+
+	resp, ok := c.representation(filter)
+	if !ok {
+		resp = &coapMessage{Code: coapContent}
+	}
+	c.mu.Lock()
+	o.seq = (o.seq + 1) & coapObserveMask
+	resp.addUint(coapOptionObserve, o.seq)
+	c.mu.Unlock()
+	return resp
+}
+
+// notify 向观察者发送通知。距上次 CON 通知超过 observe_confirm 且没有等待确认的通知时以 CON 发送，
+// 按 RFC 7252 4.2 指数退避重传，重传 max_retransmit 次仍未确认时取消观察（RFC 7641 4.5），其余以 NON 发送
+func (c *coapServer) notify(o *coapObserver, msg *coapMessage) {
+	msg.Type = coapNonConfirmable
+	msg.Token = o.token
+	msg.MessageID = c.nextMessageID()
+
+	c.mu.Lock()
+	if c.observers[o.key] != o {
+		c.mu.Unlock()
+		return
+	}
+	o.seq = (o.seq + 1) & coapObserveMask
+	o.lastMID = msg.MessageID
+	msg.addUint(coapOptionObserve, o.seq)
+	confirm := o.pending == nil && time.Since(o.confirmed) >= c.confirmInterval()
+	if confirm {
+		msg.Type = coapConfirmable
+	}
+	data := msg.marshal()
+	if confirm {
+		p := &coapPending{messageID: msg.MessageID, data: data}
+		p.timer = time.AfterFunc(c.ackTimeout, func() { c.retransmit(o, p) })
+		o.pending, o.confirmed = p, time.Now()
+	}
+	c.mu.Unlock()
+
+	c.write(o.addr, data)
+}
+
+func (c *coapServer) confirmInterval() time.Duration {
+	return time.Duration(c.config.CoAP.ObserveConfirm) * time.Second
+}
+
+// retransmit 重传未确认的 CON 通知，超过重传次数后取消观察
+func (c *coapServer) retransmit(o *coapObserver, p *coapPending) {
+	c.mu.Lock()
+	if c.observers[o.key] != o || o.pending != p {
+		c.mu.Unlock()
+		return
+	}
+	if p.retransmits >= c.maxRetransmit {
+		c.mu.Unlock()
+		c.logger.LogInfo(context.Background(), "coap observer dropped: notification not acknowledged",
+			"remote", o.addr.String(), "topic", o.filter)
+		c.cancel(o.key)
+		return
+	}
+	p.retransmits++
+	p.timer = time.AfterFunc(c.ackTimeout<<p.retransmits, func() { c.retransmit(o, p) })
+	c.mu.Unlock()
+
+	c.write(o.addr, p.data)
+}
+
+// acknowledge 客户端确认 CON 通知
+func (c *coapServer) acknowledge(addr net.Addr, messageID uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, o := range c.observers {
+		if o.pending != nil && o.pending.messageID == messageID && o.addr.String() == addr.String() {
+			o.stopPending()
+			return
+		}
+	}
+}
+
+// confirmLoop 定期以 CON 通知发送资源的当前表示，没有消息的观察者也能被确认或取消
+func (c *coapServer) confirmLoop(ctx context.Context) {
+	interval := c.confirmInterval()
+	ticker := time.NewTicker(interval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var due []*coapObserver
+		c.mu.Lock()
+		for _, o := range c.observers {
+			if o.pending == nil && time.Since(o.confirmed) >= interval {
+				due = append(due, o)
+			}
+		}
+		c.mu.Unlock()
+		for _, o := range due {
+			msg, ok := c.representation(o.filter)
+			if !ok {
+				msg = &coapMessage{Code: coapContent}
+			}
+			c.notify(o, msg)
+		}
+	}
+}
+
+// stopPending 停止等待确认，调用方持有 c.mu
+func (o *coapObserver) stopPending() {
+	if o.pending != nil {
+		o.pending.timer.Stop()
+		o.pending = nil
+	}
+}
+
+// cancel 取消观察并取消对应的 MQTT 订阅
+func (c *coapServer) cancel(key string) {
+	c.mu.Lock()
+	o, ok := c.observers[key]
+	delete(c.observers, key)
+	if ok {
+		o.stopPending()
+	}
+	c.mu.Unlock()
+	if ok {
+		c.mqtt.Unsubscribe(o.filter, o.subID)
+	}
+}
+
+// cancelByReset 客户端以 RST 回复通知时取消对应的观察
+func (c *coapServer) cancelByReset(addr net.Addr, messageID uint16) {
+	c.mu.Lock()
+	var key string
+	for k, o := range c.observers {
+		reset := o.lastMID == messageID || (o.pending != nil && o.pending.messageID == messageID)
+		if reset && o.addr.String() == addr.String() {
+			key = k
+			break
+		}
+	}
+	c.mu.Unlock()
+	if key != "" {
+		c.cancel(key)
+	}
+}
+
+func (c *coapServer) nextMessageID() uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messageID++
+	return c.messageID
+}
+
+func (c *coapServer) send(addr net.Addr, msg *coapMessage) {
+	c.write(addr, msg.marshal())
+}
+
+func (c *coapServer) write(addr net.Addr, data []byte) {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	if _, err := conn.WriteTo(data, addr); err != nil {
+		c.logger.LogErrorf(context.Background(), "coap write to %s failed: %v", addr, err)
+	}
+}
+
+// contentResponse 构造 2.05 响应，按负载内容设置 Content-Format
+func contentResponse(payload []byte) *coapMessage {
+	msg := &coapMessage{Code: coapContent, Payload: payload}
+	format := uint32(coapFormatOctetStream)
+	switch {
+	case len(payload) == 0:
+		return msg
+	case json.Valid(payload):
+		format = coapFormatJSON
+	case utf8.Valid(payload):
+		format = coapFormatText
+	}
+	msg.addUint(coapOptionContentFormat, format)
+	return msg
+}
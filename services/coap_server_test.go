@@ -0,0 +1,342 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/logger"
+)
+
+const testCoapConfig = `
+[server]
+name = "coap-test"
+address = "127.0.0.1:0"
+[coap]
+mqtt = "mqtt-test"
+`
+
+// startTestCoap 启动链接到测试 MQTT servicer 的 CoAP servicer，setup 在 Start 之前调整实例
+func startTestCoap(t *testing.T, config string, setup func(c *coapServer)) (*coapServer, *mqttServer) {
+	t.Helper()
+	m := startTestMqtt(t)
+	path := filepath.Join(t.TempDir(), "coap.toml")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCoapServer(context.Background(), &logger.AppLogger{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.LinkMQTT(m)
+	if setup != nil {
+		setup(c)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := c.Start(context.Background()); err != nil {
+			t.Errorf("coap start: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		c.Stop(context.Background())
+		<-done
+	})
+	waitFor(t, func() bool { return c.Health() == nil })
+	return c, m
+}
+
+// coapTestClient 通过 UDP 回环地址与 CoAP servicer 通信
+type coapTestClient struct {
+	t      *testing.T
+	conn   *net.UDPConn
+	server net.Addr
+	mid    uint16
+}
+
+func dialCoap(t *testing.T, c *coapServer) *coapTestClient {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c.mu.Lock()
+	addr := c.conn.LocalAddr()
+	c.mu.Unlock()
+	return &coapTestClient{t: t, conn: conn, server: addr}
+}
+
+// request 构造指向 path 的 CON 请求
+func (cl *coapTestClient) request(code uint8, path string, payload string) *coapMessage {
+	cl.mid++
+	msg := &coapMessage{Type: coapConfirmable, Code: code, MessageID: cl.mid, Token: []byte{byte(cl.mid)}}
+	for _, segment := range strings.Split(path, "/") {
+		msg.Options = append(msg.Options, coapOption{Number: coapOptionURIPath, Value: []byte(segment)})
+	}
+	if payload != "" {
+		msg.Payload = []byte(payload)
+	}
+	return msg
+}
+
+func (cl *coapTestClient) write(data []byte) {
+	cl.t.Helper()
+	if _, err := cl.conn.WriteTo(data, cl.server); err != nil {
+		cl.t.Fatal(err)
+	}
+}
+
+func (cl *coapTestClient) read(timeout time.Duration) (*coapMessage, []byte, error) {
+	cl.conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2048)
+	n, err := cl.conn.Read(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := parseCoapMessage(buf[:n])
+	if err != nil {
+		cl.t.Fatal(err)
+	}
+	return msg, buf[:n], nil
+}
+
+// expect 读取下一个报文并检查类型与响应码
+func (cl *coapTestClient) expect(typ, code uint8) (*coapMessage, []byte) {
+	cl.t.Helper()
+	msg, data, err := cl.read(5 * time.Second)
+	if err != nil {
+		cl.t.Fatal(err)
+	}
+	if msg.Type != typ || msg.Code != code {
+		cl.t.Fatalf("got type %d code %d.%02d, want type %d code %d.%02d",
+			msg.Type, msg.Code>>5, msg.Code&0x1f, typ, code>>5, code&0x1f)
+	}
+	return msg, data
+}
+
+// do 发送 CON 请求并读取 piggybacked 响应
+func (cl *coapTestClient) do(req *coapMessage, code uint8) *coapMessage {
+	cl.t.Helper()
+	cl.write(req.marshal())
+	resp, _ := cl.expect(coapAcknowledgement, code)
+	if resp.MessageID != req.MessageID || string(resp.Token) != string(req.Token) {
+		cl.t.Fatalf("response mid %d token %x, want %d %x", resp.MessageID, resp.Token, req.MessageID, req.Token)
+	}
+	return resp
+}
+
+// observe 注册观察并返回初始响应
+func (cl *coapTestClient) observe(path string) *coapMessage {
+	cl.t.Helper()
+	req := cl.request(coapGET, path, "")
+	req.addUint(coapOptionObserve, 0)
+	resp := cl.do(req, coapContent)
+	if _, ok := resp.option(coapOptionObserve); !ok {
+		cl.t.Fatal("observe response without Observe option")
+	}
+	return resp
+}
+
+// expectSilence 在 d 内没有收到报文
+func (cl *coapTestClient) expectSilence(d time.Duration) {
+	cl.t.Helper()
+	msg, _, err := cl.read(d)
+	var ne net.Error
+	if err == nil {
+		cl.t.Fatalf("unexpected message %+v", msg)
+	} else if !errors.As(err, &ne) || !ne.Timeout() {
+		cl.t.Fatal(err)
+	}
+}
+
+func coapObservers(c *coapServer) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.observers)
+}
+
+// decodeChannelMessages 解析通配符资源返回的频道消息数组
+func decodeChannelMessages(t *testing.T, payload []byte) []ChannelMessage {
+	t.Helper()
+	var msgs []ChannelMessage
+	if err := json.Unmarshal(payload, &msgs); err != nil {
+		t.Fatalf("payload %s: %v", payload, err)
+	}
+	return msgs
+}
+
+func TestCoapGetPutAndDuplicate(t *testing.T) {
+	c, m := startTestCoap(t, testCoapConfig, nil)
+	cl := dialCoap(t, c)
+
+	cl.do(cl.request(coapGET, "devices/a", ""), coapNotFound)
+	cl.do(cl.request(coapPUT, "devices/a", "21.5"), coapChanged)
+	if payload, ok := m.Retained("devices/a"); !ok || string(payload) != "21.5" {
+		t.Fatalf("retained = %q, %v", payload, ok)
+	}
+	if resp := cl.do(cl.request(coapGET, "devices/a", ""), coapContent); string(resp.Payload) != "21.5" {
+		t.Fatalf("GET payload = %q", resp.Payload)
+	}
+
+	var published int32
+	m.Subscribe("devices/b", func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		atomic.AddInt32(&published, 1)
+	})
+	req := cl.request(coapPOST, "devices/b", "1")
+	first := cl.do(req, coapChanged).marshal()
+	// 重复的 CON 报文返回缓存的响应，不再发布
+	cl.write(req.marshal())
+	if _, replay := cl.expect(coapAcknowledgement, coapChanged); string(replay) != string(first) {
+		t.Fatalf("replay = % x, want % x", replay, first)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&published); n != 1 {
+		t.Fatalf("published %d times, want 1", n)
+	}
+}
+
+func TestCoapWildcardGet(t *testing.T) {
+	c, m := startTestCoap(t, testCoapConfig, nil)
+	cl := dialCoap(t, c)
+	m.Publish("devices/b", []byte(`{"v":2}`), true, 0)
+	m.Publish("devices/a", []byte("1"), true, 0)
+	m.Publish("other/a", []byte("3"), true, 0)
+
+	resp := cl.do(cl.request(coapGET, "devices/+", ""), coapContent)
+	if format, _ := resp.option(coapOptionContentFormat); decodeCoapUint(format) != coapFormatJSON {
+		t.Fatalf("content format = %v", format)
+	}
+	msgs := decodeChannelMessages(t, resp.Payload)
+	if len(msgs) != 2 || msgs[0].Channel != "devices/a" || string(msgs[0].Data) != "1" ||
+		msgs[1].Channel != "devices/b" || string(msgs[1].Data) != `{"v":2}` {
+		t.Fatalf("wildcard GET = %s", resp.Payload)
+	}
+	// 没有匹配时返回空数组
+	if resp := cl.do(cl.request(coapGET, "missing/#", ""), coapContent); string(resp.Payload) != "[]" {
+		t.Fatalf("empty wildcard GET = %q", resp.Payload)
+	}
+}
+
+func TestCoapObserveNotifications(t *testing.T) {
+	c, m := startTestCoap(t, testCoapConfig, nil)
+	cl := dialCoap(t, c)
+	m.Publish("devices/a", []byte("0"), true, 0)
+
+	if resp := cl.observe("devices/a"); string(resp.Payload) != "0" {
+		t.Fatalf("initial representation = %q", resp.Payload)
+	}
+	wildcard := cl.observe("devices/#")
+	if msgs := decodeChannelMessages(t, wildcard.Payload); len(msgs) != 1 || msgs[0].Channel != "devices/a" {
+		t.Fatalf("initial wildcard representation = %s", wildcard.Payload)
+	}
+
+	m.Publish("devices/a", []byte("1"), false, 0)
+	got := map[string]string{}
+	var seq []uint32
+	for i := 0; i < 2; i++ {
+		n, _ := cl.expect(coapNonConfirmable, coapContent)
+		v, ok := n.option(coapOptionObserve)
+		if !ok {
+			t.Fatal("notification without Observe option")
+		}
+		seq = append(seq, decodeCoapUint(v))
+		got[string(n.Token)] = string(n.Payload)
+	}
+	if got[string(wildcard.Token)] != `{"action":"message","channel":"devices/a","data":1}` {
+		t.Errorf("wildcard notification = %q", got[string(wildcard.Token)])
+	}
+	delete(got, string(wildcard.Token))
+	for _, payload := range got {
+		if payload != "1" {
+			t.Errorf("notification = %q", payload)
+		}
+	}
+	for _, s := range seq {
+		if s == 0 {
+			t.Errorf("notification sequence %v not greater than the registration", seq)
+		}
+	}
+
+	// 客户端以 RST 回复通知时取消观察
+	m.Publish("devices/a", []byte("2"), false, 0)
+	for i := 0; i < 2; i++ {
+		n, _ := cl.expect(coapNonConfirmable, coapContent)
+		cl.write((&coapMessage{Type: coapReset, MessageID: n.MessageID}).marshal())
+	}
+	waitFor(t, func() bool { return coapObservers(c) == 0 })
+	m.Publish("devices/a", []byte("3"), false, 0)
+	cl.expectSilence(100 * time.Millisecond)
+}
+
+func TestCoapObserveConfirmable(t *testing.T) {
+	c, m := startTestCoap(t, testCoapConfig+"observe_confirm = 1\n", func(c *coapServer) {
+		c.ackTimeout = 20 * time.Millisecond
+		c.maxRetransmit = 2
+	})
+	m.Publish("devices/a", []byte("0"), true, 0)
+
+	// 确认 CON 通知的观察者保留，且不再收到重传
+	acked := dialCoap(t, c)
+	acked.observe("devices/a")
+	n, _ := acked.expect(coapConfirmable, coapContent)
+	if string(n.Payload) != "0" {
+		t.Fatalf("confirm notification = %q, want the current representation", n.Payload)
+	}
+	acked.write((&coapMessage{Type: coapAcknowledgement, MessageID: n.MessageID}).marshal())
+	acked.expectSilence(200 * time.Millisecond)
+	if coapObservers(c) != 1 {
+		t.Fatal("acknowledged observer dropped")
+	}
+	// 间隔内的其余通知以 NON 发送
+	m.Publish("devices/a", []byte("1"), false, 0)
+	acked.expect(coapNonConfirmable, coapContent)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			acked.conn.SetReadDeadline(time.Time{})
+			n, err := acked.conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if msg, err := parseCoapMessage(buf[:n]); err == nil && msg.Type == coapConfirmable {
+				acked.conn.WriteTo((&coapMessage{Type: coapAcknowledgement, MessageID: msg.MessageID}).marshal(), acked.server)
+			}
+		}
+	}()
+
+	// 重传后仍未确认的观察者被取消
+	silent := dialCoap(t, c)
+	silent.observe("devices/a")
+	var mids []uint16
+	for len(mids) < 3 {
+		msg, _, err := silent.read(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == coapConfirmable {
+			mids = append(mids, msg.MessageID)
+		}
+	}
+	if mids[0] != mids[1] || mids[1] != mids[2] {
+		t.Fatalf("retransmissions use message IDs %v", mids)
+	}
+	waitFor(t, func() bool { return coapObservers(c) == 1 })
+	c.mu.Lock()
+	for _, o := range c.observers {
+		if o.addr.String() != acked.conn.LocalAddr().String() {
+			t.Errorf("remaining observer %s", o.addr)
+		}
+	}
+	c.mu.Unlock()
+}
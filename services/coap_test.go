@@ -0,0 +1,131 @@
+package services
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCoapMessageCodec(t *testing.T) {
+	// 头部：版本 1，CON，无 token，GET，报文 ID 0x1234
+	header := []byte{0x40, coapGET, 0x12, 0x34}
+	long := bytes.Repeat([]byte("x"), 300)
+	tests := []struct {
+		name    string
+		msg     *coapMessage
+		options []byte
+	}{
+		{"no options", &coapMessage{}, nil},
+		{"delta 12", &coapMessage{Options: []coapOption{{Number: 12}}}, []byte{0xc0}},
+		{"delta 13", &coapMessage{Options: []coapOption{{Number: 13, Value: []byte("a")}}}, []byte{0xd1, 0x00, 'a'}},
+		{"delta 268", &coapMessage{Options: []coapOption{{Number: 268}}}, []byte{0xd0, 0xff}},
+		{"delta 269", &coapMessage{Options: []coapOption{{Number: 269}}}, []byte{0xe0, 0x00, 0x00}},
+		{"delta 1000", &coapMessage{Options: []coapOption{{Number: 1000}}}, []byte{0xe0, 0x02, 0xdb}},
+		{"length 12", &coapMessage{Options: []coapOption{{Number: coapOptionURIPath, Value: long[:12]}}},
+			append([]byte{0xbc}, long[:12]...)},
+		{"length 13", &coapMessage{Options: []coapOption{{Number: coapOptionURIPath, Value: long[:13]}}},
+			append([]byte{0xbd, 0x00}, long[:13]...)},
+		{"length 268", &coapMessage{Options: []coapOption{{Number: coapOptionURIPath, Value: long[:268]}}},
+			append([]byte{0xbd, 0xff}, long[:268]...)},
+		{"length 300", &coapMessage{Options: []coapOption{{Number: coapOptionURIPath, Value: long}}},
+			append([]byte{0xbe, 0x00, 0x1f}, long...)},
+		{"extended delta and length", &coapMessage{Options: []coapOption{{Number: 200, Value: long[:20]}}},
+			append([]byte{0xdd, 0xbb, 0x07}, long[:20]...)},
+		{"repeated options", &coapMessage{Options: []coapOption{
+			{Number: coapOptionObserve},
+			{Number: coapOptionURIPath, Value: []byte("a")},
+			{Number: coapOptionURIPath, Value: []byte("b")},
+			{Number: coapOptionContentFormat, Value: []byte{coapFormatJSON}},
+		}}, []byte{0x60, 0x51, 'a', 0x01, 'b', 0x11, coapFormatJSON}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.msg.Code, tt.msg.MessageID = coapGET, 0x1234
+			want := append(append([]byte(nil), header...), tt.options...)
+			if got := tt.msg.marshal(); !bytes.Equal(got, want) {
+				t.Fatalf("marshal = % x, want % x", got, want)
+			}
+			got, err := parseCoapMessage(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.msg) {
+				t.Fatalf("parse = %+v, want %+v", got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestCoapMessageTokenAndPayload(t *testing.T) {
+	msg := &coapMessage{
+		Type:      coapNonConfirmable,
+		Code:      coapContent,
+		MessageID: 7,
+		Token:     []byte{0xaa, 0xbb},
+		// 编码时按编号排序
+		Options: []coapOption{{Number: coapOptionContentFormat}, {Number: coapOptionObserve, Value: []byte{1}}},
+		Payload: []byte("21.5"),
+	}
+	want := []byte{0x52, coapContent, 0x00, 0x07, 0xaa, 0xbb, 0x61, 0x01, 0x60, 0xff, '2', '1', '.', '5'}
+	data := msg.marshal()
+	if !bytes.Equal(data, want) {
+		t.Fatalf("marshal = % x, want % x", data, want)
+	}
+	got, err := parseCoapMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != msg.Type || !bytes.Equal(got.Token, msg.Token) || string(got.Payload) != "21.5" {
+		t.Fatalf("parse = %+v", got)
+	}
+	if v, ok := got.option(coapOptionObserve); !ok || decodeCoapUint(v) != 1 {
+		t.Fatalf("observe = %v, %v", v, ok)
+	}
+}
+
+func TestCoapMessageMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"short header", []byte{0x40, coapGET, 0x00}},
+		{"version 0", []byte{0x00, coapGET, 0x00, 0x01}},
+		{"token length 9", append([]byte{0x49, coapGET, 0x00, 0x01}, make([]byte, 9)...)},
+		{"truncated token", []byte{0x42, coapGET, 0x00, 0x01, 0xaa}},
+		{"delta nibble 15", []byte{0x40, coapGET, 0x00, 0x01, 0xf0}},
+		{"length nibble 15", []byte{0x40, coapGET, 0x00, 0x01, 0xbf}},
+		{"missing 13 extension", []byte{0x40, coapGET, 0x00, 0x01, 0xd0}},
+		{"short 14 extension", []byte{0x40, coapGET, 0x00, 0x01, 0xe0, 0x00}},
+		{"truncated value", []byte{0x40, coapGET, 0x00, 0x01, 0xb3, 'a'}},
+		{"option number overflow", []byte{0x40, coapGET, 0x00, 0x01, 0xe0, 0xff, 0xff}},
+		{"payload marker without payload", []byte{0x40, coapGET, 0x00, 0x01, 0xff}},
+	}
+	for _, tt := range tests {
+		if m, err := parseCoapMessage(tt.data); err == nil {
+			t.Errorf("%s: parsed %+v, want an error", tt.name, m)
+		}
+	}
+}
+
+func TestCoapUint(t *testing.T) {
+	tests := []struct {
+		v    uint32
+		want []byte
+	}{
+		{0, nil},
+		{1, []byte{1}},
+		{255, []byte{0xff}},
+		{256, []byte{0x01, 0x00}},
+		{1<<24 - 1, []byte{0xff, 0xff, 0xff}},
+		{1 << 24, []byte{0x01, 0x00, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		got := encodeCoapUint(tt.v)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("encode %d = % x, want % x", tt.v, got, tt.want)
+		}
+		if v := decodeCoapUint(got); v != tt.v {
+			t.Errorf("decode % x = %d, want %d", got, v, tt.v)
+		}
+	}
+}
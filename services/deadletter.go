@@ -0,0 +1,228 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/queue"
+)
+
+func init() {
+	deadletter.RegisterSink(deadletter.SinkMQTT, newMQTTSink)
+	deadletter.RegisterSink(deadletter.SinkWebsocket, newWebsocketSink)
+
+	deadletter.RegisterRedriver(ServicerTypeMQTT, redriveMQTT)
+	deadletter.RegisterRedriver(ServicerTypeWebsocket, redriveWebsocket)
+	deadletter.RegisterRedriver("bridge", redriveBridge)
+	deadletter.RegisterRedriver(ServicerTypeTCP, redriveSocket)
+	deadletter.RegisterRedriver(ServicerTypeUDP, redriveSocket)
+	deadletter.RegisterRedriver(ServicerTypeWebhook, redriveWebhook)
+	deadletter.RegisterRedriver(ServicerTypeModbus, redriveModbus)
+	deadletter.RegisterRedriver("queue", redriveQueue)
+}
+
+// stageError 标记失败阶段的错误，未标记的错误视为转换阶段失败
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string { return e.err.Error() }
+func (e *stageError) Unwrap() error { return e.err }
+
+// deliveryFailed 标记发送阶段的错误
+func deliveryFailed(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stageError{stage: deadletter.StageDelivery, err: err}
+}
+
+// stageOf 返回错误的失败阶段
+func stageOf(err error) string {
+	var se *stageError
+	if errors.As(err, &se) {
+		return se.stage
+	}
+	return deadletter.StageConversion
+}
+
+// mqttSink 将死信以 JSON 发布到 MQTT 主题，带有 dead-letter 用户属性
+type mqttSink struct {
+	mqtt   *mqttServer
+	config deadletter.SinkConfig
+}
+
+func newMQTTSink(config deadletter.SinkConfig) (deadletter.Sink, error) {
+	if config.Topic == "" {
+		return nil, errors.New("mqtt sink requires topic")
+	}
+	if config.QoS > 2 {
+		return nil, fmt.Errorf("mqtt sink qos %d is out of range [0, 2]", config.QoS)
+	}
+	m, err := resolveMqttServer(config.Servicer)
+	if err != nil {
+		return nil, err
+	}
+	return &mqttSink{mqtt: m, config: config}, nil
+}
+
+// Write 发布死信
+func (s *mqttSink) Write(l *deadletter.Letter) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	props := packets.Properties{User: []packets.UserProperty{{Key: deadletter.HeaderLetter, Val: l.ID}}}
+	_, err = s.mqtt.PublishPacket(l.Expand(s.config.Topic), b, s.config.Retain, s.config.QoS, props)
+	return err
+}
+
+// websocketSink 将死信以 JSON 发布到 websocket 频道
+type websocketSink struct {
+	ws      *websocketServer
+	channel string
+}
+
+func newWebsocketSink(config deadletter.SinkConfig) (deadletter.Sink, error) {
+	if config.Channel == "" {
+		return nil, errors.New("websocket sink requires channel")
+	}
+	ws := WsServer
+	if config.Servicer != "" {
+		var ok bool
+		if ws, ok = GetWebsocketServer(config.Servicer); !ok {
+			return nil, fmt.Errorf("unknown websocket servicer %q", config.Servicer)
+		}
+	}
+	if ws == nil {
+		return nil, errors.New("no websocket servicer is configured")
+	}
+	return &websocketSink{ws: ws, channel: config.Channel}, nil
+}
+
+// Write 发布死信
+func (s *websocketSink) Write(l *deadletter.Letter) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	s.ws.PublishChannel(l.Expand(s.channel), b)
+	return nil
+}
+
+// redriveMQTT 发布到 mqtt:<servicer>:<主题>；没有目标的死信（校验失败）重新发布到来源主题，不再经过校验
+func redriveMQTT(ctx context.Context, l *deadletter.Letter) error {
+	name, topic := l.Servicer, l.Topic
+	if l.Destination != "" {
+		var ok bool
+		if name, topic, ok = strings.Cut(l.Target(), ":"); !ok {
+			return fmt.Errorf("invalid destination %q", l.Destination)
+		}
+	}
+	m, err := resolveMqttServer(name)
+	if err != nil {
+		return err
+	}
+	if len(l.Headers) == 0 {
+		return m.Publish(topic, l.Payload, false, 0)
+	}
+	_, err = m.PublishPacket(topic, l.Payload, false, 0, packets.Properties{User: UserProperties(l.Headers)})
+	return err
+}
+
+// redriveWebsocket 将未通过校验的消息重新交给来源 servicer 广播与处理，不再经过校验
+func redriveWebsocket(ctx context.Context, l *deadletter.Letter) error {
+	ws, ok := GetWebsocketServer(l.Servicer)
+	if !ok {
+		return fmt.Errorf("unknown websocket servicer %q", l.Servicer)
+	}
+	ws.handleMessage(ctx, l.Topic, FrameType(l.Payload), l.Payload)
+	return nil
+}
+
+// redriveBridge 按消息来源重新执行 bridge:<websocket servicer>:<序号> 的对应方向
+func redriveBridge(ctx context.Context, l *deadletter.Letter) error {
+	var b *bridge
+	for _, candidate := range Bridges {
+		if candidate.destination() == l.Destination {
+			b = candidate
+			break
+		}
+	}
+	if b == nil {
+		return fmt.Errorf("unknown bridge %q", l.Target())
+	}
+	var err error
+	if l.Source == ServicerTypeMQTT {
+		err = b.relayMQTT(l.Topic, l.Headers, l.Payload)
+	} else {
+		err = b.redriveWebsocket(l.Headers, l.Payload)
+	}
+	return ignoreDropped(err)
+}
+
+// redriveSocket 按消息来源重新执行 tcp / udp servicer 的桥接转发
+func redriveSocket(ctx context.Context, l *deadletter.Letter) error {
+	sock, ok := GetSocketServer(l.Target())
+	if !ok || sock.Network() != l.Kind() {
+		return fmt.Errorf("unknown %s servicer %q", l.Kind(), l.Target())
+	}
+	var err error
+	if l.Source == ServicerTypeMQTT {
+		err = sock.relayMQTT(l.Topic, l.Headers, l.Payload)
+	} else {
+		err = sock.relayFrame(l.Topic, l.Payload)
+	}
+	return ignoreDropped(err)
+}
+
+// redriveWebhook 重新发送给 webhook:<servicer>:<目标序号>
+func redriveWebhook(ctx context.Context, l *deadletter.Letter) error {
+	name, index, _ := strings.Cut(l.Target(), ":")
+	w, ok := GetWebhookServer(name)
+	if !ok {
+		return fmt.Errorf("unknown webhook servicer %q", name)
+	}
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 1 || i > len(w.config.Targets) {
+		return fmt.Errorf("webhook %s has no target %q", name, index)
+	}
+	return w.redeliver(ctx, i-1, &webhookMessage{SourceType: l.Source, Source: l.Servicer, Topic: l.Topic, Payload: l.Payload})
+}
+
+// redriveModbus 重新将 set 主题上的值写入 modbus:<servicer> 的点位
+func redriveModbus(ctx context.Context, l *deadletter.Letter) error {
+	s, _ := GetServicer(l.Target())
+	m, ok := s.(*modbusServer)
+	if !ok {
+		return fmt.Errorf("unknown modbus servicer %q", l.Target())
+	}
+	for _, d := range m.devices {
+		for i := range d.config.Points {
+			p := &d.config.Points[i]
+			if p.Writable && m.topic(d, p)+modbusSetSuffix == l.Topic {
+				return m.write(d, p, l.Payload)
+			}
+		}
+	}
+	return fmt.Errorf("modbus %s has no writable point for %s", m.Name(), l.Topic)
+}
+
+// redriveQueue 将队列中被删除的消息重新写入 queue:<队列名称>
+func redriveQueue(ctx context.Context, l *deadletter.Letter) error {
+	q, ok := queue.Get(l.Target())
+	if !ok {
+		return fmt.Errorf("unknown queue %q", l.Target())
+	}
+	if len(l.Data) == 0 {
+		return errors.New("dead letter has no queued message")
+	}
+	return q.Enqueue(l.Data)
+}
@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/logger"
+)
+
+func TestMQTTSink(t *testing.T) {
+	m := startTestMqtt(t)
+	prev := MqttServer
+	MqttServer = m
+	t.Cleanup(func() { MqttServer = prev })
+
+	received := make(chan packets.Packet, 4)
+	m.Subscribe("deadletters/#", func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	})
+	store, err := deadletter.New(&logger.AppLogger{}, &deadletter.Config{Sinks: []deadletter.SinkConfig{
+		{Type: deadletter.SinkMQTT, Topic: "deadletters/{stage}/{source}/{servicer}", QoS: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &deadletter.Letter{Stage: deadletter.StageDelivery, Source: ServicerTypeMQTT, Topic: "devices/a", Payload: []byte("21.5")}
+	store.Publish(context.Background(), l)
+	var pk packets.Packet
+	select {
+	case pk = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dead letter not published")
+	}
+	if pk.TopicName != "deadletters/delivery/mqtt/unknown" || HeadersOf(pk.Properties.User)[deadletter.HeaderLetter] != l.ID {
+		t.Fatalf("published %s with properties %v", pk.TopicName, pk.Properties.User)
+	}
+	var got deadletter.Letter
+	if err := json.Unmarshal(pk.Payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != l.ID || got.Topic != "devices/a" || string(got.Payload) != "21.5" {
+		t.Fatalf("published letter = %+v", got)
+	}
+
+	// 死信的死信只记录日志，不再发布
+	store.Publish(context.Background(), &deadletter.Letter{
+		Stage:   deadletter.StageDelivery,
+		Headers: map[string]string{deadletter.HeaderLetter: l.ID},
+	})
+	select {
+	case pk := <-received:
+		t.Fatalf("letter of a dead letter published to %s", pk.TopicName)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebsocketSink(t *testing.T) {
+	s, url := startTestWebsocket(t, `
+[server]
+name = "ws-test"
+[cors]
+allow_all = true
+`)
+	prev := WsServer
+	WsServer = s
+	t.Cleanup(func() { WsServer = prev })
+
+	conn := dialTestWebsocket(t, url)
+	sendChannel(t, conn, ChannelMessage{Action: ChannelActionSubscribe, Channel: "deadletters/+"})
+	store, err := deadletter.New(&logger.AppLogger{}, &deadletter.Config{Sinks: []deadletter.SinkConfig{
+		{Type: deadletter.SinkWebsocket, Channel: "deadletters/{stage}"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &deadletter.Letter{Stage: deadletter.StageValidation, Source: ServicerTypeWebsocket, Topic: "/ws/echo", Payload: []byte("bad")}
+	store.Publish(context.Background(), l)
+	msg := readChannel(t, conn)
+	if msg.Action != ChannelActionMessage || msg.Channel != "deadletters/validation" {
+		t.Fatalf("channel message = %+v", msg)
+	}
+	var got deadletter.Letter
+	if err := json.Unmarshal(msg.Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != l.ID || got.Topic != "/ws/echo" || string(got.Payload) != "bad" {
+		t.Fatalf("published letter = %+v", got)
+	}
+}
+
+func TestSinkConfigErrors(t *testing.T) {
+	prevMqtt, prevWs := MqttServer, WsServer
+	MqttServer, WsServer = nil, nil
+	t.Cleanup(func() { MqttServer, WsServer = prevMqtt, prevWs })
+
+	tests := []struct {
+		name   string
+		config deadletter.SinkConfig
+	}{
+		{"mqtt without topic", deadletter.SinkConfig{Type: deadletter.SinkMQTT}},
+		{"mqtt qos", deadletter.SinkConfig{Type: deadletter.SinkMQTT, Topic: "a", QoS: 3}},
+		{"no default mqtt servicer", deadletter.SinkConfig{Type: deadletter.SinkMQTT, Topic: "a"}},
+		{"unknown mqtt servicer", deadletter.SinkConfig{Type: deadletter.SinkMQTT, Topic: "a", Servicer: "missing"}},
+		{"websocket without channel", deadletter.SinkConfig{Type: deadletter.SinkWebsocket}},
+		{"no default websocket servicer", deadletter.SinkConfig{Type: deadletter.SinkWebsocket, Channel: "a"}},
+		{"unknown websocket servicer", deadletter.SinkConfig{Type: deadletter.SinkWebsocket, Channel: "a", Servicer: "missing"}},
+	}
+	for _, tt := range tests {
+		_, err := deadletter.New(&logger.AppLogger{}, &deadletter.Config{Sinks: []deadletter.SinkConfig{tt.config}})
+		if err == nil {
+			t.Errorf("%s: New succeeded, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 内置分帧方式
+const (
+	FramingNone      = "none"
+	FramingDelimiter = "delimiter"
+	FramingFixed     = "fixed"
+	FramingLength    = "length"
+)
+
+// 单帧默认最大长度
+const defaultMaxFrameSize = 64 * 1024
+
+// ErrFrameTooLarge 帧长度超过 max_frame_size
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// FramingConfig 字节流的分帧配置
+type FramingConfig struct {
+	// none, delimiter, fixed, length
+	Type string `toml:"type"`
+	// 单帧最大长度（字节），默认 64KiB
+	MaxFrameSize int `toml:"max_frame_size"`
+	// delimiter: 分隔符，支持 TOML 转义（如 "\n"、"\r\n"、"\u0003"），帧中不包含分隔符
+	Delimiter string `toml:"delimiter"`
+	// fixed: 每帧长度
+	Size int `toml:"size"`
+	// length: 长度字段
+	Length LengthFieldConfig `toml:"length"`
+}
+
+// LengthFieldConfig 长度字段分帧：帧由 offset 字节的头部、size 字节的长度字段与其后的数据组成，
+// 数据长度为长度字段的值加上 adjust
+type LengthFieldConfig struct {
+	// 长度字段之前的字节数
+	Offset int `toml:"offset"`
+	// 长度字段字节数: 1, 2, 4, 8
+	Size int `toml:"size"`
+	// big 或 little，默认 big
+	Endian string `toml:"endian"`
+	// 长度字段的值与其后数据长度的差，长度字段包含头部时为负数
+	Adjust int `toml:"adjust"`
+	// 收到的帧从开头去掉的字节数：0 保留整个帧，offset+size 只保留数据，不支持其他值
+	Strip int `toml:"strip"`
+}
+
+// Framer 将字节流切分为帧，并为写出的负载加上帧格式
+type Framer interface {
+	// Split 与 bufio.SplitFunc 语义相同，data 不足一帧时返回 0, nil, nil
+	Split(data []byte, atEOF bool) (advance int, frame []byte, err error)
+	// Encode 返回写出时的帧
+	Encode(payload []byte) ([]byte, error)
+}
+
+// FramerFactory 根据配置创建分帧器
+type FramerFactory func(config FramingConfig) (Framer, error)
+
+var (
+	framerMu sync.RWMutex
+	framers  = map[string]FramerFactory{}
+)
+
+// RegisterFramer 注册分帧方式，重复注册时覆盖
+func RegisterFramer(typ string, factory FramerFactory) {
+	framerMu.Lock()
+	defer framerMu.Unlock()
+	framers[strings.ToLower(typ)] = factory
+}
+
+// FramerTypes 返回已注册的分帧方式
+func FramerTypes() []string {
+	framerMu.RLock()
+	defer framerMu.RUnlock()
+	types := make([]string, 0, len(framers))
+	for typ := range framers {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// NewFramer 按配置创建分帧器
+func NewFramer(config FramingConfig) (Framer, error) {
+	if config.MaxFrameSize <= 0 {
+		config.MaxFrameSize = defaultMaxFrameSize
+	}
+	framerMu.RLock()
+	factory, ok := framers[strings.ToLower(config.Type)]
+	framerMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown framing type %q", config.Type)
+	}
+	return factory(config)
+}
+
+func init() {
+	RegisterFramer(FramingNone, newNoneFramer)
+	RegisterFramer(FramingDelimiter, newDelimiterFramer)
+	RegisterFramer(FramingFixed, newFixedFramer)
+	RegisterFramer(FramingLength, newLengthFramer)
+}
+
+// noneFramer 不分帧，TCP 上每次读到的数据、UDP 上每个数据报为一帧
+type noneFramer struct{}
+
+func newNoneFramer(config FramingConfig) (Framer, error) {
+	return noneFramer{}, nil
+}
+
+func (noneFramer) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+	return len(data), data, nil
+}
+
+func (noneFramer) Encode(payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+type delimiterFramer struct {
+	delimiter []byte
+	max       int
+}
+
+func newDelimiterFramer(config FramingConfig) (Framer, error) {
+	if config.Delimiter == "" {
+		return nil, errors.New("delimiter framing requires delimiter")
+	}
+	return &delimiterFramer{delimiter: []byte(config.Delimiter), max: config.MaxFrameSize}, nil
+}
+
+func (f *delimiterFramer) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.Index(data, f.delimiter); i >= 0 {
+		if i > f.max {
+			return 0, nil, ErrFrameTooLarge
+		}
+		return i + len(f.delimiter), data[:i], nil
+	}
+	if len(data) > f.max+len(f.delimiter) {
+		return 0, nil, ErrFrameTooLarge
+	}
+	// 连接关闭时剩余的数据作为最后一帧
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+func (f *delimiterFramer) Encode(payload []byte) ([]byte, error) {
+	if bytes.Contains(payload, f.delimiter) {
+		return nil, errors.New("payload contains the frame delimiter")
+	}
+	return append(append(make([]byte, 0, len(payload)+len(f.delimiter)), payload...), f.delimiter...), nil
+}
+
+type fixedFramer struct {
+	size int
+}
+
+func newFixedFramer(config FramingConfig) (Framer, error) {
+	if config.Size <= 0 || config.Size > config.MaxFrameSize {
+		return nil, fmt.Errorf("fixed framing size %d is out of range [1, %d]", config.Size, config.MaxFrameSize)
+	}
+	return &fixedFramer{size: config.Size}, nil
+}
+
+func (f *fixedFramer) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) < f.size {
+		// 不足一帧的尾部数据丢弃
+		if atEOF && len(data) > 0 {
+			return len(data), nil, nil
+		}
+		return 0, nil, nil
+	}
+	return f.size, data[:f.size], nil
+}
+
+func (f *fixedFramer) Encode(payload []byte) ([]byte, error) {
+	if len(payload) != f.size {
+		return nil, fmt.Errorf("payload length %d does not match frame size %d", len(payload), f.size)
+	}
+	return payload, nil
+}
+
+type lengthFramer struct {
+	config LengthFieldConfig
+	order  binary.ByteOrder
+	max    int
+}
+
+func newLengthFramer(config FramingConfig) (Framer, error) {
+	lc := config.Length
+	f := &lengthFramer{config: lc, max: config.MaxFrameSize}
+	switch lc.Size {
+	case 1, 2, 4, 8:
+	default:
+		return nil, fmt.Errorf("length field size %d must be 1, 2, 4 or 8", lc.Size)
+	}
+	switch strings.ToLower(lc.Endian) {
+	case "", "big":
+		f.order = binary.BigEndian
+	case "little":
+		f.order = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("unknown length field endian %q", lc.Endian)
+	}
+	if lc.Offset < 0 {
+		return nil, errors.New("length field offset must not be negative")
+	}
+	if lc.Strip != 0 && lc.Strip != f.header() {
+		return nil, fmt.Errorf("length field strip %d must be 0 or offset+size (%d)", lc.Strip, f.header())
+	}
+	return f, nil
+}
+
+func (f *lengthFramer) header() int {
+	return f.config.Offset + f.config.Size
+}
+
+func (f *lengthFramer) Split(data []byte, atEOF bool) (int, []byte, error) {
+	header := f.header()
+	if len(data) < header {
+		if atEOF && len(data) > 0 {
+			return 0, nil, errors.New("truncated frame header")
+		}
+		return 0, nil, nil
+	}
+	field := data[f.config.Offset:header]
+	var length uint64
+	switch f.config.Size {
+	case 1:
+		length = uint64(field[0])
+	case 2:
+		length = uint64(f.order.Uint16(field))
+	case 4:
+		length = uint64(f.order.Uint32(field))
+	case 8:
+		length = f.order.Uint64(field)
+	}
+	body := int64(length) + int64(f.config.Adjust)
+	if length > uint64(f.max) || body < 0 || int64(header)+body > int64(f.max) {
+		return 0, nil, ErrFrameTooLarge
+	}
+	total := header + int(body)
+	if len(data) < total {
+		if atEOF {
+			return 0, nil, errors.New("truncated frame")
+		}
+		return 0, nil, nil
+	}
+	return total, data[f.config.Strip:total], nil
+}
+
+// Encode 将负载作为数据，在前面补齐全零的 offset 字节头部与长度字段，与 strip 无关
+func (f *lengthFramer) Encode(payload []byte) ([]byte, error) {
+	header := f.header()
+	length := int64(len(payload)) - int64(f.config.Adjust)
+	if length < 0 || (f.config.Size < 8 && length >= int64(1)<<(8*f.config.Size)) {
+		return nil, fmt.Errorf("payload length %d does not fit the length field", len(payload))
+	}
+	frame := make([]byte, header, header+len(payload))
+	field := frame[f.config.Offset:header]
+	switch f.config.Size {
+	case 1:
+		field[0] = byte(length)
+	case 2:
+		f.order.PutUint16(field, uint16(length))
+	case 4:
+		f.order.PutUint32(field, uint32(length))
+	case 8:
+		f.order.PutUint64(field, uint64(length))
+	}
+	return append(frame, payload...), nil
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// splitAll 按 Split 切分整个字节流
+func splitAll(t *testing.T, f Framer, stream []byte) [][]byte {
+	t.Helper()
+	sc := bufio.NewScanner(bytes.NewReader(stream))
+	sc.Buffer(make([]byte, 0, 1024), defaultMaxFrameSize+16)
+	sc.Split(f.Split)
+	var frames [][]byte
+	for sc.Scan() {
+		frames = append(frames, append([]byte(nil), sc.Bytes()...))
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	return frames
+}
+
+func TestFramerRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   FramingConfig
+		payloads [][]byte
+		// Split 得到的帧与负载的关系，为 nil 时与负载相同
+		want func(f Framer, payload []byte) []byte
+	}{
+		{
+			name:     "delimiter",
+			config:   FramingConfig{Type: FramingDelimiter, Delimiter: "\r\n"},
+			payloads: [][]byte{[]byte("a"), []byte("hello world"), []byte("x\ny")},
+		},
+		{
+			name:     "fixed",
+			config:   FramingConfig{Type: FramingFixed, Size: 4},
+			payloads: [][]byte{[]byte("abcd"), {0, 1, 2, 3}, []byte("wxyz")},
+		},
+		{
+			name: "length strip header",
+			config: FramingConfig{Type: FramingLength, Length: LengthFieldConfig{
+				Size: 2, Strip: 2,
+			}},
+			payloads: [][]byte{[]byte("a"), bytes.Repeat([]byte{0xff}, 300), []byte("hello")},
+		},
+		{
+			name: "length little endian with offset",
+			config: FramingConfig{Type: FramingLength, Length: LengthFieldConfig{
+				Offset: 3, Size: 4, Endian: "little", Strip: 7,
+			}},
+			payloads: [][]byte{[]byte("abc"), bytes.Repeat([]byte{1}, 1000)},
+		},
+		{
+			name: "length field includes header",
+			config: FramingConfig{Type: FramingLength, Length: LengthFieldConfig{
+				Offset: 1, Size: 1, Adjust: -2, Strip: 2,
+			}},
+			payloads: [][]byte{[]byte("a"), []byte("0123456789")},
+		},
+		{
+			name: "length 8 byte field",
+			config: FramingConfig{Type: FramingLength, Length: LengthFieldConfig{
+				Size: 8, Strip: 8,
+			}},
+			payloads: [][]byte{[]byte("payload")},
+		},
+		{
+			// strip = 0 时收到的帧包含头部，发送时同样写出头部
+			name: "length keep header",
+			config: FramingConfig{Type: FramingLength, Length: LengthFieldConfig{
+				Offset: 2, Size: 2,
+			}},
+			payloads: [][]byte{[]byte("ab"), []byte("hello")},
+			want: func(f Framer, payload []byte) []byte {
+				frame, _ := f.Encode(payload)
+				return frame
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewFramer(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stream []byte
+			for _, p := range tt.payloads {
+				frame, err := f.Encode(p)
+				if err != nil {
+					t.Fatalf("encode %q: %v", p, err)
+				}
+				stream = append(stream, frame...)
+			}
+			frames := splitAll(t, f, stream)
+			if len(frames) != len(tt.payloads) {
+				t.Fatalf("got %d frames, want %d", len(frames), len(tt.payloads))
+			}
+			for i, p := range tt.payloads {
+				want := p
+				if tt.want != nil {
+					want = tt.want(f, p)
+				}
+				if !bytes.Equal(frames[i], want) {
+					t.Errorf("frame %d = %x, want %x", i, frames[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestNoneFramerRoundTrip(t *testing.T) {
+	f, err := NewFramer(FramingConfig{Type: FramingNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte{0, 1, 2, 'a'}
+	frame, err := f.Encode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// none 不分帧，每次读到的数据为一帧
+	advance, got, err := f.Split(frame, false)
+	if err != nil || advance != len(frame) || !bytes.Equal(got, payload) {
+		t.Fatalf("Split = %d, %x, %v", advance, got, err)
+	}
+}
+
+func TestLengthFramerEncodeHeader(t *testing.T) {
+	f, err := NewFramer(FramingConfig{Type: FramingLength, Length: LengthFieldConfig{Offset: 1, Size: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := f.Encode([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 0, 3, 'a', 'b', 'c'}; !bytes.Equal(frame, want) {
+		t.Fatalf("frame = %x, want %x", frame, want)
+	}
+	if n := binary.BigEndian.Uint16(frame[1:3]); n != 3 {
+		t.Fatalf("length field = %d", n)
+	}
+}
+
+func TestFramerConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config FramingConfig
+	}{
+		{"unknown type", FramingConfig{Type: "slip"}},
+		{"empty delimiter", FramingConfig{Type: FramingDelimiter}},
+		{"fixed size zero", FramingConfig{Type: FramingFixed}},
+		{"length size", FramingConfig{Type: FramingLength, Length: LengthFieldConfig{Size: 3}}},
+		{"length endian", FramingConfig{Type: FramingLength, Length: LengthFieldConfig{Size: 2, Endian: "middle"}}},
+		{"length negative offset", FramingConfig{Type: FramingLength, Length: LengthFieldConfig{Size: 2, Offset: -1}}},
+		{"length partial strip", FramingConfig{Type: FramingLength, Length: LengthFieldConfig{Offset: 2, Size: 2, Strip: 2}}},
+		{"length strip past header", FramingConfig{Type: FramingLength, Length: LengthFieldConfig{Size: 2, Strip: 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewFramer(tt.config); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestFramerSplitErrors(t *testing.T) {
+	f, err := NewFramer(FramingConfig{Type: FramingLength, MaxFrameSize: 16, Length: LengthFieldConfig{Size: 2, Strip: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := f.Split([]byte{0, 100}, false); err != ErrFrameTooLarge {
+		t.Fatalf("oversized frame: err = %v", err)
+	}
+	if _, _, err := f.Split([]byte{0, 4, 'a'}, true); err == nil {
+		t.Fatal("truncated frame at EOF: expected an error")
+	}
+	if _, err := f.Encode(bytes.Repeat([]byte{1}, 1<<16)); err == nil {
+		t.Fatal("payload longer than the length field: expected an error")
+	}
+}
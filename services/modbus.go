@@ -0,0 +1,242 @@
+package services
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Modbus 数据区
+const (
+	ModbusCoil          = "coil"
+	ModbusDiscreteInput = "discrete"
+	ModbusHolding       = "holding"
+	ModbusInput         = "input"
+)
+
+// ModbusPoint 一个轮询点位
+type ModbusPoint struct {
+	// 点位名称，发布主题为 <topic_prefix>/<设备名>/<点位名>
+	Name string `toml:"name"`
+	// coil, discrete, holding, input
+	Type string `toml:"type"`
+	// 起始地址（从 0 开始）
+	Address uint16 `toml:"address"`
+	// 寄存器数据类型: int16, uint16, int32, uint32, int64, uint64, float32, float64，
+	// coil / discrete 固定为 bool
+	DataType string `toml:"data_type"`
+	// 寄存器内两个字节的顺序，big 或 little，默认 big
+	ByteOrder string `toml:"byte_order"`
+	// 多个寄存器的顺序，big（高位寄存器在前）或 little，默认 big
+	WordOrder string `toml:"word_order"`
+	// 发布值 = 原始值 * scale + offset，scale 为 0 时视为 1
+	Scale  float64 `toml:"scale"`
+	Offset float64 `toml:"offset"`
+	// 是否接受 <主题>/set 写入，仅 coil 与 holding 可写
+	Writable bool `toml:"writable"`
+}
+
+// validate 校验点位并填充默认值
+func (p *ModbusPoint) validate() error {
+	if p.Name == "" || strings.ContainsAny(p.Name, "/+#") {
+		return fmt.Errorf("invalid point name %q", p.Name)
+	}
+	switch p.Type {
+	case ModbusCoil, ModbusDiscreteInput:
+		p.DataType = "bool"
+	case ModbusHolding, ModbusInput:
+		if p.DataType == "" {
+			p.DataType = "uint16"
+		}
+		if p.registers() == 0 {
+			return fmt.Errorf("point %s: unknown data type %q", p.Name, p.DataType)
+		}
+	default:
+		return fmt.Errorf("point %s: unknown type %q", p.Name, p.Type)
+	}
+	for _, order := range []*string{&p.ByteOrder, &p.WordOrder} {
+		switch strings.ToLower(*order) {
+		case "":
+			*order = "big"
+		case "big", "little":
+			*order = strings.ToLower(*order)
+		default:
+			return fmt.Errorf("point %s: unknown byte order %q", p.Name, *order)
+		}
+	}
+	if p.Scale == 0 {
+		p.Scale = 1
+	}
+	if p.Writable && p.Type != ModbusCoil && p.Type != ModbusHolding {
+		return fmt.Errorf("point %s: %s is read-only", p.Name, p.Type)
+	}
+	return nil
+}
+
+// registers 数据类型占用的寄存器数，bool 为 1 个线圈
+func (p *ModbusPoint) registers() uint16 {
+	switch p.DataType {
+	case "bool", "int16", "uint16":
+		return 1
+	case "int32", "uint32", "float32":
+		return 2
+	case "int64", "uint64", "float64":
+		return 4
+	}
+	return 0
+}
+
+// reorder 在 Modbus 寄存器字节与大端字节之间转换，转换是自反的
+func (p *ModbusPoint) reorder(b []byte) []byte {
+	out := make([]byte, len(b))
+	words := len(b) / 2
+	for i := 0; i < words; i++ {
+		w := i
+		if p.WordOrder == "little" {
+			w = words - 1 - i
+		}
+		hi, lo := b[2*w], b[2*w+1]
+		if p.ByteOrder == "little" {
+			hi, lo = lo, hi
+		}
+		out[2*i], out[2*i+1] = hi, lo
+	}
+	return out
+}
+
+// decode 将读取结果转为发布值：bool 或缩放后的 float64
+func (p *ModbusPoint) decode(results []byte) (any, error) {
+	if p.DataType == "bool" {
+		if len(results) < 1 {
+			return nil, fmt.Errorf("point %s: short response", p.Name)
+		}
+		return results[0]&1 == 1, nil
+	}
+	n := int(p.registers()) * 2
+	if len(results) < n {
+		return nil, fmt.Errorf("point %s: short response", p.Name)
+	}
+	b := p.reorder(results[:n])
+	var raw float64
+	switch p.DataType {
+	case "int16":
+		raw = float64(int16(binary.BigEndian.Uint16(b)))
+	case "uint16":
+		raw = float64(binary.BigEndian.Uint16(b))
+	case "int32":
+		raw = float64(int32(binary.BigEndian.Uint32(b)))
+	case "uint32":
+		raw = float64(binary.BigEndian.Uint32(b))
+	case "float32":
+		raw = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case "int64":
+		raw = float64(int64(binary.BigEndian.Uint64(b)))
+	case "uint64":
+		raw = float64(binary.BigEndian.Uint64(b))
+	case "float64":
+		raw = math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	// 去掉缩放引入的浮点误差（如 302*0.1），float32 只保留其有效位数
+	digits := 15
+	if p.DataType == "float32" {
+		digits = 7
+	}
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(raw*p.Scale+p.Offset, 'g', digits, 64), 64)
+	return v, nil
+}
+
+// encode 将写入值按缩放与字节序转为寄存器字节
+func (p *ModbusPoint) encode(value float64) ([]byte, error) {
+	raw := (value - p.Offset) / p.Scale
+	if p.DataType != "float32" && p.DataType != "float64" {
+		raw = math.Round(raw)
+	}
+	b := make([]byte, int(p.registers())*2)
+	// limit 为不含的上界，2^63、2^64 等上界按 float64 精确表示，避免 MaxInt64 舍入后放过越界值
+	outOfRange := func(min, limit float64) error {
+		if math.IsNaN(raw) || raw < min || raw >= limit {
+			return fmt.Errorf("point %s: value %v is out of range for %s", p.Name, value, p.DataType)
+		}
+		return nil
+	}
+	switch p.DataType {
+	case "int16":
+		if err := outOfRange(math.MinInt16, math.MaxInt16+1); err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint16(b, uint16(int16(raw)))
+	case "uint16":
+		if err := outOfRange(0, math.MaxUint16+1); err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint16(b, uint16(raw))
+	case "int32":
+		if err := outOfRange(math.MinInt32, math.MaxInt32+1); err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(b, uint32(int32(raw)))
+	case "uint32":
+		if err := outOfRange(0, math.MaxUint32+1); err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(b, uint32(raw))
+	case "float32":
+		// 超出 float32 表示范围时转换结果为 ±Inf
+		if err := outOfRange(-math.MaxFloat64, math.Inf(1)); err != nil || math.IsInf(float64(float32(raw)), 0) {
+			return nil, fmt.Errorf("point %s: value %v is out of range for %s", p.Name, value, p.DataType)
+		}
+		binary.BigEndian.PutUint32(b, math.Float32bits(float32(raw)))
+	case "int64":
+		if err := outOfRange(math.MinInt64, math.Ldexp(1, 63)); err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint64(b, uint64(int64(raw)))
+	case "uint64":
+		if err := outOfRange(0, math.Ldexp(1, 64)); err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint64(b, uint64(raw))
+	case "float64":
+		if err := outOfRange(-math.MaxFloat64, math.Inf(1)); err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint64(b, math.Float64bits(raw))
+	}
+	return p.reorder(b), nil
+}
+
+// parseModbusValue 解析 set 主题的负载：JSON 数字、布尔值，或 {"value": ...}。
+// 不接受 NaN 与 ±Inf，它们不能与量程比较，写入线圈时也会被当作 ON
+func parseModbusValue(payload []byte) (float64, error) {
+	s := strings.TrimSpace(string(payload))
+	switch strings.ToLower(s) {
+	case "true", "on":
+		return 1, nil
+	case "false", "off":
+		return 0, nil
+	}
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0, fmt.Errorf("invalid value %q: not a finite number", s)
+		}
+		return v, nil
+	}
+	var obj struct {
+		Value any `json:"value"`
+	}
+	if err := json.Unmarshal(payload, &obj); err == nil {
+		switch v := obj.Value.(type) {
+		case float64:
+			return v, nil
+		case bool:
+			if v {
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid value %q", s)
+}
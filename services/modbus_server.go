@@ -0,0 +1,441 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/goburrow/modbus"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/logger"
+)
+
+// Modbus 默认配置
+const (
+	defaultModbusInterval = 1000
+	defaultModbusTimeout  = 5
+	defaultModbusPrefix   = "modbus"
+	// 每个设备等待写入的 set 消息数，超过后产生死信
+	modbusWriteQueueSize = 64
+)
+
+// errModbusWriteQueueFull 设备的写入队列已满
+var errModbusWriteQueueFull = errors.New("modbus write queue is full")
+
+// modbusSetSuffix 写入主题的后缀
+const modbusSetSuffix = "/set"
+
+// ModbusConfig Modbus TCP 轮询 servicer 配置
+type ModbusConfig struct {
+	Type    string               `toml:"type"`
+	Server  ServerConfig         `toml:"server"`
+	Modbus  ModbusConfigDetail   `toml:"modbus"`
+	Devices []ModbusDeviceConfig `toml:"device"`
+}
+
+type ModbusConfigDetail struct {
+	// 发布的 MQTT servicer 名称，为空时使用默认 MQTT servicer
+	MQTT string `toml:"mqtt"`
+	// 发布主题前缀，默认 modbus
+	TopicPrefix string `toml:"topic_prefix"`
+	QoS         byte   `toml:"qos"`
+	// 发布保留消息，新订阅者可立即获得最新值
+	Retain bool `toml:"retain"`
+	// 为 false 时只在值变化时发布，为 true 时每次轮询都发布
+	PublishUnchanged bool `toml:"publish_unchanged"`
+}
+
+// ModbusDeviceConfig 一个 Modbus TCP 从站
+type ModbusDeviceConfig struct {
+	// 设备名称，用于发布主题
+	Name string `toml:"name"`
+	// host:port
+	Address string `toml:"address"`
+	SlaveID byte   `toml:"slave_id"`
+	// 轮询间隔（毫秒），默认 1000
+	Interval int `toml:"interval"`
+	// 请求超时（秒），默认 5
+	Timeout int           `toml:"timeout"`
+	Points  []ModbusPoint `toml:"point"`
+}
+
+func init() {
+	RegisterServicerType(ServicerTypeModbus, func(ctx context.Context, log *logger.AppLogger, configPath string) (Servicer, error) {
+		return NewModbusServer(ctx, log, configPath)
+	})
+}
+
+// modbusDevice 一个从站的连接与最近一次读取的值，请求按设备串行
+type modbusDevice struct {
+	config  *ModbusDeviceConfig
+	handler *modbus.TCPClientHandler
+	client  modbus.Client
+
+	// 等待写入的 set 消息，由设备的写协程按到达顺序写入
+	writes chan modbusWrite
+
+	mu     sync.Mutex
+	values map[string]any
+	// 最近一次请求是否失败，用于只在状态变化时记录日志
+	failing bool
+}
+
+// modbusWrite set 主题上的一条消息
+type modbusWrite struct {
+	point   *ModbusPoint
+	topic   string
+	headers map[string]string
+	payload []byte
+}
+
+// modbusServer 轮询 Modbus TCP 从站并将点位值发布到 MQTT，<点位主题>/set 上的消息写入从站
+type modbusServer struct {
+	logger  *logger.AppLogger
+	config  *ModbusConfig
+	mqtt    *mqttServer
+	devices []*modbusDevice
+
+	mu      sync.Mutex
+	running bool
+	stopped chan struct{}
+}
+
+// NewModbusServer 根据配置文件创建 Modbus servicer 实例
+func NewModbusServer(ctx context.Context, log *logger.AppLogger, configPath string) (*modbusServer, error) {
+	var config ModbusConfig
+	if _, err := toml.DecodeFile(configPath, &config); err != nil {
+		return nil, fmt.Errorf("load modbus config %s: %w", configPath, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid modbus config %s: %w", configPath, err)
+	}
+	m := &modbusServer{
+		logger: log,
+		config: &config,
+	}
+	for i := range config.Devices {
+		dc := &config.Devices[i]
+		handler := modbus.NewTCPClientHandler(dc.Address)
+		handler.SlaveId = dc.SlaveID
+		handler.Timeout = time.Duration(dc.Timeout) * time.Second
+		m.devices = append(m.devices, &modbusDevice{
+			config:  dc,
+			handler: handler,
+			client:  modbus.NewClient(handler),
+			writes:  make(chan modbusWrite, modbusWriteQueueSize),
+			values:  make(map[string]any),
+		})
+	}
+	return m, nil
+}
+
+// validate 校验配置并填充默认值
+func (c *ModbusConfig) validate() error {
+	if c.Modbus.QoS > 2 {
+		return fmt.Errorf("modbus.qos = %d is out of range [0, 2]", c.Modbus.QoS)
+	}
+	if c.Modbus.TopicPrefix == "" {
+		c.Modbus.TopicPrefix = defaultModbusPrefix
+	}
+	c.Modbus.TopicPrefix = strings.TrimSuffix(c.Modbus.TopicPrefix, "/")
+	names := make(map[string]bool)
+	for i := range c.Devices {
+		d := &c.Devices[i]
+		if d.Name == "" || strings.ContainsAny(d.Name, "/+#") {
+			return fmt.Errorf("device #%d: invalid name %q", i+1, d.Name)
+		}
+		if names[d.Name] {
+			return fmt.Errorf("duplicate device name %q", d.Name)
+		}
+		names[d.Name] = true
+		if d.Address == "" {
+			return fmt.Errorf("device %s: address is required", d.Name)
+		}
+		if d.Interval <= 0 {
+			d.Interval = defaultModbusInterval
+		}
+		if d.Timeout <= 0 {
+			d.Timeout = defaultModbusTimeout
+		}
+		points := make(map[string]bool)
+		for j := range d.Points {
+			p := &d.Points[j]
+			if err := p.validate(); err != nil {
+				return fmt.Errorf("device %s: %w", d.Name, err)
+			}
+			if points[p.Name] {
+				return fmt.Errorf("device %s: duplicate point name %q", d.Name, p.Name)
+			}
+			points[p.Name] = true
+		}
+	}
+	return nil
+}
+
+// LinkMQTT 设置发布的 MQTT servicer 并订阅可写点位的 set 主题，需在 Start 之前调用
+func (m *modbusServer) LinkMQTT(mqtt *mqttServer) error {
+	m.mqtt = mqtt
+	for _, d := range m.devices {
+		d := d
+		for i := range d.config.Points {
+			p := &d.config.Points[i]
+			if !p.Writable {
+				continue
+			}
+			if _, err := mqtt.Subscribe(m.topic(d, p)+modbusSetSuffix, func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+				// 内联处理函数在发布路径上同步执行，写入可能等待轮询，交给设备的写协程按顺序执行
+				w := modbusWrite{point: p, topic: pk.TopicName, headers: HeadersOf(pk.Properties.User), payload: pk.Payload}
+				select {
+				case d.writes <- w:
+				default:
+					m.writeFailed(context.Background(), w, deliveryFailed(errModbusWriteQueueFull))
+				}
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeLoop 按到达顺序执行设备的 set 消息，直到 ctx 取消
+func (m *modbusServer) writeLoop(ctx context.Context, d *modbusDevice) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case w := <-d.writes:
+			if err := m.write(d, w.point, w.payload); err != nil {
+				m.writeFailed(ctx, w, err)
+			}
+		}
+	}
+}
+
+// writeFailed 记录写入失败并产生死信
+func (m *modbusServer) writeFailed(ctx context.Context, w modbusWrite, err error) {
+	m.logger.LogErrorf(ctx, "modbus %s: %v", m.Name(), err)
+	deadletter.Publish(ctx, &deadletter.Letter{
+		Stage:       stageOf(err),
+		Error:       err.Error(),
+		Source:      ServicerTypeMQTT,
+		Servicer:    m.mqtt.Name(),
+		Topic:       w.topic,
+		Destination: ServicerTypeModbus + ":" + m.Name(),
+		Headers:     w.headers,
+		Payload:     w.payload,
+	})
+}
+
+// Name 返回 servicer 名称
+func (m *modbusServer) Name() string {
+	return m.config.Server.Name
+}
+
+// Start 为每个设备启动轮询，阻塞直到 ctx 取消或 Stop 被调用
+func (m *modbusServer) Start(ctx context.Context) error {
+	if m.mqtt == nil {
+		return errors.New("modbus servicer requires a mqtt servicer")
+	}
+	stopped := make(chan struct{})
+	m.mu.Lock()
+	m.running, m.stopped = true, stopped
+	m.mu.Unlock()
+
+	runCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, d := range m.devices {
+		d := d
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			m.poll(runCtx, d)
+		}()
+		go func() {
+			defer wg.Done()
+			m.writeLoop(runCtx, d)
+		}()
+	}
+	m.logger.LogInfo(ctx, "Starting modbus servicer",
+		"name", m.Name(),
+		"devices", len(m.devices),
+		"mqtt", m.mqtt.Name(),
+	)
+
+	select {
+	case <-ctx.Done():
+	case <-stopped:
+	}
+	cancel()
+	wg.Wait()
+	for _, d := range m.devices {
+		d.mu.Lock()
+		d.handler.Close()
+		d.mu.Unlock()
+	}
+	m.mu.Lock()
+	m.running = false
+	m.mu.Unlock()
+	return nil
+}
+
+// Stop 停止轮询并关闭连接
+func (m *modbusServer) Stop(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped != nil {
+		select {
+		case <-m.stopped:
+		default:
+			close(m.stopped)
+		}
+	}
+	return nil
+}
+
+// Health 服务运行中时返回 nil
+func (m *modbusServer) Health() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.running {
+		return ErrServicerNotRunning
+	}
+	return nil
+}
+
+func (m *modbusServer) topic(d *modbusDevice, p *ModbusPoint) string {
+	return m.config.Modbus.TopicPrefix + "/" + d.config.Name + "/" + p.Name
+}
+
+// poll 按间隔读取设备的所有点位
+func (m *modbusServer) poll(ctx context.Context, d *modbusDevice) {
+	ticker := time.NewTicker(time.Duration(d.config.Interval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		for i := range d.config.Points {
+			if ctx.Err() != nil {
+				return
+			}
+			// 设备不可达时跳过本轮剩余点位，避免逐个等待超时
+			if !m.read(ctx, d, &d.config.Points[i], false) {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// read 读取一个点位，值变化（或 force、publish_unchanged）时发布，请求失败时返回 false
+func (m *modbusServer) read(ctx context.Context, d *modbusDevice, p *ModbusPoint, force bool) bool {
+	d.mu.Lock()
+	var results []byte
+	var err error
+	switch p.Type {
+	case ModbusCoil:
+		results, err = d.client.ReadCoils(p.Address, 1)
+	case ModbusDiscreteInput:
+		results, err = d.client.ReadDiscreteInputs(p.Address, 1)
+	case ModbusHolding:
+		results, err = d.client.ReadHoldingRegisters(p.Address, p.registers())
+	case ModbusInput:
+		results, err = d.client.ReadInputRegisters(p.Address, p.registers())
+	}
+	var value any
+	if err == nil {
+		value, err = p.decode(results)
+	}
+	if m.failed(ctx, d, err) {
+		d.mu.Unlock()
+		return false
+	}
+	last, seen := d.values[p.Name]
+	d.values[p.Name] = value
+	d.mu.Unlock()
+
+	if seen && last == value && !force && !m.config.Modbus.PublishUnchanged {
+		return true
+	}
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return true
+	}
+	topic := m.topic(d, p)
+	if err := m.mqtt.Publish(topic, payload, m.config.Modbus.Retain, m.config.Modbus.QoS); err != nil {
+		m.logger.LogErrorf(ctx, "modbus %s publish %s failed: %v", m.Name(), topic, err)
+		deadletter.Publish(ctx, &deadletter.Letter{
+			Stage:       deadletter.StageDelivery,
+			Error:       err.Error(),
+			Source:      ServicerTypeModbus,
+			Servicer:    m.Name(),
+			Topic:       topic,
+			Destination: ServicerTypeMQTT + ":" + m.mqtt.Name() + ":" + topic,
+			Payload:     payload,
+		})
+	}
+	return true
+}
+
+// failed 记录请求结果，失败时关闭连接以便下次请求重连，只在状态变化时记录日志。调用方持有 d.mu
+func (m *modbusServer) failed(ctx context.Context, d *modbusDevice, err error) bool {
+	if err == nil {
+		if d.failing {
+			d.failing = false
+			m.logger.LogInfo(ctx, "modbus device recovered", "name", m.Name(), "device", d.config.Name)
+		}
+		return false
+	}
+	d.handler.Close()
+	if !d.failing {
+		d.failing = true
+		m.logger.LogErrorf(ctx, "modbus %s device %s request failed: %v", m.Name(), d.config.Name, err)
+	}
+	return true
+}
+
+// write 将 set 主题上的值写入点位，成功后立即读取并发布新值；写入失败的错误标记为发送阶段
+func (m *modbusServer) write(d *modbusDevice, p *ModbusPoint, payload []byte) error {
+	value, err := parseModbusValue(payload)
+	if err != nil {
+		return fmt.Errorf("set %s: %w", m.topic(d, p), err)
+	}
+
+	d.mu.Lock()
+	switch p.Type {
+	case ModbusCoil:
+		var v uint16
+		if value != 0 {
+			v = 0xFF00
+		}
+		_, err = d.client.WriteSingleCoil(p.Address, v)
+	case ModbusHolding:
+		var b []byte
+		if b, err = p.encode(value); err != nil {
+			d.mu.Unlock()
+			return fmt.Errorf("set %s: %w", m.topic(d, p), err)
+		}
+		if len(b) == 2 {
+			_, err = d.client.WriteSingleRegister(p.Address, uint16(b[0])<<8|uint16(b[1]))
+		} else {
+			_, err = d.client.WriteMultipleRegisters(p.Address, p.registers(), b)
+		}
+	}
+	if err != nil {
+		d.handler.Close()
+		d.mu.Unlock()
+		return deliveryFailed(fmt.Errorf("write %s failed: %w", m.topic(d, p), err))
+	}
+	d.mu.Unlock()
+	m.read(context.Background(), d, p, true)
+	return nil
+}
@@ -0,0 +1,304 @@
+package services
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/logger"
+)
+
+// modbusSimulator 进程内的 Modbus TCP 从站，支持功能码 1-6 与 16
+type modbusSimulator struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	coils    []bool
+	discrete []bool
+	holding  []uint16
+	input    []uint16
+}
+
+func startModbusSimulator(t *testing.T) *modbusSimulator {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &modbusSimulator{
+		ln:       ln,
+		coils:    make([]bool, 64),
+		discrete: make([]bool, 64),
+		holding:  make([]uint16, 64),
+		input:    make([]uint16, 64),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// serve 处理一个连接上的 MBAP 帧：事务 ID、协议 ID、长度、单元 ID 后接 PDU
+func (s *modbusSimulator) serve(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 7)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		pdu := make([]byte, int(binary.BigEndian.Uint16(header[4:6]))-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		resp := s.handle(pdu)
+		frame := append([]byte(nil), header...)
+		binary.BigEndian.PutUint16(frame[4:6], uint16(len(resp)+1))
+		if _, err := conn.Write(append(frame, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *modbusSimulator) handle(pdu []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fc := pdu[0]
+	addr, n := int(binary.BigEndian.Uint16(pdu[1:3])), int(binary.BigEndian.Uint16(pdu[3:5]))
+	// 非法数据地址
+	exception := []byte{fc | 0x80, 0x02}
+	switch fc {
+	case 1, 2:
+		bits := s.coils
+		if fc == 2 {
+			bits = s.discrete
+		}
+		if addr+n > len(bits) {
+			return exception
+		}
+		resp := []byte{fc, byte((n + 7) / 8)}
+		resp = append(resp, make([]byte, (n+7)/8)...)
+		for i := 0; i < n; i++ {
+			if bits[addr+i] {
+				resp[2+i/8] |= 1 << (i % 8)
+			}
+		}
+		return resp
+	case 3, 4:
+		regs := s.holding
+		if fc == 4 {
+			regs = s.input
+		}
+		if addr+n > len(regs) {
+			return exception
+		}
+		resp := []byte{fc, byte(2 * n)}
+		for _, r := range regs[addr : addr+n] {
+			resp = binary.BigEndian.AppendUint16(resp, r)
+		}
+		return resp
+	case 5:
+		if addr >= len(s.coils) {
+			return exception
+		}
+		s.coils[addr] = n == 0xFF00
+		return pdu[:5]
+	case 6:
+		if addr >= len(s.holding) {
+			return exception
+		}
+		s.holding[addr] = uint16(n)
+		return pdu[:5]
+	case 16:
+		if addr+n > len(s.holding) {
+			return exception
+		}
+		for i := 0; i < n; i++ {
+			s.holding[addr+i] = binary.BigEndian.Uint16(pdu[6+2*i:])
+		}
+		return pdu[:5]
+	}
+	// 非法功能码
+	return []byte{fc | 0x80, 0x01}
+}
+
+func (s *modbusSimulator) setHolding(addr int, regs ...uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copy(s.holding[addr:], regs)
+}
+
+func (s *modbusSimulator) holdingAt(addr int) uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.holding[addr]
+}
+
+func (s *modbusSimulator) coil(addr int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.coils[addr]
+}
+
+// modbusTestMessages 记录 MQTT 上每个主题的消息
+type modbusTestMessages struct {
+	mu     sync.Mutex
+	latest map[string]string
+	counts map[string]int
+}
+
+func (r *modbusTestMessages) get(topic string) (string, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.latest[topic], r.counts[topic]
+}
+
+func TestModbusSimulator(t *testing.T) {
+	store := useTestDeadLetters(t)
+	sim := startModbusSimulator(t)
+	// temperature: int16 215，scale 0.1
+	sim.setHolding(0, 215)
+	// counter: uint32 0x01020304，寄存器内字节低位在前
+	sim.setHolding(20, 0x0201, 0x0403)
+	// flow: float32 1.5，低位寄存器在前
+	sim.input[10], sim.input[11] = 0x0000, 0x3fc0
+	sim.coils[0], sim.discrete[3] = true, true
+
+	m := startTestMqtt(t)
+	received := &modbusTestMessages{latest: make(map[string]string), counts: make(map[string]int)}
+	m.Subscribe("modbus/#", func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		received.mu.Lock()
+		received.latest[pk.TopicName] = string(pk.Payload)
+		received.counts[pk.TopicName]++
+		received.mu.Unlock()
+	})
+
+	path := filepath.Join(t.TempDir(), "modbus.toml")
+	os.WriteFile(path, []byte(fmt.Sprintf(`
+[server]
+name = "modbus-test"
+[modbus]
+mqtt = "mqtt-test"
+[[device]]
+name = "plc1"
+address = %q
+slave_id = 1
+interval = 20
+timeout = 1
+[[device.point]]
+name = "temperature"
+type = "holding"
+address = 0
+data_type = "int16"
+scale = 0.1
+writable = true
+[[device.point]]
+name = "flow"
+type = "input"
+address = 10
+data_type = "float32"
+word_order = "little"
+[[device.point]]
+name = "counter"
+type = "holding"
+address = 20
+data_type = "uint32"
+byte_order = "little"
+[[device.point]]
+name = "pump"
+type = "coil"
+address = 0
+writable = true
+[[device.point]]
+name = "alarm"
+type = "discrete"
+address = 3
+`, sim.ln.Addr().String())), 0o644)
+	mb, err := NewModbusServer(context.Background(), &logger.AppLogger{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mb.LinkMQTT(m); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mb.Start(context.Background())
+	}()
+	t.Cleanup(func() {
+		mb.Stop(context.Background())
+		<-done
+	})
+
+	want := map[string]string{
+		"modbus/plc1/temperature": "21.5",
+		"modbus/plc1/flow":        "1.5",
+		"modbus/plc1/counter":     "16909060",
+		"modbus/plc1/pump":        "true",
+		"modbus/plc1/alarm":       "true",
+	}
+	for topic, value := range want {
+		waitFor(t, func() bool {
+			v, _ := received.get(topic)
+			return v == value
+		})
+	}
+	// 值不变时只发布一次
+	time.Sleep(100 * time.Millisecond)
+	if _, n := received.get("modbus/plc1/temperature"); n != 1 {
+		t.Errorf("unchanged temperature published %d times", n)
+	}
+	sim.setHolding(20, 0x0000, 0x0500)
+	waitFor(t, func() bool {
+		v, _ := received.get("modbus/plc1/counter")
+		return v == "5"
+	})
+
+	// set 主题写入从站，写入后立即发布新值
+	m.Publish("modbus/plc1/temperature/set", []byte("-12.3"), false, 0)
+	waitFor(t, func() bool { return sim.holdingAt(0) == uint16(0xff85) })
+	waitFor(t, func() bool {
+		v, _ := received.get("modbus/plc1/temperature")
+		return v == "-12.3"
+	})
+	m.Publish("modbus/plc1/pump/set", []byte(`{"value": false}`), false, 0)
+	waitFor(t, func() bool { return !sim.coil(0) })
+	waitFor(t, func() bool {
+		v, _ := received.get("modbus/plc1/pump")
+		return v == "false"
+	})
+
+	// 无法解析或超出量程的值产生死信，不写入从站
+	m.Publish("modbus/plc1/pump/set", []byte("abc"), false, 0)
+	m.Publish("modbus/plc1/temperature/set", []byte("4000"), false, 0)
+	waitFor(t, func() bool {
+		_, total := store.List(deadletter.Filter{})
+		return total == 2
+	})
+	letters, _ := store.List(deadletter.Filter{})
+	for _, l := range letters {
+		if l.Destination != "modbus:modbus-test" || l.Servicer != "mqtt-test" {
+			t.Errorf("dead letter = %+v", l)
+		}
+	}
+	if v := sim.holdingAt(0); v != 0xff85 {
+		t.Errorf("temperature register = %#x after rejected write", v)
+	}
+}
@@ -0,0 +1,232 @@
+package services
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"testing"
+)
+
+func TestParseModbusValue(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    float64
+		wantErr bool
+	}{
+		{payload: "21.5", want: 21.5},
+		{payload: " -3 ", want: -3},
+		{payload: "true", want: 1},
+		{payload: "OFF", want: 0},
+		{payload: `{"value": 7}`, want: 7},
+		{payload: `{"value": true}`, want: 1},
+		{payload: "NaN", wantErr: true},
+		{payload: "nan", wantErr: true},
+		{payload: "Inf", wantErr: true},
+		{payload: "+Inf", wantErr: true},
+		{payload: "-Inf", wantErr: true},
+		{payload: "1e400", wantErr: true},
+		{payload: `{"value": "1"}`, wantErr: true},
+		{payload: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseModbusValue([]byte(tt.payload))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseModbusValue(%q) = %v, want an error", tt.payload, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseModbusValue(%q) = %v, %v; want %v", tt.payload, got, err, tt.want)
+		}
+	}
+}
+
+func TestModbusEncodeRange(t *testing.T) {
+	tests := []struct {
+		dataType string
+		value    float64
+		wantErr  bool
+	}{
+		{"int16", math.MaxInt16, false},
+		{"int16", math.MaxInt16 + 1, true},
+		{"int16", math.MinInt16, false},
+		{"int16", math.MinInt16 - 1, true},
+		{"uint16", math.MaxUint16, false},
+		{"uint16", math.MaxUint16 + 1, true},
+		{"uint16", -1, true},
+		{"int32", math.MaxInt32, false},
+		{"int32", math.MaxInt32 + 1, true},
+		{"uint32", math.MaxUint32, false},
+		{"uint32", math.MaxUint32 + 1, true},
+		{"int64", math.MinInt64, false},
+		// float64(MaxInt64) 舍入为 2^63
+		{"int64", math.MaxInt64, true},
+		{"int64", math.Ldexp(1, 63) - 1024, false},
+		{"uint64", math.MaxUint64, true},
+		{"uint64", math.Ldexp(1, 64) - 2048, false},
+		{"float32", math.MaxFloat32, false},
+		{"float32", math.MaxFloat64, true},
+		{"float64", math.MaxFloat64, false},
+	}
+	for _, tt := range tests {
+		p := ModbusPoint{Name: "p", Type: ModbusHolding, DataType: tt.dataType}
+		if err := p.validate(); err != nil {
+			t.Fatal(err)
+		}
+		_, err := p.encode(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s encode(%v): err = %v, wantErr %v", tt.dataType, tt.value, err, tt.wantErr)
+		}
+	}
+
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		for _, dataType := range []string{"int16", "uint16", "int32", "uint32", "int64", "uint64", "float32", "float64"} {
+			p := ModbusPoint{Name: "p", Type: ModbusHolding, DataType: dataType}
+			p.validate()
+			if _, err := p.encode(v); err == nil {
+				t.Errorf("%s encode(%v): expected an error", dataType, v)
+			}
+		}
+	}
+}
+
+// modbusRegisterBytes 按字节序与字序将大端字节排列为寄存器字节
+func modbusRegisterBytes(be []byte, byteOrder, wordOrder string) []byte {
+	var words [][]byte
+	for i := 0; i < len(be); i += 2 {
+		w := []byte{be[i], be[i+1]}
+		if byteOrder == "little" {
+			w[0], w[1] = w[1], w[0]
+		}
+		words = append(words, w)
+	}
+	if wordOrder == "little" {
+		for i, j := 0, len(words)-1; i < j; i, j = i+1, j-1 {
+			words[i], words[j] = words[j], words[i]
+		}
+	}
+	return bytes.Join(words, nil)
+}
+
+func TestModbusDecodeEncodeOrders(t *testing.T) {
+	tests := []struct {
+		dataType string
+		// 大端字节的十六进制
+		be    string
+		value float64
+	}{
+		{"int16", "fffe", -2},
+		{"uint16", "abcd", 0xabcd},
+		{"int32", "fffe1dc0", -123456},
+		{"uint32", "01020304", 0x01020304},
+		{"float32", "3fc00000", 1.5},
+		{"int64", "fffffee08e04fb35", -1234567890123},
+		{"uint64", "00038d7ea4c68000", 1e15},
+		{"float64", "c004000000000000", -2.5},
+	}
+	orders := []string{"big", "little"}
+	for _, tt := range tests {
+		be, _ := hex.DecodeString(tt.be)
+		for _, byteOrder := range orders {
+			for _, wordOrder := range orders {
+				p := ModbusPoint{Name: "p", Type: ModbusHolding, DataType: tt.dataType, ByteOrder: byteOrder, WordOrder: wordOrder}
+				if err := p.validate(); err != nil {
+					t.Fatal(err)
+				}
+				if int(p.registers())*2 != len(be) {
+					t.Fatalf("%s: %d registers for %d bytes", tt.dataType, p.registers(), len(be))
+				}
+				regs := modbusRegisterBytes(be, byteOrder, wordOrder)
+				if v, err := p.decode(regs); err != nil || v != tt.value {
+					t.Errorf("%s %s/%s decode(% x) = %v, %v; want %v", tt.dataType, byteOrder, wordOrder, regs, v, err, tt.value)
+				}
+				if b, err := p.encode(tt.value); err != nil || !bytes.Equal(b, regs) {
+					t.Errorf("%s %s/%s encode(%v) = % x, %v; want % x", tt.dataType, byteOrder, wordOrder, tt.value, b, err, regs)
+				}
+				if _, err := p.decode(regs[:len(regs)-1]); err == nil {
+					t.Errorf("%s %s/%s: short response decoded", tt.dataType, byteOrder, wordOrder)
+				}
+			}
+		}
+	}
+}
+
+func TestModbusRegisterOrderVectors(t *testing.T) {
+	// float32 1.5 在四种字节序组合下的寄存器字节
+	tests := []struct {
+		byteOrder, wordOrder string
+		regs                 string
+	}{
+		{"big", "big", "3fc00000"},
+		{"big", "little", "00003fc0"},
+		{"little", "big", "c03f0000"},
+		{"little", "little", "0000c03f"},
+	}
+	for _, tt := range tests {
+		p := ModbusPoint{Name: "p", Type: ModbusInput, DataType: "float32", ByteOrder: tt.byteOrder, WordOrder: tt.wordOrder}
+		p.validate()
+		regs, _ := hex.DecodeString(tt.regs)
+		if v, err := p.decode(regs); err != nil || v != 1.5 {
+			t.Errorf("%s/%s decode(%s) = %v, %v", tt.byteOrder, tt.wordOrder, tt.regs, v, err)
+		}
+	}
+}
+
+func TestModbusScaleOffset(t *testing.T) {
+	tests := []struct {
+		dataType      string
+		scale, offset float64
+		be            string
+		value         float64
+	}{
+		{"int16", 0.1, 0, "00d7", 21.5},
+		{"int16", 0.1, 0, "ff9c", -10},
+		{"uint16", 0.01, -40, "03e8", -30},
+		{"uint32", 0.1, 0, "0000012e", 30.2},
+		{"int32", 0.5, 10, "fffffed4", -140},
+		{"float32", 2, 1, "3fc00000", 4},
+		{"float64", 0.25, -10, "4059000000000000", 15},
+		{"int64", 1000, 0, "0000000000000007", 7000},
+	}
+	for _, tt := range tests {
+		p := ModbusPoint{Name: "p", Type: ModbusHolding, DataType: tt.dataType, Scale: tt.scale, Offset: tt.offset}
+		if err := p.validate(); err != nil {
+			t.Fatal(err)
+		}
+		regs, _ := hex.DecodeString(tt.be)
+		v, err := p.decode(regs)
+		if err != nil || v != tt.value {
+			t.Errorf("%s scale %v offset %v decode(%s) = %v, %v; want %v", tt.dataType, tt.scale, tt.offset, tt.be, v, err, tt.value)
+			continue
+		}
+		if b, err := p.encode(tt.value); err != nil || !bytes.Equal(b, regs) {
+			t.Errorf("%s scale %v offset %v encode(%v) = % x, %v; want %s", tt.dataType, tt.scale, tt.offset, tt.value, b, err, tt.be)
+		}
+	}
+
+	// scale 为 0 时视为 1
+	p := ModbusPoint{Name: "p", Type: ModbusHolding, DataType: "uint16", Offset: 5}
+	p.validate()
+	if v, _ := p.decode([]byte{0x00, 0x0a}); v != 15.0 {
+		t.Errorf("decode with zero scale = %v, want 15", v)
+	}
+}
+
+func TestModbusDecodeBool(t *testing.T) {
+	p := ModbusPoint{Name: "p", Type: ModbusCoil, DataType: "int32"}
+	if err := p.validate(); err != nil || p.DataType != "bool" {
+		t.Fatalf("coil data type = %q, %v", p.DataType, err)
+	}
+	for _, tt := range []struct {
+		results []byte
+		want    bool
+	}{{[]byte{0x01}, true}, {[]byte{0x00}, false}, {[]byte{0xfe}, false}} {
+		if v, err := p.decode(tt.results); err != nil || v != tt.want {
+			t.Errorf("decode(% x) = %v, %v; want %v", tt.results, v, err, tt.want)
+		}
+	}
+	if _, err := p.decode(nil); err == nil {
+		t.Error("empty coil response decoded")
+	}
+}
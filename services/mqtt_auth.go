@@ -0,0 +1,404 @@
+package services
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/golang-jwt/jwt/v5"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 认证类型
+const (
+	AuthTypeNone  = "none"
+	AuthTypeBasic = "basic"
+	AuthTypeFile  = "file"
+	AuthTypeToken = "token"
+)
+
+// 主题访问权限，用于 ACL 配置
+const (
+	AccessDeny      = "deny"
+	AccessRead      = "r"
+	AccessWrite     = "w"
+	AccessReadWrite = "rw"
+)
+
+// ACL 主题过滤器 -> 访问权限，为空表示不限制
+type ACL map[string]string
+
+type FileAuth struct {
+	// 用户账本文件路径
+	Path string `toml:"path"`
+}
+
+type TokenAuth struct {
+	// HS256/HS384/HS512 使用的密钥
+	Secret string `toml:"secret"`
+	// RS*/ES*/EdDSA 使用的 PEM 公钥文件
+	PublicKeyFile string `toml:"public_key_file"`
+	Issuer        string `toml:"issuer"`
+	Audience      string `toml:"audience"`
+	// 携带主题 ACL 的声明名称，默认 acl
+	ACLClaim string `toml:"acl_claim"`
+}
+
+// AuthLedger 用户账本文件结构
+type AuthLedger struct {
+	Users []LedgerUser `toml:"users"`
+}
+
+// LedgerUser 账本中的用户，Password 为 bcrypt 哈希
+type LedgerUser struct {
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	ACL      ACL    `toml:"acl"`
+}
+
+var (
+	errBadCredentials = errors.New("bad username or password")
+	errAnonymous      = errors.New("anonymous access is not allowed")
+	errNoCredentials  = errors.New("auth type none does not accept credentials")
+)
+
+// authHook 按配置的认证类型校验连接并执行主题 ACL
+type authHook struct {
+	server.HookBase
+	config *MQTTConfig
+	// 用户名 -> 账本用户，file 类型使用
+	users map[string]LedgerUser
+	// token 类型的验签密钥与解析器
+	tokenKey    any
+	tokenParser *jwt.Parser
+	// 客户端 -> ACL，会话存续期间保留，离线的持久会话仍按其 ACL 接收消息。
+	// 按 *server.Client 而不是客户端ID 记录，会话被同ID的新连接接管时，旧连接的断开不影响新连接的 ACL
+	acls sync.Map
+}
+
+func newAuthHook(config *MQTTConfig) (*authHook, error) {
+	h := &authHook{config: config}
+	if err := config.Auth.AnonymousACL.Validate(); err != nil {
+		return nil, fmt.Errorf("auth.anonymous_acl: %w", err)
+	}
+
+	switch strings.ToLower(config.Auth.Type) {
+	case "", AuthTypeNone:
+		// none 只接受匿名连接与证书认证，两者都不允许时没有客户端可以连接
+		if !config.MQTT.AllowAnonymous && !config.Auth.CertAsUsername {
+			return nil, errors.New("auth.type = none requires mqtt.allow_anonymous or auth.cert_as_username")
+		}
+	case AuthTypeBasic:
+		if config.Auth.Basic.Username == "" {
+			return nil, errors.New("auth.basic.username is required")
+		}
+		if err := config.Auth.Basic.ACL.Validate(); err != nil {
+			return nil, fmt.Errorf("auth.basic.acl: %w", err)
+		}
+	case AuthTypeFile:
+		if err := h.loadLedger(config.Auth.File.Path); err != nil {
+			return nil, err
+		}
+	case AuthTypeToken:
+		if err := h.loadTokenKey(&config.Auth.Token); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth type %q", config.Auth.Type)
+	}
+	return h, nil
+}
+
+func (h *authHook) loadLedger(path string) error {
+	if path == "" {
+		return errors.New("auth.file.path is required")
+	}
+	var ledger AuthLedger
+	if _, err := toml.DecodeFile(path, &ledger); err != nil {
+		return fmt.Errorf("load auth ledger %s: %w", path, err)
+	}
+	h.users = make(map[string]LedgerUser, len(ledger.Users))
+	for _, u := range ledger.Users {
+		if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+			return fmt.Errorf("auth ledger %s: user %q password is not a bcrypt hash", path, u.Username)
+		}
+		if err := u.ACL.Validate(); err != nil {
+			return fmt.Errorf("auth ledger %s: user %q: %w", path, u.Username, err)
+		}
+		h.users[u.Username] = u
+	}
+	return nil
+}
+
+func (h *authHook) loadTokenKey(config *TokenAuth) error {
+	var methods []string
+	switch {
+	case config.Secret != "":
+		h.tokenKey = []byte(config.Secret)
+		methods = []string{"HS256", "HS384", "HS512"}
+	case config.PublicKeyFile != "":
+		pem, err := os.ReadFile(config.PublicKeyFile)
+		if err != nil {
+			return fmt.Errorf("read token public key: %w", err)
+		}
+		if key, err := jwt.ParseRSAPublicKeyFromPEM(pem); err == nil {
+			h.tokenKey = key
+			methods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+		} else if key, err := jwt.ParseECPublicKeyFromPEM(pem); err == nil {
+			h.tokenKey = key
+			methods = []string{"ES256", "ES384", "ES512"}
+		} else if key, err := jwt.ParseEdPublicKeyFromPEM(pem); err == nil {
+			h.tokenKey = key
+			methods = []string{"EdDSA"}
+		} else {
+			return fmt.Errorf("token public key %s: unsupported key type", config.PublicKeyFile)
+		}
+	default:
+		return errors.New("auth.token.secret or auth.token.public_key_file is required")
+	}
+
+	opts := []jwt.ParserOption{jwt.WithValidMethods(methods)}
+	if config.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(config.Issuer))
+	}
+	if config.Audience != "" {
+		opts = append(opts, jwt.WithAudience(config.Audience))
+	}
+	h.tokenParser = jwt.NewParser(opts...)
+	return nil
+}
+
+// ID 返回钩子标识
+func (h *authHook) ID() string {
+	return "servicer-auth"
+}
+
+// Provides 声明钩子实现的方法
+func (h *authHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		server.OnConnectAuthenticate,
+		server.OnACLCheck,
+		server.OnDisconnect,
+		server.OnClientExpired,
+	}, []byte{b})
+}
+
+// OnConnectAuthenticate 校验连接凭据，通过后记录该连接的 ACL
+func (h *authHook) OnConnectAuthenticate(cl *server.Client, pk packets.Packet) bool {
+	acl, err := h.authenticate(cl, pk)
+	if err != nil {
+		h.Log.Info("mqtt client authentication failed",
+			"client", cl.ID,
+			"username", string(pk.Connect.Username),
+			"remote", cl.Net.Remote,
+			"error", err)
+		return false
+	}
+	h.acls.Store(cl, acl)
+	return true
+}
+
+func (h *authHook) authenticate(cl *server.Client, pk packets.Packet) (ACL, error) {
+	return h.credentials(string(pk.Connect.Username), pk.Connect.Password, util.IdentityFromConn(cl.Net.Conn))
+}
+
+// credentials 按认证配置校验用户名与密码，identity 为已校验的客户端证书身份，可为 nil。
+// STOMP 等经由该 MQTT servicer 收发消息的协议使用同一套账号与 ACL
+func (h *authHook) credentials(username string, password []byte, identity *util.ClientIdentity) (ACL, error) {
+	// 未携带任何凭据时，可使用已校验的客户端证书认证，否则视为匿名连接
+	if username == "" && len(password) == 0 {
+		if identity != nil && h.config.Auth.CertAsUsername {
+			return h.authenticateCert(identity)
+		}
+		if !h.config.MQTT.AllowAnonymous {
+			return nil, errAnonymous
+		}
+		return h.config.Auth.AnonymousACL, nil
+	}
+
+	if h.config.Auth.RequireCertMatch && !identity.Matches(username) {
+		return nil, fmt.Errorf("username does not match client certificate")
+	}
+
+	switch strings.ToLower(h.config.Auth.Type) {
+	case "", AuthTypeNone:
+		// 没有可校验的账号，携带凭据的连接不能获得匿名 ACL 之外的权限
+		return nil, errNoCredentials
+	case AuthTypeBasic:
+		basic := h.config.Auth.Basic
+		userOk := subtle.ConstantTimeCompare([]byte(username), []byte(basic.Username)) == 1
+		passOk := subtle.ConstantTimeCompare(password, []byte(basic.Password)) == 1
+		if !userOk || !passOk {
+			return nil, errBadCredentials
+		}
+		return basic.ACL, nil
+	case AuthTypeFile:
+		u, ok := h.users[username]
+		if !ok || bcrypt.CompareHashAndPassword([]byte(u.Password), password) != nil {
+			return nil, errBadCredentials
+		}
+		return u.ACL, nil
+	case AuthTypeToken:
+		return h.verifyToken(username, string(password))
+	}
+	return nil, fmt.Errorf("unknown auth type %q", h.config.Auth.Type)
+}
+
+// authenticateCert 以证书 CN 作为用户名认证，不再校验密码
+func (h *authHook) authenticateCert(identity *util.ClientIdentity) (ACL, error) {
+	switch strings.ToLower(h.config.Auth.Type) {
+	case "", AuthTypeNone:
+		return nil, nil
+	case AuthTypeBasic:
+		if identity.CommonName != h.config.Auth.Basic.Username {
+			return nil, errBadCredentials
+		}
+		return h.config.Auth.Basic.ACL, nil
+	case AuthTypeFile:
+		u, ok := h.users[identity.CommonName]
+		if !ok {
+			return nil, errBadCredentials
+		}
+		return u.ACL, nil
+	}
+	return nil, fmt.Errorf("client certificate authentication is not supported by auth type %q", h.config.Auth.Type)
+}
+
+// verifyToken 校验 CONNECT 密码字段中携带的 JWT，用户名需与 sub 声明一致
+func (h *authHook) verifyToken(username, token string) (ACL, error) {
+	claims := jwt.MapClaims{}
+	if _, err := h.tokenParser.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) {
+		return h.tokenKey, nil
+	}); err != nil {
+		return nil, err
+	}
+	if sub, _ := claims.GetSubject(); username != "" && sub != "" && sub != username {
+		return nil, fmt.Errorf("token subject %q does not match username", sub)
+	}
+
+	claim := h.config.Auth.Token.ACLClaim
+	if claim == "" {
+		claim = "acl"
+	}
+	// 空 ACL 表示不限制，token 必须显式授予主题，不携带或为空时拒绝连接
+	raw, ok := claims[claim]
+	if !ok {
+		return nil, fmt.Errorf("token has no %q claim", claim)
+	}
+	filters, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("token claim %q must be an object", claim)
+	}
+	if len(filters) == 0 {
+		return nil, fmt.Errorf("token claim %q grants no topics", claim)
+	}
+	acl := make(ACL, len(filters))
+	for filter, access := range filters {
+		s, ok := access.(string)
+		if !ok {
+			return nil, fmt.Errorf("token claim %q: access for %q must be a string", claim, filter)
+		}
+		acl[filter] = s
+	}
+	if err := acl.Validate(); err != nil {
+		return nil, fmt.Errorf("token claim %q: %w", claim, err)
+	}
+	return acl, nil
+}
+
+// OnACLCheck 检查连接对主题的读写权限
+func (h *authHook) OnACLCheck(cl *server.Client, topic string, write bool) bool {
+	if v, ok := h.acls.Load(cl); ok {
+		return v.(ACL).Allows(topic, write)
+	}
+	acl, ok := h.restoredACL(cl)
+	if !ok {
+		return false
+	}
+	h.acls.Store(cl, acl)
+	return acl.Allows(topic, write)
+}
+
+// restoredACL 为从 [storage] 恢复、重启后尚未重连的会话按用户名推算 ACL；
+// token 认证的 ACL 来自连接时的 token，无法推算，客户端重连前不投递消息
+func (h *authHook) restoredACL(cl *server.Client) (ACL, bool) {
+	username := string(cl.Properties.Username)
+	if username == "" {
+		if !h.config.MQTT.AllowAnonymous {
+			return nil, false
+		}
+		return h.config.Auth.AnonymousACL, true
+	}
+	switch strings.ToLower(h.config.Auth.Type) {
+	case AuthTypeBasic:
+		if username != h.config.Auth.Basic.Username {
+			return nil, false
+		}
+		return h.config.Auth.Basic.ACL, true
+	case AuthTypeFile:
+		u, ok := h.users[username]
+		return u.ACL, ok
+	}
+	return nil, false
+}
+
+// OnDisconnect 会话随连接结束或被新连接接管时清理 ACL，持久会话保留到重连或过期
+func (h *authHook) OnDisconnect(cl *server.Client, err error, expire bool) {
+	if expire || cl.IsTakenOver() {
+		h.acls.Delete(cl)
+	}
+}
+
+// OnClientExpired 持久会话过期后清理 ACL
+func (h *authHook) OnClientExpired(cl *server.Client) {
+	h.acls.Delete(cl)
+}
+
+// Allows 判断 ACL 是否允许对主题的读或写，任一匹配的 deny 规则优先，
+// 未配置任何规则时不限制
+func (acl ACL) Allows(topic string, write bool) bool {
+	if len(acl) == 0 {
+		return true
+	}
+	allowed := false
+	for filter, access := range acl {
+		if _, ok := auth.MatchTopic(filter, topic); !ok {
+			continue
+		}
+		switch strings.ToLower(access) {
+		case AccessDeny:
+			return false
+		case AccessReadWrite:
+			allowed = true
+		case AccessRead:
+			allowed = allowed || !write
+		case AccessWrite:
+			allowed = allowed || write
+		}
+	}
+	return allowed
+}
+
+// Validate 校验 ACL 中的访问权限取值
+func (acl ACL) Validate() error {
+	for filter, access := range acl {
+		if !server.IsValidFilter(filter, false) {
+			return fmt.Errorf("invalid acl filter %q", filter)
+		}
+		switch strings.ToLower(access) {
+		case AccessDeny, AccessRead, AccessWrite, AccessReadWrite:
+		default:
+			return fmt.Errorf("invalid access %q for acl filter %q", access, filter)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestAuthHook 创建日志输出被丢弃的认证钩子
+func newTestAuthHook(config *MQTTConfig) (*authHook, error) {
+	h, err := newAuthHook(config)
+	if err != nil {
+		return nil, err
+	}
+	h.Log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return h, nil
+}
+
+func connectPacket(username, password string) packets.Packet {
+	return packets.Packet{Connect: packets.ConnectParams{
+		Username: []byte(username),
+		Password: []byte(password),
+	}}
+}
+
+func TestAuthNoneAcceptsOnlyAnonymous(t *testing.T) {
+	config := &MQTTConfig{}
+	config.Auth.Type = AuthTypeNone
+	config.MQTT.AllowAnonymous = true
+	config.Auth.AnonymousACL = ACL{"public/#": AccessReadWrite}
+	h, err := newTestAuthHook(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl := &server.Client{ID: "anon"}
+	if !h.OnConnectAuthenticate(cl, connectPacket("", "")) {
+		t.Fatal("anonymous client rejected")
+	}
+	if !h.OnACLCheck(cl, "public/a", true) || h.OnACLCheck(cl, "private/a", true) {
+		t.Fatal("anonymous client is not limited by anonymous_acl")
+	}
+
+	for _, pk := range []packets.Packet{connectPacket("admin", "made-up"), connectPacket("admin", ""), connectPacket("", "secret")} {
+		if h.OnConnectAuthenticate(&server.Client{ID: "with-credentials"}, pk) {
+			t.Errorf("client with username %q password %q accepted", pk.Connect.Username, pk.Connect.Password)
+		}
+	}
+}
+
+func TestAuthNoneRequiresAnonymousOrCertificates(t *testing.T) {
+	config := &MQTTConfig{}
+	config.Auth.Type = AuthTypeNone
+	if _, err := newAuthHook(config); err == nil {
+		t.Fatal("auth none without allow_anonymous: expected an error")
+	}
+	config.Auth.CertAsUsername = true
+	if _, err := newAuthHook(config); err != nil {
+		t.Fatalf("auth none with cert_as_username: %v", err)
+	}
+}
+
+func TestAuthBasic(t *testing.T) {
+	config := &MQTTConfig{}
+	config.Auth.Type = AuthTypeBasic
+	config.Auth.Basic = BaseAuth{Username: "admin", Password: "password", ACL: ACL{"devices/#": AccessRead}}
+	h, err := newTestAuthHook(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.OnConnectAuthenticate(&server.Client{ID: "anon"}, connectPacket("", "")) {
+		t.Fatal("anonymous client accepted with allow_anonymous = false")
+	}
+	if h.OnConnectAuthenticate(&server.Client{ID: "wrong"}, connectPacket("admin", "wrong")) {
+		t.Fatal("wrong password accepted")
+	}
+	cl := &server.Client{ID: "admin"}
+	if !h.OnConnectAuthenticate(cl, connectPacket("admin", "password")) {
+		t.Fatal("valid credentials rejected")
+	}
+	if !h.OnACLCheck(cl, "devices/a", false) || h.OnACLCheck(cl, "devices/a", true) {
+		t.Fatal("basic acl not applied")
+	}
+}
+
+func TestAuthFile(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users.toml")
+	os.WriteFile(path, []byte(fmt.Sprintf(`
+[[users]]
+username = "device"
+password = %q
+[users.acl]
+"devices/device/#" = "rw"
+"devices/device/secret" = "deny"
+`, hash)), 0o644)
+
+	config := &MQTTConfig{}
+	config.Auth.Type = AuthTypeFile
+	config.Auth.File.Path = path
+	h, err := newTestAuthHook(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pk := range []packets.Packet{connectPacket("device", "wrong"), connectPacket("nobody", "secret"), connectPacket("", "")} {
+		if h.OnConnectAuthenticate(&server.Client{ID: "rejected"}, pk) {
+			t.Errorf("username %q password %q accepted", pk.Connect.Username, pk.Connect.Password)
+		}
+	}
+	cl := &server.Client{ID: "device"}
+	if !h.OnConnectAuthenticate(cl, connectPacket("device", "secret")) {
+		t.Fatal("valid credentials rejected")
+	}
+	if !h.OnACLCheck(cl, "devices/device/a", true) || h.OnACLCheck(cl, "devices/other/a", false) ||
+		h.OnACLCheck(cl, "devices/device/secret", false) {
+		t.Fatal("ledger acl not applied")
+	}
+
+	// 密码不是 bcrypt 哈希时启动失败
+	os.WriteFile(path, []byte("[[users]]\nusername = \"device\"\npassword = \"secret\"\n"), 0o644)
+	if _, err := newAuthHook(config); err == nil {
+		t.Fatal("plain text ledger password: expected an error")
+	}
+}
+
+func signTestToken(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuthToken(t *testing.T) {
+	config := &MQTTConfig{}
+	config.Auth.Type = AuthTypeToken
+	config.Auth.Token = TokenAuth{Secret: "secret", Issuer: "issuer"}
+	h, err := newTestAuthHook(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl := map[string]any{"devices/device/#": "rw"}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name     string
+		username string
+		token    string
+		ok       bool
+	}{
+		{"valid", "device", signTestToken(t, "secret", jwt.MapClaims{"sub": "device", "iss": "issuer", "exp": exp, "acl": acl}), true},
+		{"empty username", "", signTestToken(t, "secret", jwt.MapClaims{"sub": "device", "iss": "issuer", "exp": exp, "acl": acl}), true},
+		{"subject mismatch", "other", signTestToken(t, "secret", jwt.MapClaims{"sub": "device", "iss": "issuer", "exp": exp, "acl": acl}), false},
+		{"bad signature", "device", signTestToken(t, "wrong", jwt.MapClaims{"sub": "device", "iss": "issuer", "exp": exp, "acl": acl}), false},
+		{"wrong issuer", "device", signTestToken(t, "secret", jwt.MapClaims{"sub": "device", "iss": "other", "exp": exp, "acl": acl}), false},
+		{"expired", "device", signTestToken(t, "secret", jwt.MapClaims{"sub": "device", "iss": "issuer", "exp": time.Now().Add(-time.Hour).Unix(), "acl": acl}), false},
+		{"no acl claim", "device", signTestToken(t, "secret", jwt.MapClaims{"sub": "device", "iss": "issuer", "exp": exp}), false},
+		{"empty acl claim", "device", signTestToken(t, "secret", jwt.MapClaims{"sub": "device", "iss": "issuer", "exp": exp, "acl": map[string]any{}}), false},
+		{"invalid acl access", "device", signTestToken(t, "secret", jwt.MapClaims{"sub": "device", "iss": "issuer", "exp": exp, "acl": map[string]any{"#": "all"}}), false},
+		{"not a token", "device", "secret", false},
+	}
+	for _, tt := range tests {
+		cl := &server.Client{ID: tt.name}
+		if ok := h.OnConnectAuthenticate(cl, connectPacket(tt.username, tt.token)); ok != tt.ok {
+			t.Errorf("%s: authenticated = %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if tt.ok && (!h.OnACLCheck(cl, "devices/device/a", true) || h.OnACLCheck(cl, "devices/other/a", false)) {
+			t.Errorf("%s: token acl not applied", tt.name)
+		}
+	}
+}
+
+// TestAuthTakeoverKeepsACL 同一客户端ID重连接管会话后，旧连接的断开不清除新连接的 ACL
+func TestAuthTakeoverKeepsACL(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "mqtt.sock")
+	m := newTestMqtt(t, fmt.Sprintf(`
+[server]
+name = "mqtt-test"
+address = "127.0.0.1:0"
+[auth]
+type = "token"
+[auth.token]
+secret = "secret"
+[[listeners]]
+type = "unix"
+address = %q
+`, sock))
+	runTestMqtt(t, m)
+	token := signTestToken(t, "secret", jwt.MapClaims{"sub": "device", "acl": map[string]any{"devices/#": "r"}})
+	connect := func(c *mqttTestClient) {
+		c.write(packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Connect},
+			Connect: packets.ConnectParams{
+				ProtocolName:     []byte("MQTT"),
+				ClientIdentifier: "device",
+				Clean:            true,
+				Keepalive:        60,
+				UsernameFlag:     true,
+				Username:         []byte("device"),
+				PasswordFlag:     true,
+				Password:         []byte(token),
+			},
+		}, (*packets.Packet).ConnectEncode)
+		if ack := c.expect(packets.Connack); ack.ReasonCode != packets.CodeSuccess.Code {
+			t.Fatalf("connack reason %#x", ack.ReasonCode)
+		}
+	}
+
+	old := dialTestMqtt(t, sock)
+	connect(old)
+	c := dialTestMqtt(t, sock)
+	connect(c)
+	// 旧连接的 OnDisconnect 返回后 broker 才减少已连接数
+	waitFor(t, func() bool { return atomic.LoadInt64(&m.Server.Info.ClientsConnected) == 1 })
+
+	c.write(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+		PacketID:    1,
+		Filters:     packets.Subscriptions{{Filter: "devices/#"}},
+	}, (*packets.Packet).SubscribeEncode)
+	if ack := c.expect(packets.Suback); len(ack.ReasonCodes) != 1 || ack.ReasonCodes[0] != packets.CodeGrantedQos0.Code {
+		t.Fatalf("suback after takeover = %v", ack.ReasonCodes)
+	}
+	if err := m.Publish("devices/a", []byte("1"), false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if pk := c.expect(packets.Publish); pk.TopicName != "devices/a" {
+		t.Fatalf("delivery after takeover = %s", pk.TopicName)
+	}
+}
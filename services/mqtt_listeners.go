@@ -0,0 +1,117 @@
+package services
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/networkProtocalTrans/util"
+)
+
+// MQTT 额外监听器类型
+const (
+	MQTTListenerTCP       = "tcp"
+	MQTTListenerWebsocket = "ws"
+	MQTTListenerUnix      = "unix"
+	MQTTListenerHTTPStats = "http-stats"
+)
+
+// MQTTListenerConfig [[listeners]] 中的一个额外监听器，与 [server] address 上的主监听器共用同一 broker
+type MQTTListenerConfig struct {
+	// tcp, ws（MQTT over websocket，任意路径，子协议 mqtt）, unix, http-stats（GET 返回 broker 统计 JSON）
+	Type string `toml:"type"`
+	// 监听器 ID，默认为 <servicer 名称>-<type>-<序号>
+	ID string `toml:"id"`
+	// 监听地址，unix 为 socket 文件路径（启动时删除已存在的文件）
+	Address string `toml:"address"`
+	// 该监听器上的最大连接数，0 表示不限制，http-stats 不适用
+	MaxConnections int `toml:"max_connections"`
+	// 该监听器的 TLS 配置，unix 不支持，tls.address 不适用
+	TLS util.TLSConfig `toml:"tls"`
+}
+
+// validateListeners 校验额外监听器配置并填充默认 ID
+func (c *MQTTConfig) validateListeners() error {
+	ids := map[string]bool{c.listenerID(): true, c.listenerID() + "-tls": true}
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		switch l.Type {
+		case MQTTListenerTCP, MQTTListenerWebsocket, MQTTListenerHTTPStats:
+		case MQTTListenerUnix:
+			if l.TLS.Enable {
+				return fmt.Errorf("listeners #%d: tls is not supported on unix listeners", i+1)
+			}
+		default:
+			return fmt.Errorf("listeners #%d: unknown type %q", i+1, l.Type)
+		}
+		if l.Address == "" {
+			return fmt.Errorf("listeners #%d: address is required", i+1)
+		}
+		if l.TLS.Address != "" {
+			return fmt.Errorf("listeners #%d: tls.address is not supported, add another listener instead", i+1)
+		}
+		if l.MaxConnections < 0 {
+			return fmt.Errorf("listeners #%d: max_connections = %d is out of range", i+1, l.MaxConnections)
+		}
+		if l.ID == "" {
+			l.ID = fmt.Sprintf("%s-%s-%d", c.Server.Name, l.Type, i+1)
+		}
+		if ids[l.ID] {
+			return fmt.Errorf("listeners #%d: duplicate id %q", i+1, l.ID)
+		}
+		ids[l.ID] = true
+	}
+	return nil
+}
+
+// listenerID 主监听器 ID，未配置 tcp.id 时使用 servicer 名称
+func (c *MQTTConfig) listenerID() string {
+	if c.TCP.ID != "" {
+		return c.TCP.ID
+	}
+	return c.Server.Name + "-tcp"
+}
+
+// loadListenerTLS 加载各额外监听器的证书，未启用 TLS 的监听器对应 nil
+func (c *MQTTConfig) loadListenerTLS() ([]*tls.Config, error) {
+	configs := make([]*tls.Config, len(c.Listeners))
+	for i := range c.Listeners {
+		config, err := c.Listeners[i].TLS.Load()
+		if err != nil {
+			return nil, fmt.Errorf("listener %s tls: %w", c.Listeners[i].ID, err)
+		}
+		configs[i] = config
+	}
+	return configs, nil
+}
+
+// addListeners 将额外监听器加入 broker
+func (m *mqttServer) addListeners(s *server.Server) error {
+	for i, l := range m.config.Listeners {
+		config := listeners.Config{
+			ID:        l.ID,
+			Address:   l.Address,
+			TLSConfig: m.listenerTLS[i],
+		}
+		var listener listeners.Listener
+		switch l.Type {
+		case MQTTListenerTCP:
+			listener = listeners.NewTCP(config)
+		case MQTTListenerWebsocket:
+			listener = listeners.NewWebsocket(config)
+		case MQTTListenerUnix:
+			listener = listeners.NewUnixSock(config)
+		case MQTTListenerHTTPStats:
+			// 统计接口不建立 MQTT 连接，不需要连接数与超时控制
+			if err := s.AddListener(listeners.NewHTTPStats(config, s.Info)); err != nil {
+				return fmt.Errorf("add %s listener %s: %w", l.Type, l.ID, err)
+			}
+			continue
+		}
+		if err := s.AddListener(newLimitListener(listener, l.MaxConnections, m.config.Connection)); err != nil {
+			return fmt.Errorf("add %s listener %s: %w", l.Type, l.ID, err)
+		}
+	}
+	return nil
+}
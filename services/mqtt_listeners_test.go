@@ -0,0 +1,272 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/logger"
+)
+
+// freeAddr 返回当前未被占用的本地地址，用于无法监听 :0 后取回端口的 http 类监听器
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// writeTestCert 生成 127.0.0.1 的自签名证书，返回证书与私钥文件路径及信任该证书的 CertPool
+func writeTestCert(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mqtt-test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestMQTTListenersValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string   // 错误信息片段，为空时应校验通过
+		ids    []string // 校验后各监听器的 ID
+	}{
+		{"default ids", `
+[[listeners]]
+type = "ws"
+address = ":1882"
+[[listeners]]
+type = "unix"
+address = "/tmp/mqtt.sock"
+[[listeners]]
+type = "http-stats"
+id = "stats"
+address = ":8080"
+[[listeners]]
+type = "tcp"
+address = ":8883"
+max_connections = 10
+[listeners.tls]
+enable = true
+`, "", []string{"mqtt-test-ws-1", "mqtt-test-unix-2", "stats", "mqtt-test-tcp-4"}},
+		{"unknown type", "[[listeners]]\ntype = \"quic\"\naddress = \":1\"", `listeners #1: unknown type "quic"`, nil},
+		{"missing address", "[[listeners]]\ntype = \"ws\"", "listeners #1: address is required", nil},
+		{"tls on unix", "[[listeners]]\ntype = \"unix\"\naddress = \"a.sock\"\n[listeners.tls]\nenable = true", "tls is not supported on unix listeners", nil},
+		{"tls address", "[[listeners]]\ntype = \"ws\"\naddress = \":1\"\n[listeners.tls]\naddress = \":2\"", "tls.address is not supported", nil},
+		{"negative max_connections", "[[listeners]]\ntype = \"tcp\"\naddress = \":1\"\nmax_connections = -1", "max_connections = -1 is out of range", nil},
+		{"duplicate id", "[[listeners]]\ntype = \"tcp\"\nid = \"a\"\naddress = \":1\"\n[[listeners]]\ntype = \"ws\"\nid = \"a\"\naddress = \":2\"", `listeners #2: duplicate id "a"`, nil},
+		{"main listener id", "[[listeners]]\ntype = \"tcp\"\nid = \"mqtt-test-tcp\"\naddress = \":1\"", "duplicate id", nil},
+		{"main tls listener id", "[[listeners]]\ntype = \"tcp\"\nid = \"mqtt-test-tcp-tls\"\naddress = \":1\"", "duplicate id", nil},
+		{"custom main listener id", "[tcp]\nid = \"t1\"\n[[listeners]]\ntype = \"tcp\"\nid = \"t1\"\naddress = \":1\"", `duplicate id "t1"`, nil},
+	}
+	for _, tt := range tests {
+		c := decodeMQTTConfig(t, tt.config)
+		err := c.validate()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+			continue
+		}
+		for i, id := range tt.ids {
+			if c.Listeners[i].ID != id {
+				t.Errorf("%s: listener %d id = %q, want %q", tt.name, i+1, c.Listeners[i].ID, id)
+			}
+		}
+	}
+}
+
+func TestMQTTListenerTLSLoadError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.toml")
+	os.WriteFile(path, []byte(testMqttConfig+`
+[[listeners]]
+type = "tcp"
+address = "127.0.0.1:0"
+[listeners.tls]
+enable = true
+cert_file = "missing.pem"
+key_file = "missing.pem"
+`), 0o644)
+	_, err := NewMqttServer(context.Background(), &logger.AppLogger{}, path)
+	if err == nil || !strings.Contains(err.Error(), "listener mqtt-test-tcp-1 tls") {
+		t.Fatalf("error = %v", err)
+	}
+}
+
+func TestMQTTExtraListeners(t *testing.T) {
+	certFile, keyFile, pool := writeTestCert(t)
+	sock := filepath.Join(t.TempDir(), "mqtt.sock")
+	wsAddr, statsAddr := freeAddr(t), freeAddr(t)
+	m := newTestMqtt(t, testMqttConfig+fmt.Sprintf(`
+[[listeners]]
+type = "tcp"
+id = "extra"
+address = "127.0.0.1:0"
+max_connections = 1
+[[listeners]]
+type = "tcp"
+id = "secure"
+address = "127.0.0.1:0"
+[listeners.tls]
+enable = true
+cert_file = %q
+key_file = %q
+[[listeners]]
+type = "ws"
+id = "ws"
+address = %q
+[[listeners]]
+type = "unix"
+id = "unix"
+address = %q
+[[listeners]]
+type = "http-stats"
+id = "stats"
+address = %q
+`, certFile, keyFile, wsAddr, sock, statsAddr))
+	runTestMqtt(t, m)
+
+	address := func(id string) string {
+		l, ok := m.Server.Listeners.Get(id)
+		if !ok {
+			t.Fatalf("listener %s not found", id)
+		}
+		if _, limited := l.(*limitListener); limited == (id == "stats") {
+			t.Errorf("listener %s: %T", id, l)
+		}
+		return l.Address()
+	}
+	newClient := func(conn net.Conn) *mqttTestClient {
+		t.Cleanup(func() { conn.Close() })
+		return &mqttTestClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	}
+
+	// tcp，超过该监听器 max_connections 的连接被关闭
+	conn, err := net.Dial("tcp", address("extra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newClient(conn).connect("tcp-client")
+	conn, err = net.Dial("tcp", address("extra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("connection over max_connections: read error = %v, want closed", err)
+	}
+	conn.Close()
+
+	// tcp + TLS
+	conn, err = tls.Dial("tcp", address("secure"), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newClient(conn).connect("tls-client")
+
+	// unix socket
+	dialTestMqtt(t, address("unix")).connect("unix-client")
+
+	// MQTT over websocket，子协议 mqtt，每个报文一个二进制消息
+	// ws 与 http-stats 监听器在 broker 启动后异步开始监听
+	dialer := websocket.Dialer{Subprotocols: []string{"mqtt"}}
+	var ws *websocket.Conn
+	waitFor(t, func() bool {
+		ws, _, err = dialer.Dial("ws://"+address("ws")+"/mqtt", nil)
+		return err == nil
+	})
+	defer ws.Close()
+	pk := packets.Packet{
+		ProtocolVersion: 4,
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		Connect:         packets.ConnectParams{ProtocolName: []byte("MQTT"), ClientIdentifier: "ws-client", Keepalive: 60},
+	}
+	var buf bytes.Buffer
+	if err := pk.ConnectEncode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, ack, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ack) != 4 || ack[0]>>4 != packets.Connack || ack[3] != packets.CodeSuccess.Code {
+		t.Fatalf("websocket connack = %x", ack)
+	}
+
+	// http-stats 返回 broker 统计
+	waitFor(t, func() bool { return atomic.LoadInt64(&m.Server.Info.ClientsConnected) == 4 })
+	var resp *http.Response
+	waitFor(t, func() bool {
+		resp, err = http.Get("http://" + address("stats"))
+		return err == nil
+	})
+	defer resp.Body.Close()
+	var info struct {
+		ClientsConnected int64 `json:"clients_connected"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ClientsConnected != 4 {
+		t.Errorf("stats clients_connected = %d, want 4", info.ClientsConnected)
+	}
+}
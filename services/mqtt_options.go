@@ -0,0 +1,212 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	// MQTT 协议允许的最大报文长度：剩余长度上限 268435455 加 5 字节固定报头
+	maxMQTTPacketSize = 268435460
+	// 连接级超时的上限（秒）
+	maxConnectionTimeout = 24 * 60 * 60
+	// 客户端网络缓冲区大小上限（字节）
+	maxClientBufferSize = 16 * 1024 * 1024
+)
+
+// rangeCheck 配置项的取值范围
+type rangeCheck struct {
+	name     string
+	value    int64
+	min, max int64
+}
+
+// validate 校验配置取值范围，超出范围时返回错误而不是忽略
+func (c *MQTTConfig) validate() error {
+	if c.Server.Address == "" {
+		return fmt.Errorf("server.address is required")
+	}
+
+	checks := []rangeCheck{
+		{"tcp.max_connections", int64(c.TCP.MaxConnections), 0, math.MaxInt32},
+		{"tcp.buffer_size", int64(c.TCP.BufferSize), 0, maxClientBufferSize},
+		{"connection.max_connections", int64(c.Connection.MaxConnections), 0, math.MaxInt32},
+		{"connection.heartbeat_timeout", int64(c.Connection.HeartbeatTimeout), 0, maxConnectionTimeout},
+		{"connection.write_timeout", int64(c.Connection.WriteTimeout), 0, maxConnectionTimeout},
+		{"connection.read_timeout", int64(c.Connection.ReadTimeout), 0, maxConnectionTimeout},
+		{"mqtt.max_message_size", int64(c.MQTT.MaxMessageSize), 0, maxMQTTPacketSize},
+		{"mqtt.keep_alive", int64(c.MQTT.KeepAlive), 0, math.MaxUint16},
+		{"mqtt.session_expiry", int64(c.MQTT.SessionExpiry), 0, math.MaxUint32},
+		{"mqtt.message_expiry", c.MQTT.MessageExpiry, 0, math.MaxUint32},
+		{"mqtt.receive_maximum", int64(c.MQTT.ReceiveMaximum), 0, math.MaxUint16},
+		{"mqtt.maximum_inflight", int64(c.MQTT.MaximumInflight), 0, math.MaxUint16},
+		{"mqtt.writes_pending", int64(c.MQTT.WritesPending), 0, math.MaxInt32},
+	}
+	if c.MQTT.MaximumQoS != nil {
+		checks = append(checks, rangeCheck{"mqtt.maximum_qos", int64(*c.MQTT.MaximumQoS), 0, 2})
+	}
+	for _, check := range checks {
+		if check.value < check.min || check.value > check.max {
+			return fmt.Errorf("%s = %d is out of range [%d, %d]", check.name, check.value, check.min, check.max)
+		}
+	}
+	if c.TCP.BufferSize > 0 && c.TCP.BufferSize < 512 {
+		return fmt.Errorf("tcp.buffer_size = %d is too small, minimum is 512", c.TCP.BufferSize)
+	}
+	if c.MQTT.MaxMessageSize > 0 && c.MQTT.MaxMessageSize < 64 {
+		return fmt.Errorf("mqtt.max_message_size = %d is too small, minimum is 64", c.MQTT.MaxMessageSize)
+	}
+	if err := c.validateListeners(); err != nil {
+		return err
+	}
+	return c.validateStorage()
+}
+
+// options 将配置映射为 mochi 的 Options 与 Capabilities，未配置（0）的字段使用 mochi 默认值
+func (c *MQTTConfig) options() *server.Options {
+	caps := server.NewDefaultServerCapabilities()
+	if c.Connection.MaxConnections > 0 {
+		caps.MaximumClients = int64(c.Connection.MaxConnections)
+	}
+	if c.MQTT.MaxMessageSize > 0 {
+		caps.MaximumPacketSize = uint32(c.MQTT.MaxMessageSize)
+	}
+	if c.MQTT.SessionExpiry > 0 {
+		caps.MaximumSessionExpiryInterval = uint32(c.MQTT.SessionExpiry)
+	}
+	if c.MQTT.MessageExpiry > 0 {
+		// 同时作为 inflight 与保留消息的过期时间
+		caps.MaximumMessageExpiryInterval = c.MQTT.MessageExpiry
+	}
+	if c.MQTT.ReceiveMaximum > 0 {
+		caps.ReceiveMaximum = uint16(c.MQTT.ReceiveMaximum)
+	}
+	if c.MQTT.MaximumInflight > 0 {
+		caps.MaximumInflight = uint16(c.MQTT.MaximumInflight)
+	}
+	if c.MQTT.WritesPending > 0 {
+		caps.MaximumClientWritesPending = int32(c.MQTT.WritesPending)
+	}
+	if c.MQTT.MaximumQoS != nil {
+		caps.MaximumQos = byte(*c.MQTT.MaximumQoS)
+	}
+
+	level := slog.LevelInfo
+	if c.Server.Debug {
+		level = slog.LevelDebug
+	}
+
+	return &server.Options{
+		Capabilities:             caps,
+		ClientNetReadBufferSize:  c.TCP.BufferSize,
+		ClientNetWriteBufferSize: c.TCP.BufferSize,
+		Logger:                   slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level})),
+		// 开启内联客户端以便桥接等内部模块直接收发消息
+		InlineClient: true,
+	}
+}
+
+// limitListener 包装 mochi 监听器，限制监听器上的并发连接数并为连接设置读写超时
+type limitListener struct {
+	listeners.Listener
+	maxConns int64
+	conns    int64
+	timeouts ConnectionConfig
+}
+
+func newLimitListener(l listeners.Listener, maxConns int, timeouts ConnectionConfig) *limitListener {
+	return &limitListener{
+		Listener: l,
+		maxConns: int64(maxConns),
+		timeouts: timeouts,
+	}
+}
+
+// Serve 在建立连接前检查连接数，并替换为带超时控制的连接
+func (l *limitListener) Serve(establish listeners.EstablishFn) {
+	l.Listener.Serve(func(id string, c net.Conn) error {
+		n := atomic.AddInt64(&l.conns, 1)
+		defer atomic.AddInt64(&l.conns, -1)
+		if l.maxConns > 0 && n > l.maxConns {
+			c.Close()
+			return fmt.Errorf("listener %s reached max connections %d", id, l.maxConns)
+		}
+
+		dc := &deadlineConn{
+			Conn:         c,
+			writeTimeout: time.Duration(l.timeouts.WriteTimeout) * time.Second,
+			idleTimeout:  time.Duration(l.timeouts.HeartbeatTimeout) * time.Second,
+		}
+		// CONNECT 报文需在 read_timeout 内到达，之后由 mochi 按 keepalive 刷新期限
+		if l.timeouts.ReadTimeout > 0 {
+			c.SetReadDeadline(time.Now().Add(time.Duration(l.timeouts.ReadTimeout) * time.Second))
+		}
+		return establish(id, dc)
+	})
+}
+
+// deadlineConn 为每次写设置写超时，并将 mochi 按 keepalive 设置的期限限制在 idleTimeout 内
+type deadlineConn struct {
+	net.Conn
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.Conn.Write(b)
+}
+
+// NetConn 返回被包装的连接
+func (c *deadlineConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	if c.idleTimeout > 0 {
+		if limit := time.Now().Add(c.idleTimeout); t.IsZero() || t.After(limit) {
+			t = limit
+		}
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+// keepaliveHook 为未设置或超过上限 keepalive 的 v5 客户端下发服务端 keepalive
+type keepaliveHook struct {
+	server.HookBase
+	keepAlive uint16
+}
+
+// ID 返回钩子标识
+func (h *keepaliveHook) ID() string {
+	return "servicer-keepalive"
+}
+
+// Provides 声明钩子实现的方法
+func (h *keepaliveHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{server.OnConnect}, []byte{b})
+}
+
+// OnConnect 覆盖客户端 keepalive，mochi 会在 CONNACK 中携带 ServerKeepAlive 属性
+func (h *keepaliveHook) OnConnect(cl *server.Client, pk packets.Packet) error {
+	if cl.Properties.ProtocolVersion < 5 {
+		return nil
+	}
+	if cl.State.Keepalive == 0 || cl.State.Keepalive > h.keepAlive {
+		cl.State.Keepalive = h.keepAlive
+		cl.State.ServerKeepalive = true
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// decodeMQTTConfig 解析 [server] 之后的配置片段
+func decodeMQTTConfig(t *testing.T, config string) *MQTTConfig {
+	t.Helper()
+	var c MQTTConfig
+	if _, err := toml.Decode("[server]\nname = \"mqtt-test\"\naddress = \"127.0.0.1:0\"\n"+config, &c); err != nil {
+		t.Fatal(err)
+	}
+	return &c
+}
+
+func TestMQTTConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string // 错误信息片段，为空时应校验通过
+	}{
+		{"defaults", "", ""},
+		{"upper bounds", `
+[tcp]
+max_connections = 2147483647
+buffer_size = 16777216
+[connection]
+max_connections = 2147483647
+heartbeat_timeout = 86400
+write_timeout = 86400
+read_timeout = 86400
+[mqtt]
+max_message_size = 268435460
+keep_alive = 65535
+session_expiry = 4294967295
+message_expiry = 4294967295
+receive_maximum = 65535
+maximum_inflight = 65535
+writes_pending = 2147483647
+maximum_qos = 2
+`, ""},
+		{"lower bounds", `
+[tcp]
+buffer_size = 512
+[mqtt]
+max_message_size = 64
+maximum_qos = 0
+`, ""},
+		{"negative tcp.max_connections", "[tcp]\nmax_connections = -1", "tcp.max_connections = -1 is out of range"},
+		{"tcp.buffer_size too large", "[tcp]\nbuffer_size = 16777217", "tcp.buffer_size = 16777217 is out of range"},
+		{"tcp.buffer_size too small", "[tcp]\nbuffer_size = 511", "tcp.buffer_size = 511 is too small"},
+		{"negative connection.max_connections", "[connection]\nmax_connections = -1", "connection.max_connections"},
+		{"connection.heartbeat_timeout", "[connection]\nheartbeat_timeout = 86401", "connection.heartbeat_timeout"},
+		{"connection.write_timeout", "[connection]\nwrite_timeout = -1", "connection.write_timeout"},
+		{"connection.read_timeout", "[connection]\nread_timeout = 86401", "connection.read_timeout"},
+		{"mqtt.max_message_size too large", "[mqtt]\nmax_message_size = 268435461", "mqtt.max_message_size = 268435461 is out of range"},
+		{"mqtt.max_message_size too small", "[mqtt]\nmax_message_size = 63", "mqtt.max_message_size = 63 is too small"},
+		{"mqtt.keep_alive", "[mqtt]\nkeep_alive = 65536", "mqtt.keep_alive"},
+		{"mqtt.session_expiry", "[mqtt]\nsession_expiry = 4294967296", "mqtt.session_expiry"},
+		{"mqtt.message_expiry", "[mqtt]\nmessage_expiry = -1", "mqtt.message_expiry"},
+		{"mqtt.receive_maximum", "[mqtt]\nreceive_maximum = 65536", "mqtt.receive_maximum"},
+		{"mqtt.maximum_inflight", "[mqtt]\nmaximum_inflight = 65536", "mqtt.maximum_inflight"},
+		{"mqtt.writes_pending", "[mqtt]\nwrites_pending = -1", "mqtt.writes_pending"},
+		{"mqtt.maximum_qos", "[mqtt]\nmaximum_qos = 3", "mqtt.maximum_qos = 3 is out of range [0, 2]"},
+		{"unknown storage", "[storage]\ntype = \"redis\"", "unknown type"},
+	}
+	for _, tt := range tests {
+		err := decodeMQTTConfig(t, tt.config).validate()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	var c MQTTConfig
+	if err := c.validate(); err == nil || err.Error() != "server.address is required" {
+		t.Errorf("without address: error = %v", err)
+	}
+}
+
+func TestMQTTConfigValidateShippedConfig(t *testing.T) {
+	var c MQTTConfig
+	if _, err := toml.DecodeFile("../conf/servicer/mqtt-test.toml", &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMQTTConfigOptions(t *testing.T) {
+	c := decodeMQTTConfig(t, `
+[tcp]
+buffer_size = 1024
+[connection]
+max_connections = 100
+[mqtt]
+max_message_size = 4096
+session_expiry = 3600
+message_expiry = 600
+receive_maximum = 32
+maximum_inflight = 64
+writes_pending = 128
+maximum_qos = 1
+`)
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	opts := c.options()
+	caps := opts.Capabilities
+	if caps.MaximumClients != 100 || caps.MaximumPacketSize != 4096 || caps.MaximumSessionExpiryInterval != 3600 ||
+		caps.MaximumMessageExpiryInterval != 600 || caps.ReceiveMaximum != 32 || caps.MaximumInflight != 64 ||
+		caps.MaximumClientWritesPending != 128 || caps.MaximumQos != 1 {
+		t.Errorf("capabilities = %+v", caps)
+	}
+	if opts.ClientNetReadBufferSize != 1024 || opts.ClientNetWriteBufferSize != 1024 || !opts.InlineClient {
+		t.Errorf("options = %+v", opts)
+	}
+	if opts.Logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("debug logging enabled without server.debug")
+	}
+
+	// 未配置的字段使用 mochi 默认值，maximum_qos = 0 不视为未配置
+	c = decodeMQTTConfig(t, "debug = true\n[mqtt]\nmaximum_qos = 0")
+	opts = c.options()
+	want := server.NewDefaultServerCapabilities()
+	want.MaximumQos = 0
+	if got := opts.Capabilities; *got != *want {
+		t.Errorf("capabilities = %+v, want %+v", got, want)
+	}
+	if opts.ClientNetReadBufferSize != 0 || opts.ClientNetWriteBufferSize != 0 {
+		t.Errorf("buffer sizes = %d, %d", opts.ClientNetReadBufferSize, opts.ClientNetWriteBufferSize)
+	}
+	if !opts.Logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("debug logging disabled with server.debug")
+	}
+}
+
+func TestMQTTListenerLimits(t *testing.T) {
+	m := newTestMqtt(t, testMqttConfig+`
+[tcp]
+max_connections = 1
+[connection]
+read_timeout = 1
+`)
+	runTestMqtt(t, m)
+	l, ok := m.Server.Listeners.Get(m.config.listenerID())
+	if !ok {
+		t.Fatal("tcp listener not found")
+	}
+
+	dialed := time.Now()
+	first, err := net.Dial("tcp", l.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	waitFor(t, func() bool { return atomic.LoadInt64(&l.(*limitListener).conns) == 1 })
+
+	// 超过 max_connections 的连接被立即关闭
+	second, err := net.Dial("tcp", l.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("second connection: read error = %v, want closed", err)
+	}
+
+	// 未在 read_timeout 内发送 CONNECT 的连接被关闭
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := first.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("first connection: read error = %v, want closed", err)
+	}
+	if d := time.Since(dialed); d < 900*time.Millisecond {
+		t.Errorf("connection closed after %v, want about 1s", d)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestKeepaliveHook(t *testing.T) {
+	h := &keepaliveHook{keepAlive: 60}
+	tests := []struct {
+		name      string
+		version   byte
+		keepalive uint16
+		want      uint16
+		server    bool
+	}{
+		{"v5 unset", 5, 0, 60, true},
+		{"v5 above limit", 5, 120, 60, true},
+		{"v5 within limit", 5, 30, 30, false},
+		{"v3 unset", 4, 0, 0, false},
+		{"v3 above limit", 4, 120, 120, false},
+	}
+	for _, tt := range tests {
+		cl := &server.Client{}
+		cl.Properties.ProtocolVersion = tt.version
+		cl.State.Keepalive = tt.keepalive
+		h.OnConnect(cl, packets.Packet{})
+		if cl.State.Keepalive != tt.want || cl.State.ServerKeepalive != tt.server {
+			t.Errorf("%s: keepalive = %d, server keepalive = %v", tt.name, cl.State.Keepalive, cl.State.ServerKeepalive)
+		}
+	}
+}
@@ -2,26 +2,34 @@ package services
 
 import (
 	"context"
-	"os"
-	"os/signal"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
 	"sync"
-	"syscall"
 
 	"github.com/BurntSushi/toml"
 	server "github.com/mochi-mqtt/server/v2"
-	"github.com/mochi-mqtt/server/v2/hooks/auth"
 	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
 	"github.com/networkProtocalTrans/logger"
 	"github.com/networkProtocalTrans/util"
+	"github.com/networkProtocalTrans/validation"
 )
 
 // 添加配置结构
 type MQTTConfig struct {
+	Type       string           `toml:"type"`
 	Server     ServerConfig     `toml:"server"`
 	Connection ConnectionConfig `toml:"connection"`
 	TCP        TCPConfig        `toml:"tcp"`
 	Auth       AuthConfig       `toml:"auth"`
 	MQTT       MQTTConfigDetail `toml:"mqtt"`
+	TLS        util.TLSConfig   `toml:"tls"`
+	// 额外监听器，如 MQTT over websocket 与 unix socket
+	Listeners []MQTTListenerConfig `toml:"listeners"`
+	// 会话与保留消息的持久化存储
+	Storage MQTTStorageConfig `toml:"storage"`
 }
 
 type TCPConfig struct {
@@ -31,13 +39,24 @@ type TCPConfig struct {
 }
 
 type AuthConfig struct {
-	Type  string   `toml:"type"`
-	Basic BaseAuth `toml:"basic"`
+	// none, basic, file, token。none 只接受匿名连接（受 allow_anonymous 与 anonymous_acl 约束）
+	// 与 cert_as_username 的证书认证，携带用户名或密码的连接被拒绝
+	Type  string    `toml:"type"`
+	Basic BaseAuth  `toml:"basic"`
+	File  FileAuth  `toml:"file"`
+	Token TokenAuth `toml:"token"`
+	// 匿名连接的主题 ACL，仅在 allow_anonymous 时生效
+	AnonymousACL ACL `toml:"anonymous_acl"`
+	// 未携带凭据但出示已校验客户端证书的连接，以证书 CN 作为用户名认证
+	CertAsUsername bool `toml:"cert_as_username"`
+	// 携带凭据时，用户名必须与已校验客户端证书的 CN 或 SAN 一致
+	RequireCertMatch bool `toml:"require_cert_match"`
 }
 
 type BaseAuth struct {
 	Username string `toml:"username"`
 	Password string `toml:"password"`
+	ACL      ACL    `toml:"acl"`
 }
 
 type MQTTConfigDetail struct {
@@ -45,108 +64,327 @@ type MQTTConfigDetail struct {
 	KeepAlive      int  `toml:"keep_alive"`
 	SessionExpiry  int  `toml:"session_expiry"`
 	AllowAnonymous bool `toml:"allow_anonymous"`
+	// inflight 与保留消息的最长过期时间（秒）
+	MessageExpiry   int64 `toml:"message_expiry"`
+	ReceiveMaximum  int   `toml:"receive_maximum"`
+	MaximumInflight int   `toml:"maximum_inflight"`
+	WritesPending   int   `toml:"writes_pending"`
+	// 未配置时为 2
+	MaximumQoS *int `toml:"maximum_qos"`
+}
+
+func init() {
+	RegisterServicerType(ServicerTypeMQTT, func(ctx context.Context, log *logger.AppLogger, configPath string) (Servicer, error) {
+		return NewMqttServer(ctx, log, configPath)
+	})
+}
+
+// ErrServicerNotRunning servicer 未运行
+var ErrServicerNotRunning = errors.New("servicer is not running")
+
+// inlineSubscription 记录内联订阅，服务重启后重新订阅
+type inlineSubscription struct {
+	filter  string
+	handler server.InlineSubFn
 }
 
 // 修改 mqttServer 结构体
 type mqttServer struct {
+	// 当前运行的 broker 实例，未运行时为 nil
 	Server *server.Server
 	Logger *logger.AppLogger
 	config *MQTTConfig
+	auth   *authHook
+	// 未启用 TLS 时为 nil
+	tlsConfig *tls.Config
+	// 额外监听器的 TLS 配置，与 config.Listeners 一一对应
+	listenerTLS []*tls.Config
+
+	mu      sync.RWMutex
+	stopped chan struct{}
+	// 内联订阅标识自增计数
+	subID int
+	subs  map[int]inlineSubscription
 }
 
-func GetMqttServer(ctx context.Context, logger *logger.AppLogger, configPath string) *mqttServer {
-	if defaultMqttServer != nil {
-		return defaultMqttServer
+// NewMqttServer 根据配置文件创建 MQTT servicer 实例，调用 Start 后开始服务
+func NewMqttServer(ctx context.Context, logger *logger.AppLogger, configPath string) (*mqttServer, error) {
+	// 加载配置
+	var config MQTTConfig
+	if _, err := toml.DecodeFile(configPath, &config); err != nil {
+		return nil, fmt.Errorf("load mqtt config %s: %w", configPath, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid mqtt config %s: %w", configPath, err)
+	}
+
+	hook, err := newAuthHook(&config)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt auth: %w", err)
+	}
+	tlsConfig, err := config.TLS.Load()
+	if err != nil {
+		return nil, fmt.Errorf("mqtt tls: %w", err)
+	}
+	listenerTLS, err := config.loadListenerTLS()
+	if err != nil {
+		return nil, fmt.Errorf("mqtt %w", err)
 	}
 
-	mqttOnce.Do(func() {
+	return &mqttServer{
+		Logger:      logger,
+		config:      &config,
+		auth:        hook,
+		tlsConfig:   tlsConfig,
+		listenerTLS: listenerTLS,
+		subs:        make(map[int]inlineSubscription),
+	}, nil
+}
 
-		// 加载配置
-		var config MQTTConfig
-		if _, err := toml.DecodeFile(configPath, &config); err != nil {
-			logger.LogFatal(ctx, "Failed to load MQTT config", "error", err)
-			return
-		}
+// newBroker 按配置创建 broker 实例并添加监听器与钩子
+func (m *mqttServer) newBroker() (*server.Server, error) {
+	config := m.config
 
-		// 创建服务器实例
-		s := server.New(&server.Options{
-			Capabilities: &server.Capabilities{},
-		})
+	// 创建服务器实例
+	s := server.New(config.options())
 
-		// 配置TCP监听器
-		tcp := listeners.NewTCP(listeners.Config{
-			ID:      config.TCP.ID,
-			Address: config.Server.Address,
-		})
+	// 配置TCP监听器，未配置 ID 时使用 servicer 名称
+	id := config.listenerID()
+	// 启用 TLS 且未配置 tls.address 时主监听器直接使用 TLS，否则额外监听 tls.address
+	tcpConfig := listeners.Config{
+		ID:      id,
+		Address: config.Server.Address,
+	}
+	if m.tlsConfig != nil && config.TLS.Address == "" {
+		tcpConfig.TLSConfig = m.tlsConfig
+	}
+	tcp := listeners.NewTCP(tcpConfig)
+
+	if err := s.AddListener(newLimitListener(tcp, config.TCP.MaxConnections, config.Connection)); err != nil {
+		return nil, fmt.Errorf("add tcp listener: %w", err)
+	}
 
-		if err := s.AddListener(tcp); err != nil {
-			logger.LogFatal(ctx, "Failed to add TCP listener", "error", err)
+	if m.tlsConfig != nil && config.TLS.Address != "" {
+		secure := listeners.NewTCP(listeners.Config{
+			ID:        id + "-tls",
+			Address:   config.TLS.Address,
+			TLSConfig: m.tlsConfig,
+		})
+		if err := s.AddListener(newLimitListener(secure, config.TCP.MaxConnections, config.Connection)); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("add tls listener: %w", err)
 		}
+	}
+
+	if err := m.addListeners(s); err != nil {
+		s.Close()
+		return nil, err
+	}
 
-		// 配置认证
-		var hook server.Hook
-		switch config.Auth.Type {
-		case "basic":
+	// 配置认证
+	if err := s.AddHook(m.auth, nil); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("add authentication hook: %w", err)
+	}
+
+	if err := m.addStorage(s); err != nil {
+		s.Close()
+		return nil, err
+	}
 
-		default:
-			hook = &auth.AllowHook{}
+	if validation.DefaultValidator != nil {
+		if err := s.AddHook(&validationHook{mqtt: m}, nil); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("add validation hook: %w", err)
 		}
+	}
 
-		if err := s.AddHook(hook, nil); err != nil {
-			logger.LogFatal(ctx, "Failed to add authentication hook", "error", err)
+	if config.MQTT.KeepAlive > 0 {
+		if err := s.AddHook(&keepaliveHook{keepAlive: uint16(config.MQTT.KeepAlive)}, nil); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("add keepalive hook: %w", err)
 		}
+	}
+	return s, nil
+}
+
+// Name 返回 servicer 名称
+func (m *mqttServer) Name() string {
+	return m.config.Server.Name
+}
 
-		mqttServer := &mqttServer{
-			Server: s,
-			Logger: logger,
-			config: &config,
+// Start 启动 MQTT 服务器并阻塞，直到 ctx 取消或 Stop 被调用
+func (m *mqttServer) Start(ctx context.Context) error {
+	s, err := m.newBroker()
+	if err != nil {
+		return err
+	}
+
+	m.Logger.LogInfo(ctx, "Starting MQTT server",
+		"name", m.config.Server.Name,
+		"address", m.config.Server.Address,
+		"listeners", len(m.config.Listeners),
+	)
+	if err := s.Serve(); err != nil {
+		s.Close()
+		return fmt.Errorf("serve mqtt: %w", err)
+	}
+
+	// 重新建立内联订阅，订阅回调可能同步触发发布，不能持锁调用
+	m.mu.Lock()
+	subs := make(map[int]inlineSubscription, len(m.subs))
+	for id, sub := range m.subs {
+		subs[id] = sub
+	}
+	stopped := make(chan struct{})
+	m.Server, m.stopped = s, stopped
+	m.mu.Unlock()
+	for id, sub := range subs {
+		if err := s.Subscribe(sub.filter, id, sub.handler); err != nil {
+			m.Logger.LogError(ctx, "Failed to restore inline subscription", "name", m.Name(), "filter", sub.filter, "error", err)
 		}
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-stopped:
+	}
 
-		// 设置优雅退出
-		go mqttServer.gracefulShutdown(ctx)
+	m.mu.Lock()
+	m.Server = nil
+	m.mu.Unlock()
+	return s.Close()
+}
 
-		// 启动MQTT服务器
-		logger.LogInfo(ctx, "Starting MQTT server",
-			"name", config.Server.Name,
-			"address", config.Server.Address,
-		)
+// Stop 关闭 MQTT 服务器
+func (m *mqttServer) Stop(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Server == nil {
+		return nil
+	}
+	select {
+	case <-m.stopped:
+	default:
+		close(m.stopped)
+	}
+	return nil
+}
 
-		util.SafeGo(ctx, func() {
-			if err := s.Serve(); err!= nil {
-				logger.LogFatal(ctx, "Failed to start MQTT server", "error", err)
-			}
-		})
-		
+// Health 服务器运行中时返回 nil
+func (m *mqttServer) Health() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.Server == nil {
+		return ErrServicerNotRunning
+	}
+	return nil
+}
 
-		// 关闭服务端时需要做的一些清理工作
-		defaultMqttServer = mqttServer
+// Publish 通过内联客户端向 broker 发布消息
+func (m *mqttServer) Publish(topic string, payload []byte, retain bool, qos byte) error {
+	m.mu.RLock()
+	s := m.Server
+	m.mu.RUnlock()
+	if s == nil {
+		return ErrServicerNotRunning
+	}
+	return s.Publish(topic, payload, retain, qos)
+}
+
+// PublishPacket 以内联客户端发布消息，可携带 MQTT v5 属性（如用户属性），
+// 返回发布时匹配的客户端订阅数量，共享订阅每组计为一个，不含内联订阅
+func (m *mqttServer) PublishPacket(topic string, payload []byte, retain bool, qos byte, props packets.Properties) (int, error) {
+	m.mu.RLock()
+	s := m.Server
+	m.mu.RUnlock()
+	if s == nil {
+		return 0, ErrServicerNotRunning
+	}
+	cl, ok := s.Clients.Get(server.InlineClientId)
+	if !ok {
+		return 0, server.ErrInlineClientNotEnabled
+	}
+	subscribers := s.Topics.Subscribers(topic)
+	n := len(subscribers.Subscriptions) + len(subscribers.Shared)
+
+	err := s.InjectPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    qos,
+			Retain: retain,
+		},
+		TopicName:  topic,
+		Payload:    payload,
+		Properties: props,
+		PacketID:   uint16(qos),
 	})
-	return defaultMqttServer
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
 }
 
-var (
-	defaultMqttServer *mqttServer
-	mqttOnce          = sync.Once{}
-)
+// Retained 返回与主题过滤器匹配的第一条保留消息的负载
+func (m *mqttServer) Retained(filter string) ([]byte, bool) {
+	m.mu.RLock()
+	s := m.Server
+	m.mu.RUnlock()
+	if s == nil {
+		return nil, false
+	}
+	for _, pk := range s.Topics.Messages(filter) {
+		return pk.Payload, true
+	}
+	return nil, false
+}
 
+// RetainedMessages 返回与主题过滤器匹配的所有保留消息，按主题排序
+func (m *mqttServer) RetainedMessages(filter string) []packets.Packet {
+	m.mu.RLock()
+	s := m.Server
+	m.mu.RUnlock()
+	if s == nil {
+		return nil
+	}
+	msgs := s.Topics.Messages(filter)
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].TopicName < msgs[j].TopicName })
+	return msgs
+}
 
-func (m *mqttServer) gracefulShutdown(ctx context.Context) {
-	// 监听系统信号
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+// Subscribe 通过内联客户端订阅主题过滤器，返回订阅标识用于取消订阅。
+// 服务未运行时先记录订阅，启动后生效
+func (m *mqttServer) Subscribe(filter string, handler server.InlineSubFn) (int, error) {
+	if !server.IsValidFilter(filter, false) {
+		return 0, packets.ErrTopicFilterInvalid
+	}
 
-	// 等待信号
-	sig := <-sigChan
-	m.Logger.LogInfo(ctx, "Received shutdown signal", "signal", sig.String())
+	m.mu.Lock()
+	m.subID++
+	id := m.subID
+	m.subs[id] = inlineSubscription{filter: filter, handler: handler}
+	s := m.Server
+	m.mu.Unlock()
 
-	// 关闭 MQTT 服务器
-	m.Logger.LogInfo(ctx, "Shutting down MQTT server...")
-	m.Stop()
-	m.Logger.LogInfo(ctx, "MQTT server stopped")
+	if s != nil {
+		if err := s.Subscribe(filter, id, handler); err != nil {
+			m.mu.Lock()
+			delete(m.subs, id)
+			m.mu.Unlock()
+			return 0, err
+		}
+	}
+	return id, nil
 }
 
-func (m *mqttServer) Stop() {
-	if err := m.Server.Close(); err != nil {
-		m.Logger.LogError(context.Background(), "Error closing MQTT server", "error", err)
+// Unsubscribe 取消内联订阅
+func (m *mqttServer) Unsubscribe(filter string, id int) error {
+	m.mu.Lock()
+	delete(m.subs, id)
+	s := m.Server
+	m.mu.Unlock()
+	if s == nil {
+		return nil
 	}
+	return s.Unsubscribe(filter, id)
 }
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/logger"
+)
+
+// testMqttConfig 监听随机端口、只接受匿名连接的 MQTT servicer 配置
+const testMqttConfig = `
+[server]
+name = "mqtt-test"
+address = "127.0.0.1:0"
+[auth]
+type = "none"
+[mqtt]
+allow_anonymous = true
+`
+
+// newTestMqtt 按配置创建 MQTT servicer，不启动
+func newTestMqtt(t *testing.T, config string) *mqttServer {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mqtt.toml")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMqttServer(context.Background(), &logger.AppLogger{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// runTestMqtt 启动 MQTT servicer 并等待其就绪，返回的函数停止 servicer 并等待 Start 返回
+func runTestMqtt(t *testing.T, m *mqttServer) (stop func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := m.Start(context.Background()); err != nil {
+			t.Errorf("mqtt start: %v", err)
+		}
+	}()
+	waitFor(t, func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+			return m.Health() == nil
+		}
+	})
+	var stopped bool
+	stop = func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		m.Stop(context.Background())
+		<-done
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// startTestMqtt 创建并启动使用 testMqttConfig 的 MQTT servicer
+func startTestMqtt(t *testing.T) *mqttServer {
+	t.Helper()
+	m := newTestMqtt(t, testMqttConfig)
+	runTestMqtt(t, m)
+	return m
+}
+
+func TestMqttInlineSubscriptionsSurviveRestart(t *testing.T) {
+	m := newTestMqtt(t, testMqttConfig)
+	received := make(chan string, 10)
+	// 启动前订阅，启动后生效
+	if _, err := m.Subscribe("devices/#", func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk.TopicName
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		stop := runTestMqtt(t, m)
+		if err := m.Publish("devices/a", []byte("1"), false, 0); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case topic := <-received:
+			if topic != "devices/a" {
+				t.Fatalf("received %q", topic)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("run %d: inline subscription not delivered", i+1)
+		}
+		stop()
+	}
+	if err := m.Publish("devices/a", nil, false, 0); err != ErrServicerNotRunning {
+		t.Fatalf("publish after stop = %v, want ErrServicerNotRunning", err)
+	}
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	badgerdb "github.com/dgraph-io/badger/v4"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/badger"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
+	"go.etcd.io/bbolt"
+)
+
+// MQTT 持久化存储类型
+const (
+	MQTTStorageNone   = "none"
+	MQTTStorageBolt   = "bolt"
+	MQTTStorageBadger = "badger"
+)
+
+const (
+	// 默认数据目录，实际目录为 <data>/<servicer 名称>
+	defaultStorageDir = "./data"
+	// bolt 数据文件名
+	boltFile = "mqtt.db"
+	// bolt 压缩时单个事务写入的最大字节数
+	boltCompactTxSize = 64 << 20
+	// 等待数据文件锁的超时
+	storageOpenTimeout = 5 * time.Second
+)
+
+// MQTTStorageConfig [storage] 持久化会话、订阅、inflight QoS 1/2 消息与保留消息，servicer 重启后恢复
+type MQTTStorageConfig struct {
+	// none（默认，不持久化）, bolt（单文件 B+ 树）, badger（LSM 树，适合写入量大的场景）
+	Type string `toml:"type"`
+	// 数据目录，默认 ./data/<servicer 名称>，不同 servicer 不能共用
+	Dir string `toml:"dir"`
+	// bolt: 启动时压缩数据文件，回收已删除数据占用的空间
+	CompactOnStart bool `toml:"compact_on_start"`
+	// badger: 值日志垃圾回收间隔（秒），默认 300
+	GCInterval int64 `toml:"gc_interval"`
+	// badger: 值日志文件中可回收数据的比例超过该值时重写文件，取值 (0, 1)，默认 0.5
+	GCDiscardRatio float64 `toml:"gc_discard_ratio"`
+}
+
+// validateStorage 校验持久化存储配置并填充默认数据目录
+func (c *MQTTConfig) validateStorage() error {
+	st := &c.Storage
+	switch st.Type {
+	case "", MQTTStorageNone:
+		st.Type = MQTTStorageNone
+		return nil
+	case MQTTStorageBolt, MQTTStorageBadger:
+	default:
+		return fmt.Errorf("storage: unknown type %q", st.Type)
+	}
+	if st.Dir == "" {
+		st.Dir = filepath.Join(defaultStorageDir, c.Server.Name)
+	}
+	if st.GCInterval < 0 {
+		return fmt.Errorf("storage: gc_interval = %d is out of range", st.GCInterval)
+	}
+	if st.GCDiscardRatio < 0 || st.GCDiscardRatio >= 1 {
+		return fmt.Errorf("storage: gc_discard_ratio = %v is out of range (0, 1)", st.GCDiscardRatio)
+	}
+	return nil
+}
+
+// addStorage 按 [storage] 配置添加持久化钩子，broker 启动时从中恢复状态，关闭时钩子关闭数据文件
+func (m *mqttServer) addStorage(s *server.Server) error {
+	st := m.config.Storage
+	if st.Type == MQTTStorageNone {
+		return nil
+	}
+	if err := os.MkdirAll(st.Dir, 0o755); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+
+	switch st.Type {
+	case MQTTStorageBolt:
+		path := filepath.Join(st.Dir, boltFile)
+		if st.CompactOnStart {
+			if err := m.compactBolt(path); err != nil {
+				return fmt.Errorf("storage: compact %s: %w", path, err)
+			}
+		}
+		if err := s.AddHook(&boltHook{Hook: new(bolt.Hook)}, &bolt.Options{
+			Path:    path,
+			Options: &bbolt.Options{Timeout: storageOpenTimeout},
+		}); err != nil {
+			return fmt.Errorf("add bolt storage hook: %w", err)
+		}
+	case MQTTStorageBadger:
+		opts := badgerdb.DefaultOptions(st.Dir)
+		if err := s.AddHook(new(badger.Hook), &badger.Options{
+			Path:           st.Dir,
+			Options:        &opts,
+			GcInterval:     st.GCInterval,
+			GcDiscardRatio: st.GCDiscardRatio,
+		}); err != nil {
+			return fmt.Errorf("add badger storage hook: %w", err)
+		}
+	}
+	m.Logger.LogInfo(context.Background(), "mqtt storage enabled", "name", m.Name(), "type", st.Type, "dir", st.Dir)
+	return nil
+}
+
+// compactBolt 将数据文件复制为紧凑的新文件后替换原文件，文件不存在时跳过
+func (m *mqttServer) compactBolt(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	src, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: storageOpenTimeout, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".compact"
+	os.Remove(tmp)
+	dst, err := bbolt.Open(tmp, 0o600, &bbolt.Options{Timeout: storageOpenTimeout})
+	if err != nil {
+		return err
+	}
+	if err := bbolt.Compact(dst, src, boltCompactTxSize); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	src.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	if compacted, err := os.Stat(path); err == nil {
+		m.Logger.LogInfo(context.Background(), "mqtt storage compacted",
+			"name", m.Name(), "path", path, "before", info.Size(), "after", compacted.Size())
+	}
+	return nil
+}
+
+// boltHook bolt 存储钩子写入 inflight 消息时未保存报文ID，恢复时从存储键 inflight_<客户端ID>:<报文ID> 中补回，
+// 否则重启后重连的客户端无法重发 inflight 消息
+type boltHook struct {
+	*bolt.Hook
+}
+
+// StoredInflightMessages 返回补全报文ID后的 inflight 消息
+func (h *boltHook) StoredInflightMessages() ([]storage.Message, error) {
+	v, err := h.Hook.StoredInflightMessages()
+	if err != nil {
+		return v, err
+	}
+	for i := range v {
+		if v[i].PacketID != 0 {
+			continue
+		}
+		idx := strings.LastIndexByte(v[i].ID, ':')
+		if id, err := strconv.ParseUint(v[i].ID[idx+1:], 10, 16); err == nil {
+			v[i].PacketID = uint16(id)
+		}
+	}
+	return v, nil
+}
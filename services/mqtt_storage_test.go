@@ -0,0 +1,229 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// mqttTestClient 连接 broker 的 MQTT 3.1.1 客户端，逐个收发报文，dialTestMqtt 通过 unix socket 连接
+type mqttTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTestMqtt(t *testing.T, sock string) *mqttTestClient {
+	t.Helper()
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &mqttTestClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *mqttTestClient) write(pk packets.Packet, encode func(pk *packets.Packet, buf *bytes.Buffer) error) {
+	c.t.Helper()
+	pk.ProtocolVersion = 4
+	var buf bytes.Buffer
+	if err := encode(&pk, &buf); err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read 读取下一个报文，解码 CONNACK、SUBACK 与 PUBLISH
+func (c *mqttTestClient) read() packets.Packet {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	hb, err := c.r.ReadByte()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	pk := packets.Packet{ProtocolVersion: 4}
+	if err := pk.FixedHeader.Decode(hb); err != nil {
+		c.t.Fatal(err)
+	}
+	n, _, err := packets.DecodeLength(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	pk.FixedHeader.Remaining = n
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		c.t.Fatal(err)
+	}
+	switch pk.FixedHeader.Type {
+	case packets.Connack:
+		err = pk.ConnackDecode(body)
+	case packets.Suback:
+		err = pk.SubackDecode(body)
+	case packets.Publish:
+		err = pk.PublishDecode(body)
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return pk
+}
+
+// expect 读取下一个报文并检查类型
+func (c *mqttTestClient) expect(typ byte) packets.Packet {
+	c.t.Helper()
+	pk := c.read()
+	if pk.FixedHeader.Type != typ {
+		c.t.Fatalf("got packet type %d, want %d", pk.FixedHeader.Type, typ)
+	}
+	return pk
+}
+
+// connect 以持久会话连接，返回 broker 是否保留了会话
+func (c *mqttTestClient) connect(clientID string) bool {
+	c.t.Helper()
+	c.write(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connect},
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			ClientIdentifier: clientID,
+			Keepalive:        60,
+		},
+	}, (*packets.Packet).ConnectEncode)
+	ack := c.expect(packets.Connack)
+	if ack.ReasonCode != packets.CodeSuccess.Code {
+		c.t.Fatalf("connack reason %#x", ack.ReasonCode)
+	}
+	return ack.SessionPresent
+}
+
+func (c *mqttTestClient) puback(id uint16) {
+	c.t.Helper()
+	c.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}, PacketID: id}, (*packets.Packet).PubackEncode)
+}
+
+func TestMqttStorageSurvivesRestart(t *testing.T) {
+	for _, storageType := range []string{MQTTStorageBolt, MQTTStorageBadger} {
+		t.Run(storageType, func(t *testing.T) {
+			dir := t.TempDir()
+			sock := filepath.Join(dir, "mqtt.sock")
+			config := testMqttConfig + fmt.Sprintf(`
+[storage]
+type = %q
+dir = %q
+[[listeners]]
+type = "unix"
+address = %q
+`, storageType, filepath.Join(dir, "data"), sock)
+
+			m := newTestMqtt(t, config)
+			stop := runTestMqtt(t, m)
+			if err := m.Publish("devices/a", []byte("retained"), true, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			c := dialTestMqtt(t, sock)
+			if c.connect("device-1") {
+				t.Fatal("session present on first connect")
+			}
+			c.write(packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+				PacketID:    1,
+				Filters:     packets.Subscriptions{{Filter: "devices/#", Qos: 1}},
+			}, (*packets.Packet).SubscribeEncode)
+			c.expect(packets.Suback)
+			if pk := c.expect(packets.Publish); pk.TopicName != "devices/a" || !pk.FixedHeader.Retain {
+				t.Fatalf("retained delivery = %s %q", pk.TopicName, pk.Payload)
+			}
+			// 不确认的 QoS 1 消息留在 inflight 中
+			if err := m.Publish("devices/b", []byte("inflight"), false, 1); err != nil {
+				t.Fatal(err)
+			}
+			inflight := c.expect(packets.Publish)
+			if inflight.TopicName != "devices/b" || inflight.FixedHeader.Qos != 1 || inflight.PacketID == 0 {
+				t.Fatalf("qos 1 delivery = %s qos %d id %d", inflight.TopicName, inflight.FixedHeader.Qos, inflight.PacketID)
+			}
+			c.conn.Close()
+			stop()
+
+			// 重新创建 servicer，从存储恢复保留消息、会话订阅与 inflight 消息
+			m = newTestMqtt(t, config)
+			runTestMqtt(t, m)
+			if payload, ok := m.Retained("devices/a"); !ok || string(payload) != "retained" {
+				t.Fatalf("retained after restart = %q, %v", payload, ok)
+			}
+
+			c = dialTestMqtt(t, sock)
+			if !c.connect("device-1") {
+				t.Fatal("session not restored after restart")
+			}
+			resent := c.expect(packets.Publish)
+			if resent.TopicName != "devices/b" || string(resent.Payload) != "inflight" ||
+				resent.PacketID != inflight.PacketID || !resent.FixedHeader.Dup {
+				t.Fatalf("resent inflight = %s %q id %d dup %v, want id %d",
+					resent.TopicName, resent.Payload, resent.PacketID, resent.FixedHeader.Dup, inflight.PacketID)
+			}
+			c.puback(resent.PacketID)
+
+			// 恢复的订阅继续接收消息
+			if err := m.Publish("devices/c", []byte("after"), false, 1); err != nil {
+				t.Fatal(err)
+			}
+			pk := c.expect(packets.Publish)
+			if pk.TopicName != "devices/c" || string(pk.Payload) != "after" {
+				t.Fatalf("delivery after restart = %s %q", pk.TopicName, pk.Payload)
+			}
+			c.puback(pk.PacketID)
+		})
+	}
+}
+
+func TestBoltHookRestoresInflightPacketID(t *testing.T) {
+	h := &boltHook{Hook: new(bolt.Hook)}
+	h.SetOpts(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	if err := h.Init(&bolt.Options{Path: filepath.Join(t.TempDir(), boltFile)}); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	cl := &server.Client{ID: "device:1"}
+	for _, id := range []uint16{7, 65535} {
+		h.OnQosPublish(cl, packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+			PacketID:    id,
+			TopicName:   "devices/a",
+			Payload:     []byte("1"),
+		}, time.Now().Unix(), 0)
+	}
+
+	// bolt 存储钩子本身不保存报文ID
+	raw, err := h.Hook.StoredInflightMessages()
+	if err != nil || len(raw) != 2 || raw[0].PacketID != 0 {
+		t.Fatalf("stored inflight = %+v, %v", raw, err)
+	}
+	msgs, err := h.StoredInflightMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[uint16]bool{}
+	for _, msg := range msgs {
+		if msg.Client != "device:1" {
+			t.Errorf("inflight client = %q", msg.Client)
+		}
+		ids[msg.PacketID] = true
+	}
+	if len(ids) != 2 || !ids[7] || !ids[65535] {
+		t.Fatalf("restored packet IDs = %v, want 7 and 65535", ids)
+	}
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/networkProtocalTrans/logger"
+)
+
+// servicer 类型
+const (
+	ServicerTypeMQTT      = "mqtt"
+	ServicerTypeWebsocket = "websocket"
+	ServicerTypeCoAP      = "coap"
+	ServicerTypeWebhook   = "webhook"
+	ServicerTypeTCP       = "tcp"
+	ServicerTypeUDP       = "udp"
+	ServicerTypeModbus    = "modbus"
+)
+
+// servicerHeader 各类型 servicer 配置文件的公共部分，用于识别类型与名称
+type servicerHeader struct {
+	Type   string       `toml:"type"`
+	Server ServerConfig `toml:"server"`
+}
+
+var (
+	registryMu sync.RWMutex
+	factories  = map[string]ServicerFactory{}
+	servicers  = map[string]Servicer{}
+	// 按加载顺序记录的 servicer
+	servicerList []Servicer
+)
+
+// RegisterServicerType 注册 servicer 类型的创建函数
+func RegisterServicerType(typ string, factory ServicerFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	factories[strings.ToLower(typ)] = factory
+}
+
+// LoadServicers 扫描 dir 下的 *.toml 配置文件，按 type 字段创建 servicer，
+// 同一类型可通过不同的 server.name 创建多个实例
+func LoadServicers(ctx context.Context, log *logger.AppLogger, dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.toml"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		var header servicerHeader
+		if _, err := toml.DecodeFile(file, &header); err != nil {
+			return fmt.Errorf("load servicer config %s: %w", file, err)
+		}
+		name := header.Server.Name
+		if name == "" {
+			return fmt.Errorf("servicer config %s: server.name is required", file)
+		}
+		if _, ok := GetServicer(name); ok {
+			return fmt.Errorf("servicer config %s: duplicate servicer name %q", file, name)
+		}
+
+		registryMu.RLock()
+		factory, ok := factories[strings.ToLower(header.Type)]
+		registryMu.RUnlock()
+		if !ok {
+			return fmt.Errorf("servicer config %s: unknown servicer type %q", file, header.Type)
+		}
+		s, err := factory(ctx, log, file)
+		if err != nil {
+			return fmt.Errorf("servicer %s: %w", name, err)
+		}
+
+		registryMu.Lock()
+		servicers[name] = s
+		servicerList = append(servicerList, s)
+		registryMu.Unlock()
+		log.LogInfo(ctx, "servicer loaded", "name", name, "type", header.Type, "config", file)
+	}
+	return nil
+}
+
+// Servicers 按加载顺序返回所有 servicer
+func Servicers() []Servicer {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return append([]Servicer(nil), servicerList...)
+}
+
+// GetServicer 按名称获取 servicer
+func GetServicer(name string) (Servicer, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	s, ok := servicers[name]
+	return s, ok
+}
+
+// GetMqttServer 按名称获取 MQTT servicer
+func GetMqttServer(name string) (*mqttServer, bool) {
+	s, ok := GetServicer(name)
+	if !ok {
+		return nil, false
+	}
+	m, ok := s.(*mqttServer)
+	return m, ok
+}
+
+// GetWebsocketServer 按名称获取 websocket servicer
+func GetWebsocketServer(name string) (*websocketServer, bool) {
+	s, ok := GetServicer(name)
+	if !ok {
+		return nil, false
+	}
+	ws, ok := s.(*websocketServer)
+	return ws, ok
+}
+
+// GetWebhookServer 按名称获取 webhook servicer
+func GetWebhookServer(name string) (*webhookServer, bool) {
+	s, ok := GetServicer(name)
+	if !ok {
+		return nil, false
+	}
+	w, ok := s.(*webhookServer)
+	return w, ok
+}
+
+// GetSocketServer 按名称获取 tcp 或 udp servicer
+func GetSocketServer(name string) (*socketServer, bool) {
+	s, ok := GetServicer(name)
+	if !ok {
+		return nil, false
+	}
+	sock, ok := s.(*socketServer)
+	return sock, ok
+}
+
+// firstMqttServer 返回最先加载的 MQTT servicer
+func firstMqttServer() *mqttServer {
+	for _, s := range Servicers() {
+		if m, ok := s.(*mqttServer); ok {
+			return m
+		}
+	}
+	return nil
+}
+
+// firstWebsocketServer 返回最先加载的 websocket servicer
+func firstWebsocketServer() *websocketServer {
+	for _, s := range Servicers() {
+		if ws, ok := s.(*websocketServer); ok {
+			return ws
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/networkProtocalTrans/logger"
+)
+
+// 测试用 servicer 类型，配置中 fail = true 时创建失败
+const servicerTypeFake = "fake"
+
+func init() {
+	RegisterServicerType(servicerTypeFake, func(ctx context.Context, log *logger.AppLogger, configPath string) (Servicer, error) {
+		b, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(string(b), "fail = true") {
+			return nil, errors.New("fake servicer failed")
+		}
+		var header servicerHeader
+		if _, err := toml.Decode(string(b), &header); err != nil {
+			return nil, err
+		}
+		return newFakeServicer(header.Server.Name, 0), nil
+	})
+}
+
+// useTestRegistry 测试结束时将已加载的 servicer 恢复为测试开始时的状态
+func useTestRegistry(t *testing.T) {
+	t.Helper()
+	registryMu.Lock()
+	prevMap := make(map[string]Servicer, len(servicers))
+	for name, s := range servicers {
+		prevMap[name] = s
+	}
+	prevList := append([]Servicer(nil), servicerList...)
+	registryMu.Unlock()
+	t.Cleanup(func() {
+		registryMu.Lock()
+		servicers, servicerList = prevMap, prevList
+		registryMu.Unlock()
+	})
+}
+
+// writeServicerConfigs 将 文件名 -> 配置 写入临时目录并返回目录
+func writeServicerConfigs(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, config := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func fakeConfig(name string) string {
+	return fmt.Sprintf("type = %q\n[server]\nname = %q\n", servicerTypeFake, name)
+}
+
+func TestLoadServicers(t *testing.T) {
+	useTestRegistry(t)
+	before := len(Servicers())
+	dir := writeServicerConfigs(t, map[string]string{
+		"b.toml":     fakeConfig("fake-b"),
+		"a.toml":     "type = \"FAKE\"\n[server]\nname = \"fake-a\"\n",
+		"ignored.md": fakeConfig("fake-ignored"),
+		"mqtt.toml":  "type = \"mqtt\"\n" + testMqttConfig,
+	})
+	if err := LoadServicers(context.Background(), &logger.AppLogger{}, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// 按配置文件名排序加载，类型不区分大小写
+	loaded := Servicers()[before:]
+	var names []string
+	for _, s := range loaded {
+		names = append(names, s.Name())
+	}
+	if strings.Join(names, ",") != "fake-a,fake-b,mqtt-test" {
+		t.Fatalf("loaded %v", names)
+	}
+	if s, ok := GetServicer("fake-b"); !ok || s != loaded[1] {
+		t.Errorf("GetServicer(fake-b) = %v, %v", s, ok)
+	}
+	if _, ok := GetServicer("fake-ignored"); ok {
+		t.Error("loaded a servicer from a non-toml file")
+	}
+	if m, ok := GetMqttServer("mqtt-test"); !ok || m != loaded[2] {
+		t.Errorf("GetMqttServer(mqtt-test) = %v, %v", m, ok)
+	}
+	// 按类型获取时类型不符视为不存在
+	if _, ok := GetMqttServer("fake-a"); ok {
+		t.Error("GetMqttServer returned a fake servicer")
+	}
+	if _, ok := GetWebsocketServer("mqtt-test"); ok {
+		t.Error("GetWebsocketServer returned a mqtt servicer")
+	}
+	if _, ok := GetWebhookServer("missing"); ok {
+		t.Error("GetWebhookServer returned a missing servicer")
+	}
+	if _, ok := GetSocketServer("mqtt-test"); ok {
+		t.Error("GetSocketServer returned a mqtt servicer")
+	}
+}
+
+func TestLoadServicersErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{"missing name", map[string]string{"a.toml": "type = \"fake\"\n[server]\n"}, "server.name is required"},
+		{"unknown type", map[string]string{"a.toml": "type = \"smtp\"\n[server]\nname = \"a\"\n"}, `unknown servicer type "smtp"`},
+		{"invalid toml", map[string]string{"a.toml": "type = "}, "load servicer config"},
+		{"factory error", map[string]string{"a.toml": fakeConfig("fake-a") + "fail = true\n"}, "servicer fake-a: fake servicer failed"},
+		{"duplicate name", map[string]string{"a.toml": fakeConfig("fake-a"), "b.toml": fakeConfig("fake-a")}, `duplicate servicer name "fake-a"`},
+		{"invalid mqtt config", map[string]string{"a.toml": "type = \"mqtt\"\n[server]\nname = \"mqtt-a\"\n"}, "server.address is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestRegistry(t)
+			err := LoadServicers(context.Background(), &logger.AppLogger{}, writeServicerConfigs(t, tt.files))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestResolveMqttServer(t *testing.T) {
+	useTestRegistry(t)
+	prev := MqttServer
+	MqttServer = nil
+	t.Cleanup(func() { MqttServer = prev })
+
+	if _, err := resolveMqttServer(""); err == nil {
+		t.Error("resolved a default mqtt servicer without one configured")
+	}
+	dir := writeServicerConfigs(t, map[string]string{
+		"a.toml": "type = \"mqtt\"\n" + strings.Replace(testMqttConfig, "mqtt-test", "mqtt-a", 1),
+		"b.toml": "type = \"mqtt\"\n" + strings.Replace(testMqttConfig, "mqtt-test", "mqtt-b", 1),
+		"c.toml": fakeConfig("fake-c"),
+	})
+	if err := LoadServicers(context.Background(), &logger.AppLogger{}, dir); err != nil {
+		t.Fatal(err)
+	}
+	MqttServer = firstMqttServer()
+
+	tests := []struct {
+		name string
+		want string // 为空时应返回错误
+	}{
+		{"", "mqtt-a"},
+		{"mqtt-b", "mqtt-b"},
+		{"fake-c", ""},
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		m, err := resolveMqttServer(tt.name)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("resolveMqttServer(%q) = %s, want an error", tt.name, m.Name())
+		case tt.want != "" && (err != nil || m.Name() != tt.want):
+			t.Errorf("resolveMqttServer(%q) = %v, %v, want %s", tt.name, m, err, tt.want)
+		}
+	}
+}
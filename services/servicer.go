@@ -0,0 +1,22 @@
+package services
+
+import (
+	"context"
+
+	"github.com/networkProtocalTrans/logger"
+)
+
+// Servicer 各类型 servicer 的公共生命周期
+type Servicer interface {
+	// Name 返回 servicer 名称，对应配置中的 server.name
+	Name() string
+	// Start 启动服务并阻塞，ctx 取消或 Stop 被调用后返回 nil，运行失败时返回错误
+	Start(ctx context.Context) error
+	// Stop 停止服务，使 Start 返回
+	Stop(ctx context.Context) error
+	// Health 返回健康状态，nil 表示健康
+	Health() error
+}
+
+// ServicerFactory 根据配置文件创建 servicer 实例
+type ServicerFactory func(ctx context.Context, log *logger.AppLogger, configPath string) (Servicer, error)
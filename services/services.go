@@ -2,16 +2,125 @@ package services
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	"github.com/networkProtocalTrans/logger"
 )
 
+// servicer 配置文件目录
+const ServicerConfigDir = "./conf/servicer"
+
 var (
+	// 默认 servicer，为同类型中最先加载（按配置文件名排序）的实例
 	MqttServer *mqttServer
 	WsServer   *websocketServer
+	Bridges    []*bridge
+	// 由 main 创建的 Supervisor，用于查询 servicer 运行状态
+	DefaultSupervisor *Supervisor
 )
 
+// InitServices 加载所有 servicer 并建立桥接，servicer 由 Supervisor 启动
 func InitServices(ctx context.Context) {
-	MqttServer = GetMqttServer(ctx, logger.DefaultLogger, "./conf/servicer/mqtt-test.toml")
-	WsServer = GetWebsocketServer(ctx, logger.DefaultLogger, "./conf/servicer/web-socket-test.toml")
+	log := logger.DefaultLogger
+	if err := LoadServicers(ctx, log, ServicerConfigDir); err != nil {
+		log.LogFatal(ctx, "Failed to load servicers", "error", err)
+	}
+	MqttServer = firstMqttServer()
+	WsServer = firstWebsocketServer()
+
+	for _, s := range Servicers() {
+		// CoAP 资源映射到 MQTT 主题
+		if c, ok := s.(*coapServer); ok {
+			mqtt, err := resolveMqttServer(c.config.CoAP.MQTT)
+			if err != nil {
+				log.LogFatal(ctx, "CoAP servicer requires a mqtt servicer", "coap", c.Name(), "error", err)
+			}
+			c.LinkMQTT(mqtt)
+			continue
+		}
+
+		// Modbus 点位发布到 MQTT
+		if mb, ok := s.(*modbusServer); ok {
+			mqtt, err := resolveMqttServer(mb.config.Modbus.MQTT)
+			if err != nil {
+				log.LogFatal(ctx, "Modbus servicer requires a mqtt servicer", "modbus", mb.Name(), "error", err)
+			}
+			if err := mb.LinkMQTT(mqtt); err != nil {
+				log.LogFatal(ctx, "Failed to link modbus servicer to mqtt", "modbus", mb.Name(), "error", err)
+			}
+			continue
+		}
+
+		// tcp / udp 帧转发到 MQTT 与 websocket，未配置对应方向时可以没有 MQTT servicer
+		if sock, ok := s.(*socketServer); ok {
+			rule := sock.config.Bridge
+			mqtt, err := resolveMqttServer(rule.MQTT)
+			if err != nil && rule.MQTT != "" {
+				log.LogFatal(ctx, "Socket bridge references unknown mqtt servicer", "socket", sock.Name(), "error", err)
+			}
+			ws := WsServer
+			if rule.Websocket != "" {
+				var ok bool
+				if ws, ok = GetWebsocketServer(rule.Websocket); !ok {
+					log.LogFatal(ctx, "Socket bridge references unknown websocket servicer", "socket", sock.Name(), "websocket", rule.Websocket)
+				}
+			}
+			if err := sock.LinkBridge(ctx, mqtt, ws); err != nil {
+				log.LogFatal(ctx, "Failed to start socket bridge", "socket", sock.Name(), "error", err)
+			}
+			continue
+		}
+
+		// webhook 订阅配置的消息来源
+		if w, ok := s.(*webhookServer); ok {
+			if err := w.linkSources(ctx); err != nil {
+				log.LogFatal(ctx, "Failed to link webhook sources", "webhook", w.Name(), "error", err)
+			}
+			continue
+		}
+
+		// 启动 MQTT 与 websocket 之间的桥接
+		ws, ok := s.(*websocketServer)
+		if !ok {
+			continue
+		}
+		for i, rule := range ws.config.Bridges {
+			mqtt, err := resolveMqttServer(rule.MQTT)
+			if err != nil {
+				log.LogFatal(ctx, "Bridge requires a mqtt servicer", "websocket", ws.Name(), "error", err)
+			}
+			b := NewBridge(log, mqtt, ws, rule, i+1)
+			if err := b.Start(ctx); err != nil {
+				log.LogFatal(ctx, "Failed to start bridge", "websocket", ws.Name(), "error", err)
+			}
+			Bridges = append(Bridges, b)
+		}
+
+		// 启用 pubsub 时 websocket 频道映射到 MQTT 主题，否则频道只在本服务内转发
+		if pubsub := ws.config.PubSub; pubsub.Enable {
+			mqtt, err := resolveMqttServer(pubsub.MQTT)
+			if err != nil {
+				log.LogFatal(ctx, "Websocket pubsub requires a mqtt servicer", "websocket", ws.Name(), "error", err)
+			}
+			if err := ws.LinkMQTT(mqtt); err != nil {
+				log.LogFatal(ctx, "Failed to link websocket channels to mqtt", "websocket", ws.Name(), "error", err)
+			}
+		}
+	}
+}
+
+// resolveMqttServer 按名称查找 MQTT servicer，名称为空时使用默认 MQTT servicer
+func resolveMqttServer(name string) (*mqttServer, error) {
+	if name == "" {
+		if MqttServer == nil {
+			return nil, errors.New("no mqtt servicer is configured")
+		}
+		return MqttServer, nil
+	}
+	m, ok := GetMqttServer(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown mqtt servicer %q", name)
+	}
+	return m, nil
 }
@@ -0,0 +1,546 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/logger"
+	"github.com/networkProtocalTrans/script"
+)
+
+const (
+	// udp 对端默认保留时间（秒），超过后不再向其发送下行消息
+	defaultUDPPeerTimeout = 300
+	// 默认写超时（秒）
+	defaultSocketWriteTimeout = 10
+)
+
+// remotePlaceholder publish_topic 中替换为对端地址的占位符
+const remotePlaceholder = "{remote}"
+
+// SocketConfig tcp / udp servicer 配置
+type SocketConfig struct {
+	Type    string             `toml:"type"`
+	Server  ServerConfig       `toml:"server"`
+	Socket  SocketConfigDetail `toml:"socket"`
+	Framing FramingConfig      `toml:"framing"`
+	Bridge  SocketBridgeConfig `toml:"bridge"`
+}
+
+type SocketConfigDetail struct {
+	// tcp 最大连接数，0 表示不限制
+	MaxConnections int `toml:"max_connections"`
+	// 空闲超时（秒）：tcp 连接在此期间未收到数据时断开，0 表示不断开；
+	// udp 对端在此期间未发送数据时不再向其发送下行消息，默认 300
+	IdleTimeout int `toml:"idle_timeout"`
+	// 写超时（秒），默认 10
+	WriteTimeout int `toml:"write_timeout"`
+}
+
+// SocketBridgeConfig 帧与 MQTT 主题、websocket 路径之间的转发
+type SocketBridgeConfig struct {
+	// MQTT servicer 名称，为空时使用默认 MQTT servicer
+	MQTT string `toml:"mqtt"`
+	// 收到的帧发布到的 MQTT 主题，为空则不发布，可包含 {remote} 占位符
+	PublishTopic string `toml:"publish_topic"`
+	QoS          byte   `toml:"qos"`
+	Retain       bool   `toml:"retain"`
+	// 订阅的 MQTT 主题过滤器，匹配的消息编码为帧后发送给所有对端，为空则不订阅
+	Topic string `toml:"topic"`
+	// 收到的帧广播到的 websocket servicer 与路径，path 为空则不广播
+	Websocket string `toml:"websocket"`
+	Path      string `toml:"path"`
+	// 对转发的帧与 MQTT 消息执行的脚本，codec 默认为 json，帧为文本时可用 text。
+	// 脚本可修改发布主题与 headers（MQTT v5 用户属性），返回 null 时不转发
+	Script *script.Config `toml:"script"`
+}
+
+// FrameHandler 处理对端发来的一帧，remote 为对端地址
+type FrameHandler func(ctx context.Context, remote string, frame []byte)
+
+func init() {
+	for _, network := range []string{ServicerTypeTCP, ServicerTypeUDP} {
+		network := network
+		RegisterServicerType(network, func(ctx context.Context, log *logger.AppLogger, configPath string) (Servicer, error) {
+			return NewSocketServer(ctx, log, network, configPath)
+		})
+	}
+}
+
+// udpPeer 最近发送过数据的 udp 对端
+type udpPeer struct {
+	addr     net.Addr
+	lastSeen time.Time
+}
+
+// socketServer 原始 TCP / UDP 服务，按配置的分帧方式将字节流切分为消息
+type socketServer struct {
+	logger  *logger.AppLogger
+	config  *SocketConfig
+	network string
+	framer  Framer
+
+	mqtt *mqttServer
+	ws   *websocketServer
+	// [bridge.script] 编译后的脚本，未配置时为 nil
+	script *script.Script
+
+	mu       sync.Mutex
+	listener net.Listener
+	packet   net.PacketConn
+	conns    map[net.Conn]*tcpConn
+	peers    map[string]*udpPeer
+	handlers []FrameHandler
+	count    int64
+}
+
+// NewSocketServer 根据配置文件创建 tcp 或 udp servicer 实例
+func NewSocketServer(ctx context.Context, log *logger.AppLogger, network, configPath string) (*socketServer, error) {
+	var config SocketConfig
+	if _, err := toml.DecodeFile(configPath, &config); err != nil {
+		return nil, fmt.Errorf("load %s config %s: %w", network, configPath, err)
+	}
+	if config.Server.Address == "" {
+		return nil, fmt.Errorf("invalid %s config %s: server.address is required", network, configPath)
+	}
+	if config.Framing.Type == "" {
+		config.Framing.Type = FramingNone
+	}
+	if config.Framing.MaxFrameSize <= 0 {
+		config.Framing.MaxFrameSize = defaultMaxFrameSize
+	}
+	framer, err := NewFramer(config.Framing)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s config %s: %w", network, configPath, err)
+	}
+	if config.Bridge.QoS > 2 {
+		return nil, fmt.Errorf("invalid %s config %s: bridge.qos = %d is out of range [0, 2]", network, configPath, config.Bridge.QoS)
+	}
+	if config.Socket.WriteTimeout <= 0 {
+		config.Socket.WriteTimeout = defaultSocketWriteTimeout
+	}
+	if network == ServicerTypeUDP && config.Socket.IdleTimeout <= 0 {
+		config.Socket.IdleTimeout = defaultUDPPeerTimeout
+	}
+	return &socketServer{
+		logger:  log,
+		config:  &config,
+		network: network,
+		framer:  framer,
+		conns:   make(map[net.Conn]*tcpConn),
+		peers:   make(map[string]*udpPeer),
+	}, nil
+}
+
+// Name 返回 servicer 名称
+func (s *socketServer) Name() string {
+	return s.config.Server.Name
+}
+
+// Network 返回 tcp 或 udp
+func (s *socketServer) Network() string {
+	return s.network
+}
+
+// OnFrame 注册帧处理函数，需在 Start 之前调用
+func (s *socketServer) OnFrame(handler FrameHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers = append(s.handlers, handler)
+}
+
+// LinkBridge 按 [bridge] 配置建立与 MQTT、websocket 的转发
+func (s *socketServer) LinkBridge(ctx context.Context, m *mqttServer, ws *websocketServer) error {
+	rule := s.config.Bridge
+	if rule.PublishTopic != "" || rule.Topic != "" {
+		if m == nil {
+			return errors.New("bridge requires a mqtt servicer")
+		}
+		s.mqtt = m
+	}
+	if rule.Path != "" {
+		if ws == nil {
+			return errors.New("bridge requires a websocket servicer")
+		}
+		s.ws = ws
+	}
+	if rule.Script != nil {
+		sc, err := script.New(s.network+" "+s.Name(), *rule.Script)
+		if err != nil {
+			return err
+		}
+		s.script = sc
+	}
+	if rule.Topic != "" {
+		if _, err := m.Subscribe(rule.Topic, func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+			headers := HeadersOf(pk.Properties.User)
+			if err := s.relayMQTT(pk.TopicName, headers, pk.Payload); err != nil {
+				s.failed(context.Background(), ServicerTypeMQTT, m.Name(), pk.TopicName, headers, pk.Payload, err)
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	if s.mqtt != nil || s.ws != nil {
+		s.OnFrame(s.forward)
+	}
+	return nil
+}
+
+// relayMQTT 对 MQTT 消息执行脚本后编码为帧发送给所有对端
+func (s *socketServer) relayMQTT(topic string, headers map[string]string, payload []byte) error {
+	msg, err := runScript(s.script, &script.Message{
+		Topic:   topic,
+		Source:  "mqtt",
+		Headers: headers,
+		Payload: payload,
+	})
+	if err != nil {
+		return fmt.Errorf("script failed for %s: %w", topic, err)
+	}
+	if _, err := s.Send(msg.Payload); err != nil {
+		return deliveryFailed(fmt.Errorf("send frame failed: %w", err))
+	}
+	return nil
+}
+
+// forward 将帧发布到 MQTT 主题并广播到 websocket 路径
+func (s *socketServer) forward(ctx context.Context, remote string, frame []byte) {
+	if err := s.relayFrame(remote, frame); err != nil {
+		s.failed(ctx, s.network, s.Name(), remote, nil, frame, err)
+	}
+}
+
+// relayFrame 对帧执行脚本后发布到 MQTT 主题并广播到 websocket 路径，发布失败的错误标记为发送阶段
+func (s *socketServer) relayFrame(remote string, frame []byte) error {
+	rule := s.config.Bridge
+	topic := strings.ReplaceAll(rule.PublishTopic, remotePlaceholder, remote)
+	msg, err := runScript(s.script, &script.Message{Topic: topic, Source: s.network, Payload: frame})
+	if err != nil {
+		return fmt.Errorf("script failed for %s: %w", remote, err)
+	}
+	if s.ws != nil {
+		s.ws.Broadcast(rule.Path, FrameType(msg.Payload), msg.Payload)
+	}
+	if s.mqtt != nil && rule.PublishTopic != "" {
+		if len(msg.Headers) == 0 {
+			err = s.mqtt.Publish(msg.Topic, msg.Payload, rule.Retain, rule.QoS)
+		} else {
+			_, err = s.mqtt.PublishPacket(msg.Topic, msg.Payload, rule.Retain, rule.QoS, packets.Properties{User: UserProperties(msg.Headers)})
+		}
+		if err != nil {
+			return deliveryFailed(fmt.Errorf("publish to %s failed: %w", msg.Topic, err))
+		}
+	}
+	return nil
+}
+
+// failed 记录桥接转发失败并产生死信，脚本丢弃的消息不记录
+func (s *socketServer) failed(ctx context.Context, source, servicer, topic string, headers map[string]string, payload []byte, err error) {
+	if errors.Is(err, script.ErrDropped) {
+		return
+	}
+	s.logger.LogErrorf(ctx, "%s %s: %v", s.network, s.Name(), err)
+	deadletter.Publish(ctx, &deadletter.Letter{
+		Stage:       stageOf(err),
+		Error:       err.Error(),
+		Source:      source,
+		Servicer:    servicer,
+		Topic:       topic,
+		Destination: s.network + ":" + s.Name(),
+		Headers:     headers,
+		Payload:     payload,
+	})
+}
+
+// Start 开始监听并处理数据，阻塞直到 ctx 取消或 Stop 被调用
+func (s *socketServer) Start(ctx context.Context) error {
+	s.logger.LogInfo(ctx, "Starting socket server",
+		"name", s.Name(),
+		"network", s.network,
+		"address", s.config.Server.Address,
+		"framing", s.config.Framing.Type,
+	)
+	if s.network == ServicerTypeUDP {
+		return s.serveUDP(ctx)
+	}
+	return s.serveTCP(ctx)
+}
+
+// Stop 关闭监听与所有连接
+func (s *socketServer) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.packet != nil {
+		s.packet.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+// Health 服务运行中时返回 nil
+func (s *socketServer) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil && s.packet == nil {
+		return ErrServicerNotRunning
+	}
+	return nil
+}
+
+// Send 将负载编码为帧发送给所有 tcp 连接或最近活跃的 udp 对端，返回发送的对端数。
+// tcp 帧放入各连接的发送队列后立即返回，由连接的写协程写出，慢速对端不会阻塞调用方
+func (s *socketServer) Send(payload []byte) (int, error) {
+	frame, err := s.framer.Encode(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	if s.packet == nil {
+		n := 0
+		for _, c := range s.conns {
+			if c.enqueue(frame) {
+				n++
+			} else {
+				s.logger.LogInfo(context.Background(), "tcp connection evicted: send queue full",
+					"name", s.Name(), "remote", c.conn.RemoteAddr().String())
+			}
+		}
+		s.mu.Unlock()
+		return n, nil
+	}
+	packet := s.packet
+	expired := time.Now().Add(-time.Duration(s.config.Socket.IdleTimeout) * time.Second)
+	peers := make(map[string]net.Addr, len(s.peers))
+	for key, p := range s.peers {
+		if p.lastSeen.Before(expired) {
+			delete(s.peers, key)
+			continue
+		}
+		peers[key] = p.addr
+	}
+	s.mu.Unlock()
+
+	n := 0
+	for key, addr := range peers {
+		if _, err := packet.WriteTo(frame, addr); err != nil {
+			s.logger.LogErrorf(context.Background(), "udp %s write to %s failed: %v", s.Name(), key, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// tcpConn 一个 tcp 连接与其发送队列，只有 writeLoop 向连接写入
+type tcpConn struct {
+	conn net.Conn
+	// 发送队列，在 socketServer.mu 下写入与关闭
+	send chan []byte
+	// 单次写入超时
+	writeTimeout time.Duration
+}
+
+// enqueue 将帧放入发送队列，队列已满说明对端消费过慢，关闭连接以免占用内存，由读协程清理
+func (c *tcpConn) enqueue(frame []byte) bool {
+	select {
+	case c.send <- frame:
+		return true
+	default:
+		c.conn.Close()
+		return false
+	}
+}
+
+// writeLoop 依次写出发送队列中的帧，写入失败时关闭连接并丢弃其余的帧，直到队列关闭
+func (c *tcpConn) writeLoop() {
+	for frame := range c.send {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+		if _, err := c.conn.Write(frame); err != nil {
+			// 读协程随后发现连接错误并清理
+			c.conn.Close()
+			for range c.send {
+			}
+			return
+		}
+	}
+}
+
+func (s *socketServer) dispatch(ctx context.Context, remote string, frame []byte) {
+	if len(frame) == 0 {
+		return
+	}
+	// 扫描缓冲区会被复用，交给处理函数的帧需要复制
+	frame = append([]byte(nil), frame...)
+	s.mu.Lock()
+	handlers := s.handlers
+	s.mu.Unlock()
+	for _, h := range handlers {
+		h(ctx, remote, frame)
+	}
+}
+
+func (s *socketServer) serveTCP(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.config.Server.Address)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.listener = ln
+	s.mu.Unlock()
+	stop := context.AfterFunc(ctx, func() {
+		ln.Close()
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer func() {
+		s.mu.Lock()
+		s.listener = nil
+		for c := range s.conns {
+			c.Close()
+		}
+		s.mu.Unlock()
+		wg.Wait()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if max := s.config.Socket.MaxConnections; max > 0 && atomic.LoadInt64(&s.count) >= int64(max) {
+			s.logger.LogInfo(ctx, "tcp connection rejected: too many connections", "name", s.Name(), "remote", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		atomic.AddInt64(&s.count, 1)
+		c := &tcpConn{
+			conn:         conn,
+			send:         make(chan []byte, defaultSendQueueSize),
+			writeTimeout: time.Duration(s.config.Socket.WriteTimeout) * time.Second,
+		}
+		s.mu.Lock()
+		s.conns[conn] = c
+		s.mu.Unlock()
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.writeLoop()
+		}()
+		go func() {
+			defer wg.Done()
+			defer atomic.AddInt64(&s.count, -1)
+			s.handleConn(ctx, c)
+		}()
+	}
+}
+
+// handleConn 从连接中读取帧直到连接关闭、空闲超时或分帧出错
+func (s *socketServer) handleConn(ctx context.Context, c *tcpConn) {
+	conn := c.conn
+	remote := conn.RemoteAddr().String()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		close(c.send)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	idle := time.Duration(s.config.Socket.IdleTimeout) * time.Second
+	scanner := bufio.NewScanner(&idleReader{conn: conn, timeout: idle})
+	scanner.Buffer(make([]byte, 4096), s.config.Framing.MaxFrameSize+64)
+	scanner.Split(s.framer.Split)
+	for scanner.Scan() {
+		s.dispatch(ctx, remote, scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.LogInfo(ctx, "tcp connection closed", "name", s.Name(), "remote", remote, "error", err.Error())
+	}
+}
+
+// idleReader 每次读取前刷新读期限
+type idleReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	if r.timeout > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	return r.conn.Read(b)
+}
+
+func (s *socketServer) serveUDP(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp", s.config.Server.Address)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.packet = conn
+	s.mu.Unlock()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+	defer func() {
+		s.mu.Lock()
+		s.packet = nil
+		s.peers = make(map[string]*udpPeer)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		remote := addr.String()
+		s.mu.Lock()
+		s.peers[remote] = &udpPeer{addr: addr, lastSeen: time.Now()}
+		s.mu.Unlock()
+
+		// 一个数据报中可以包含多帧，按数据报结束（atEOF）处理尾部
+		data := buf[:n]
+		for len(data) > 0 {
+			advance, frame, err := s.framer.Split(data, true)
+			if err != nil {
+				s.logger.LogInfo(ctx, "udp frame dropped", "name", s.Name(), "remote", remote, "error", err.Error())
+				break
+			}
+			if advance <= 0 {
+				break
+			}
+			s.dispatch(ctx, remote, frame)
+			data = data[advance:]
+		}
+	}
+}
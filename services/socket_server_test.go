@@ -0,0 +1,125 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/networkProtocalTrans/logger"
+)
+
+// startTCPServer 在随机端口启动 tcp servicer，返回监听地址
+func startTCPServer(t *testing.T, framing FramingConfig) (*socketServer, string) {
+	t.Helper()
+	framer, err := NewFramer(framing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socketServer{
+		logger: &logger.AppLogger{},
+		config: &SocketConfig{
+			Server:  ServerConfig{Name: "tcp-test", Address: "127.0.0.1:0"},
+			Socket:  SocketConfigDetail{WriteTimeout: defaultSocketWriteTimeout},
+			Framing: framing,
+		},
+		network: ServicerTypeTCP,
+		framer:  framer,
+		conns:   make(map[net.Conn]*tcpConn),
+		peers:   make(map[string]*udpPeer),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Start(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		ln := s.listener
+		s.mu.Unlock()
+		if ln != nil {
+			return s, ln.Addr().String()
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("tcp servicer did not start")
+	return nil, ""
+}
+
+// waitConns 等待 servicer 登记 n 个连接
+func waitConns(t *testing.T, s *socketServer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		got := len(s.conns)
+		s.mu.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("servicer did not register %d connections", n)
+}
+
+func TestSocketSendFramesToPeers(t *testing.T) {
+	s, addr := startTCPServer(t, FramingConfig{Type: FramingDelimiter, Delimiter: "\n", MaxFrameSize: defaultMaxFrameSize})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitConns(t, s, 1)
+
+	for _, p := range []string{"one", "two"} {
+		if n, err := s.Send([]byte(p)); err != nil || n != 1 {
+			t.Fatalf("Send(%q) = %d, %v", p, n, err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, want := range []string{"one\n", "two\n"} {
+		line, err := r.ReadString('\n')
+		if err != nil || line != want {
+			t.Fatalf("read %q, %v; want %q", line, err, want)
+		}
+	}
+}
+
+func TestSocketSendDoesNotBlockOnSlowPeer(t *testing.T) {
+	s, addr := startTCPServer(t, FramingConfig{Type: FramingNone, MaxFrameSize: defaultMaxFrameSize})
+	// 对端从不读取，内核缓冲区写满后写协程阻塞，发送队列随后写满
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitConns(t, s, 1)
+
+	frame := bytes.Repeat([]byte{'x'}, 64*1024)
+	start := time.Now()
+	evicted := false
+	for i := 0; i < 4096 && !evicted; i++ {
+		n, err := s.Send(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		evicted = n == 0
+	}
+	if !evicted {
+		t.Fatal("slow peer was never evicted")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Send blocked for %v", elapsed)
+	}
+	// 被驱逐的连接由读协程清理
+	waitConns(t, s, 0)
+}
@@ -0,0 +1,242 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/logger"
+)
+
+// SSE 默认配置
+const (
+	defaultSSEBufferSize  = 100
+	defaultSSEQueueSize   = 64
+	defaultSSEHeartbeat   = 15
+	defaultSSEIdleTimeout = 60
+)
+
+// ErrSSENotAllowed [sse.acl] 不允许读取订阅的主题过滤器
+var ErrSSENotAllowed = errors.New("subscribing is not allowed by sse.acl")
+
+// SSEConfig conf/api.toml 中的 [sse] 部分
+type SSEConfig struct {
+	// 每个主题过滤器保留用于 Last-Event-ID 续传的事件数
+	BufferSize int `toml:"buffer_size"`
+	// 每个客户端的发送队列长度，队列满时断开该客户端
+	QueueSize int `toml:"queue_size"`
+	// 心跳间隔（秒）
+	Heartbeat int `toml:"heartbeat"`
+	// 最后一个客户端断开后保留订阅与缓冲区的时间（秒），期间重连的客户端可以续传
+	IdleTimeout int `toml:"idle_timeout"`
+	// 可以订阅的主题过滤器，规则与 MQTT ACL 相同（r、rw 允许订阅，deny 优先，匹配 deny 规则的消息不推送），
+	// 未配置时拒绝所有订阅
+	ACL ACL `toml:"acl"`
+}
+
+// HeartbeatInterval 返回心跳间隔
+func (c SSEConfig) HeartbeatInterval() time.Duration {
+	if c.Heartbeat <= 0 {
+		return defaultSSEHeartbeat * time.Second
+	}
+	return time.Duration(c.Heartbeat) * time.Second
+}
+
+// SSEEvent 一条 SSE 事件，Data 为与 websocket 频道消息相同的 JSON 结构
+type SSEEvent struct {
+	ID   uint64
+	Data []byte
+}
+
+// SSESubscription 一个 SSE 客户端的订阅
+type SSESubscription struct {
+	// 续传的历史事件
+	Replay []SSEEvent
+	events chan SSEEvent
+	stream *sseStream
+	once   sync.Once
+}
+
+// Events 返回实时事件，客户端消费过慢被断开时关闭
+func (s *SSESubscription) Events() <-chan SSEEvent {
+	return s.events
+}
+
+// Close 取消订阅
+func (s *SSESubscription) Close() {
+	s.stream.remove(s)
+}
+
+// sseStream 一个主题过滤器上的订阅与事件缓冲区，由该过滤器上的所有 SSE 客户端共享
+type sseStream struct {
+	broker *SSEBroker
+	filter string
+	subID  int
+
+	mu      sync.Mutex
+	nextID  uint64
+	buffer  []SSEEvent
+	clients map[*SSESubscription]struct{}
+	idle    *time.Timer
+	closed  bool
+}
+
+// SSEBroker 将 MQTT 主题过滤器上的消息分发给 SSE 客户端
+type SSEBroker struct {
+	mqtt   *mqttServer
+	config SSEConfig
+	logger *logger.AppLogger
+
+	mu      sync.Mutex
+	streams map[string]*sseStream
+}
+
+// NewSSEBroker 创建基于 MQTT servicer 的 SSE 分发器
+func NewSSEBroker(log *logger.AppLogger, m *mqttServer, config SSEConfig) *SSEBroker {
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultSSEBufferSize
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultSSEQueueSize
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = defaultSSEIdleTimeout
+	}
+	return &SSEBroker{
+		mqtt:    m,
+		config:  config,
+		logger:  log,
+		streams: make(map[string]*sseStream),
+	}
+}
+
+// Subscribe 订阅主题过滤器。hasLast 为 true 时返回缓冲区中 ID 大于 lastID 的事件用于续传。
+// $ 开头的系统主题与共享订阅不允许订阅，[sse.acl] 不允许读取时返回 ErrSSENotAllowed
+func (b *SSEBroker) Subscribe(filter string, lastID uint64, hasLast bool) (*SSESubscription, error) {
+	if strings.HasPrefix(filter, "$") || !server.IsValidFilter(filter, false) {
+		return nil, packets.ErrTopicFilterInvalid
+	}
+	if len(b.config.ACL) == 0 || !b.config.ACL.Allows(filter, false) {
+		return nil, ErrSSENotAllowed
+	}
+
+	for {
+		stream, err := b.stream(filter)
+		if err != nil {
+			return nil, err
+		}
+		sub := &SSESubscription{
+			events: make(chan SSEEvent, b.config.QueueSize),
+			stream: stream,
+		}
+		stream.mu.Lock()
+		if stream.closed {
+			// 空闲超时与本次订阅并发，重新创建
+			stream.mu.Unlock()
+			continue
+		}
+		if hasLast {
+			for _, ev := range stream.buffer {
+				if ev.ID > lastID {
+					sub.Replay = append(sub.Replay, ev)
+				}
+			}
+		}
+		if stream.idle != nil {
+			stream.idle.Stop()
+			stream.idle = nil
+		}
+		stream.clients[sub] = struct{}{}
+		stream.mu.Unlock()
+		return sub, nil
+	}
+}
+
+// stream 返回过滤器对应的流，不存在时创建并订阅 MQTT
+func (b *SSEBroker) stream(filter string) (*sseStream, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.streams[filter]; ok {
+		return s, nil
+	}
+	s := &sseStream{
+		broker: b,
+		filter: filter,
+		// 以创建时间作为起始 ID，流重建后 ID 仍然递增，旧的 Last-Event-ID 不会误跳过新事件
+		nextID:  uint64(time.Now().UnixNano()),
+		clients: make(map[*SSESubscription]struct{}),
+	}
+	id, err := b.mqtt.Subscribe(filter, func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		s.publish(pk.TopicName, pk.Payload)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.subID = id
+	b.streams[filter] = s
+	return s, nil
+}
+
+// publish 记录事件并发送给所有客户端
+func (s *sseStream) publish(topic string, payload []byte) {
+	data, err := encodeChannelMessage(topic, payload)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || !s.broker.config.ACL.Allows(topic, false) {
+		return
+	}
+	s.nextID++
+	ev := SSEEvent{ID: s.nextID, Data: data}
+	s.buffer = append(s.buffer, ev)
+	if n := len(s.buffer) - s.broker.config.BufferSize; n > 0 {
+		s.buffer = append(s.buffer[:0], s.buffer[n:]...)
+	}
+	for sub := range s.clients {
+		select {
+		case sub.events <- ev:
+		default:
+			// 客户端消费过慢，断开后可通过 Last-Event-ID 续传
+			s.broker.logger.LogInfo(context.Background(), "sse client evicted: send queue full", "topic", s.filter)
+			delete(s.clients, sub)
+			sub.once.Do(func() { close(sub.events) })
+		}
+	}
+}
+
+// remove 移除客户端，最后一个客户端离开后空闲超时再取消 MQTT 订阅
+func (s *sseStream) remove(sub *SSESubscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[sub]; ok {
+		delete(s.clients, sub)
+		sub.once.Do(func() { close(sub.events) })
+	}
+	if len(s.clients) > 0 || s.closed || s.idle != nil {
+		return
+	}
+	s.idle = time.AfterFunc(time.Duration(s.broker.config.IdleTimeout)*time.Second, s.expire)
+}
+
+// expire 空闲超时后关闭流
+func (s *sseStream) expire() {
+	b := s.broker
+	b.mu.Lock()
+	s.mu.Lock()
+	if len(s.clients) > 0 || s.closed {
+		s.mu.Unlock()
+		b.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+	delete(b.streams, s.filter)
+	b.mu.Unlock()
+	b.mqtt.Unsubscribe(s.filter, s.subID)
+}
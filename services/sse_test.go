@@ -0,0 +1,221 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/logger"
+)
+
+func newTestSSEBroker(t *testing.T, config SSEConfig) (*SSEBroker, *mqttServer) {
+	t.Helper()
+	m := startTestMqtt(t)
+	if config.ACL == nil {
+		config.ACL = ACL{"#": AccessRead}
+	}
+	return NewSSEBroker(&logger.AppLogger{}, m, config), m
+}
+
+// nextSSEEvent 读取下一条实时事件，返回其主题
+func nextSSEEvent(t *testing.T, sub *SSESubscription) (SSEEvent, string) {
+	t.Helper()
+	select {
+	case ev, ok := <-sub.Events():
+		if !ok {
+			t.Fatal("sse subscription closed")
+		}
+		var msg ChannelMessage
+		if err := json.Unmarshal(ev.Data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return ev, msg.Channel
+	case <-time.After(5 * time.Second):
+		t.Fatal("no sse event")
+	}
+	return SSEEvent{}, ""
+}
+
+func TestSSEResumeFromLastEventID(t *testing.T) {
+	b, m := newTestSSEBroker(t, SSEConfig{BufferSize: 3})
+	sub, err := b.Subscribe("devices/#", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint64
+	for i := 0; i < 4; i++ {
+		m.Publish(fmt.Sprintf("devices/%d", i), []byte("1"), false, 0)
+		ev, topic := nextSSEEvent(t, sub)
+		if topic != fmt.Sprintf("devices/%d", i) {
+			t.Fatalf("event %d topic = %s", i, topic)
+		}
+		if i > 0 && ev.ID <= ids[i-1] {
+			t.Fatalf("event IDs not increasing: %d after %d", ev.ID, ids[i-1])
+		}
+		ids = append(ids, ev.ID)
+	}
+	sub.Close()
+
+	tests := []struct {
+		lastID  uint64
+		hasLast bool
+		want    []uint64
+	}{
+		{0, false, nil},
+		{ids[1], true, ids[2:]},
+		{ids[3], true, nil},
+		// 缓冲区只保留最近 3 条
+		{ids[0] - 1, true, ids[1:]},
+	}
+	for _, tt := range tests {
+		sub, err := b.Subscribe("devices/#", tt.lastID, tt.hasLast)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []uint64
+		for _, ev := range sub.Replay {
+			got = append(got, ev.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("replay after %d (%v) = %v, want %v", tt.lastID, tt.hasLast, got, tt.want)
+		}
+		sub.Close()
+	}
+}
+
+func TestSSEEvictsSlowClient(t *testing.T) {
+	b, m := newTestSSEBroker(t, SSEConfig{QueueSize: 2})
+	slow, err := b.Subscribe("devices/#", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, err := b.Subscribe("devices/#", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+
+	var last SSEEvent
+	for i := 0; i < 3; i++ {
+		m.Publish(fmt.Sprintf("devices/%d", i), []byte("1"), false, 0)
+		last, _ = nextSSEEvent(t, fast)
+	}
+	// 慢客户端收到队列中的 2 条事件后被断开
+	var received []uint64
+	for ev := range slow.Events() {
+		received = append(received, ev.ID)
+	}
+	if len(received) != 2 {
+		t.Fatalf("slow client received %v before eviction, want 2 events", received)
+	}
+	slow.Close()
+
+	// 重连后从最后收到的事件续传
+	resumed, err := b.Subscribe("devices/#", received[1], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if len(resumed.Replay) != 1 || resumed.Replay[0].ID != last.ID {
+		t.Fatalf("replay after eviction = %v, want event %d", resumed.Replay, last.ID)
+	}
+}
+
+func TestSSEIdleTeardown(t *testing.T) {
+	b, m := newTestSSEBroker(t, SSEConfig{IdleTimeout: 1})
+	streams := func() int {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.streams)
+	}
+	inlineSubs := func() int {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		return len(m.subs)
+	}
+
+	sub, err := b.Subscribe("devices/#", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Publish("devices/a", []byte("1"), false, 0)
+	ev, _ := nextSSEEvent(t, sub)
+	sub.Close()
+
+	// 空闲超时前重连，复用流与缓冲区
+	m.Publish("devices/b", []byte("1"), false, 0)
+	waitFor(t, func() bool {
+		sub, _ := b.Subscribe("devices/#", ev.ID, true)
+		defer sub.Close()
+		return len(sub.Replay) == 1
+	})
+	if streams() != 1 || inlineSubs() != 1 {
+		t.Fatalf("streams = %d, inline subscriptions = %d before idle timeout", streams(), inlineSubs())
+	}
+
+	// 最后一个客户端离开并超时后取消 MQTT 订阅
+	waitFor(t, func() bool { return streams() == 0 && inlineSubs() == 0 })
+	sub, err = b.Subscribe("devices/#", ev.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if len(sub.Replay) != 0 {
+		t.Fatalf("replay from a torn down stream = %v", sub.Replay)
+	}
+	m.Publish("devices/c", []byte("1"), false, 0)
+	if next, _ := nextSSEEvent(t, sub); next.ID <= ev.ID {
+		t.Fatalf("event ID %d after teardown is not greater than %d", next.ID, ev.ID)
+	}
+}
+
+func TestSSEACL(t *testing.T) {
+	b, m := newTestSSEBroker(t, SSEConfig{ACL: ACL{
+		"devices/#":      AccessRead,
+		"devices/secret": AccessDeny,
+		"commands/#":     AccessWrite,
+	}})
+	tests := []struct {
+		filter string
+		err    error
+	}{
+		{"devices/#", nil},
+		{"devices/+/temperature", nil},
+		{"$SYS/#", packets.ErrTopicFilterInvalid},
+		{"$share/group/devices/#", packets.ErrTopicFilterInvalid},
+		{"devices/#/a", packets.ErrTopicFilterInvalid},
+		{"other/a", ErrSSENotAllowed},
+		{"#", ErrSSENotAllowed},
+		{"commands/a", ErrSSENotAllowed},
+	}
+	for _, tt := range tests {
+		sub, err := b.Subscribe(tt.filter, 0, false)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("subscribe %q: err = %v, want %v", tt.filter, err, tt.err)
+		}
+		if err == nil {
+			sub.Close()
+		}
+	}
+
+	// 匹配 deny 规则的消息不推送
+	sub, err := b.Subscribe("devices/#", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	m.Publish("devices/secret", []byte("1"), false, 0)
+	m.Publish("devices/a", []byte("1"), false, 0)
+	if _, topic := nextSSEEvent(t, sub); topic != "devices/a" {
+		t.Fatalf("received %s, want devices/a", topic)
+	}
+
+	// 未配置 sse.acl 时拒绝所有订阅
+	b = NewSSEBroker(&logger.AppLogger{}, m, SSEConfig{})
+	if _, err := b.Subscribe("devices/#", 0, false); !errors.Is(err, ErrSSENotAllowed) {
+		t.Fatalf("subscribe without sse.acl: err = %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// STOMP 客户端命令
+const (
+	stompConnect     = "CONNECT"
+	stompStomp       = "STOMP"
+	stompSend        = "SEND"
+	stompSubscribe   = "SUBSCRIBE"
+	stompUnsubscribe = "UNSUBSCRIBE"
+	stompAck         = "ACK"
+	stompNack        = "NACK"
+	stompBegin       = "BEGIN"
+	stompCommit      = "COMMIT"
+	stompAbort       = "ABORT"
+	stompDisconnect  = "DISCONNECT"
+)
+
+// STOMP 服务端命令
+const (
+	stompConnected = "CONNECTED"
+	stompMessage   = "MESSAGE"
+	stompReceipt   = "RECEIPT"
+	stompError     = "ERROR"
+)
+
+var errStompFrame = errors.New("malformed stomp frame")
+
+// stompHeader 保持顺序的帧头，同名帧头以第一个为准（STOMP 1.2 2.2）
+type stompHeader struct {
+	Key   string
+	Value string
+}
+
+// stompFrame 一个 STOMP 帧
+type stompFrame struct {
+	Command string
+	Headers []stompHeader
+	Body    []byte
+}
+
+// header 返回第一个名为 key 的帧头
+func (f *stompFrame) header(key string) (string, bool) {
+	for _, h := range f.Headers {
+		if h.Key == key {
+			return h.Value, true
+		}
+	}
+	return "", false
+}
+
+func (f *stompFrame) set(key, value string) {
+	f.Headers = append(f.Headers, stompHeader{Key: key, Value: value})
+}
+
+// escapes 帧头转义，CONNECT 与 CONNECTED 帧不转义
+var (
+	stompEscaper   = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+	stompUnescaper = strings.NewReplacer("\\r", "\r", "\\n", "\n", "\\c", ":", "\\\\", "\\")
+)
+
+func stompEscapes(command string) bool {
+	return command != stompConnect && command != stompConnected
+}
+
+// parseStompFrames 解析一个 websocket 消息中的全部 STOMP 帧，帧之间的空行（心跳）被忽略
+func parseStompFrames(data []byte) ([]*stompFrame, error) {
+	var frames []*stompFrame
+	for {
+		data = bytes.TrimLeft(data, "\r\n")
+		if len(data) == 0 {
+			return frames, nil
+		}
+		f, rest, err := parseStompFrame(data)
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, f)
+		data = rest
+	}
+}
+
+func parseStompFrame(data []byte) (*stompFrame, []byte, error) {
+	line, data, ok := cutStompLine(data)
+	if !ok || line == "" {
+		return nil, nil, errStompFrame
+	}
+	f := &stompFrame{Command: line}
+	escaped := stompEscapes(f.Command)
+	for {
+		line, data, ok = cutStompLine(data)
+		if !ok {
+			return nil, nil, errStompFrame
+		}
+		if line == "" {
+			break
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, nil, errStompFrame
+		}
+		if escaped {
+			key, value = stompUnescaper.Replace(key), stompUnescaper.Replace(value)
+		}
+		f.set(key, value)
+	}
+
+	if v, ok := f.header("content-length"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || len(data) < n+1 || data[n] != 0 {
+			return nil, nil, errStompFrame
+		}
+		f.Body = data[:n]
+		return f, data[n+1:], nil
+	}
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return nil, nil, errStompFrame
+	}
+	f.Body = data[:i]
+	return f, data[i+1:], nil
+}
+
+// cutStompLine 取出以 LF 或 CRLF 结尾的一行
+func cutStompLine(data []byte) (string, []byte, bool) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return "", nil, false
+	}
+	return strings.TrimSuffix(string(data[:i]), "\r"), data[i+1:], true
+}
+
+// marshal 编码帧，有消息体时附带 content-length
+func (f *stompFrame) marshal() []byte {
+	var b bytes.Buffer
+	b.WriteString(f.Command)
+	b.WriteByte('\n')
+	escaped := stompEscapes(f.Command)
+	for _, h := range f.Headers {
+		key, value := h.Key, h.Value
+		if escaped {
+			key, value = stompEscaper.Replace(key), stompEscaper.Replace(value)
+		}
+		b.WriteString(key)
+		b.WriteByte(':')
+		b.WriteString(value)
+		b.WriteByte('\n')
+	}
+	if len(f.Body) > 0 {
+		if _, ok := f.header("content-length"); !ok {
+			b.WriteString("content-length:")
+			b.WriteString(strconv.Itoa(len(f.Body)))
+			b.WriteByte('\n')
+		}
+	}
+	b.WriteByte('\n')
+	b.Write(f.Body)
+	b.WriteByte(0)
+	return b.Bytes()
+}
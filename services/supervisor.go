@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/networkProtocalTrans/logger"
+)
+
+const (
+	// 重启退避的初始与最大间隔
+	supervisorMinBackoff = time.Second
+	supervisorMaxBackoff = time.Minute
+	// 连续崩溃超过该次数后不再重启
+	supervisorMaxRestarts = 10
+)
+
+// supervised 受管 servicer 的运行状态
+type supervised struct {
+	servicer Servicer
+	cancel   context.CancelFunc
+	done     chan struct{}
+	restarts int
+	// 连续崩溃次数，运行足够久后清零
+	crashes int
+	gaveUp  bool
+	lastErr error
+}
+
+// Supervisor 启动并守护一组 servicer，异常退出时按指数退避重启，连续崩溃过多时放弃重启，
+// 停止时按启动的逆序关闭
+type Supervisor struct {
+	logger *logger.AppLogger
+	// 重启退避的初始与最大间隔，以及连续崩溃次数上限
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxRestarts int
+
+	mu      sync.Mutex
+	members []*supervised
+}
+
+// ServicerStatus servicer 的运行状态
+type ServicerStatus struct {
+	Name     string `json:"name"`
+	Healthy  bool   `json:"healthy"`
+	Error    string `json:"error,omitempty"`
+	Restarts int    `json:"restarts"`
+	// 连续崩溃次数超过上限，已放弃重启
+	GaveUp bool `json:"gave_up,omitempty"`
+}
+
+func NewSupervisor(log *logger.AppLogger, servicers ...Servicer) *Supervisor {
+	sup := &Supervisor{
+		logger:      log,
+		minBackoff:  supervisorMinBackoff,
+		maxBackoff:  supervisorMaxBackoff,
+		maxRestarts: supervisorMaxRestarts,
+	}
+	for _, s := range servicers {
+		sup.Add(s)
+	}
+	return sup
+}
+
+// Add 添加受管 servicer，需在 Start 之前调用
+func (sup *Supervisor) Add(s Servicer) {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	sup.members = append(sup.members, &supervised{servicer: s, done: make(chan struct{})})
+}
+
+// Start 按添加顺序启动所有 servicer
+func (sup *Supervisor) Start(ctx context.Context) {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	for _, m := range sup.members {
+		var mctx context.Context
+		mctx, m.cancel = context.WithCancel(ctx)
+		go sup.run(mctx, m)
+	}
+}
+
+// run 运行 servicer，直到其正常返回或 supervisor 停止
+func (sup *Supervisor) run(ctx context.Context, m *supervised) {
+	defer close(m.done)
+	name := m.servicer.Name()
+	backoff := sup.minBackoff
+	for {
+		started := time.Now()
+		err := sup.startSafely(ctx, m.servicer)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			sup.logger.LogInfo(ctx, "servicer exited", "name", name)
+			return
+		}
+
+		// 运行足够久后视为已恢复，重置退避与连续崩溃次数
+		recovered := time.Since(started) > sup.maxBackoff
+		if recovered {
+			backoff = sup.minBackoff
+		}
+		sup.mu.Lock()
+		if recovered {
+			m.crashes = 0
+		}
+		m.lastErr = err
+		m.crashes++
+		if m.crashes > sup.maxRestarts {
+			m.gaveUp = true
+			sup.mu.Unlock()
+			sup.logger.LogError(ctx, "servicer crashed too many times, giving up", "name", name, "error", err, "crashes", m.crashes)
+			return
+		}
+		m.restarts++
+		sup.mu.Unlock()
+		sup.logger.LogError(ctx, "servicer crashed, restarting", "name", name, "error", err, "backoff", backoff.String())
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > sup.maxBackoff {
+			backoff = sup.maxBackoff
+		}
+	}
+}
+
+// startSafely 调用 Start 并将 panic 转为错误
+func (sup *Supervisor) startSafely(ctx context.Context, s Servicer) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return s.Start(ctx)
+}
+
+// Stop 按启动的逆序停止所有 servicer，并等待其退出，ctx 超时后不再等待
+func (sup *Supervisor) Stop(ctx context.Context) {
+	sup.mu.Lock()
+	members := append([]*supervised(nil), sup.members...)
+	sup.mu.Unlock()
+
+	for i := len(members) - 1; i >= 0; i-- {
+		m := members[i]
+		name := m.servicer.Name()
+		if m.cancel == nil {
+			continue
+		}
+		sup.logger.LogInfo(ctx, "Stopping servicer", "name", name)
+		if err := m.servicer.Stop(ctx); err != nil {
+			sup.logger.LogError(ctx, "Error stopping servicer", "name", name, "error", err)
+		}
+		// 取消 servicer 的上下文，确保处于启动或退避中的 servicer 也能退出
+		m.cancel()
+		select {
+		case <-m.done:
+		case <-ctx.Done():
+			sup.logger.LogError(ctx, "Timed out waiting for servicer to stop", "name", name)
+		}
+	}
+}
+
+// Status 返回所有受管 servicer 的状态
+func (sup *Supervisor) Status() []ServicerStatus {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	status := make([]ServicerStatus, 0, len(sup.members))
+	for _, m := range sup.members {
+		st := ServicerStatus{Name: m.servicer.Name(), Healthy: true, Restarts: m.restarts, GaveUp: m.gaveUp}
+		if m.gaveUp {
+			st.Healthy = false
+			st.Error = fmt.Sprintf("gave up after %d restarts: %v", m.restarts, m.lastErr)
+		} else if err := m.servicer.Health(); err != nil {
+			st.Healthy = false
+			st.Error = err.Error()
+		}
+		status = append(status, st)
+	}
+	return status
+}
@@ -0,0 +1,220 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/networkProtocalTrans/logger"
+)
+
+// fakeServicer 测试用 servicer，Start 前 fail 次返回错误，之后阻塞到 Stop、ctx 取消或 crash 收到信号
+type fakeServicer struct {
+	name  string
+	fail  int
+	panic bool
+	// 记录 Stop 顺序，多个 fakeServicer 共用
+	stopped *[]string
+	stopMu  *sync.Mutex
+
+	mu     sync.Mutex
+	starts []time.Time
+	stop   chan struct{}
+	crash  chan struct{}
+}
+
+func newFakeServicer(name string, fail int) *fakeServicer {
+	return &fakeServicer{name: name, fail: fail, stop: make(chan struct{}), crash: make(chan struct{})}
+}
+
+func (f *fakeServicer) Name() string {
+	return f.name
+}
+
+func (f *fakeServicer) Start(ctx context.Context) error {
+	f.mu.Lock()
+	f.starts = append(f.starts, time.Now())
+	n := len(f.starts)
+	f.mu.Unlock()
+	if n <= f.fail {
+		if f.panic {
+			panic("boom")
+		}
+		return errors.New("crashed")
+	}
+	select {
+	case <-f.stop:
+	case <-ctx.Done():
+	case <-f.crash:
+		return errors.New("crashed")
+	}
+	return nil
+}
+
+func (f *fakeServicer) Stop(ctx context.Context) error {
+	if f.stopped != nil {
+		f.stopMu.Lock()
+		*f.stopped = append(*f.stopped, f.name)
+		f.stopMu.Unlock()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-f.stop:
+	default:
+		close(f.stop)
+	}
+	return nil
+}
+
+func (f *fakeServicer) Health() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.starts) <= f.fail {
+		return errors.New("not running")
+	}
+	return nil
+}
+
+func (f *fakeServicer) startTimes() []time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]time.Time(nil), f.starts...)
+}
+
+// newTestSupervisor 使用毫秒级退避的 supervisor，测试结束时停止
+func newTestSupervisor(t *testing.T, maxRestarts int, servicers ...Servicer) *Supervisor {
+	t.Helper()
+	sup := NewSupervisor(&logger.AppLogger{}, servicers...)
+	sup.minBackoff = 20 * time.Millisecond
+	sup.maxBackoff = 80 * time.Millisecond
+	sup.maxRestarts = maxRestarts
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		sup.Stop(ctx)
+	})
+	return sup
+}
+
+func TestSupervisorRestartsWithBackoff(t *testing.T) {
+	tests := []struct {
+		name  string
+		panic bool
+	}{
+		{"error", false},
+		{"panic", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeServicer("flaky", 4)
+			f.panic = tt.panic
+			sup := newTestSupervisor(t, 10, f)
+			sup.Start(context.Background())
+			waitFor(t, func() bool { return f.Health() == nil })
+
+			starts := f.startTimes()
+			if len(starts) != 5 {
+				t.Fatalf("started %d times, want 5", len(starts))
+			}
+			// 退避从 20ms 开始翻倍，最大 80ms
+			for i, min := range []time.Duration{20, 40, 80, 80} {
+				if gap := starts[i+1].Sub(starts[i]); gap < min*time.Millisecond {
+					t.Errorf("restart %d after %v, want at least %v", i+1, gap, min*time.Millisecond)
+				}
+			}
+			status := sup.Status()
+			if len(status) != 1 || status[0].Name != "flaky" || !status[0].Healthy || status[0].Restarts != 4 || status[0].GaveUp {
+				t.Errorf("status = %+v", status)
+			}
+		})
+	}
+}
+
+func TestSupervisorGivesUp(t *testing.T) {
+	f := newFakeServicer("broken", 100)
+	ok := newFakeServicer("ok", 0)
+	sup := newTestSupervisor(t, 3, f, ok)
+	sup.Start(context.Background())
+	waitFor(t, func() bool { return sup.Status()[0].GaveUp })
+
+	// 首次启动与 3 次重启后放弃
+	time.Sleep(100 * time.Millisecond)
+	if n := len(f.startTimes()); n != 4 {
+		t.Errorf("started %d times, want 4", n)
+	}
+	status := sup.Status()
+	if st := status[0]; st.Healthy || st.Restarts != 3 || st.Error != "gave up after 3 restarts: crashed" {
+		t.Errorf("broken status = %+v", st)
+	}
+	if st := status[1]; !st.Healthy || st.GaveUp {
+		t.Errorf("ok status = %+v", st)
+	}
+}
+
+func TestSupervisorResetsCrashesAfterRecovery(t *testing.T) {
+	f := newFakeServicer("recovering", 0)
+	sup := newTestSupervisor(t, 1, f)
+	sup.Start(context.Background())
+
+	// 每次运行超过最大退避后才崩溃，连续崩溃次数清零，不会达到上限
+	for i := 1; i <= 3; i++ {
+		waitFor(t, func() bool { return len(f.startTimes()) == i })
+		time.Sleep(100 * time.Millisecond)
+		f.crash <- struct{}{}
+	}
+	waitFor(t, func() bool { return len(f.startTimes()) == 4 })
+	if st := sup.Status()[0]; !st.Healthy || st.GaveUp || st.Restarts != 3 {
+		t.Errorf("status = %+v", st)
+	}
+}
+
+func TestSupervisorStopsInReverseOrder(t *testing.T) {
+	var mu sync.Mutex
+	var stopped []string
+	var servicers []Servicer
+	for _, name := range []string{"mqtt", "websocket", "api"} {
+		f := newFakeServicer(name, 0)
+		f.stopped, f.stopMu = &stopped, &mu
+		servicers = append(servicers, f)
+	}
+	sup := newTestSupervisor(t, 10, servicers...)
+	sup.Start(context.Background())
+	waitFor(t, func() bool {
+		for _, s := range servicers {
+			if len(s.(*fakeServicer).startTimes()) == 0 {
+				return false
+			}
+		}
+		return true
+	})
+
+	sup.Stop(context.Background())
+	mu.Lock()
+	defer mu.Unlock()
+	if len(stopped) != 3 || stopped[0] != "api" || stopped[1] != "websocket" || stopped[2] != "mqtt" {
+		t.Fatalf("stopped in order %v, want [api websocket mqtt]", stopped)
+	}
+}
+
+func TestSupervisorStopDuringBackoff(t *testing.T) {
+	f := newFakeServicer("broken", 100)
+	sup := newTestSupervisor(t, 10, f)
+	sup.maxBackoff = time.Hour
+	sup.minBackoff = time.Hour
+	sup.Start(context.Background())
+	waitFor(t, func() bool { return sup.Status()[0].Restarts == 1 })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sup.Stop(context.Background())
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not interrupt the restart backoff")
+	}
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/validation"
+)
+
+// validationHook 按 conf/validation.toml 中的 mqtt 规则校验客户端发布的消息，
+// 内联客户端（路由、桥接与 HTTP 发布接口）的消息不在此校验
+type validationHook struct {
+	server.HookBase
+	mqtt *mqttServer
+}
+
+// ID 返回钩子标识
+func (h *validationHook) ID() string {
+	return "servicer-validation"
+}
+
+// Provides 声明钩子实现的方法
+func (h *validationHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{server.OnPublish}, []byte{b})
+}
+
+// OnPublish 校验负载。tag 动作写入用户属性后照常发布；reject 与 error_topic 动作不发布原消息，
+// v5 客户端的 QoS 1/2 发布以 0x99 (payload format invalid) 应答，其余按正常应答后丢弃
+func (h *validationHook) OnPublish(cl *server.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline || strings.HasPrefix(pk.TopicName, "$") {
+		return pk, nil
+	}
+	v := validation.DefaultValidator.Validate(validation.SourceMQTT, h.mqtt.Name(), pk.TopicName, pk.Payload)
+	if v == nil {
+		return pk, nil
+	}
+	ctx := context.Background()
+	h.mqtt.Logger.LogInfo(ctx, "mqtt message failed validation",
+		"name", h.mqtt.Name(), "client", cl.ID, "topic", pk.TopicName, "rule", v.Rule, "action", v.Action, "error", v.Error())
+
+	switch v.Action {
+	case validation.ActionTag:
+		pk.Properties.User = append(pk.Properties.User, packets.UserProperty{Key: v.TagHeader, Val: v.Error()})
+		return pk, nil
+	case validation.ActionErrorTopic:
+		if err := PublishViolation(v, pk.Payload); err != nil {
+			h.mqtt.Logger.LogErrorf(ctx, "mqtt %s: publish validation error to %s failed: %v", h.mqtt.Name(), v.ErrorTopic, err)
+		}
+	}
+	deadletter.Publish(ctx, violationLetter(v, HeadersOf(pk.Properties.User), pk.Payload))
+	if cl.Properties.ProtocolVersion == 5 && pk.FixedHeader.Qos > 0 {
+		return pk, packets.Code{Code: packets.ErrPayloadFormatInvalid.Code, Reason: v.Error()}
+	}
+	return pk, packets.CodeSuccessIgnore
+}
+
+// PublishViolation 将校验错误与原负载发布到规则的 error_topic
+func PublishViolation(v *validation.Violation, payload []byte) error {
+	name := v.ErrorServicer
+	if name == "" && v.Source == validation.SourceMQTT {
+		name = v.Servicer
+	}
+	m, err := resolveMqttServer(name)
+	if err != nil {
+		return err
+	}
+	return m.Publish(v.ErrorTopic, v.Envelope(payload), false, 0)
+}
+
+// violationLetter 未转发的消息的死信，重新投递时在来源重新注入，不再经过校验
+func violationLetter(v *validation.Violation, headers map[string]string, payload []byte) *deadletter.Letter {
+	return &deadletter.Letter{
+		Stage:    deadletter.StageValidation,
+		Error:    v.Error(),
+		Source:   v.Source,
+		Servicer: v.Servicer,
+		Topic:    v.Topic,
+		Headers:  headers,
+		Payload:  payload,
+	}
+}
+
+// checkMessage 按 websocket 规则校验客户端消息，返回交给消息处理方的上下文；
+// 消息被拒绝或转到 error_topic 时回复错误并返回 false
+func (s *websocketServer) checkMessage(ctx context.Context, client *wsClient, message []byte) (context.Context, bool) {
+	v := validation.DefaultValidator.Validate(validation.SourceWebsocket, s.Name(), client.path, message)
+	if v == nil {
+		return ctx, true
+	}
+	s.logger.LogInfo(ctx, "websocket message failed validation",
+		"name", s.Name(), "client", client.id, "path", client.path, "rule", v.Rule, "action", v.Action, "error", v.Error())
+
+	switch v.Action {
+	case validation.ActionTag:
+		return validation.NewContext(ctx, v), true
+	case validation.ActionErrorTopic:
+		if err := PublishViolation(v, message); err != nil {
+			s.logger.LogErrorf(ctx, "websocket %s: publish validation error to %s failed: %v", s.Name(), v.ErrorTopic, err)
+		}
+	}
+	deadletter.Publish(ctx, violationLetter(v, nil, message))
+	s.reply(client, ChannelMessage{Action: ChannelActionError, Error: v.Error()})
+	return ctx, false
+}
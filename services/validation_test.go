@@ -0,0 +1,122 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/validation"
+)
+
+func TestValidationHookActions(t *testing.T) {
+	schema := filepath.Join(t.TempDir(), "telemetry.json")
+	os.WriteFile(schema, []byte(`{"type":"object","required":["value"],"properties":{"value":{"type":"number"}}}`), 0o644)
+	v, err := validation.New(&validation.Config{Rules: []validation.RuleConfig{
+		{Name: "rejected", Source: validation.SourceMQTT, Topic: "rejected/+", Schema: schema},
+		{Name: "tagged", Source: validation.SourceMQTT, Topic: "tagged/+", Schema: schema, Action: validation.ActionTag},
+		{Name: "errors", Source: validation.SourceMQTT, Topic: "errors/+", Schema: schema, Action: validation.ActionErrorTopic,
+			ErrorTopic: "invalid/{rule}/{topic}"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := validation.DefaultValidator
+	validation.DefaultValidator = v
+	t.Cleanup(func() { validation.DefaultValidator = prev })
+
+	m := startTestMqtt(t)
+	registryMu.Lock()
+	servicers[m.Name()] = m
+	registryMu.Unlock()
+	t.Cleanup(func() {
+		registryMu.Lock()
+		delete(servicers, m.Name())
+		registryMu.Unlock()
+	})
+	published := make(chan packets.Packet, 4)
+	m.Subscribe("invalid/#", func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		published <- pk
+	})
+	hook := &validationHook{mqtt: m}
+
+	tests := []struct {
+		name     string
+		topic    string
+		payload  string
+		version  byte
+		qos      byte
+		err      error // OnPublish 返回的错误
+		tag      bool  // 是否写入 schema-error 用户属性
+		letter   bool  // 是否记录死信
+		errTopic string
+	}{
+		{"valid payload", "rejected/a", `{"value":21.5}`, 5, 1, nil, false, false, ""},
+		{"unmatched topic", "other/a", `{"value":"hot"}`, 5, 1, nil, false, false, ""},
+		{"reject v5 qos 1", "rejected/a", `{"value":"hot"}`, 5, 1, packets.ErrPayloadFormatInvalid, false, true, ""},
+		{"reject v5 qos 0", "rejected/a", `{"value":"hot"}`, 5, 0, packets.CodeSuccessIgnore, false, true, ""},
+		{"reject v3", "rejected/a", `{"value":"hot"}`, 4, 1, packets.CodeSuccessIgnore, false, true, ""},
+		{"tag", "tagged/a", `{"value":"hot"}`, 5, 1, nil, true, false, ""},
+		{"error_topic", "errors/a", `{"value":"hot"}`, 5, 1, packets.ErrPayloadFormatInvalid, false, true, "invalid/errors/errors/a"},
+		{"system topic", "$SYS/rejected/a", `{"value":"hot"}`, 5, 1, nil, false, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := useTestDeadLetters(t)
+			cl := &server.Client{ID: "client-a"}
+			cl.Properties.ProtocolVersion = tt.version
+			in := packets.Packet{TopicName: tt.topic, Payload: []byte(tt.payload), FixedHeader: packets.FixedHeader{Qos: tt.qos}}
+
+			pk, err := hook.OnPublish(cl, in)
+			var code packets.Code
+			if tt.err == nil && err != nil || tt.err != nil && (!errors.As(err, &code) || code.Code != tt.err.(packets.Code).Code) {
+				t.Fatalf("OnPublish error = %v, want %v", err, tt.err)
+			}
+			if tagged := HeadersOf(pk.Properties.User)[validation.DefaultTagHeader] != ""; tagged != tt.tag {
+				t.Errorf("user properties = %v", pk.Properties.User)
+			}
+
+			letters, total := store.List(deadletter.Filter{})
+			if (total == 1) != tt.letter || total > 1 {
+				t.Fatalf("got %d dead letters", total)
+			}
+			if tt.letter {
+				l := letters[0]
+				if l.Stage != deadletter.StageValidation || l.Source != validation.SourceMQTT || l.Servicer != m.Name() ||
+					l.Topic != tt.topic || string(l.Payload) != tt.payload || l.Error == "" {
+					t.Errorf("dead letter = %+v", l)
+				}
+			}
+
+			if tt.errTopic == "" {
+				return
+			}
+			select {
+			case pk := <-published:
+				var envelope struct {
+					Rule    string `json:"rule"`
+					Topic   string `json:"topic"`
+					Payload string `json:"payload"`
+				}
+				if err := json.Unmarshal(pk.Payload, &envelope); err != nil {
+					t.Fatal(err)
+				}
+				if pk.TopicName != tt.errTopic || envelope.Rule != "errors" || envelope.Topic != tt.topic || envelope.Payload != tt.payload {
+					t.Errorf("published %s: %s", pk.TopicName, pk.Payload)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("validation error not published")
+			}
+		})
+	}
+	select {
+	case pk := <-published:
+		t.Errorf("unexpected validation error published to %s", pk.TopicName)
+	default:
+	}
+}
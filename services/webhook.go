@@ -0,0 +1,654 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/logger"
+	"github.com/networkProtocalTrans/queue"
+)
+
+// webhook 默认配置
+const (
+	defaultWebhookConcurrency = 4
+	defaultWebhookQueueSize   = 1000
+	defaultWebhookTimeout     = 10
+	defaultWebhookSigHeader   = "X-Webhook-Signature"
+)
+
+// 请求中附带的消息来源头
+const (
+	WebhookHeaderSource    = "X-Webhook-Source"
+	WebhookHeaderTopic     = "X-Webhook-Topic"
+	WebhookHeaderTimestamp = "X-Webhook-Timestamp"
+	WebhookHeaderAttempt   = "X-Webhook-Attempt"
+)
+
+// ErrWebhookQueueFull 发送队列已满
+var ErrWebhookQueueFull = errors.New("webhook queue is full")
+
+// WebhookConfig webhook servicer 配置
+type WebhookConfig struct {
+	Type    string                `toml:"type"`
+	Server  ServerConfig          `toml:"server"`
+	Webhook WebhookConfigDetail   `toml:"webhook"`
+	Sources []WebhookSourceConfig `toml:"source"`
+	Targets []WebhookTarget       `toml:"target"`
+}
+
+type WebhookConfigDetail struct {
+	// 同时进行的请求数上限
+	Concurrency int `toml:"concurrency"`
+	// 等待发送的请求队列长度，队列满时丢弃新消息
+	QueueSize int `toml:"queue_size"`
+}
+
+// WebhookSourceConfig 转发的消息来源
+type WebhookSourceConfig struct {
+	// mqtt 或 websocket
+	Type string `toml:"type"`
+	// servicer 名称，为空时使用同类型的默认 servicer
+	Servicer string `toml:"servicer"`
+	// mqtt 主题过滤器
+	Topic string `toml:"topic"`
+	// websocket 连接路径
+	Path string `toml:"path"`
+}
+
+// WebhookTarget 接收消息的 HTTP 地址
+type WebhookTarget struct {
+	URL string `toml:"url"`
+	// 请求方法，默认 POST
+	Method string `toml:"method"`
+	// 附加请求头，可覆盖 Content-Type，X-Webhook-* 与签名头由服务端设置
+	Headers map[string]string `toml:"headers"`
+	// 单次请求超时（秒）
+	Timeout   int              `toml:"timeout"`
+	Retry     WebhookRetry     `toml:"retry"`
+	Signature WebhookSignature `toml:"signature"`
+	// 持久化队列，队列名称为 webhook:<servicer 名称>:<目标序号>。配置后发往该目标的消息先写入磁盘，
+	// 按顺序逐条发送，网络错误、超时、429 与 5xx 时按队列的重试间隔重试同一条消息，不使用 retry 配置
+	Queue *queue.Config `toml:"queue"`
+}
+
+// WebhookRetry 失败重试策略，间隔按 multiplier 指数增长
+type WebhookRetry struct {
+	// 最多尝试次数（含首次），默认 1 即不重试
+	MaxAttempts int `toml:"max_attempts"`
+	// 首次重试间隔与最大间隔（毫秒）
+	InitialInterval int     `toml:"initial_interval"`
+	MaxInterval     int     `toml:"max_interval"`
+	Multiplier      float64 `toml:"multiplier"`
+}
+
+// WebhookSignature 请求的 HMAC 签名，签名内容为 "<X-Webhook-Timestamp>.<请求体>"，签名头的值为 <algorithm>=<hex>。
+// 接收方应同时校验时间戳的时效，防止截获的请求被重放
+type WebhookSignature struct {
+	Secret string `toml:"secret"`
+	// 签名头名称，默认 X-Webhook-Signature
+	Header string `toml:"header"`
+	// sha256 或 sha512，默认 sha256
+	Algorithm string `toml:"algorithm"`
+}
+
+// WebhookStats 发送统计
+type WebhookStats struct {
+	Delivered int64 `json:"delivered"`
+	Retried   int64 `json:"retried"`
+	Failed    int64 `json:"failed"`
+	Dropped   int64 `json:"dropped"`
+}
+
+func init() {
+	RegisterServicerType(ServicerTypeWebhook, func(ctx context.Context, log *logger.AppLogger, configPath string) (Servicer, error) {
+		return NewWebhookServer(ctx, log, configPath)
+	})
+}
+
+// webhookJob 一次待发送的请求
+type webhookJob struct {
+	// 目标在配置中的下标
+	index  int
+	target *WebhookTarget
+	// 来源类型（mqtt、websocket 或路由规则的源类型）与来源 servicer 名称
+	sourceType string
+	source     string
+	topic      string
+	payload    []byte
+	attempt    int
+	// 消息进入发送队列的时间
+	received time.Time
+}
+
+// webhookMessage 写入持久化队列的消息
+type webhookMessage struct {
+	SourceType string `json:"source_type,omitempty"`
+	Source     string `json:"source"`
+	Topic      string `json:"topic"`
+	Payload    []byte `json:"payload"`
+}
+
+// webhookServer 将 MQTT 消息或 websocket 帧以 HTTP 请求转发给外部地址
+type webhookServer struct {
+	logger *logger.AppLogger
+	config *WebhookConfig
+	client *http.Client
+	queue  chan *webhookJob
+	// 与 targets 一一对应，未配置队列的目标为 nil
+	queues []*queue.Queue
+
+	mu      sync.Mutex
+	running bool
+	stopped chan struct{}
+	// 等待重试的任务，停止时取消
+	retries map[*time.Timer]struct{}
+
+	stats WebhookStats
+}
+
+// NewWebhookServer 根据配置文件创建 webhook servicer 实例
+func NewWebhookServer(ctx context.Context, log *logger.AppLogger, configPath string) (*webhookServer, error) {
+	var config WebhookConfig
+	if _, err := toml.DecodeFile(configPath, &config); err != nil {
+		return nil, fmt.Errorf("load webhook config %s: %w", configPath, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid webhook config %s: %w", configPath, err)
+	}
+	w := &webhookServer{
+		logger:  log,
+		config:  &config,
+		client:  &http.Client{},
+		queue:   make(chan *webhookJob, config.Webhook.QueueSize),
+		queues:  make([]*queue.Queue, len(config.Targets)),
+		retries: make(map[*time.Timer]struct{}),
+	}
+	for i := range config.Targets {
+		t := &config.Targets[i]
+		if t.Queue == nil {
+			continue
+		}
+		name := fmt.Sprintf("webhook:%s:%d", config.Server.Name, i+1)
+		q, err := queue.Open(name, *t.Queue, w.queueSender(t))
+		if err != nil {
+			return nil, err
+		}
+		q.OnDiscard(w.discarded(name))
+		w.queues[i] = q
+	}
+	return w, nil
+}
+
+// validate 校验配置并填充默认值
+func (c *WebhookConfig) validate() error {
+	if c.Webhook.Concurrency <= 0 {
+		c.Webhook.Concurrency = defaultWebhookConcurrency
+	}
+	if c.Webhook.QueueSize <= 0 {
+		c.Webhook.QueueSize = defaultWebhookQueueSize
+	}
+	for i, src := range c.Sources {
+		switch src.Type {
+		case ServicerTypeMQTT:
+			if !server.IsValidFilter(src.Topic, false) {
+				return fmt.Errorf("source #%d: invalid topic %q", i+1, src.Topic)
+			}
+		case ServicerTypeWebsocket:
+			if src.Path == "" {
+				return fmt.Errorf("source #%d: path is required", i+1)
+			}
+		default:
+			return fmt.Errorf("source #%d: unknown type %q", i+1, src.Type)
+		}
+	}
+	if len(c.Targets) == 0 {
+		return errors.New("at least one target is required")
+	}
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		u, err := url.Parse(t.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("target #%d: invalid url %q", i+1, t.URL)
+		}
+		if t.Method == "" {
+			t.Method = http.MethodPost
+		}
+		t.Method = strings.ToUpper(t.Method)
+		if t.Timeout <= 0 {
+			t.Timeout = defaultWebhookTimeout
+		}
+		if t.Retry.MaxAttempts <= 0 {
+			t.Retry.MaxAttempts = 1
+		}
+		if t.Retry.InitialInterval <= 0 {
+			t.Retry.InitialInterval = 1000
+		}
+		if t.Retry.MaxInterval < t.Retry.InitialInterval {
+			t.Retry.MaxInterval = 60000
+		}
+		if t.Retry.Multiplier < 1 {
+			t.Retry.Multiplier = 2
+		}
+		if t.Signature.Header == "" {
+			t.Signature.Header = defaultWebhookSigHeader
+		}
+		switch strings.ToLower(t.Signature.Algorithm) {
+		case "":
+			t.Signature.Algorithm = "sha256"
+		case "sha256", "sha512":
+			t.Signature.Algorithm = strings.ToLower(t.Signature.Algorithm)
+		default:
+			return fmt.Errorf("target #%d: unsupported signature algorithm %q", i+1, t.Signature.Algorithm)
+		}
+	}
+	return nil
+}
+
+// Name 返回 servicer 名称
+func (w *webhookServer) Name() string {
+	return w.config.Server.Name
+}
+
+// Start 启动发送协程并阻塞，直到 ctx 取消或 Stop 被调用
+func (w *webhookServer) Start(ctx context.Context) error {
+	stopped := make(chan struct{})
+	w.mu.Lock()
+	w.running, w.stopped = true, stopped
+	w.mu.Unlock()
+
+	runCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, q := range w.queues {
+		if q == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(q *queue.Queue) {
+			defer wg.Done()
+			q.Run(runCtx)
+		}(q)
+	}
+	for i := 0; i < w.config.Webhook.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-runCtx.Done():
+					return
+				case job := <-w.queue:
+					w.deliver(runCtx, job)
+				}
+			}
+		}()
+	}
+	w.logger.LogInfo(ctx, "Starting webhook servicer",
+		"name", w.Name(),
+		"targets", len(w.config.Targets),
+		"concurrency", w.config.Webhook.Concurrency,
+	)
+
+	select {
+	case <-ctx.Done():
+	case <-stopped:
+	}
+	cancel()
+	wg.Wait()
+
+	w.mu.Lock()
+	w.running = false
+	for t := range w.retries {
+		t.Stop()
+	}
+	w.retries = make(map[*time.Timer]struct{})
+	w.mu.Unlock()
+	return nil
+}
+
+// Stop 停止发送，进行中的请求被取消
+func (w *webhookServer) Stop(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped != nil {
+		select {
+		case <-w.stopped:
+		default:
+			close(w.stopped)
+		}
+	}
+	return nil
+}
+
+// Health 服务运行中时返回 nil
+func (w *webhookServer) Health() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.running {
+		return ErrServicerNotRunning
+	}
+	return nil
+}
+
+// Stats 返回发送统计
+func (w *webhookServer) Stats() WebhookStats {
+	return WebhookStats{
+		Delivered: atomic.LoadInt64(&w.stats.Delivered),
+		Retried:   atomic.LoadInt64(&w.stats.Retried),
+		Failed:    atomic.LoadInt64(&w.stats.Failed),
+		Dropped:   atomic.LoadInt64(&w.stats.Dropped),
+	}
+}
+
+// Deliver 将消息加入所有目标的发送队列，队列满时返回 ErrWebhookQueueFull。
+// sourceType 与 source 为消息的来源类型与来源 servicer 名称
+func (w *webhookServer) Deliver(sourceType, source, topic string, payload []byte) error {
+	var err error
+	for i := range w.config.Targets {
+		if !w.deliverTo(i, sourceType, source, topic, payload) {
+			err = ErrWebhookQueueFull
+		}
+	}
+	return err
+}
+
+// deliverTo 将消息加入第 i 个目标的持久化队列或内存队列
+func (w *webhookServer) deliverTo(i int, sourceType, source, topic string, payload []byte) bool {
+	if q := w.queues[i]; q != nil {
+		m := &webhookMessage{SourceType: sourceType, Source: source, Topic: topic, Payload: payload}
+		if err := q.Enqueue(m); err != nil {
+			w.logger.LogErrorf(context.Background(), "webhook %s: %v", w.Name(), err)
+			w.failed(context.Background(), i, m, time.Time{}, err)
+			return false
+		}
+		return true
+	}
+	return w.enqueue(&webhookJob{
+		index:      i,
+		target:     &w.config.Targets[i],
+		sourceType: sourceType,
+		source:     source,
+		topic:      topic,
+		payload:    payload,
+		attempt:    1,
+		received:   time.Now(),
+	})
+}
+
+func (w *webhookServer) enqueue(job *webhookJob) bool {
+	select {
+	case w.queue <- job:
+		return true
+	default:
+		atomic.AddInt64(&w.stats.Dropped, 1)
+		w.logger.LogErrorf(context.Background(), "webhook %s queue full, dropped message for %s", w.Name(), job.target.URL)
+		w.failed(context.Background(), job.index, job.message(), job.received, ErrWebhookQueueFull)
+		return false
+	}
+}
+
+// redeliver 重新投递死信：配置了持久化队列的目标写入队列，其余目标立即发送一次并返回结果
+func (w *webhookServer) redeliver(ctx context.Context, i int, m *webhookMessage) error {
+	if q := w.queues[i]; q != nil {
+		return q.Enqueue(m)
+	}
+	if err := w.Health(); err != nil {
+		return err
+	}
+	err := w.send(ctx, &webhookJob{
+		index:      i,
+		target:     &w.config.Targets[i],
+		sourceType: m.SourceType,
+		source:     m.Source,
+		topic:      m.Topic,
+		payload:    m.Payload,
+		attempt:    1,
+	})
+	if err != nil {
+		return fmt.Errorf("delivery to %s failed: %w", w.config.Targets[i].URL, err)
+	}
+	atomic.AddInt64(&w.stats.Delivered, 1)
+	return nil
+}
+
+// message 任务对应的消息
+func (job *webhookJob) message() *webhookMessage {
+	return &webhookMessage{SourceType: job.sourceType, Source: job.source, Topic: job.topic, Payload: job.payload}
+}
+
+// failed 为未能发送给第 i 个目标的消息产生死信，received 为零值时使用失败时间
+func (w *webhookServer) failed(ctx context.Context, i int, m *webhookMessage, received time.Time, err error) {
+	deadletter.Publish(ctx, &deadletter.Letter{
+		Stage:       deadletter.StageDelivery,
+		Error:       err.Error(),
+		Source:      m.SourceType,
+		Servicer:    m.Source,
+		Topic:       m.Topic,
+		Destination: fmt.Sprintf("webhook:%s:%d", w.Name(), i+1),
+		Payload:     m.Payload,
+		Received:    received,
+	})
+}
+
+// discarded 为持久化队列删除的消息产生死信，重新投递时写回队列
+func (w *webhookServer) discarded(name string) queue.DiscardFunc {
+	return func(e *queue.Entry, err error) {
+		var m webhookMessage
+		json.Unmarshal(e.Data, &m)
+		deadletter.Publish(context.Background(), &deadletter.Letter{
+			Stage:       deadletter.StageDelivery,
+			Error:       err.Error(),
+			Source:      m.SourceType,
+			Servicer:    m.Source,
+			Topic:       m.Topic,
+			Destination: "queue:" + name,
+			Payload:     m.Payload,
+			Data:        e.Data,
+			Received:    e.Created,
+		})
+	}
+}
+
+// deliver 发送请求，失败时按退避间隔重新入队
+func (w *webhookServer) deliver(ctx context.Context, job *webhookJob) {
+	err := w.send(ctx, job)
+	if err == nil {
+		atomic.AddInt64(&w.stats.Delivered, 1)
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	retry := job.target.Retry
+	if job.attempt >= retry.MaxAttempts || !retryable(err) {
+		atomic.AddInt64(&w.stats.Failed, 1)
+		w.logger.LogErrorf(ctx, "webhook %s delivery to %s failed after %d attempts: %v", w.Name(), job.target.URL, job.attempt, err)
+		w.failed(ctx, job.index, job.message(), job.received,
+			fmt.Errorf("delivery to %s failed after %d attempts: %w", job.target.URL, job.attempt, err))
+		return
+	}
+
+	atomic.AddInt64(&w.stats.Retried, 1)
+	delay := backoff(retry, job.attempt)
+	job.attempt++
+	// 等待期间不占用发送协程
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.running {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		w.mu.Lock()
+		delete(w.retries, timer)
+		w.mu.Unlock()
+		w.enqueue(job)
+	})
+	w.retries[timer] = struct{}{}
+}
+
+// queueSender 从持久化队列发送消息，可重试的错误交给队列稍后重试
+func (w *webhookServer) queueSender(target *WebhookTarget) queue.Sender {
+	return func(ctx context.Context, e *queue.Entry) error {
+		var m webhookMessage
+		if err := json.Unmarshal(e.Data, &m); err != nil {
+			return queue.Permanent(err)
+		}
+		err := w.send(ctx, &webhookJob{
+			target:     target,
+			sourceType: m.SourceType,
+			source:     m.Source,
+			topic:      m.Topic,
+			payload:    m.Payload,
+			attempt:    e.Attempts + 1,
+		})
+		switch {
+		case err == nil:
+			atomic.AddInt64(&w.stats.Delivered, 1)
+			return nil
+		case !retryable(err):
+			atomic.AddInt64(&w.stats.Failed, 1)
+			return queue.Permanent(fmt.Errorf("delivery to %s failed: %w", target.URL, err))
+		}
+		atomic.AddInt64(&w.stats.Retried, 1)
+		return err
+	}
+}
+
+// backoff 第 attempt 次失败后的重试间隔
+func backoff(retry WebhookRetry, attempt int) time.Duration {
+	interval := float64(retry.InitialInterval) * math.Pow(retry.Multiplier, float64(attempt-1))
+	if interval > float64(retry.MaxInterval) {
+		interval = float64(retry.MaxInterval)
+	}
+	return time.Duration(interval) * time.Millisecond
+}
+
+// webhookStatusError 目标返回的非 2xx 响应
+type webhookStatusError struct {
+	status int
+}
+
+func (e *webhookStatusError) Error() string {
+	return "unexpected status " + strconv.Itoa(e.status)
+}
+
+// retryable 网络错误、超时、429 与 5xx 可以重试，其余 4xx 不重试
+func retryable(err error) bool {
+	var statusErr *webhookStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status == http.StatusTooManyRequests || statusErr.status >= 500
+	}
+	return true
+}
+
+func (w *webhookServer) send(ctx context.Context, job *webhookJob) error {
+	t := job.target
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(t.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, t.Method, t.URL, bytes.NewReader(job.payload))
+	if err != nil {
+		return err
+	}
+	contentType := "application/octet-stream"
+	if json.Valid(job.payload) {
+		contentType = "application/json"
+	} else if utf8.Valid(job.payload) {
+		contentType = "text/plain; charset=utf-8"
+	}
+	req.Header.Set("Content-Type", contentType)
+	// 附加请求头不能覆盖来源、时间戳与签名头，否则签名校验与重放检查失效
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set(WebhookHeaderSource, job.source)
+	req.Header.Set(WebhookHeaderTopic, job.topic)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(WebhookHeaderTimestamp, timestamp)
+	req.Header.Set(WebhookHeaderAttempt, strconv.Itoa(job.attempt))
+	if t.Signature.Secret != "" {
+		req.Header.Set(t.Signature.Header, sign(t.Signature, timestamp, job.payload))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &webhookStatusError{status: resp.StatusCode}
+	}
+	return nil
+}
+
+// sign 计算 "<timestamp>.<body>" 的 HMAC 签名，时间戳被篡改时签名不再匹配
+func sign(sig WebhookSignature, timestamp string, body []byte) string {
+	var h func() hash.Hash = sha256.New
+	if sig.Algorithm == "sha512" {
+		h = sha512.New
+	}
+	mac := hmac.New(h, []byte(sig.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return sig.Algorithm + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// linkSources 订阅配置的消息来源
+func (w *webhookServer) linkSources(ctx context.Context) error {
+	for i, src := range w.config.Sources {
+		switch src.Type {
+		case ServicerTypeMQTT:
+			m, err := resolveMqttServer(src.Servicer)
+			if err != nil {
+				return fmt.Errorf("source #%d: %w", i+1, err)
+			}
+			source := m.Name()
+			if _, err := m.Subscribe(src.Topic, func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+				w.Deliver(ServicerTypeMQTT, source, pk.TopicName, pk.Payload)
+			}); err != nil {
+				return fmt.Errorf("source #%d: %w", i+1, err)
+			}
+		case ServicerTypeWebsocket:
+			ws := WsServer
+			if src.Servicer != "" {
+				var ok bool
+				if ws, ok = GetWebsocketServer(src.Servicer); !ok {
+					return fmt.Errorf("source #%d: unknown websocket servicer %q", i+1, src.Servicer)
+				}
+			}
+			if ws == nil {
+				return fmt.Errorf("source #%d: no websocket servicer is configured", i+1)
+			}
+			source, path := ws.Name(), src.Path
+			ws.OnMessage(func(ctx context.Context, p string, messageType int, message []byte) {
+				if p == path {
+					w.Deliver(ServicerTypeWebsocket, source, p, message)
+				}
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/logger"
+)
+
+// webhookRequest 测试服务端收到的请求
+type webhookRequest struct {
+	at      time.Time
+	header  http.Header
+	body    []byte
+	attempt int
+}
+
+// startTestWebhook 按配置创建并启动 webhook servicer，测试结束时停止
+func startTestWebhook(t *testing.T, config string) *webhookServer {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "webhook.toml")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWebhookServer(context.Background(), &logger.AppLogger{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Start(context.Background())
+	}()
+	t.Cleanup(func() {
+		w.Stop(context.Background())
+		<-done
+	})
+	waitFor(t, func() bool { return w.Health() == nil })
+	return w
+}
+
+// useTestDeadLetters 将死信记录到新的 Store，测试结束时恢复
+func useTestDeadLetters(t *testing.T) *deadletter.Store {
+	t.Helper()
+	store, err := deadletter.New(&logger.AppLogger{}, &deadletter.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := deadletter.Default
+	deadletter.Default = store
+	t.Cleanup(func() { deadletter.Default = prev })
+	return store
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookRetriesWithBackoffAndSigns(t *testing.T) {
+	var mu sync.Mutex
+	var requests []webhookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		attempt, _ := strconv.Atoi(r.Header.Get(WebhookHeaderAttempt))
+		mu.Lock()
+		requests = append(requests, webhookRequest{at: time.Now(), header: r.Header.Clone(), body: body, attempt: attempt})
+		n := len(requests)
+		mu.Unlock()
+		if n < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	w := startTestWebhook(t, fmt.Sprintf(`
+[server]
+name = "webhook-test"
+[[target]]
+url = %q
+[target.retry]
+max_attempts = 3
+initial_interval = 50
+max_interval = 1000
+multiplier = 2
+[target.signature]
+secret = "s3cret"
+`, srv.URL))
+
+	payload := []byte(`{"temperature":21.5}`)
+	if err := w.Deliver(ServicerTypeMQTT, "mqtt-test", "devices/a", payload); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return w.Stats().Delivered == 1 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 3 {
+		t.Fatalf("got %d requests, want 3", len(requests))
+	}
+	for i, req := range requests {
+		if req.attempt != i+1 {
+			t.Errorf("request %d: %s = %d", i+1, WebhookHeaderAttempt, req.attempt)
+		}
+		if string(req.body) != string(payload) {
+			t.Errorf("request %d: body = %q", i+1, req.body)
+		}
+		if req.header.Get(WebhookHeaderSource) != "mqtt-test" || req.header.Get(WebhookHeaderTopic) != "devices/a" {
+			t.Errorf("request %d: source headers = %q, %q", i+1, req.header.Get(WebhookHeaderSource), req.header.Get(WebhookHeaderTopic))
+		}
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(req.header.Get(WebhookHeaderTimestamp) + "."))
+		mac.Write(req.body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.header.Get(defaultWebhookSigHeader) != want {
+			t.Errorf("request %d: signature = %q, want %q", i+1, req.header.Get(defaultWebhookSigHeader), want)
+		}
+	}
+	// 第 1、2 次失败后分别等待 50ms 与 100ms
+	for i, min := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond} {
+		if gap := requests[i+1].at.Sub(requests[i].at); gap < min {
+			t.Errorf("retry %d after %v, want at least %v", i+1, gap, min)
+		}
+	}
+	if s := w.Stats(); s.Retried != 2 || s.Failed != 0 {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+func TestWebhookHeadersDoNotOverrideReservedHeaders(t *testing.T) {
+	requests := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests <- r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	w := startTestWebhook(t, fmt.Sprintf(`
+[server]
+name = "webhook-test"
+[[target]]
+url = %q
+headers = { Authorization = "Bearer t", Content-Type = "application/vnd.test", X-Webhook-Timestamp = "1", X-Webhook-Topic = "forged", X-Webhook-Signature = "forged" }
+[target.signature]
+secret = "s3cret"
+`, srv.URL))
+	if err := w.Deliver(ServicerTypeMQTT, "mqtt-test", "devices/a", []byte("21.5")); err != nil {
+		t.Fatal(err)
+	}
+
+	var header http.Header
+	select {
+	case header = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request received")
+	}
+	if header.Get("Authorization") != "Bearer t" || header.Get("Content-Type") != "application/vnd.test" {
+		t.Errorf("configured headers = %q, %q", header.Get("Authorization"), header.Get("Content-Type"))
+	}
+	if header.Get(WebhookHeaderTopic) != "devices/a" {
+		t.Errorf("%s = %q", WebhookHeaderTopic, header.Get(WebhookHeaderTopic))
+	}
+	timestamp, _ := strconv.ParseInt(header.Get(WebhookHeaderTimestamp), 10, 64)
+	if time.Since(time.Unix(timestamp, 0)) > time.Minute {
+		t.Errorf("%s = %q", WebhookHeaderTimestamp, header.Get(WebhookHeaderTimestamp))
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(header.Get(WebhookHeaderTimestamp) + ".21.5"))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); header.Get(defaultWebhookSigHeader) != want {
+		t.Errorf("signature = %q, want %q", header.Get(defaultWebhookSigHeader), want)
+	}
+}
+
+func TestWebhookDeadLetterAfterFinalFailure(t *testing.T) {
+	store := useTestDeadLetters(t)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	w := startTestWebhook(t, fmt.Sprintf(`
+[server]
+name = "webhook-test"
+[[target]]
+url = %q
+[target.retry]
+max_attempts = 2
+initial_interval = 10
+`, srv.URL))
+
+	if err := w.Deliver(ServicerTypeMQTT, "mqtt-test", "devices/a", []byte("21.5")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return w.Stats().Failed == 1 })
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("got %d requests, want 2", n)
+	}
+	letters, total := store.List(deadletter.Filter{})
+	if total != 1 {
+		t.Fatalf("got %d dead letters, want 1", total)
+	}
+	l := letters[0]
+	if l.Stage != deadletter.StageDelivery || l.Source != ServicerTypeMQTT || l.Servicer != "mqtt-test" ||
+		l.Topic != "devices/a" || l.Destination != "webhook:webhook-test:1" || string(l.Payload) != "21.5" {
+		t.Errorf("dead letter = %+v", l)
+	}
+	if l.Error == "" {
+		t.Error("dead letter has no error")
+	}
+}
+
+func TestWebhookNonRetryableStatusFailsAtOnce(t *testing.T) {
+	useTestDeadLetters(t)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	w := startTestWebhook(t, fmt.Sprintf(`
+[server]
+name = "webhook-test"
+[[target]]
+url = %q
+[target.retry]
+max_attempts = 5
+initial_interval = 10
+`, srv.URL))
+
+	w.Deliver(ServicerTypeMQTT, "mqtt-test", "devices/a", []byte("1"))
+	waitFor(t, func() bool { return w.Stats().Failed == 1 })
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("got %d requests for a 400 response, want 1", n)
+	}
+}
+
+func TestWebhookConcurrency(t *testing.T) {
+	const concurrency, messages = 3, 10
+	var inflight, peak int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		<-release
+	}))
+	defer srv.Close()
+
+	w := startTestWebhook(t, fmt.Sprintf(`
+[server]
+name = "webhook-test"
+[webhook]
+concurrency = %d
+[[target]]
+url = %q
+`, concurrency, srv.URL))
+
+	for i := 0; i < messages; i++ {
+		if err := w.Deliver(ServicerTypeMQTT, "mqtt-test", "devices/a", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&inflight) == concurrency })
+	// 并发已满时其余消息留在队列中
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&inflight); n != concurrency {
+		t.Fatalf("%d requests in flight, want %d", n, concurrency)
+	}
+	close(release)
+	waitFor(t, func() bool { return w.Stats().Delivered == messages })
+	if p := atomic.LoadInt32(&peak); p != concurrency {
+		t.Errorf("peak concurrency = %d, want %d", p, concurrency)
+	}
+}
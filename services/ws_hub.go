@@ -0,0 +1,319 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/logger"
+)
+
+// 每个客户端发送队列的默认长度
+const defaultSendQueueSize = 256
+
+// wsMessage 待发送给客户端的消息。
+// to 不为空时只发送给该客户端；channel 不为空时发送给订阅了匹配频道的客户端，data 为负载原文；
+// 否则发送给连接在 path 上、未订阅任何频道且未协商子协议的客户端，path 为空时不限路径
+type wsMessage struct {
+	to          *wsClient
+	channel     string
+	path        string
+	messageType int
+	data        []byte
+	// 来自 broker 上过滤器 filter 的频道消息：客户端的多个频道过滤器都匹配时，
+	// 只经其中最小的过滤器下发，避免重叠的订阅重复收到
+	filter string
+	// 写出后发送关闭帧并断开连接，用于协议要求回复后断开的场景（如 STOMP ERROR）
+	closeAfter bool
+	// 不为空时 hub 分发后写入放入发送队列的客户端数
+	done chan int
+}
+
+// wsSubscription 客户端订阅或取消订阅频道
+type wsSubscription struct {
+	client    *wsClient
+	filter    string
+	subscribe bool
+}
+
+// wsClient 一个 websocket 连接，只有 writePump 向连接写入
+type wsClient struct {
+	// 在频道订阅索引中的标识
+	id   string
+	conn *websocket.Conn
+	path string
+	// 协商的子协议，为空时为回显模式
+	protocol string
+	// 已订阅的频道过滤器，只由 hub 访问
+	filters map[string]struct{}
+	// 已在 broker 上订阅的频道过滤器，只由连接的读循环访问
+	links map[string]struct{}
+	// 发送队列，由 hub 关闭
+	send chan wsMessage
+	// 单次写入超时，0 表示不限制
+	writeTimeout time.Duration
+	// 发送 ping 的间隔，0 表示不发送
+	pingPeriod time.Duration
+}
+
+// writePump 依次写出发送队列中的消息并定期发送 ping，队列关闭后发送关闭帧并断开连接
+func (c *wsClient) writePump(ctx context.Context, log *logger.AppLogger) {
+	defer c.conn.Close()
+
+	var ping <-chan time.Time
+	if c.pingPeriod > 0 {
+		ticker := time.NewTicker(c.pingPeriod)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		var err error
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				c.setWriteDeadline()
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			c.setWriteDeadline()
+			err = c.conn.WriteMessage(msg.messageType, msg.data)
+			if err == nil && msg.closeAfter {
+				c.setWriteDeadline()
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				c.conn.Close()
+				for range c.send {
+				}
+				return
+			}
+		case <-ping:
+			c.setWriteDeadline()
+			err = c.conn.WriteMessage(websocket.PingMessage, nil)
+		}
+		if err != nil {
+			log.LogErrorf(ctx, "websocketServer WriteMessage failed: %v", err)
+			// 关闭连接使读循环退出并注销客户端，期间继续消费队列直到 hub 将其关闭
+			c.conn.Close()
+			for range c.send {
+			}
+			return
+		}
+	}
+}
+
+func (c *wsClient) setWriteDeadline() {
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+}
+
+// wsHub 在单独的 goroutine 中维护客户端集合，注册、注销、订阅与广播都通过 channel 串行处理。
+// stop 后 hub 退出，此后的请求直接丢弃
+type wsHub struct {
+	register   chan *wsClient
+	unregister chan *wsClient
+	subscribe  chan wsSubscription
+	broadcast  chan wsMessage
+	clients    map[*wsClient]struct{}
+	// stop 时关闭，run 在断开所有客户端后退出并关闭 done
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	// 频道订阅索引，与内嵌 broker 使用相同的主题匹配规则
+	topics *server.TopicsIndex
+	ids    map[string]*wsClient
+	logger *logger.AppLogger
+}
+
+func newWSHub(log *logger.AppLogger) *wsHub {
+	h := &wsHub{
+		register:   make(chan *wsClient),
+		unregister: make(chan *wsClient),
+		subscribe:  make(chan wsSubscription),
+		broadcast:  make(chan wsMessage, defaultSendQueueSize),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+		clients:    make(map[*wsClient]struct{}),
+		topics:     server.NewTopicsIndex(),
+		ids:        make(map[string]*wsClient),
+		logger:     log,
+	}
+	go h.run()
+	return h
+}
+
+// run hub 主循环，stop 后断开所有客户端并退出
+func (h *wsHub) run() {
+	defer close(h.done)
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = struct{}{}
+			h.ids[client.id] = client
+		case client := <-h.unregister:
+			h.remove(client)
+		case sub := <-h.subscribe:
+			h.updateSubscription(sub)
+		case msg := <-h.broadcast:
+			h.dispatch(msg)
+		case <-h.quit:
+			for client := range h.clients {
+				h.remove(client)
+			}
+			return
+		}
+	}
+}
+
+// dispatch 按消息目标将消息放入客户端发送队列
+func (h *wsHub) dispatch(msg wsMessage) {
+	n := 0
+	switch {
+	case msg.to != nil:
+		if _, ok := h.clients[msg.to]; ok && h.enqueue(msg.to, msg) {
+			n++
+		}
+	case msg.channel != "":
+		subs := h.topics.Subscribers(msg.channel)
+		if len(subs.Subscriptions) == 0 && len(subs.Shared) == 0 {
+			break
+		}
+		subs.SelectShared()
+		subs.MergeSharedSelected()
+		frame, err := encodeChannelMessage(msg.channel, msg.data)
+		if err != nil {
+			h.logger.LogErrorf(context.Background(), "encode websocket channel message failed: %v", err)
+			break
+		}
+		out := wsMessage{messageType: websocket.TextMessage, data: frame}
+		for id := range subs.Subscriptions {
+			client, ok := h.ids[id]
+			if !ok || (msg.filter != "" && firstLink(client, msg.channel) != msg.filter) {
+				continue
+			}
+			if h.enqueue(client, out) {
+				n++
+			}
+		}
+	default:
+		for client := range h.clients {
+			if len(client.filters) > 0 || client.protocol != "" || (msg.path != "" && msg.path != client.path) {
+				continue
+			}
+			if h.enqueue(client, msg) {
+				n++
+			}
+		}
+	}
+	if msg.done != nil {
+		msg.done <- n
+	}
+}
+
+// firstLink 客户端匹配主题的频道过滤器中，对应的 MQTT 过滤器最小的一个
+func firstLink(client *wsClient, topic string) string {
+	first := ""
+	for filter := range client.filters {
+		f := linkFilter(filter)
+		if _, ok := auth.MatchTopic(f, topic); ok && (first == "" || f < first) {
+			first = f
+		}
+	}
+	return first
+}
+
+// enqueue 将消息放入客户端发送队列，队列已满说明客户端消费过慢，断开以免拖慢其他客户端
+func (h *wsHub) enqueue(client *wsClient, msg wsMessage) bool {
+	select {
+	case client.send <- msg:
+		return true
+	default:
+		h.logger.LogInfo(context.Background(), "websocket client evicted: send queue full",
+			"path", client.path, "remote", client.conn.RemoteAddr().String())
+		h.remove(client)
+		return false
+	}
+}
+
+func (h *wsHub) updateSubscription(sub wsSubscription) {
+	client := sub.client
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	if sub.subscribe {
+		h.topics.Subscribe(client.id, packets.Subscription{Filter: sub.filter})
+		client.filters[sub.filter] = struct{}{}
+		return
+	}
+	h.topics.Unsubscribe(sub.filter, client.id)
+	delete(client.filters, sub.filter)
+}
+
+// remove 注销客户端、清理其频道订阅并关闭发送队列，writePump 随后断开连接
+func (h *wsHub) remove(client *wsClient) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	for filter := range client.filters {
+		h.topics.Unsubscribe(filter, client.id)
+	}
+	delete(h.clients, client)
+	delete(h.ids, client.id)
+	close(client.send)
+}
+
+// join 注册客户端，hub 已停止时返回 false
+func (h *wsHub) join(client *wsClient) bool {
+	select {
+	case h.register <- client:
+		return true
+	case <-h.quit:
+		return false
+	}
+}
+
+// leave 注销客户端
+func (h *wsHub) leave(client *wsClient) {
+	select {
+	case h.unregister <- client:
+	case <-h.quit:
+	}
+}
+
+// update 更新客户端的频道订阅
+func (h *wsHub) update(sub wsSubscription) {
+	select {
+	case h.subscribe <- sub:
+	case <-h.quit:
+	}
+}
+
+// send 将消息交给 hub 分发
+func (h *wsHub) send(msg wsMessage) {
+	select {
+	case h.broadcast <- msg:
+	case <-h.quit:
+	}
+}
+
+// sendWait 同 send，等待分发完成后返回放入发送队列的客户端数，hub 已停止时返回 0
+func (h *wsHub) sendWait(msg wsMessage) int {
+	msg.done = make(chan int, 1)
+	h.send(msg)
+	select {
+	case n := <-msg.done:
+		return n
+	case <-h.done:
+		return 0
+	}
+}
+
+// stop 断开所有客户端并停止 hub，返回时 run 已退出
+func (h *wsHub) stop() {
+	h.stopOnce.Do(func() { close(h.quit) })
+	<-h.done
+}
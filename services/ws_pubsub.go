@@ -0,0 +1,290 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/codec"
+)
+
+// websocket 频道控制消息的 action
+const (
+	ChannelActionSubscribe   = "subscribe"
+	ChannelActionUnsubscribe = "unsubscribe"
+	ChannelActionPublish     = "publish"
+	// 服务端下发的频道消息
+	ChannelActionMessage = "message"
+	// 服务端对携带 id 的控制消息的确认
+	ChannelActionAck   = "ack"
+	ChannelActionError = "error"
+)
+
+// ChannelEncodingBase64 data 为 base64 编码的二进制负载
+const ChannelEncodingBase64 = "base64"
+
+// PubSubConfig websocket 频道与 MQTT 主题的映射配置
+type PubSubConfig struct {
+	// 是否将频道映射到 MQTT 主题，未启用时频道只在本服务内转发
+	Enable bool `toml:"enable"`
+	// 频道映射的 MQTT servicer 名称，为空时使用默认 MQTT servicer
+	MQTT string `toml:"mqtt"`
+	// 客户端发布到频道时使用的 QoS 与保留标志
+	QoS    byte `toml:"qos"`
+	Retain bool `toml:"retain"`
+	// MQTT 主题上的负载编码（msgpack、cbor、xml、protobuf:<消息全名> 等），配置后频道消息的 data 为解码后的 JSON 值，
+	// 客户端发布的 data 按该编码发布，为空时原样转发
+	Codec string `toml:"codec"`
+}
+
+// ChannelMessage websocket 频道控制消息，客户端与服务端使用同一结构：
+//
+//	{"action":"subscribe","channel":"devices/+/temperature","id":"1"}
+//	{"action":"publish","channel":"devices/a/temperature","data":{"value":21.5}}
+//	{"action":"message","channel":"devices/a/temperature","data":{"value":21.5}}
+//
+// channel 即 MQTT 主题，订阅时支持 + 与 # 通配符
+type ChannelMessage struct {
+	Action  string `json:"action"`
+	Channel string `json:"channel,omitempty"`
+	// 客户端指定的请求标识，服务端在 ack 或 error 中原样返回
+	ID string `json:"id,omitempty"`
+	// 负载：合法 JSON 原样传递，其余文本为 JSON 字符串，二进制为 base64 字符串
+	Data     json.RawMessage `json:"data,omitempty"`
+	Encoding string          `json:"encoding,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// jsonCodec 频道消息 data 的编码
+var jsonCodec, _ = codec.Get(codec.JSON)
+
+// parseChannelMessage 判断文本帧是否为频道控制消息
+func parseChannelMessage(message []byte) (*ChannelMessage, bool) {
+	var msg ChannelMessage
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return nil, false
+	}
+	switch msg.Action {
+	case ChannelActionSubscribe, ChannelActionUnsubscribe, ChannelActionPublish:
+		return &msg, true
+	}
+	return nil, false
+}
+
+// payload 取出 publish 消息的负载原文
+func (m *ChannelMessage) payload() ([]byte, error) {
+	if len(m.Data) == 0 {
+		return nil, nil
+	}
+	var text string
+	isString := json.Unmarshal(m.Data, &text) == nil
+	if m.Encoding == ChannelEncodingBase64 {
+		if !isString {
+			return nil, errors.New("base64 data must be a JSON string")
+		}
+		return base64.StdEncoding.DecodeString(text)
+	}
+	if m.Encoding != "" {
+		return nil, fmt.Errorf("unsupported encoding %q", m.Encoding)
+	}
+	if isString {
+		return []byte(text), nil
+	}
+	return m.Data, nil
+}
+
+// encodeChannelMessage 将频道上的负载编码为下发给客户端的 message
+func encodeChannelMessage(channel string, payload []byte) ([]byte, error) {
+	msg := ChannelMessage{Action: ChannelActionMessage, Channel: channel}
+	switch {
+	case len(payload) == 0:
+	case json.Valid(payload):
+		msg.Data = payload
+	case utf8.Valid(payload):
+		msg.Data, _ = json.Marshal(string(payload))
+	default:
+		msg.Data, _ = json.Marshal(base64.StdEncoding.EncodeToString(payload))
+		msg.Encoding = ChannelEncodingBase64
+	}
+	return json.Marshal(msg)
+}
+
+// handleChannelMessage 处理客户端的频道控制消息
+func (s *websocketServer) handleChannelMessage(ctx context.Context, client *wsClient, msg *ChannelMessage) {
+	if err := s.applyChannelMessage(client, msg); err != nil {
+		s.reply(client, ChannelMessage{Action: ChannelActionError, Channel: msg.Channel, ID: msg.ID, Error: err.Error()})
+		return
+	}
+	if msg.ID != "" {
+		s.reply(client, ChannelMessage{Action: ChannelActionAck, Channel: msg.Channel, ID: msg.ID})
+	}
+}
+
+func (s *websocketServer) applyChannelMessage(client *wsClient, msg *ChannelMessage) error {
+	switch msg.Action {
+	case ChannelActionSubscribe, ChannelActionUnsubscribe:
+		if !server.IsValidFilter(msg.Channel, false) {
+			return packets.ErrTopicFilterInvalid
+		}
+		subscribe := msg.Action == ChannelActionSubscribe
+		s.hub.update(wsSubscription{client: client, filter: msg.Channel, subscribe: subscribe})
+		if !subscribe {
+			s.unlinkChannel(client, msg.Channel)
+			return nil
+		}
+		// 先加入频道再订阅 MQTT，订阅时下发的保留消息能送达该客户端
+		if err := s.linkChannel(client, msg.Channel); err != nil {
+			s.hub.update(wsSubscription{client: client, filter: msg.Channel})
+			return err
+		}
+		return nil
+	case ChannelActionPublish:
+		if msg.Channel == "" || !server.IsValidFilter(msg.Channel, true) {
+			return packets.ErrTopicNameInvalid
+		}
+		payload, err := msg.payload()
+		if err != nil {
+			return err
+		}
+		if s.codec != nil && s.mqtt != nil {
+			if msg.Encoding != "" || len(msg.Data) == 0 {
+				return errors.New("data must be a JSON value when the channel has a codec")
+			}
+			if payload, err = codec.Transcode(jsonCodec, s.codec, msg.Data); err != nil {
+				return err
+			}
+		}
+		return s.publishChannel(msg.Channel, payload)
+	}
+	return nil
+}
+
+// reply 向单个客户端发送控制消息的响应
+func (s *websocketServer) reply(client *wsClient, msg ChannelMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	s.hub.send(wsMessage{to: client, messageType: websocket.TextMessage, data: data})
+}
+
+// publishChannel 发布客户端消息：关联了 MQTT servicer 时发布到同名主题，再经订阅回到频道订阅者
+func (s *websocketServer) publishChannel(channel string, payload []byte) error {
+	if s.mqtt == nil {
+		s.PublishChannel(channel, payload)
+		return nil
+	}
+	return s.mqtt.Publish(channel, payload, s.config.PubSub.Retain, s.config.PubSub.QoS)
+}
+
+// PublishChannel 将负载发送给订阅了匹配频道的客户端
+func (s *websocketServer) PublishChannel(channel string, payload []byte) {
+	s.hub.send(wsMessage{channel: channel, data: payload})
+}
+
+// PublishChannelWait 同 PublishChannel，等待消息放入发送队列后返回接收的客户端数
+func (s *websocketServer) PublishChannelWait(channel string, payload []byte) int {
+	return s.hub.sendWait(wsMessage{channel: channel, data: payload})
+}
+
+// LinkMQTT 将频道映射到 MQTT 主题：客户端订阅频道时在 broker 上订阅同名过滤器，消息转发给频道订阅者，
+// 客户端发布的消息发布到 broker
+func (s *websocketServer) LinkMQTT(m *mqttServer) error {
+	if name := s.config.PubSub.Codec; name != "" {
+		c, err := codec.Get(name)
+		if err != nil {
+			return err
+		}
+		s.codec = c
+	}
+	s.mqtt = m
+	return nil
+}
+
+// channelLink 频道过滤器在 broker 上的内联订阅，refs 为订阅了该过滤器的客户端数
+type channelLink struct {
+	id   int
+	refs int
+}
+
+// linkFilter 频道过滤器对应的 MQTT 过滤器，共享订阅 $share/<组>/<过滤器> 由 hub 选择客户端，broker 上订阅其中的过滤器
+func linkFilter(filter string) string {
+	if parts := strings.SplitN(filter, "/", 3); len(parts) == 3 && strings.EqualFold(parts[0], server.SharePrefix) {
+		return parts[2]
+	}
+	return filter
+}
+
+// linkChannel 客户端订阅频道后在 broker 上订阅对应的过滤器，同一过滤器只订阅一次
+func (s *websocketServer) linkChannel(client *wsClient, filter string) error {
+	if s.mqtt == nil {
+		return nil
+	}
+	if _, ok := client.links[filter]; ok {
+		return nil
+	}
+	f := linkFilter(filter)
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+	if l, ok := s.links[f]; ok {
+		l.refs++
+	} else {
+		id, err := s.mqtt.Subscribe(f, s.forwardChannel(f))
+		if err != nil {
+			return err
+		}
+		s.links[f] = &channelLink{id: id, refs: 1}
+	}
+	client.links[filter] = struct{}{}
+	return nil
+}
+
+// unlinkChannel 客户端取消订阅频道，最后一个订阅方离开后取消 broker 上的订阅
+func (s *websocketServer) unlinkChannel(client *wsClient, filter string) {
+	if _, ok := client.links[filter]; !ok {
+		return
+	}
+	delete(client.links, filter)
+	f := linkFilter(filter)
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+	l, ok := s.links[f]
+	if !ok {
+		return
+	}
+	if l.refs--; l.refs == 0 {
+		delete(s.links, f)
+		s.mqtt.Unsubscribe(f, l.id)
+	}
+}
+
+// unlinkAll 连接断开后取消其所有频道的 broker 订阅
+func (s *websocketServer) unlinkAll(client *wsClient) {
+	for filter := range client.links {
+		s.unlinkChannel(client, filter)
+	}
+}
+
+// forwardChannel 将 broker 上匹配 filter 的消息转发给频道订阅者
+func (s *websocketServer) forwardChannel(filter string) server.InlineSubFn {
+	return func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		payload := pk.Payload
+		// $SYS 等 broker 主题为文本，不经过编码转换
+		if s.codec != nil && !strings.HasPrefix(pk.TopicName, "$") {
+			var err error
+			if payload, err = codec.Transcode(s.codec, jsonCodec, payload); err != nil {
+				// 主题上其他编码的消息不转发给频道，每条消息都会失败，只记录调试日志
+				s.logger.LogDebugf(context.Background(), "websocket %s: decode %s message on %s failed: %v", s.Name(), s.config.PubSub.Codec, pk.TopicName, err)
+				return
+			}
+		}
+		s.hub.send(wsMessage{channel: pk.TopicName, filter: filter, data: payload})
+	}
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/networkProtocalTrans/logger"
+)
+
+const testPubSubConfig = `
+[server]
+name = "ws-test"
+[cors]
+allow_all = true
+[pubsub]
+enable = true
+`
+
+// sendChannel 发送频道控制消息并等待 ack
+func sendChannel(t *testing.T, conn *websocket.Conn, msg ChannelMessage) {
+	t.Helper()
+	msg.ID = "req"
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	if reply := readChannel(t, conn); reply.Action != ChannelActionAck {
+		t.Fatalf("%s %s: reply = %+v", msg.Action, msg.Channel, reply)
+	}
+}
+
+func readChannel(t *testing.T, conn *websocket.Conn) ChannelMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg ChannelMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// linkRefs 返回 broker 上各过滤器的订阅客户端数
+func linkRefs(s *websocketServer) map[string]int {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+	refs := make(map[string]int, len(s.links))
+	for f, l := range s.links {
+		refs[f] = l.refs
+	}
+	return refs
+}
+
+func TestPubSubSubscribesPerChannelFilter(t *testing.T) {
+	m := startTestMqtt(t)
+	s, url := startTestWebsocket(t, testPubSubConfig)
+	if err := s.LinkMQTT(m); err != nil {
+		t.Fatal(err)
+	}
+	if refs := linkRefs(s); len(refs) != 0 {
+		t.Fatalf("broker subscriptions before any client subscribed: %v", refs)
+	}
+
+	conn := dialTestWebsocket(t, url)
+	sendChannel(t, conn, ChannelMessage{Action: ChannelActionSubscribe, Channel: "devices/+/temperature"})
+	// 重复订阅不增加计数
+	sendChannel(t, conn, ChannelMessage{Action: ChannelActionSubscribe, Channel: "devices/+/temperature"})
+	other := dialTestWebsocket(t, url)
+	sendChannel(t, other, ChannelMessage{Action: ChannelActionSubscribe, Channel: "devices/+/temperature"})
+	if refs := linkRefs(s); len(refs) != 1 || refs["devices/+/temperature"] != 2 {
+		t.Fatalf("broker subscriptions = %v", refs)
+	}
+
+	if err := m.Publish("devices/a/temperature", []byte(`{"value":21.5}`), false, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*websocket.Conn{conn, other} {
+		msg := readChannel(t, c)
+		if msg.Action != ChannelActionMessage || msg.Channel != "devices/a/temperature" || string(msg.Data) != `{"value":21.5}` {
+			t.Fatalf("message = %+v", msg)
+		}
+	}
+
+	sendChannel(t, conn, ChannelMessage{Action: ChannelActionUnsubscribe, Channel: "devices/+/temperature"})
+	if refs := linkRefs(s); refs["devices/+/temperature"] != 1 {
+		t.Fatalf("broker subscriptions after unsubscribe = %v", refs)
+	}
+	// 最后一个订阅方断开后取消 broker 上的订阅
+	other.Close()
+	waitFor(t, func() bool { return len(linkRefs(s)) == 0 })
+}
+
+func TestPubSubOverlappingFiltersDeliverOnce(t *testing.T) {
+	m := startTestMqtt(t)
+	s, url := startTestWebsocket(t, testPubSubConfig)
+	if err := s.LinkMQTT(m); err != nil {
+		t.Fatal(err)
+	}
+	conn := dialTestWebsocket(t, url)
+	sendChannel(t, conn, ChannelMessage{Action: ChannelActionSubscribe, Channel: "devices/#"})
+	sendChannel(t, conn, ChannelMessage{Action: ChannelActionSubscribe, Channel: "devices/+/temperature"})
+	sendChannel(t, conn, ChannelMessage{Action: ChannelActionSubscribe, Channel: "$share/g/devices/a/temperature"})
+
+	m.Publish("devices/a/temperature", []byte("1"), false, 0)
+	m.Publish("devices/end", []byte("2"), false, 0)
+	if msg := readChannel(t, conn); msg.Channel != "devices/a/temperature" {
+		t.Fatalf("first message = %+v", msg)
+	}
+	// 下一条即为后发布的消息，说明第一条只下发了一次
+	if msg := readChannel(t, conn); msg.Channel != "devices/end" {
+		t.Fatalf("second message = %+v, want devices/end", msg)
+	}
+}
+
+func TestPubSubDecodeFailureIsNotForwarded(t *testing.T) {
+	m := startTestMqtt(t)
+	s, url := startTestWebsocket(t, testPubSubConfig+`codec = "msgpack"`+"\n")
+	if err := s.LinkMQTT(m); err != nil {
+		t.Fatal(err)
+	}
+	conn := dialTestWebsocket(t, url)
+	sendChannel(t, conn, ChannelMessage{Action: ChannelActionSubscribe, Channel: "devices/#"})
+
+	// 0xc1 不是合法的 msgpack
+	m.Publish("devices/bad", []byte{0xc1}, false, 0)
+	m.Publish("devices/good", []byte{0x81, 0xa1, 'v', 0x01}, false, 0)
+	msg := readChannel(t, conn)
+	if msg.Channel != "devices/good" {
+		t.Fatalf("message = %+v, want devices/good", msg)
+	}
+	var v map[string]int
+	if err := json.Unmarshal(msg.Data, &v); err != nil || v["v"] != 1 {
+		t.Fatalf("data = %s, %v", msg.Data, err)
+	}
+}
+
+func TestStompRequiresPubSub(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ws.toml")
+	os.WriteFile(path, []byte("[server]\nname = \"ws-test\"\n[stomp]\nenable = true\n"), 0o644)
+	if _, err := NewWebsocketServer(context.Background(), &logger.AppLogger{}, path); err == nil {
+		t.Fatal("stomp without pubsub.enable: expected an error")
+	}
+}
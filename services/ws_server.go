@@ -2,24 +2,35 @@ package services
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/networkProtocalTrans/codec"
 	"github.com/networkProtocalTrans/logger"
 	"github.com/networkProtocalTrans/util"
 )
+
 var addr = flag.String("addr", "localhost:8080", "http service address")
 
 // 添加配置结构
 type WSConfig struct {
+	Type       string           `toml:"type"`
 	Server     ServerConfig     `toml:"server"`
 	Websocket  WebsocketConfig  `toml:"websocket"`
 	Connection ConnectionConfig `toml:"connection"`
 	CORS       CORSConfig       `toml:"cors"`
+	Bridges    []BridgeConfig   `toml:"bridge"`
+	PubSub     PubSubConfig     `toml:"pubsub"`
+	Stomp      StompConfig      `toml:"stomp"`
+	TLS        util.TLSConfig   `toml:"tls"`
 }
 
 type ServerConfig struct {
@@ -33,6 +44,8 @@ type WebsocketConfig struct {
 	WriteBufferSize   int   `toml:"write_buffer_size"`
 	MaxMessageSize    int64 `toml:"max_message_size"`
 	EnableCompression bool  `toml:"enable_compression"`
+	// 每个客户端的发送队列长度，队列满时断开该客户端
+	SendQueueSize int `toml:"send_queue_size"`
 }
 
 type ConnectionConfig struct {
@@ -47,34 +60,69 @@ type CORSConfig struct {
 	AllowAll       bool     `toml:"allow_all"`
 }
 
+// MessageHandler 处理客户端发来的 websocket 消息，path 为客户端连接的路径
+type MessageHandler func(ctx context.Context, path string, messageType int, message []byte)
+
 // 修改 websocketServer 结构体
 type websocketServer struct {
-	clients    map[*websocket.Conn]bool
-	broadcast  chan []byte
+	hub *wsHub
+	// 频道映射的 MQTT servicer，为 nil 时频道只在本服务内转发
+	mqtt *mqttServer
+	// pubsub.codec 对应的编解码器，未配置时为 nil
+	codec      codec.Codec
+	mu         sync.Mutex
+	upgrader   websocket.Upgrader
+	tlsConfig  *tls.Config
+	httpServer *http.Server
+	stopped    chan struct{}
+	running    bool
+	handlers   []MessageHandler
 	logger     *logger.AppLogger
 	config     *WSConfig
 	maxClients int
+	// 当前连接数，包括正在握手的连接
+	conns int64
+	// 客户端标识自增计数
+	clientID int64
+	// 频道过滤器在 broker 上的订阅，键为 MQTT 过滤器
+	linkMu sync.Mutex
+	links  map[string]*channelLink
+}
+
+func init() {
+	RegisterServicerType(ServicerTypeWebsocket, func(ctx context.Context, log *logger.AppLogger, configPath string) (Servicer, error) {
+		return NewWebsocketServer(ctx, log, configPath)
+	})
 }
 
-// 创建websocket服务器实例
-func GetWebsocketServer(ctx context.Context, log *logger.AppLogger, configPath string) *websocketServer {
-	if defaultWSserver != nil {
-		return defaultWSserver
+// NewWebsocketServer 根据配置文件创建 websocket servicer 实例
+func NewWebsocketServer(ctx context.Context, log *logger.AppLogger, configPath string) (*websocketServer, error) {
+	// 加载配置
+	var config WSConfig
+	if _, err := toml.DecodeFile(configPath, &config); err != nil {
+		return nil, fmt.Errorf("load websocket config %s: %w", configPath, err)
 	}
 
-	wsOnce.Do(func() {
-		// 加载配置
-		var config WSConfig
-		if _, err := toml.DecodeFile(configPath, &config); err != nil {
-			log.LogFatal(ctx, "Failed to load websocket config", "error", err)
-			return
-		}
+	tlsConfig, err := config.TLS.Load()
+	if err != nil {
+		return nil, fmt.Errorf("websocket tls: %w", err)
+	}
+
+	if config.Stomp.Enable && !config.PubSub.Enable {
+		return nil, fmt.Errorf("websocket config %s: stomp requires pubsub.enable", configPath)
+	}
+	if config.Stomp.Enable && config.Stomp.Prefixes == nil {
+		config.Stomp.Prefixes = []string{"/topic/", "/queue/"}
+	}
 
-		// 更新 upgrader 配置
-		upgrader = websocket.Upgrader{
+	s := &websocketServer{
+		tlsConfig: tlsConfig,
+		hub:       newWSHub(log),
+		upgrader: websocket.Upgrader{
 			ReadBufferSize:    config.Websocket.ReadBufferSize,
 			WriteBufferSize:   config.Websocket.WriteBufferSize,
 			EnableCompression: config.Websocket.EnableCompression,
+			HandshakeTimeout:  time.Duration(config.Connection.ReadTimeout) * time.Second,
 			CheckOrigin: func(r *http.Request) bool {
 				if config.CORS.AllowAll {
 					return true
@@ -87,69 +135,250 @@ func GetWebsocketServer(ctx context.Context, log *logger.AppLogger, configPath s
 				}
 				return false
 			},
+		},
+		logger:     log,
+		config:     &config,
+		maxClients: config.Connection.MaxConnections,
+		links:      make(map[string]*channelLink),
+	}
+	if config.Stomp.Enable {
+		// 只有请求了子协议的客户端才会选中，其余客户端不受影响
+		s.upgrader.Subprotocols = stompSubprotocols
+	}
+	return s, nil
+}
+
+// Name 返回 servicer 名称
+func (s *websocketServer) Name() string {
+	return s.config.Server.Name
+}
+
+// Start 在配置的地址上启动独立监听并阻塞，直到 ctx 取消或 Stop 被调用。
+// /ws/ 为测试页面，/ws/ 下的其余路径均接受 websocket 连接；未配置地址时不监听，只通过 API 路由挂载使用
+func (s *websocketServer) Start(ctx context.Context) error {
+	stopped := make(chan struct{})
+	s.mu.Lock()
+	s.stopped = stopped
+	s.running = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	if s.config.Server.Address == "" {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
 		}
+		return nil
+	}
 
-		defaultWSserver = &websocketServer{
-			clients:    make(map[*websocket.Conn]bool),
-			broadcast:  make(chan []byte),
-			logger:     log,
-			config:     &config,
-			maxClients: config.Connection.MaxConnections,
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+	engine.GET("/ws/*path", func(c *gin.Context) {
+		if c.Param("path") == "/" {
+			s.Test(c)
+			return
 		}
+		s.HandleConnections(c)
 	})
-	return defaultWSserver
-}
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	// 允许所有CORS请求
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	lns, err := s.config.TLS.Listen(s.config.Server.Address, s.tlsConfig)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	httpServer := &http.Server{
+		Handler:           engine,
+		ReadHeaderTimeout: time.Duration(s.config.Connection.ReadTimeout) * time.Second,
+	}
+	s.mu.Lock()
+	s.httpServer = httpServer
+	s.mu.Unlock()
+
+	s.logger.LogInfo(ctx, "Starting websocket server",
+		"name", s.config.Server.Name,
+		"address", s.config.Server.Address,
+		"tls", s.tlsConfig != nil,
+		"tls_address", s.config.TLS.Address,
+	)
+	util.SafeGo(ctx, func() {
+		select {
+		case <-ctx.Done():
+			httpServer.Close()
+		case <-stopped:
+		}
+	})
+	return util.ServeHTTP(httpServer, lns)
 }
 
-var (
-	defaultWSserver *websocketServer
-	wsOnce          = sync.Once{}
-)
+// Stop 关闭监听、断开所有客户端并停止 hub，之后不再接受连接
+func (s *websocketServer) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	httpServer, stopped := s.httpServer, s.stopped
+	s.httpServer = nil
+	s.mu.Unlock()
 
+	if stopped != nil {
+		select {
+		case <-stopped:
+		default:
+			close(stopped)
+		}
+	}
+
+	var err error
+	if httpServer != nil {
+		// Shutdown 不会关闭已被接管的 websocket 连接，下面单独关闭
+		err = httpServer.Shutdown(ctx)
+	}
 
+	s.hub.stop()
+	return err
+}
+
+// Health 服务运行中时返回 nil
+func (s *websocketServer) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running {
+		return ErrServicerNotRunning
+	}
+	return nil
+}
 
 // HandleConnections 处理websocket连接
-// TODO add panic handler
 func (s *websocketServer) HandleConnections(c *gin.Context) {
 	ctx := c.Request.Context()
-    w,r := c.Writer, c.Request
-    ws, err := upgrader.Upgrade(w, r, nil)
-    if err != nil {
-        s.logger.LogErrorf(ctx,"websocketServer Upgrade failed: %v", err)
-        return
-    }
-    defer ws.Close()
-
-    s.clients[ws] = true
-
-    for {
-        messageType, message, err := ws.ReadMessage()
-        if err != nil {
-            s.logger.LogErrorf(ctx,"websocketServer ReadMessage failed: %v", err)
-            delete(s.clients, ws)
-            break
-        }
-
-        // 广播消息给所有客户端
-        for client := range s.clients {
-            if err := client.WriteMessage(messageType, message); err != nil {
-                s.logger.LogErrorf(ctx,"websocketServer WriteMessage failed: %v", err)
-                client.Close()
-                delete(s.clients, client)
-            }
-        }
-    }
-}
-
-func (s *websocketServer)Test(c *gin.Context){
-	util.HomeTemplate.Execute(c.Writer, "ws://"+c.Request.Host+"/ws/echo")
+	w, r := c.Writer, c.Request
+
+	// 超过最大连接数时在握手前拒绝
+	n := atomic.AddInt64(&s.conns, 1)
+	defer atomic.AddInt64(&s.conns, -1)
+	if s.maxClients > 0 && n > int64(s.maxClients) {
+		s.logger.LogInfo(ctx, "websocket connection rejected: max connections reached",
+			"max_connections", s.maxClients, "remote", r.RemoteAddr)
+		c.String(http.StatusServiceUnavailable, "too many connections")
+		return
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.LogErrorf(ctx, "websocketServer Upgrade failed: %v", err)
+		return
+	}
+
+	conn := s.config.Connection
+	if s.config.Websocket.MaxMessageSize > 0 {
+		ws.SetReadLimit(s.config.Websocket.MaxMessageSize)
+	}
+	// 超过 heartbeat_timeout 未收到任何帧（包括 pong）的连接视为断开
+	heartbeat := time.Duration(conn.HeartbeatTimeout) * time.Second
+	if heartbeat > 0 {
+		ws.SetReadDeadline(time.Now().Add(heartbeat))
+		ws.SetPongHandler(func(string) error {
+			return ws.SetReadDeadline(time.Now().Add(heartbeat))
+		})
+	}
+
+	queueSize := s.config.Websocket.SendQueueSize
+	if queueSize <= 0 {
+		queueSize = defaultSendQueueSize
+	}
+	client := &wsClient{
+		id:           fmt.Sprintf("%s-%d", s.Name(), atomic.AddInt64(&s.clientID, 1)),
+		filters:      make(map[string]struct{}),
+		links:        make(map[string]struct{}),
+		conn:         ws,
+		path:         r.URL.Path,
+		protocol:     ws.Subprotocol(),
+		send:         make(chan wsMessage, queueSize),
+		writeTimeout: time.Duration(conn.WriteTimeout) * time.Second,
+		// 每个心跳周期内发送两次 ping，单个 ping 丢失不会导致断开
+		pingPeriod: heartbeat / 2,
+	}
+	path := client.path
+	// 客户端证书身份随上下文传给消息处理方
+	ctx = util.WithClientIdentity(ctx, util.IdentityFromState(r.TLS))
+	if !s.hub.join(client) {
+		ws.Close()
+		return
+	}
+	go client.writePump(ctx, s.logger)
+	defer s.hub.leave(client)
+	defer s.unlinkAll(client)
+	// 读循环中的 panic 只断开当前连接，注销客户端后 writePump 随之退出
+	defer util.HandlePanic(func() error {
+		s.logger.LogErrorf(ctx, "websocket connection %s on %s closed after panic", client.id, path)
+		return nil
+	})
+
+	// STOMP 帧由会话处理，不回显也不交给桥接
+	if client.protocol != "" {
+		s.serveStomp(ctx, client, heartbeat)
+		return
+	}
+
+	for {
+		messageType, message, err := ws.ReadMessage()
+		if err != nil {
+			s.logger.LogErrorf(ctx, "websocketServer ReadMessage failed: %v", err)
+			break
+		}
+		if heartbeat > 0 {
+			ws.SetReadDeadline(time.Now().Add(heartbeat))
+		}
+
+		// 频道控制消息只由服务端处理，不回显也不交给桥接
+		if messageType == websocket.TextMessage {
+			if msg, ok := parseChannelMessage(message); ok {
+				s.handleChannelMessage(ctx, client, msg)
+				continue
+			}
+		}
+
+		// 按 conf/validation.toml 中的规则校验，未通过的消息不广播也不交给桥接
+		msgCtx, ok := s.checkMessage(ctx, client, message)
+		if !ok {
+			continue
+		}
+
+		s.handleMessage(msgCtx, path, messageType, message)
+	}
+}
+
+// handleMessage 广播客户端消息并交给桥接等订阅方处理
+func (s *websocketServer) handleMessage(ctx context.Context, path string, messageType int, message []byte) {
+	// 广播消息给所有未订阅频道的客户端
+	s.Broadcast("", messageType, message)
+
+	// 交给桥接等订阅方处理
+	for _, handler := range s.handlers {
+		handler(ctx, path, messageType, message)
+	}
 }
 
+// OnMessage 注册客户端消息处理函数，需在开始接受连接前调用
+func (s *websocketServer) OnMessage(handler MessageHandler) {
+	s.handlers = append(s.handlers, handler)
+}
+
+// Broadcast 向连接在 path 上且未订阅频道的客户端发送消息，path 为空时不限路径。
+// 消息进入各客户端的发送队列后即返回，不等待写出
+func (s *websocketServer) Broadcast(path string, messageType int, message []byte) {
+	s.hub.send(wsMessage{path: path, messageType: messageType, data: message})
+}
+
+// BroadcastWait 同 Broadcast，等待消息放入发送队列后返回接收的客户端数
+func (s *websocketServer) BroadcastWait(path string, messageType int, message []byte) int {
+	return s.hub.sendWait(wsMessage{path: path, messageType: messageType, data: message})
+}
+
+func (s *websocketServer) Test(c *gin.Context) {
+	scheme := "ws://"
+	if c.Request.TLS != nil {
+		scheme = "wss://"
+	}
+	util.HomeTemplate.Execute(c.Writer, scheme+c.Request.Host+"/ws/echo")
+}
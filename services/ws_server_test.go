@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/networkProtocalTrans/logger"
+)
+
+// startTestWebsocket 按配置创建 websocket servicer，并通过 httptest 服务挂载连接处理
+func startTestWebsocket(t *testing.T, config string) (*websocketServer, string) {
+	t.Helper()
+	if logger.DefaultLogger == nil {
+		logger.DefaultLogger = &logger.AppLogger{}
+	}
+	path := filepath.Join(t.TempDir(), "ws.toml")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewWebsocketServer(context.Background(), &logger.AppLogger{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.GET("/ws/*path", s.HandleConnections)
+	srv := httptest.NewServer(engine)
+	t.Cleanup(srv.Close)
+	return s, "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/echo"
+}
+
+func dialTestWebsocket(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestWebsocketPanicClosesOnlyTheConnection(t *testing.T) {
+	s, url := startTestWebsocket(t, `
+[server]
+name = "ws-test"
+[cors]
+allow_all = true
+[connection]
+write_timeout = 5
+`)
+	s.OnMessage(func(ctx context.Context, path string, messageType int, message []byte) {
+		if string(message) == "panic" {
+			panic("handler failed")
+		}
+	})
+
+	conn := dialTestWebsocket(t, url)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("panic")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		// 先收到回显，随后连接被关闭
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok {
+				t.Fatalf("connection not closed after panic: %v", err)
+			}
+			break
+		}
+	}
+
+	other := dialTestWebsocket(t, url)
+	if err := other.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, msg, err := other.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Fatalf("echo after panic = %q, %v", msg, err)
+	}
+}
+
+func TestWebsocketStopStopsHub(t *testing.T) {
+	s, url := startTestWebsocket(t, `
+[server]
+name = "ws-test"
+[cors]
+allow_all = true
+`)
+	conn := dialTestWebsocket(t, url)
+	waitFor(t, func() bool { return s.BroadcastWait("", websocket.TextMessage, []byte("ping")) == 1 })
+
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.hub.done:
+	default:
+		t.Fatal("hub still running after Stop")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	// hub 停止后发送不再阻塞，新连接被拒绝
+	done := make(chan int, 1)
+	go func() {
+		s.Broadcast("", websocket.TextMessage, []byte("late"))
+		s.PublishChannel("a", []byte("late"))
+		done <- s.BroadcastWait("", websocket.TextMessage, []byte("late"))
+	}()
+	select {
+	case n := <-done:
+		if n != 0 {
+			t.Errorf("BroadcastWait after Stop = %d, want 0", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Broadcast blocked after Stop")
+	}
+	late, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	late.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := late.ReadMessage(); err == nil {
+		t.Fatal("connection accepted after Stop")
+	}
+}
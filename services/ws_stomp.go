@@ -0,0 +1,508 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/deadletter"
+	"github.com/networkProtocalTrans/util"
+	"github.com/networkProtocalTrans/validation"
+)
+
+// stompSubprotocols 协商的 STOMP over websocket 子协议，按优先顺序
+var stompSubprotocols = []string{"v12.stomp", "v11.stomp", "v10.stomp"}
+
+// STOMP 订阅的确认模式
+const (
+	stompAckAuto             = "auto"
+	stompAckClient           = "client"
+	stompAckClientIndividual = "client-individual"
+)
+
+// 未确认消息的默认上限
+const defaultStompMaxPendingAcks = 1000
+
+// StompConfig STOMP over websocket 配置，destination 映射为 pubsub 关联的 MQTT servicer 上的主题
+type StompConfig struct {
+	// 是否协商 v12.stomp / v11.stomp / v10.stomp 子协议，未请求子协议的客户端仍为回显模式
+	Enable bool `toml:"enable"`
+	// 从 destination 开头去掉的前缀，去掉后的部分即 MQTT 主题，默认 ["/topic/", "/queue/"]
+	Prefixes []string `toml:"prefixes"`
+	// 为 true 时 destination 以 . 分隔层级、* 匹配单层（RabbitMQ 风格），与 MQTT 的 / 与 + 互相转换
+	DotSeparator bool `toml:"dot_separator"`
+	// 每个连接的最大订阅数，0 表示不限制
+	MaxSubscriptions int `toml:"max_subscriptions"`
+	// client / client-individual 模式下每个连接未确认消息的上限，超过时断开，默认 1000
+	MaxPendingAcks int `toml:"max_pending_acks"`
+}
+
+// stompSubscription 一个 STOMP 订阅，对应一个 MQTT 内联订阅
+type stompSubscription struct {
+	id     string
+	prefix string
+	filter string
+	ack    string
+	subID  int
+}
+
+// stompPending 等待确认的消息
+type stompPending struct {
+	sub *stompSubscription
+	seq uint64
+}
+
+// stompSession 一个 STOMP 连接的状态
+type stompSession struct {
+	// 连接的上下文，携带客户端证书身份
+	ctx     context.Context
+	server  *websocketServer
+	client  *wsClient
+	id      string
+	version string
+	// CONNECT 认证得到的 ACL，SEND、SUBSCRIBE 与下发的消息按其检查
+	acl ACL
+
+	mu        sync.Mutex
+	connected bool
+	subs      map[string]*stompSubscription
+	pending   map[string]stompPending
+	seq       uint64
+	closed    bool
+}
+
+// serveStomp 处理协商了 STOMP 子协议的连接，直到连接关闭
+func (s *websocketServer) serveStomp(ctx context.Context, client *wsClient, heartbeat time.Duration) {
+	sess := &stompSession{
+		ctx:     ctx,
+		server:  s,
+		client:  client,
+		id:      client.id,
+		subs:    make(map[string]*stompSubscription),
+		pending: make(map[string]stompPending),
+	}
+	defer sess.close()
+
+	for {
+		_, message, err := client.conn.ReadMessage()
+		if err != nil {
+			s.logger.LogErrorf(ctx, "websocketServer stomp ReadMessage failed: %v", err)
+			return
+		}
+		if heartbeat > 0 {
+			client.conn.SetReadDeadline(time.Now().Add(heartbeat))
+		}
+		frames, err := parseStompFrames(message)
+		for _, f := range frames {
+			if !sess.handle(f) {
+				break
+			}
+		}
+		if err != nil {
+			sess.fail(nil, err.Error())
+		}
+	}
+}
+
+// handle 处理一个客户端帧，连接将被关闭时返回 false
+func (sess *stompSession) handle(f *stompFrame) bool {
+	sess.mu.Lock()
+	closed, connected := sess.closed, sess.connected
+	sess.mu.Unlock()
+	if closed {
+		return false
+	}
+	if !connected && f.Command != stompConnect && f.Command != stompStomp {
+		sess.fail(f, "not connected")
+		return false
+	}
+
+	var err error
+	switch f.Command {
+	case stompConnect, stompStomp:
+		return sess.connect(f)
+	case stompSend:
+		err = sess.send(f)
+	case stompSubscribe:
+		err = sess.subscribe(f)
+	case stompUnsubscribe:
+		err = sess.unsubscribe(f)
+	case stompAck, stompNack:
+		err = sess.ack(f)
+	case stompBegin, stompCommit, stompAbort:
+		err = fmt.Errorf("transactions are not supported")
+	case stompDisconnect:
+		sess.receipt(f, true)
+		return false
+	default:
+		err = fmt.Errorf("unknown command %q", f.Command)
+	}
+	if err != nil {
+		sess.fail(f, err.Error())
+		return false
+	}
+	sess.receipt(f, false)
+	return true
+}
+
+// connect 协商版本并回复 CONNECTED
+func (sess *stompSession) connect(f *stompFrame) bool {
+	if sess.connected {
+		sess.fail(f, "already connected")
+		return false
+	}
+	if sess.server.mqtt == nil {
+		sess.fail(f, "stomp requires a mqtt servicer")
+		return false
+	}
+	version := "1.0"
+	if accept, ok := f.header("accept-version"); ok {
+		version = ""
+		for _, v := range []string{"1.2", "1.1", "1.0"} {
+			if strings.Contains(","+accept+",", ","+v+",") {
+				version = v
+				break
+			}
+		}
+		if version == "" {
+			sess.fail(f, "supported protocol versions are 1.0 1.1 1.2")
+			return false
+		}
+	}
+	// login / passcode 按 MQTT servicer 的认证配置校验，未携带时视为匿名连接
+	login, _ := f.header("login")
+	passcode, _ := f.header("passcode")
+	acl, err := sess.server.mqtt.auth.credentials(login, []byte(passcode), util.ClientIdentityFrom(sess.ctx))
+	if err != nil {
+		sess.server.logger.LogInfo(sess.ctx, "stomp client authentication failed",
+			"name", sess.server.Name(), "client", sess.id, "login", login, "error", err)
+		sess.fail(f, "authentication failed")
+		return false
+	}
+	sess.mu.Lock()
+	sess.connected, sess.version, sess.acl = true, version, acl
+	sess.mu.Unlock()
+
+	reply := &stompFrame{Command: stompConnected}
+	reply.set("version", version)
+	reply.set("session", sess.id)
+	reply.set("server", "networkProtocalTrans")
+	// 连接存活由 websocket ping 与 heartbeat_timeout 保证，不使用 STOMP 心跳
+	reply.set("heart-beat", "0,0")
+	sess.write(reply, false)
+	return true
+}
+
+// send 将 SEND 帧的消息体发布到 destination 对应的 MQTT 主题
+func (sess *stompSession) send(f *stompFrame) error {
+	if _, ok := f.header("transaction"); ok {
+		return fmt.Errorf("transactions are not supported")
+	}
+	destination, ok := f.header("destination")
+	if !ok {
+		return fmt.Errorf("missing destination header")
+	}
+	_, topic := sess.topic(destination)
+	if topic == "" || !server.IsValidFilter(topic, true) {
+		return fmt.Errorf("invalid destination %q", destination)
+	}
+	if !sess.acl.Allows(topic, true) {
+		return fmt.Errorf("not authorized to send to %q", destination)
+	}
+	cfg := sess.server.config.PubSub
+	retain := cfg.Retain
+	if v, ok := f.header("retain"); ok {
+		retain = v == "true"
+	}
+	// 内联发布不经过 MQTT 的校验钩子，按 mqtt 规则在此校验
+	mqtt := sess.server.mqtt
+	var props packets.Properties
+	if v := validation.DefaultValidator.Validate(validation.SourceMQTT, mqtt.Name(), topic, f.Body); v != nil {
+		if err := sess.violation(v, f.Body); err != nil {
+			return err
+		}
+		props.User = append(props.User, packets.UserProperty{Key: v.TagHeader, Val: v.Error()})
+	}
+	_, err := mqtt.PublishPacket(topic, f.Body, retain, cfg.QoS, props)
+	return err
+}
+
+// violation 处理未通过校验的 SEND 消息体：tag 动作返回 nil 后照常发布，其余动作不发布并返回错误
+func (sess *stompSession) violation(v *validation.Violation, body []byte) error {
+	s := sess.server
+	s.logger.LogInfo(sess.ctx, "stomp message failed validation",
+		"name", s.Name(), "client", sess.id, "topic", v.Topic, "rule", v.Rule, "action", v.Action, "error", v.Error())
+	switch v.Action {
+	case validation.ActionTag:
+		return nil
+	case validation.ActionErrorTopic:
+		if err := PublishViolation(v, body); err != nil {
+			s.logger.LogErrorf(sess.ctx, "websocket %s: publish validation error to %s failed: %v", s.Name(), v.ErrorTopic, err)
+		}
+	}
+	deadletter.Publish(sess.ctx, violationLetter(v, nil, body))
+	return v
+}
+
+// subscribe 建立 MQTT 内联订阅，匹配的消息以 MESSAGE 帧下发
+func (sess *stompSession) subscribe(f *stompFrame) error {
+	id, ok := f.header("id")
+	if !ok && sess.version == "1.0" {
+		// STOMP 1.0 的 id 可选
+		id, ok = f.header("destination")
+	}
+	if !ok || id == "" {
+		return fmt.Errorf("missing id header")
+	}
+	destination, ok := f.header("destination")
+	if !ok {
+		return fmt.Errorf("missing destination header")
+	}
+	prefix, filter := sess.topic(destination)
+	if !server.IsValidFilter(filter, false) {
+		return fmt.Errorf("invalid destination %q", destination)
+	}
+	if !sess.acl.Allows(filter, false) {
+		return fmt.Errorf("not authorized to subscribe to %q", destination)
+	}
+	ack, _ := f.header("ack")
+	switch ack {
+	case "":
+		ack = stompAckAuto
+	case stompAckAuto, stompAckClient, stompAckClientIndividual:
+	default:
+		return fmt.Errorf("invalid ack mode %q", ack)
+	}
+
+	sub := &stompSubscription{id: id, prefix: prefix, filter: filter, ack: ack}
+	sess.mu.Lock()
+	if _, exists := sess.subs[id]; exists {
+		sess.mu.Unlock()
+		return fmt.Errorf("duplicate subscription id %q", id)
+	}
+	if max := sess.server.config.Stomp.MaxSubscriptions; max > 0 && len(sess.subs) >= max {
+		sess.mu.Unlock()
+		return fmt.Errorf("too many subscriptions")
+	}
+	sess.subs[id] = sub
+	sess.mu.Unlock()
+
+	// 订阅时会同步下发保留消息，不能持有锁
+	subID, err := sess.server.mqtt.Subscribe(filter, func(cl *server.Client, _ packets.Subscription, pk packets.Packet) {
+		sess.deliver(sub, pk.TopicName, pk.Payload)
+	})
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if err != nil {
+		delete(sess.subs, id)
+		return err
+	}
+	sub.subID = subID
+	if sess.closed {
+		// 订阅期间连接已关闭
+		sess.server.mqtt.Unsubscribe(filter, subID)
+	}
+	return nil
+}
+
+func (sess *stompSession) unsubscribe(f *stompFrame) error {
+	id, ok := f.header("id")
+	if !ok && sess.version == "1.0" {
+		id, ok = f.header("destination")
+	}
+	if !ok {
+		return fmt.Errorf("missing id header")
+	}
+	sess.mu.Lock()
+	sub, exists := sess.subs[id]
+	if exists {
+		delete(sess.subs, id)
+		for ackID, p := range sess.pending {
+			if p.sub == sub {
+				delete(sess.pending, ackID)
+			}
+		}
+	}
+	sess.mu.Unlock()
+	if !exists {
+		return fmt.Errorf("unknown subscription %q", id)
+	}
+	return sess.server.mqtt.Unsubscribe(sub.filter, sub.subID)
+}
+
+// ack 确认或拒绝消息。MQTT 内联订阅没有重新投递，NACK 与 ACK 一样只释放未确认计数
+func (sess *stompSession) ack(f *stompFrame) error {
+	if _, ok := f.header("transaction"); ok {
+		return fmt.Errorf("transactions are not supported")
+	}
+	key := "id"
+	if sess.version != "1.2" {
+		key = "message-id"
+	}
+	id, ok := f.header(key)
+	if !ok {
+		return fmt.Errorf("missing %s header", key)
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	p, ok := sess.pending[id]
+	if !ok {
+		return fmt.Errorf("unknown message %q", id)
+	}
+	delete(sess.pending, id)
+	// client 模式为累积确认
+	if p.sub.ack == stompAckClient {
+		for ackID, other := range sess.pending {
+			if other.sub == p.sub && other.seq < p.seq {
+				delete(sess.pending, ackID)
+			}
+		}
+	}
+	return nil
+}
+
+// deliver 在 MQTT 发布路径上调用，将消息编码为 MESSAGE 帧放入发送队列
+func (sess *stompSession) deliver(sub *stompSubscription, topic string, payload []byte) {
+	sess.mu.Lock()
+	// 过滤器被允许时，其中的主题仍可能被 deny 规则排除
+	if sess.closed || sess.subs[sub.id] != sub || !sess.acl.Allows(topic, false) {
+		sess.mu.Unlock()
+		return
+	}
+	sess.seq++
+	messageID := strconv.FormatUint(sess.seq, 10)
+	f := &stompFrame{Command: stompMessage}
+	f.set("subscription", sub.id)
+	f.set("message-id", messageID)
+	f.set("destination", sess.destination(sub.prefix, topic))
+	f.set("content-type", stompContentType(payload))
+	if sub.ack != stompAckAuto {
+		f.set("ack", messageID)
+		sess.pending[messageID] = stompPending{sub: sub, seq: sess.seq}
+	}
+	max := sess.server.config.Stomp.MaxPendingAcks
+	if max <= 0 {
+		max = defaultStompMaxPendingAcks
+	}
+	overflow := len(sess.pending) > max
+	sess.mu.Unlock()
+
+	if overflow {
+		sess.fail(nil, "too many unacknowledged messages")
+		return
+	}
+	f.Body = payload
+	sess.write(f, false)
+}
+
+// receipt 客户端要求回执时回复 RECEIPT，closeAfter 为 true 时随后关闭连接
+func (sess *stompSession) receipt(f *stompFrame, closeAfter bool) {
+	id, ok := f.header("receipt")
+	if !ok {
+		if closeAfter {
+			sess.shutdown()
+			sess.client.conn.Close()
+		}
+		return
+	}
+	reply := &stompFrame{Command: stompReceipt}
+	reply.set("receipt-id", id)
+	sess.write(reply, closeAfter)
+	if closeAfter {
+		sess.shutdown()
+	}
+}
+
+// fail 发送 ERROR 帧并在写出后关闭连接（STOMP 1.2 要求）
+func (sess *stompSession) fail(f *stompFrame, message string) {
+	sess.mu.Lock()
+	closed := sess.closed
+	sess.closed = true
+	sess.mu.Unlock()
+	if closed {
+		return
+	}
+	reply := &stompFrame{Command: stompError}
+	reply.set("message", message)
+	if f != nil {
+		if id, ok := f.header("receipt"); ok {
+			reply.set("receipt-id", id)
+		}
+	}
+	sess.write(reply, true)
+}
+
+// write 将帧放入客户端发送队列，closeAfter 为 true 时写出后断开连接
+func (sess *stompSession) write(f *stompFrame, closeAfter bool) {
+	data := f.marshal()
+	messageType := websocket.TextMessage
+	if !utf8.Valid(data) {
+		messageType = websocket.BinaryMessage
+	}
+	sess.server.hub.send(wsMessage{to: sess.client, messageType: messageType, data: data, closeAfter: closeAfter})
+}
+
+// shutdown 标记会话关闭，之后不再处理帧与下发消息
+func (sess *stompSession) shutdown() {
+	sess.mu.Lock()
+	sess.closed = true
+	sess.mu.Unlock()
+}
+
+// close 连接断开时取消所有 MQTT 订阅
+func (sess *stompSession) close() {
+	sess.mu.Lock()
+	sess.closed = true
+	subs := sess.subs
+	sess.subs = make(map[string]*stompSubscription)
+	sess.pending = make(map[string]stompPending)
+	sess.mu.Unlock()
+	for _, sub := range subs {
+		if sub.subID != 0 {
+			sess.server.mqtt.Unsubscribe(sub.filter, sub.subID)
+		}
+	}
+}
+
+// topic 将 destination 转为 MQTT 主题，返回去掉的前缀
+func (sess *stompSession) topic(destination string) (string, string) {
+	cfg := sess.server.config.Stomp
+	prefix := ""
+	for _, p := range cfg.Prefixes {
+		if strings.HasPrefix(destination, p) {
+			prefix = p
+			break
+		}
+	}
+	topic := strings.TrimPrefix(destination, prefix)
+	if cfg.DotSeparator {
+		topic = strings.NewReplacer(".", "/", "*", "+").Replace(topic)
+	}
+	return prefix, topic
+}
+
+// destination 将 MQTT 主题转为 MESSAGE 帧的 destination
+func (sess *stompSession) destination(prefix, topic string) string {
+	if sess.server.config.Stomp.DotSeparator {
+		topic = strings.ReplaceAll(topic, "/", ".")
+	}
+	return prefix + topic
+}
+
+func stompContentType(payload []byte) string {
+	switch {
+	case json.Valid(payload):
+		return "application/json"
+	case utf8.Valid(payload):
+		return "text/plain;charset=utf-8"
+	}
+	return "application/octet-stream"
+}
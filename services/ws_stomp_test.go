@@ -0,0 +1,221 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/networkProtocalTrans/validation"
+)
+
+// testStompMqttConfig 使用 basic 认证的 MQTT servicer，admin 可读写 devices/# 与 telemetry/#，devices/secret/# 除外
+const testStompMqttConfig = `
+[server]
+name = "mqtt-test"
+address = "127.0.0.1:0"
+[auth]
+type = "basic"
+[auth.basic]
+username = "admin"
+password = "password"
+[auth.basic.acl]
+"devices/#" = "rw"
+"devices/secret/#" = "deny"
+"telemetry/#" = "rw"
+`
+
+const testStompConfig = `
+[server]
+name = "ws-test"
+[cors]
+allow_all = true
+[pubsub]
+enable = true
+[stomp]
+enable = true
+`
+
+// startTestStomp 启动 MQTT 与启用 STOMP 的 websocket servicer，返回 websocket 地址
+func startTestStomp(t *testing.T) (*mqttServer, string) {
+	t.Helper()
+	m := newTestMqtt(t, testStompMqttConfig)
+	runTestMqtt(t, m)
+	s, url := startTestWebsocket(t, testStompConfig)
+	if err := s.LinkMQTT(m); err != nil {
+		t.Fatal(err)
+	}
+	return m, url
+}
+
+type stompTestClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func dialStomp(t *testing.T, url string) *stompTestClient {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: []string{"v12.stomp"}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &stompTestClient{t: t, conn: conn}
+}
+
+// send 发送帧，headers 为交替的帧头名称与取值
+func (c *stompTestClient) send(command string, body string, headers ...string) {
+	c.t.Helper()
+	f := &stompFrame{Command: command, Body: []byte(body)}
+	for i := 0; i+1 < len(headers); i += 2 {
+		f.set(headers[i], headers[i+1])
+	}
+	if err := c.conn.WriteMessage(websocket.TextMessage, f.marshal()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *stompTestClient) read() *stompFrame {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	frames, err := parseStompFrames(data)
+	if err != nil || len(frames) != 1 {
+		c.t.Fatalf("frames = %v, %v", frames, err)
+	}
+	return frames[0]
+}
+
+// expect 读取下一帧并检查命令
+func (c *stompTestClient) expect(command string) *stompFrame {
+	c.t.Helper()
+	f := c.read()
+	if f.Command != command {
+		msg, _ := f.header("message")
+		c.t.Fatalf("got %s (%s), want %s", f.Command, msg, command)
+	}
+	return f
+}
+
+func (c *stompTestClient) connect(login, passcode string) {
+	c.t.Helper()
+	c.send(stompConnect, "", "accept-version", "1.2", "host", "test", "login", login, "passcode", passcode)
+}
+
+func TestStompAuthenticatesAgainstMqtt(t *testing.T) {
+	_, url := startTestStomp(t)
+
+	for _, creds := range [][2]string{{"admin", "wrong"}, {"other", "password"}, {"", ""}} {
+		c := dialStomp(t, url)
+		c.connect(creds[0], creds[1])
+		if msg, _ := c.expect(stompError).header("message"); msg != "authentication failed" {
+			t.Errorf("login %q: error = %q", creds[0], msg)
+		}
+	}
+
+	c := dialStomp(t, url)
+	c.connect("admin", "password")
+	c.expect(stompConnected)
+}
+
+func TestStompChecksACL(t *testing.T) {
+	m, url := startTestStomp(t)
+
+	denied := []struct {
+		command string
+		headers []string
+	}{
+		{stompSubscribe, []string{"id", "1", "destination", "/topic/other/#"}},
+		{stompSubscribe, []string{"id", "1", "destination", "/topic/devices/secret/a"}},
+		{stompSend, []string{"destination", "/topic/other"}},
+		{stompSend, []string{"destination", "/topic/devices/secret/a"}},
+	}
+	for _, d := range denied {
+		c := dialStomp(t, url)
+		c.connect("admin", "password")
+		c.expect(stompConnected)
+		c.send(d.command, "1", d.headers...)
+		c.expect(stompError)
+	}
+
+	c := dialStomp(t, url)
+	c.connect("admin", "password")
+	c.expect(stompConnected)
+	c.send(stompSubscribe, "", "id", "1", "destination", "/topic/devices/#", "receipt", "r1")
+	c.expect(stompReceipt)
+	// 订阅的过滤器被允许，其中被 deny 的主题不下发
+	m.Publish("devices/secret/a", []byte("hidden"), false, 0)
+	m.Publish("devices/a", []byte("visible"), false, 0)
+	f := c.expect(stompMessage)
+	if dest, _ := f.header("destination"); dest != "/topic/devices/a" || string(f.Body) != "visible" {
+		t.Fatalf("message to %s: %q", dest, f.Body)
+	}
+
+	received := make(chan string, 1)
+	m.Subscribe("devices/b", func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- string(pk.Payload)
+	})
+	c.send(stompSend, "hello", "destination", "/topic/devices/b")
+	select {
+	case payload := <-received:
+		if payload != "hello" {
+			t.Fatalf("published %q", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SEND not published")
+	}
+}
+
+func TestStompValidatesSend(t *testing.T) {
+	schema := filepath.Join(t.TempDir(), "telemetry.json")
+	os.WriteFile(schema, []byte(`{"type":"object","required":["value"],"properties":{"value":{"type":"number"}}}`), 0o644)
+	v, err := validation.New(&validation.Config{Rules: []validation.RuleConfig{
+		{Name: "telemetry", Source: validation.SourceMQTT, Topic: "telemetry/+", Schema: schema},
+		{Name: "tagged", Source: validation.SourceMQTT, Topic: "devices/tagged", Schema: schema, Action: validation.ActionTag},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := validation.DefaultValidator
+	validation.DefaultValidator = v
+	t.Cleanup(func() { validation.DefaultValidator = prev })
+	useTestDeadLetters(t)
+
+	m, url := startTestStomp(t)
+	received := make(chan packets.Packet, 4)
+	m.Subscribe("#", func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	})
+
+	c := dialStomp(t, url)
+	c.connect("admin", "password")
+	c.expect(stompConnected)
+	c.send(stompSend, `{"value":"hot"}`, "destination", "/topic/telemetry/a")
+	c.expect(stompError)
+
+	c = dialStomp(t, url)
+	c.connect("admin", "password")
+	c.expect(stompConnected)
+	c.send(stompSend, `{"value":"hot"}`, "destination", "/topic/devices/tagged")
+	c.send(stompSend, `{"value":21.5}`, "destination", "/topic/telemetry/a")
+	for _, want := range []string{"devices/tagged", "telemetry/a"} {
+		select {
+		case pk := <-received:
+			if pk.TopicName != want {
+				t.Fatalf("published to %s, want %s", pk.TopicName, want)
+			}
+			if tagged := len(pk.Properties.User) == 1 && pk.Properties.User[0].Key == validation.DefaultTagHeader; tagged != (want == "devices/tagged") {
+				t.Errorf("%s: user properties = %v", want, pk.Properties.User)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not published", want)
+		}
+	}
+}
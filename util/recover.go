@@ -15,7 +15,8 @@ func HandlePanic(fn func() error) {
         stack := debug.Stack()
         
         // Log the panic and stack trace
-        logger.DefaultLogger.LogFatalf(context.Background(),"PANIC: %v\n%s", r, string(stack))
+        // 只记录错误，LogFatalf 会退出进程
+        logger.DefaultLogger.LogErrorf(context.Background(),"PANIC: %v\n%s", r, string(stack))
         // Optionally re-panic if you want the program to terminate
         // panic(r)
 		fn()
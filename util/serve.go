@@ -0,0 +1,29 @@
+package util
+
+import (
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ServeHTTP 在所有监听器上运行 srv 并阻塞，任一监听器出错时关闭 srv 并返回该错误，
+// srv 被 Shutdown/Close 时返回 nil
+func ServeHTTP(srv *http.Server, lns []net.Listener) error {
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		ln := ln
+		go func() {
+			errs <- srv.Serve(ln)
+		}()
+	}
+
+	var first error
+	for range lns {
+		err := <-errs
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && first == nil {
+			first = err
+			srv.Close()
+		}
+	}
+	return first
+}
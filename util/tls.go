@@ -0,0 +1,189 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// TLSConfig servicer 配置文件中的 [tls] 部分
+type TLSConfig struct {
+	Enable bool `toml:"enable"`
+	// 额外的 TLS 监听地址，为空时主监听地址直接使用 TLS
+	Address  string `toml:"address"`
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// 校验客户端证书的 CA 证书包
+	CAFile string `toml:"ca_file"`
+	// 客户端证书模式: none, request, require, verify_if_given, require_and_verify。
+	// request 与 require 只要求出示证书而不校验，IdentityFromState 不会为其返回身份
+	ClientAuth string `toml:"client_auth"`
+	// 最低 TLS 版本: 1.0, 1.1, 1.2, 1.3，默认 1.2
+	MinVersion string `toml:"min_version"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                   tls.NoClientCert,
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify_if_given":    tls.VerifyClientCertIfGiven,
+	"require_and_verify": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Load 加载证书并生成 tls.Config，未启用时返回 nil
+func (c *TLSConfig) Load() (*tls.Config, error) {
+	if !c.Enable {
+		return nil, nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("tls.cert_file and tls.key_file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls key pair: %w", err)
+	}
+
+	clientAuth, ok := clientAuthTypes[strings.ToLower(c.ClientAuth)]
+	if !ok {
+		return nil, fmt.Errorf("invalid tls.client_auth %q", c.ClientAuth)
+	}
+	minVersion, ok := tlsVersions[c.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid tls.min_version %q", c.MinVersion)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+		MinVersion:   minVersion,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read tls ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in tls ca file %s", c.CAFile)
+		}
+		config.ClientCAs = pool
+	} else if clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("tls.ca_file is required when client_auth is %q", c.ClientAuth)
+	}
+	return config, nil
+}
+
+// Listen 按配置创建监听器：未启用 TLS 时只监听 address；启用且未配置 tls.address 时 address 使用 TLS；
+// 配置了 tls.address 时同时监听明文的 address 与 TLS 的 tls.address
+func (c *TLSConfig) Listen(address string, config *tls.Config) ([]net.Listener, error) {
+	if config == nil {
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+	if c.Address == "" {
+		ln, err := tls.Listen("tcp", address, config)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+
+	plain, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	secure, err := tls.Listen("tcp", c.Address, config)
+	if err != nil {
+		plain.Close()
+		return nil, err
+	}
+	return []net.Listener{plain, secure}, nil
+}
+
+// ClientIdentity 经过校验的客户端证书身份
+type ClientIdentity struct {
+	CommonName     string   `json:"common_name"`
+	DNSNames       []string `json:"dns_names,omitempty"`
+	EmailAddresses []string `json:"email_addresses,omitempty"`
+	URIs           []string `json:"uris,omitempty"`
+}
+
+// Matches 判断 name 是否为证书的 CN 或任一 SAN
+func (id *ClientIdentity) Matches(name string) bool {
+	if id == nil || name == "" {
+		return false
+	}
+	if id.CommonName == name {
+		return true
+	}
+	for _, sans := range [][]string{id.DNSNames, id.EmailAddresses, id.URIs} {
+		for _, san := range sans {
+			if san == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IdentityFromState 从 TLS 连接状态中取出客户端身份，只信任已通过 CA 校验的证书
+func IdentityFromState(state *tls.ConnectionState) *ClientIdentity {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	id := &ClientIdentity{
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+	}
+	for _, uri := range cert.URIs {
+		id.URIs = append(id.URIs, uri.String())
+	}
+	return id
+}
+
+// IdentityFromConn 从连接中取出客户端身份，conn 可以是包装了 *tls.Conn 的连接
+func IdentityFromConn(conn net.Conn) *ClientIdentity {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			state := c.ConnectionState()
+			return IdentityFromState(&state)
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+type identityKey struct{}
+
+// WithClientIdentity 将客户端身份存入上下文
+func WithClientIdentity(ctx context.Context, id *ClientIdentity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// ClientIdentityFrom 从上下文中取出客户端身份，没有时返回 nil
+func ClientIdentityFrom(ctx context.Context) *ClientIdentity {
+	id, _ := ctx.Value(identityKey{}).(*ClientIdentity)
+	return id
+}
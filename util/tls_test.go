@@ -0,0 +1,369 @@
+package util
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testCert 测试用证书与私钥，pem 文件位于测试临时目录
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+var testSerial int64
+
+// newTestCert 生成由 parent 签发的证书，parent 为 nil 时生成自签名 CA
+func newTestCert(t *testing.T, parent *testCert, template *x509.Certificate) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template.SerialNumber = big.NewInt(testSerial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, "cert.pem"),
+		keyFile:  filepath.Join(dir, "key.pem"),
+	}
+	os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return c
+}
+
+// testPKI CA、由其签发的服务端与客户端证书，以及另一个 CA 签发的客户端证书
+type testPKI struct {
+	ca, server, client, rogue *testCert
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	ca := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "test-ca"}})
+	server := newTestCert(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	uri, _ := url.Parse("spiffe://example.org/device-1")
+	client := newTestCert(t, ca, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "device-1"},
+		DNSNames:       []string{"device-1.example.org"},
+		EmailAddresses: []string{"device-1@example.org"},
+		URIs:           []*url.URL{uri},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	otherCA := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "other-ca"}})
+	rogue := newTestCert(t, otherCA, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "device-1"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return &testPKI{ca: ca, server: server, client: client, rogue: rogue}
+}
+
+func (p *testPKI) config(clientAuth string) *TLSConfig {
+	return &TLSConfig{
+		Enable:     true,
+		CertFile:   p.server.certFile,
+		KeyFile:    p.server.keyFile,
+		CAFile:     p.ca.certFile,
+		ClientAuth: clientAuth,
+	}
+}
+
+// clientConfig 信任测试 CA 的客户端配置，cert 为 nil 时不出示证书。
+// 证书总是被出示，即使签发者不在服务端接受的 CA 列表中
+func (p *testPKI) clientConfig(cert *testCert) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(p.ca.cert)
+	config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	if cert != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			c := cert.tlsCertificate()
+			return &c, nil
+		}
+	}
+	return config
+}
+
+func TestTLSConfigLoad(t *testing.T) {
+	pki := newTestPKI(t)
+
+	if config, err := (&TLSConfig{CertFile: "missing"}).Load(); config != nil || err != nil {
+		t.Fatalf("disabled: %v, %v", config, err)
+	}
+
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	os.WriteFile(garbage, []byte("not a certificate"), 0o600)
+	invalid := map[string]func(c *TLSConfig){
+		"missing cert_file":               func(c *TLSConfig) { c.CertFile = "" },
+		"mismatched key pair":             func(c *TLSConfig) { c.KeyFile = pki.client.keyFile },
+		"unknown client_auth":             func(c *TLSConfig) { c.ClientAuth = "always" },
+		"unknown min_version":             func(c *TLSConfig) { c.MinVersion = "1.4" },
+		"missing ca_file":                 func(c *TLSConfig) { c.CAFile = filepath.Join(t.TempDir(), "missing.pem") },
+		"ca_file without certificates":    func(c *TLSConfig) { c.CAFile = garbage },
+		"verify_if_given without ca_file": func(c *TLSConfig) { c.ClientAuth, c.CAFile = "verify_if_given", "" },
+		"require_and_verify without ca":   func(c *TLSConfig) { c.ClientAuth, c.CAFile = "require_and_verify", "" },
+	}
+	for name, modify := range invalid {
+		c := pki.config("none")
+		modify(c)
+		if _, err := c.Load(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	for mode, want := range map[string]tls.ClientAuthType{
+		"":                   tls.NoClientCert,
+		"none":               tls.NoClientCert,
+		"request":            tls.RequestClientCert,
+		"require":            tls.RequireAnyClientCert,
+		"verify_if_given":    tls.VerifyClientCertIfGiven,
+		"REQUIRE_AND_VERIFY": tls.RequireAndVerifyClientCert,
+	} {
+		config, err := pki.config(mode).Load()
+		if err != nil {
+			t.Fatalf("%q: %v", mode, err)
+		}
+		if config.ClientAuth != want || config.MinVersion != tls.VersionTLS12 || config.ClientCAs == nil || len(config.Certificates) != 1 {
+			t.Errorf("%q: client_auth %v, min version %x", mode, config.ClientAuth, config.MinVersion)
+		}
+	}
+	// 不校验客户端证书的模式可以不配置 ca_file
+	c := pki.config("require")
+	c.CAFile, c.MinVersion = "", "1.3"
+	if config, err := c.Load(); err != nil || config.ClientCAs != nil || config.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("require without ca_file: %v, %v", config, err)
+	}
+}
+
+// acceptIdentity 接受一个连接并完成握手，返回客户端身份与握手错误
+func acceptIdentity(ln net.Listener) (<-chan *ClientIdentity, <-chan error) {
+	ids, errs := make(chan *ClientIdentity, 1), make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.(*tls.Conn).Handshake(); err != nil {
+			errs <- err
+			return
+		}
+		ids <- IdentityFromConn(conn)
+		// 等待客户端关闭，TLS 1.3 下客户端在收到服务端的回应后才得知握手结果
+		io.Copy(io.Discard, conn)
+	}()
+	return ids, errs
+}
+
+func TestIdentityByClientAuthMode(t *testing.T) {
+	pki := newTestPKI(t)
+	identity := &ClientIdentity{
+		CommonName:     "device-1",
+		DNSNames:       []string{"device-1.example.org"},
+		EmailAddresses: []string{"device-1@example.org"},
+		URIs:           []string{"spiffe://example.org/device-1"},
+	}
+	tests := []struct {
+		mode   string
+		client *testCert
+		// 握手是否成功，成功时的客户端身份
+		ok   bool
+		want *ClientIdentity
+	}{
+		{"none", nil, true, nil},
+		{"none", pki.client, true, nil},
+		// request 与 require 不校验证书，即使证书由受信任的 CA 签发也不产生身份
+		{"request", nil, true, nil},
+		{"request", pki.client, true, nil},
+		{"request", pki.rogue, true, nil},
+		{"require", nil, false, nil},
+		{"require", pki.client, true, nil},
+		{"require", pki.rogue, true, nil},
+		{"verify_if_given", nil, true, nil},
+		{"verify_if_given", pki.client, true, identity},
+		{"verify_if_given", pki.rogue, false, nil},
+		{"require_and_verify", nil, false, nil},
+		{"require_and_verify", pki.client, true, identity},
+		{"require_and_verify", pki.rogue, false, nil},
+	}
+	for _, tt := range tests {
+		name := tt.mode + "/no cert"
+		switch tt.client {
+		case pki.client:
+			name = tt.mode + "/trusted cert"
+		case pki.rogue:
+			name = tt.mode + "/untrusted cert"
+		}
+		t.Run(name, func(t *testing.T) {
+			c := pki.config(tt.mode)
+			config, err := c.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			lns, err := c.Listen("127.0.0.1:0", config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lns[0].Close()
+			ids, errs := acceptIdentity(lns[0])
+
+			conn, err := tls.Dial("tcp", lns[0].Addr().String(), pki.clientConfig(tt.client))
+			if err == nil {
+				defer conn.Close()
+			}
+			select {
+			case id := <-ids:
+				if !tt.ok {
+					t.Fatalf("handshake accepted with identity %+v", id)
+				}
+				if !reflect.DeepEqual(id, tt.want) {
+					t.Fatalf("identity = %+v, want %+v", id, tt.want)
+				}
+			case err := <-errs:
+				if tt.ok {
+					t.Fatalf("handshake failed: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("handshake timed out")
+			}
+		})
+	}
+}
+
+func TestTLSConfigListen(t *testing.T) {
+	pki := newTestPKI(t)
+
+	// 未启用 TLS 时只有明文监听
+	lns, err := (&TLSConfig{}).Listen("127.0.0.1:0", nil)
+	if err != nil || len(lns) != 1 {
+		t.Fatalf("plain: %v, %v", lns, err)
+	}
+	lns[0].Close()
+
+	c := pki.config("none")
+	config, err := c.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 配置 tls.address 时同时监听明文与 TLS 地址
+	c.Address = "127.0.0.1:0"
+	lns, err = c.Listen("127.0.0.1:0", config)
+	if err != nil || len(lns) != 2 {
+		t.Fatalf("plain and tls: %v, %v", lns, err)
+	}
+	defer lns[0].Close()
+	defer lns[1].Close()
+	go func() {
+		conn, err := lns[0].Accept()
+		if err == nil {
+			conn.Write([]byte("plain"))
+			conn.Close()
+		}
+	}()
+	plain, err := net.Dial("tcp", lns[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if b, _ := io.ReadAll(plain); string(b) != "plain" {
+		t.Fatalf("plain listener read %q", b)
+	}
+	ids, errs := acceptIdentity(lns[1])
+	secure, err := tls.Dial("tcp", lns[1].Addr().String(), pki.clientConfig(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secure.Close()
+	select {
+	case <-ids:
+	case err := <-errs:
+		t.Fatal(err)
+	}
+
+	// 已被占用的 tls.address 不遗留明文监听
+	c.Address = lns[1].Addr().String()
+	if _, err := c.Listen("127.0.0.1:0", config); err == nil {
+		t.Fatal("listen on a used tls.address: expected an error")
+	}
+}
+
+func TestIdentityFromStateRequiresVerifiedChain(t *testing.T) {
+	pki := newTestPKI(t)
+	if id := IdentityFromState(nil); id != nil {
+		t.Fatalf("nil state: %+v", id)
+	}
+	// 未经校验的对端证书不产生身份
+	state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{pki.client.cert}}
+	if id := IdentityFromState(state); id != nil {
+		t.Fatalf("unverified peer certificate: %+v", id)
+	}
+	state.VerifiedChains = [][]*x509.Certificate{{pki.client.cert, pki.ca.cert}}
+	id := IdentityFromState(state)
+	if id == nil || id.CommonName != "device-1" {
+		t.Fatalf("verified chain: %+v", id)
+	}
+	for _, name := range []string{"device-1", "device-1.example.org", "device-1@example.org", "spiffe://example.org/device-1"} {
+		if !id.Matches(name) {
+			t.Errorf("identity does not match %q", name)
+		}
+	}
+	if id.Matches("device-2") || id.Matches("") || (*ClientIdentity)(nil).Matches("device-1") {
+		t.Error("identity matches an unrelated name")
+	}
+
+	ctx := WithClientIdentity(context.Background(), id)
+	if ClientIdentityFrom(ctx) != id || ClientIdentityFrom(context.Background()) != nil {
+		t.Error("identity not carried by context")
+	}
+}
@@ -0,0 +1,333 @@
+package validation
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/networkProtocalTrans/codec"
+	"github.com/networkProtocalTrans/logger"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// ConfigPath 校验规则配置文件
+const ConfigPath = "./conf/validation.toml"
+
+// 规则作用的入口
+const (
+	SourceMQTT      = "mqtt"
+	SourceWebsocket = "websocket"
+	SourceHTTP      = "http"
+)
+
+// 校验失败时的处理方式
+const (
+	// 拒绝消息，MQTT v5 QoS 1/2 发布返回 0x99（payload format invalid），websocket 与 HTTP 返回错误
+	ActionReject = "reject"
+	// 在 headers（MQTT v5 用户属性）中标记错误后照常转发
+	ActionTag = "tag"
+	// 不转发原消息，将错误与原负载发布到 error_topic
+	ActionErrorTopic = "error_topic"
+)
+
+// DefaultTagHeader tag 动作默认写入的 header 名称
+const DefaultTagHeader = "schema-error"
+
+// 单条消息最多返回的错误数
+const maxDetails = 10
+
+// Config 校验规则配置
+type Config struct {
+	Rules []RuleConfig `toml:"rule"`
+}
+
+// RuleConfig 一条校验规则，消息按配置顺序匹配第一条规则
+type RuleConfig struct {
+	// 规则名称，用于日志与错误信息，默认 <source>:<topic 或 path>
+	Name string `toml:"name" json:"name"`
+	// mqtt（客户端发布、/api/v1/publish 与 STOMP SEND）、websocket（客户端发送的消息）、http（/api/v1/ingest）
+	Source string `toml:"source" json:"source"`
+	// servicer 名称，为空时作用于同类型的所有 servicer，http 类型不使用
+	Servicer string `toml:"servicer" json:"servicer,omitempty"`
+	// mqtt 主题过滤器
+	Topic string `toml:"topic" json:"topic,omitempty"`
+	// websocket 连接路径，或 http 类型在 /api/v1/ingest 下的路径
+	Path string `toml:"path" json:"path,omitempty"`
+	// JSON Schema 文件路径
+	Schema string `toml:"schema" json:"schema"`
+	// 负载的编解码器（json、msgpack、cbor、xml、protobuf:<消息全名>），解码后再校验，默认 json
+	Codec string `toml:"codec" json:"codec,omitempty"`
+	// reject、tag、error_topic，默认 reject
+	Action string `toml:"action" json:"action"`
+	// tag: 写入的 header 名称，默认 schema-error
+	TagHeader string `toml:"tag_header" json:"tag_header,omitempty"`
+	// error_topic: 错误消息发布到的 MQTT 主题，支持 {topic}（原主题或路径）与 {rule} 占位符
+	ErrorTopic string `toml:"error_topic" json:"error_topic,omitempty"`
+	// error_topic: 发布错误消息的 MQTT servicer，为空时 mqtt 规则使用消息所在的 servicer，其余使用默认 MQTT servicer
+	ErrorServicer string `toml:"error_servicer" json:"error_servicer,omitempty"`
+}
+
+// Detail 一处校验错误
+type Detail struct {
+	// 出错值在负载中的 JSON Pointer，为空时表示整个负载
+	Location string `json:"location"`
+	Message  string `json:"message"`
+}
+
+// Violation 负载不符合规则的 schema
+type Violation struct {
+	Rule     string   `json:"rule"`
+	Action   string   `json:"action"`
+	Source   string   `json:"source"`
+	Servicer string   `json:"servicer,omitempty"`
+	Topic    string   `json:"topic"`
+	Errors   []Detail `json:"errors"`
+
+	// 占位符已替换的错误主题与 servicer，仅 error_topic 动作使用
+	ErrorTopic    string `json:"-"`
+	ErrorServicer string `json:"-"`
+	TagHeader     string `json:"-"`
+}
+
+// Error 返回第一处错误的描述
+func (v *Violation) Error() string {
+	msg := fmt.Sprintf("payload does not match schema of rule %s", v.Rule)
+	if len(v.Errors) == 0 {
+		return msg
+	}
+	d := v.Errors[0]
+	if d.Location == "" {
+		return msg + ": " + d.Message
+	}
+	return msg + ": " + d.Location + ": " + d.Message
+}
+
+// Envelope 发布到 error_topic 的 JSON 消息，原负载为 UTF-8 文本时放在 payload，否则 base64 编码后放在 payload_base64
+func (v *Violation) Envelope(payload []byte) []byte {
+	out := struct {
+		*Violation
+		Payload       *string `json:"payload,omitempty"`
+		PayloadBase64 string  `json:"payload_base64,omitempty"`
+	}{Violation: v}
+	if utf8.Valid(payload) {
+		s := string(payload)
+		out.Payload = &s
+	} else {
+		out.PayloadBase64 = base64.StdEncoding.EncodeToString(payload)
+	}
+	b, _ := json.Marshal(out)
+	return b
+}
+
+// rule 编译后的规则
+type rule struct {
+	config RuleConfig
+	schema *jsonschema.Schema
+	codec  codec.Codec
+}
+
+// Validator 按规则校验入口消息，nil 表示未配置规则
+type Validator struct {
+	rules []*rule
+}
+
+// DefaultValidator 由 InitValidation 加载，未配置规则时为 nil
+var DefaultValidator *Validator
+
+// New 校验规则配置并编译 schema
+func New(config *Config) (*Validator, error) {
+	compiler := jsonschema.NewCompiler()
+	// 同一 schema 文件被多条规则引用时只编译一次
+	schemas := make(map[string]*jsonschema.Schema)
+	v := &Validator{}
+	for i, rc := range config.Rules {
+		if err := rc.validate(); err != nil {
+			return nil, fmt.Errorf("rule #%d: %w", i+1, err)
+		}
+		sch, ok := schemas[rc.Schema]
+		if !ok {
+			var err error
+			if sch, err = compiler.Compile(rc.Schema); err != nil {
+				return nil, fmt.Errorf("rule %s: compile schema: %w", rc.Name, err)
+			}
+			schemas[rc.Schema] = sch
+		}
+		c, err := codec.Get(rc.Codec)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rc.Name, err)
+		}
+		v.rules = append(v.rules, &rule{config: rc, schema: sch, codec: c})
+	}
+	return v, nil
+}
+
+// validate 检查规则并填充默认值
+func (rc *RuleConfig) validate() error {
+	switch rc.Source {
+	case SourceMQTT:
+		if rc.Topic == "" {
+			return fmt.Errorf("mqtt rule requires topic")
+		}
+	case SourceWebsocket, SourceHTTP:
+		if rc.Path == "" {
+			return fmt.Errorf("%s rule requires path", rc.Source)
+		}
+	default:
+		return fmt.Errorf("unknown source %q", rc.Source)
+	}
+	if rc.Schema == "" {
+		return fmt.Errorf("schema is required")
+	}
+	if rc.Name == "" {
+		rc.Name = rc.Source + ":" + rc.Topic + rc.Path
+	}
+	if rc.Codec == "" {
+		rc.Codec = codec.JSON
+	}
+	if rc.Action == "" {
+		rc.Action = ActionReject
+	}
+	switch rc.Action {
+	case ActionReject:
+	case ActionTag:
+		if rc.TagHeader == "" {
+			rc.TagHeader = DefaultTagHeader
+		}
+	case ActionErrorTopic:
+		if rc.ErrorTopic == "" {
+			return fmt.Errorf("rule %s: error_topic action requires error_topic", rc.Name)
+		}
+	default:
+		return fmt.Errorf("rule %s: unknown action %q", rc.Name, rc.Action)
+	}
+	return nil
+}
+
+// match 规则是否作用于该消息
+func (r *rule) match(source, servicer, topic string) bool {
+	rc := r.config
+	if rc.Source != source || (rc.Servicer != "" && rc.Servicer != servicer) {
+		return false
+	}
+	if source == SourceMQTT {
+		// auth.MatchTopic 只比较过滤器的层级，telemetry/+ 也会匹配 telemetry/a/b，
+		// 不以 # 结尾的过滤器还需层级数相同
+		if _, ok := auth.MatchTopic(rc.Topic, topic); !ok {
+			return false
+		}
+		return strings.HasSuffix(rc.Topic, "#") || strings.Count(rc.Topic, "/") == strings.Count(topic, "/")
+	}
+	return rc.Path == topic
+}
+
+// Validate 按第一条匹配的规则校验负载，没有匹配的规则或校验通过时返回 nil。
+// topic 为 mqtt 主题，或 websocket / http 的路径
+func (v *Validator) Validate(source, servicer, topic string, payload []byte) *Violation {
+	if v == nil {
+		return nil
+	}
+	for _, r := range v.rules {
+		if !r.match(source, servicer, topic) {
+			continue
+		}
+		details := r.check(payload)
+		if len(details) == 0 {
+			return nil
+		}
+		rc := r.config
+		expand := strings.NewReplacer("{topic}", topic, "{rule}", rc.Name)
+		return &Violation{
+			Rule:          rc.Name,
+			Action:        rc.Action,
+			Source:        source,
+			Servicer:      servicer,
+			Topic:         topic,
+			Errors:        details,
+			ErrorTopic:    expand.Replace(rc.ErrorTopic),
+			ErrorServicer: rc.ErrorServicer,
+			TagHeader:     rc.TagHeader,
+		}
+	}
+	return nil
+}
+
+// check 解码并校验负载，返回错误列表
+func (r *rule) check(payload []byte) []Detail {
+	doc, err := r.codec.Decode(payload)
+	if err != nil {
+		return []Detail{{Message: fmt.Sprintf("payload is not valid %s: %v", r.config.Codec, err)}}
+	}
+	err = r.schema.Validate(doc)
+	if err == nil {
+		return nil
+	}
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return []Detail{{Message: err.Error()}}
+	}
+	// basic 输出中的叶子节点为具体的错误，非叶子节点只是汇总
+	var details []Detail
+	out := ve.BasicOutput()
+	for _, unit := range out.Errors {
+		if unit.Error == nil || len(details) == maxDetails {
+			continue
+		}
+		details = append(details, Detail{Location: unit.InstanceLocation, Message: unit.Error.String()})
+	}
+	if len(details) == 0 && out.Error != nil {
+		details = append(details, Detail{Location: out.InstanceLocation, Message: out.Error.String()})
+	}
+	return details
+}
+
+// LoadConfig 加载校验规则，配置文件不存在时返回空配置
+func LoadConfig(path string) (*Config, error) {
+	var config Config
+	if _, err := toml.DecodeFile(path, &config); err != nil {
+		if os.IsNotExist(err) {
+			return &config, nil
+		}
+		return nil, fmt.Errorf("load validation config %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// InitValidation 加载校验规则，需在 codec.InitCodecs 之后、servicer 启动之前调用
+func InitValidation(ctx context.Context) {
+	log := logger.DefaultLogger
+	config, err := LoadConfig(ConfigPath)
+	if err != nil {
+		log.LogFatal(ctx, "Failed to load validation rules", "error", err)
+	}
+	if len(config.Rules) == 0 {
+		return
+	}
+	v, err := New(config)
+	if err != nil {
+		log.LogFatal(ctx, "Failed to load validation rules", "error", err)
+	}
+	DefaultValidator = v
+	log.LogInfo(ctx, "validation rules loaded", "rules", len(v.rules))
+}
+
+type contextKey struct{}
+
+// NewContext 将 tag 动作的校验结果随上下文传给消息处理方
+func NewContext(ctx context.Context, v *Violation) context.Context {
+	return context.WithValue(ctx, contextKey{}, v)
+}
+
+// Headers 返回上下文中 tag 动作写入的 headers，没有时返回 nil
+func Headers(ctx context.Context) map[string]string {
+	v, _ := ctx.Value(contextKey{}).(*Violation)
+	if v == nil {
+		return nil
+	}
+	return map[string]string{v.TagHeader: v.Error()}
+}
@@ -0,0 +1,325 @@
+package validation
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/networkProtocalTrans/codec"
+)
+
+// telemetrySchema 要求负载为带数值 value 字段的对象
+const telemetrySchema = `{"type":"object","required":["value"],"properties":{"value":{"type":"number"}}}`
+
+// writeSchema 将 schema 写入临时目录并返回路径
+func writeSchema(t *testing.T, name, schema string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(schema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	config, err := LoadConfig(filepath.Join(dir, "missing.toml"))
+	if err != nil || len(config.Rules) != 0 {
+		t.Fatalf("missing file: config = %+v, err = %v", config, err)
+	}
+
+	path := filepath.Join(dir, "validation.toml")
+	os.WriteFile(path, []byte(`
+[[rule]]
+name = "telemetry"
+source = "mqtt"
+topic = "telemetry/+"
+schema = "schemas/telemetry.json"
+action = "error_topic"
+error_topic = "errors/{rule}/{topic}"
+
+[[rule]]
+source = "websocket"
+path = "/ws/echo"
+schema = "schemas/echo.json"
+codec = "msgpack"
+`), 0o644)
+	config, err = LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RuleConfig{
+		{Name: "telemetry", Source: SourceMQTT, Topic: "telemetry/+", Schema: "schemas/telemetry.json", Action: ActionErrorTopic, ErrorTopic: "errors/{rule}/{topic}"},
+		{Source: SourceWebsocket, Path: "/ws/echo", Schema: "schemas/echo.json", Codec: codec.MsgPack},
+	}
+	if len(config.Rules) != len(want) {
+		t.Fatalf("got %d rules, want %d", len(config.Rules), len(want))
+	}
+	for i := range want {
+		if config.Rules[i] != want[i] {
+			t.Errorf("rule %d = %+v, want %+v", i+1, config.Rules[i], want[i])
+		}
+	}
+
+	os.WriteFile(path, []byte(`[[rule]`), 0o644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("invalid toml: LoadConfig succeeded, want an error")
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	schema := writeSchema(t, "telemetry.json", telemetrySchema)
+	tests := []struct {
+		name   string
+		config RuleConfig
+		want   RuleConfig
+	}{
+		{
+			"mqtt",
+			RuleConfig{Source: SourceMQTT, Topic: "telemetry/+", Schema: schema},
+			RuleConfig{Name: "mqtt:telemetry/+", Source: SourceMQTT, Topic: "telemetry/+", Schema: schema, Codec: codec.JSON, Action: ActionReject},
+		},
+		{
+			"websocket tag",
+			RuleConfig{Source: SourceWebsocket, Path: "/ws/echo", Schema: schema, Action: ActionTag},
+			RuleConfig{Name: "websocket:/ws/echo", Source: SourceWebsocket, Path: "/ws/echo", Schema: schema, Codec: codec.JSON, Action: ActionTag, TagHeader: DefaultTagHeader},
+		},
+		{
+			"http custom tag header",
+			RuleConfig{Name: "ingest", Source: SourceHTTP, Path: "/sensors", Schema: schema, Action: ActionTag, TagHeader: "x-invalid"},
+			RuleConfig{Name: "ingest", Source: SourceHTTP, Path: "/sensors", Schema: schema, Codec: codec.JSON, Action: ActionTag, TagHeader: "x-invalid"},
+		},
+	}
+	for _, tt := range tests {
+		v, err := New(&Config{Rules: []RuleConfig{tt.config}})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := v.rules[0].config; got != tt.want {
+			t.Errorf("%s: rule = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	schema := writeSchema(t, "telemetry.json", telemetrySchema)
+	invalid := writeSchema(t, "invalid.json", `{"type":`)
+	tests := []struct {
+		name   string
+		config RuleConfig
+	}{
+		{"unknown source", RuleConfig{Source: "coap", Topic: "a", Schema: schema}},
+		{"mqtt without topic", RuleConfig{Source: SourceMQTT, Schema: schema}},
+		{"websocket without path", RuleConfig{Source: SourceWebsocket, Topic: "a", Schema: schema}},
+		{"http without path", RuleConfig{Source: SourceHTTP, Schema: schema}},
+		{"missing schema", RuleConfig{Source: SourceMQTT, Topic: "a"}},
+		{"unknown action", RuleConfig{Source: SourceMQTT, Topic: "a", Schema: schema, Action: "drop"}},
+		{"error_topic without topic", RuleConfig{Source: SourceMQTT, Topic: "a", Schema: schema, Action: ActionErrorTopic}},
+		{"schema file not found", RuleConfig{Source: SourceMQTT, Topic: "a", Schema: filepath.Join(t.TempDir(), "missing.json")}},
+		{"invalid schema", RuleConfig{Source: SourceMQTT, Topic: "a", Schema: invalid}},
+		{"unknown codec", RuleConfig{Source: SourceMQTT, Topic: "a", Schema: schema, Codec: "yaml"}},
+	}
+	for _, tt := range tests {
+		if _, err := New(&Config{Rules: []RuleConfig{tt.config}}); err == nil {
+			t.Errorf("%s: New succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestValidateMatching(t *testing.T) {
+	schema := writeSchema(t, "telemetry.json", telemetrySchema)
+	any := writeSchema(t, "any.json", `true`)
+	v, err := New(&Config{Rules: []RuleConfig{
+		{Name: "pass", Source: SourceMQTT, Topic: "telemetry/trusted", Schema: any},
+		{Name: "telemetry", Source: SourceMQTT, Topic: "telemetry/+", Schema: schema},
+		{Name: "edge", Source: SourceMQTT, Servicer: "mqtt-edge", Topic: "devices/#", Schema: schema},
+		{Name: "echo", Source: SourceWebsocket, Path: "/ws/echo", Schema: schema},
+		{Name: "ingest", Source: SourceHTTP, Path: "/sensors", Schema: schema},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := []byte(`{"value":"hot"}`)
+	tests := []struct {
+		name     string
+		source   string
+		servicer string
+		topic    string
+		want     string // 匹配的规则，为空时不校验
+	}{
+		{"single level wildcard", SourceMQTT, "mqtt-test", "telemetry/a", "telemetry"},
+		{"first matching rule wins", SourceMQTT, "mqtt-test", "telemetry/trusted", ""},
+		{"wildcard does not match deeper levels", SourceMQTT, "mqtt-test", "telemetry/a/b", ""},
+		{"multi level wildcard", SourceMQTT, "mqtt-edge", "devices/a/b", "edge"},
+		{"other servicer", SourceMQTT, "mqtt-test", "devices/a/b", ""},
+		{"websocket path", SourceWebsocket, "ws-test", "/ws/echo", "echo"},
+		{"websocket other path", SourceWebsocket, "ws-test", "/ws/echo/a", ""},
+		{"http path", SourceHTTP, "", "/sensors", "ingest"},
+		{"source mismatch", SourceWebsocket, "ws-test", "/sensors", ""},
+		{"mqtt topic is not a path", SourceHTTP, "", "telemetry/a", ""},
+	}
+	for _, tt := range tests {
+		got := v.Validate(tt.source, tt.servicer, tt.topic, bad)
+		switch {
+		case tt.want == "" && got != nil:
+			t.Errorf("%s: matched rule %s, want none", tt.name, got.Rule)
+		case tt.want != "" && got == nil:
+			t.Errorf("%s: no violation, want rule %s", tt.name, tt.want)
+		case got != nil && (got.Rule != tt.want || got.Source != tt.source || got.Servicer != tt.servicer || got.Topic != tt.topic):
+			t.Errorf("%s: violation = %+v", tt.name, got)
+		}
+	}
+
+	if got := v.Validate(SourceMQTT, "mqtt-test", "telemetry/a", []byte(`{"value":21.5}`)); got != nil {
+		t.Errorf("valid payload: violation = %+v", got)
+	}
+	var none *Validator
+	if got := none.Validate(SourceMQTT, "mqtt-test", "telemetry/a", bad); got != nil {
+		t.Errorf("nil validator: violation = %+v", got)
+	}
+}
+
+func TestValidateActions(t *testing.T) {
+	schema := writeSchema(t, "telemetry.json", telemetrySchema)
+	tests := []struct {
+		name   string
+		config RuleConfig
+		want   Violation
+	}{
+		{
+			"reject",
+			RuleConfig{Name: "telemetry", Source: SourceMQTT, Topic: "telemetry/+", Schema: schema},
+			Violation{Rule: "telemetry", Action: ActionReject},
+		},
+		{
+			"tag",
+			RuleConfig{Name: "telemetry", Source: SourceMQTT, Topic: "telemetry/+", Schema: schema, Action: ActionTag},
+			Violation{Rule: "telemetry", Action: ActionTag, TagHeader: DefaultTagHeader},
+		},
+		{
+			"error_topic",
+			RuleConfig{Name: "telemetry", Source: SourceMQTT, Topic: "telemetry/+", Schema: schema, Action: ActionErrorTopic,
+				ErrorTopic: "errors/{rule}/{topic}", ErrorServicer: "mqtt-errors"},
+			Violation{Rule: "telemetry", Action: ActionErrorTopic, ErrorTopic: "errors/telemetry/telemetry/a", ErrorServicer: "mqtt-errors"},
+		},
+	}
+	for _, tt := range tests {
+		v, err := New(&Config{Rules: []RuleConfig{tt.config}})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := v.Validate(SourceMQTT, "mqtt-test", "telemetry/a", []byte(`{"value":"hot"}`))
+		if got == nil {
+			t.Fatalf("%s: no violation", tt.name)
+		}
+		if got.Rule != tt.want.Rule || got.Action != tt.want.Action || got.TagHeader != tt.want.TagHeader ||
+			got.ErrorTopic != tt.want.ErrorTopic || got.ErrorServicer != tt.want.ErrorServicer {
+			t.Errorf("%s: violation = %+v", tt.name, got)
+		}
+		if len(got.Errors) != 1 || got.Errors[0].Location != "/value" {
+			t.Errorf("%s: errors = %+v", tt.name, got.Errors)
+		}
+		if msg := got.Error(); !strings.HasPrefix(msg, "payload does not match schema of rule telemetry: /value: ") {
+			t.Errorf("%s: Error() = %q", tt.name, msg)
+		}
+	}
+}
+
+func TestValidateDetails(t *testing.T) {
+	var props []string
+	var values []string
+	for i := 0; i < maxDetails+2; i++ {
+		props = append(props, fmt.Sprintf(`"f%d":{"type":"number"}`, i))
+		values = append(values, fmt.Sprintf(`"f%d":"x"`, i))
+	}
+	many := writeSchema(t, "many.json", `{"type":"object","properties":{`+strings.Join(props, ",")+`}}`)
+	schema := writeSchema(t, "telemetry.json", telemetrySchema)
+	v, err := New(&Config{Rules: []RuleConfig{
+		{Name: "many", Source: SourceMQTT, Topic: "many", Schema: many},
+		{Name: "telemetry", Source: SourceMQTT, Topic: "telemetry/+", Schema: schema},
+		{Name: "packed", Source: SourceMQTT, Topic: "packed", Schema: schema, Codec: codec.MsgPack},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := v.Validate(SourceMQTT, "", "many", []byte("{"+strings.Join(values, ",")+"}")); got == nil || len(got.Errors) != maxDetails {
+		t.Errorf("many errors: violation = %+v", got)
+	}
+	got := v.Validate(SourceMQTT, "", "telemetry/a", []byte("not json"))
+	if got == nil || len(got.Errors) != 1 || got.Errors[0].Location != "" ||
+		!strings.HasPrefix(got.Errors[0].Message, "payload is not valid json: ") {
+		t.Fatalf("not json: violation = %+v", got)
+	}
+	if msg := got.Error(); !strings.HasPrefix(msg, "payload does not match schema of rule telemetry: payload is not valid json: ") {
+		t.Errorf("not json: Error() = %q", msg)
+	}
+	got = v.Validate(SourceMQTT, "", "telemetry/a", []byte(`{}`))
+	if got == nil || len(got.Errors) != 1 || got.Errors[0].Location != "" {
+		t.Errorf("missing property: violation = %+v", got)
+	}
+
+	// {"value": 21.5} 与 {"value": "hot"} 的 msgpack 编码
+	if got := v.Validate(SourceMQTT, "", "packed", []byte("\x81\xa5value\xcb\x40\x35\x80\x00\x00\x00\x00\x00")); got != nil {
+		t.Errorf("valid msgpack: violation = %+v", got)
+	}
+	if got := v.Validate(SourceMQTT, "", "packed", []byte("\x81\xa5value\xa3hot")); got == nil || got.Errors[0].Location != "/value" {
+		t.Errorf("invalid msgpack: violation = %+v", got)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	v := &Violation{Rule: "telemetry", Action: ActionErrorTopic, Source: SourceMQTT, Servicer: "mqtt-test", Topic: "telemetry/a",
+		Errors: []Detail{{Location: "/value", Message: "got string, want number"}}, ErrorTopic: "errors/telemetry/a"}
+	tests := []struct {
+		name    string
+		payload []byte
+		text    *string
+		binary  string
+	}{
+		{"text", []byte(`{"value":"hot"}`), strPtr(`{"value":"hot"}`), ""},
+		{"empty", []byte{}, strPtr(""), ""},
+		{"binary", []byte{0xff, 0x00}, nil, base64.StdEncoding.EncodeToString([]byte{0xff, 0x00})},
+	}
+	for _, tt := range tests {
+		var got struct {
+			Violation
+			ErrorTopic    string  `json:"error_topic"`
+			Payload       *string `json:"payload"`
+			PayloadBase64 string  `json:"payload_base64"`
+		}
+		if err := json.Unmarshal(v.Envelope(tt.payload), &got); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got.Rule != v.Rule || got.Topic != v.Topic || got.Servicer != v.Servicer || len(got.Errors) != 1 || got.Errors[0] != v.Errors[0] {
+			t.Errorf("%s: envelope = %+v", tt.name, got.Violation)
+		}
+		if got.ErrorTopic != "" {
+			t.Errorf("%s: envelope contains error_topic %q", tt.name, got.ErrorTopic)
+		}
+		if (got.Payload == nil) != (tt.text == nil) || (got.Payload != nil && *got.Payload != *tt.text) || got.PayloadBase64 != tt.binary {
+			t.Errorf("%s: payload = %v, payload_base64 = %q", tt.name, got.Payload, got.PayloadBase64)
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	ctx := context.Background()
+	if h := Headers(ctx); h != nil {
+		t.Errorf("without violation: headers = %v", h)
+	}
+	v := &Violation{Rule: "telemetry", Action: ActionTag, TagHeader: "x-invalid", Errors: []Detail{{Message: "bad"}}}
+	h := Headers(NewContext(ctx, v))
+	if len(h) != 1 || h["x-invalid"] != "payload does not match schema of rule telemetry: bad" {
+		t.Errorf("headers = %v", h)
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}